@@ -27,6 +27,7 @@ package psi
 import (
 	"fmt"
 	"sync"
+	"syscall"
 
 	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon"
 )
@@ -37,6 +38,7 @@ type PsiphonProvider interface {
 	BindToDevice(fileDescriptor int) error
 	GetPrimaryDnsServer() string
 	GetSecondaryDnsServer() string
+	GetNetworkID() string
 }
 
 var controllerMutex sync.Mutex
@@ -49,9 +51,37 @@ func Start(
 	provider PsiphonProvider,
 	useDeviceBinder bool) error {
 
+	return StartWithTunFileDescriptor(
+		configJson, embeddedServerEntryList, provider, useDeviceBinder, 0)
+}
+
+// StartWithTunFileDescriptor is Start with a packet tunnel, which relays the
+// IP packets of a VpnService through the tunnel; see psiphon.PacketTunnel.
+// tunFileDescriptor is a detached VpnService file descriptor, which the
+// packet tunnel takes ownership of, and which is closed when starting fails;
+// 0 runs no packet tunnel. A packet tunnel requires useDeviceBinder, so that
+// the tunnel connections are excluded from the VpnService.
+//
+// Only IPv4 is tunneled. IPv6 connections routed to the VpnService are
+// refused, with a TCP RST or an ICMPv6 port unreachable, so that
+// applications fall back to IPv4; preferably, the VpnService routes only
+// IPv4.
+func StartWithTunFileDescriptor(
+	configJson, embeddedServerEntryList string,
+	provider PsiphonProvider,
+	useDeviceBinder bool,
+	tunFileDescriptor int) (err error) {
+
 	controllerMutex.Lock()
 	defer controllerMutex.Unlock()
 
+	// Once the controller is run, it owns the file descriptor.
+	defer func() {
+		if err != nil && tunFileDescriptor != 0 {
+			syscall.Close(tunFileDescriptor)
+		}
+	}()
+
 	if controller != nil {
 		return fmt.Errorf("already started")
 	}
@@ -60,7 +90,14 @@ func Start(
 	if err != nil {
 		return fmt.Errorf("error loading configuration file: %s", err)
 	}
+	if tunFileDescriptor != 0 {
+		if !useDeviceBinder {
+			return fmt.Errorf("packet tunnel requires device binder")
+		}
+		config.PacketTunnelFileDescriptor = tunFileDescriptor
+	}
 	config.NetworkConnectivityChecker = provider
+	config.NetworkIDGetter = provider
 
 	if useDeviceBinder {
 		config.DeviceBinder = provider
@@ -82,6 +119,7 @@ func Start(
 	}
 
 	serverEntries, err := psiphon.DecodeAndValidateServerEntryList(
+		nil,
 		embeddedServerEntryList,
 		psiphon.GetCurrentTimestamp(),
 		psiphon.SERVER_ENTRY_SOURCE_EMBEDDED)
@@ -135,3 +173,30 @@ func SetClientVerificationPayload(clientVerificationPayload string) {
 		controller.SetClientVerificationPayload(clientVerificationPayload)
 	}
 }
+
+// This is a passthrough to Controller.NetworkChanged.
+// Note: should only be called after Start() and before Stop(); otherwise,
+// will silently take no action.
+func NetworkChanged() {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		controller.NetworkChanged()
+	}
+}
+
+// This is a passthrough to Controller.Reconfigure.
+// Note: should only be called after Start() and before Stop(); otherwise,
+// will silently take no action.
+func Reconfigure(egressRegion, tunnelProtocol string) error {
+
+	controllerMutex.Lock()
+	defer controllerMutex.Unlock()
+
+	if controller != nil {
+		return controller.Reconfigure(egressRegion, tunnelProtocol)
+	}
+	return nil
+}
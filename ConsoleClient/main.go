@@ -138,6 +138,7 @@ func main() {
 			}
 			// TODO: stream embedded server list data? also, the cast makes an unnecessary copy of a large buffer?
 			serverEntries, err := psiphon.DecodeAndValidateServerEntryList(
+				nil,
 				string(serverEntryList),
 				psiphon.GetCurrentTimestamp(),
 				psiphon.SERVER_ENTRY_SOURCE_EMBEDDED)
@@ -47,6 +47,7 @@ import java.net.NetworkInterface;
 import java.net.SocketException;
 import java.security.KeyStore;
 import java.security.KeyStoreException;
+import java.security.MessageDigest;
 import java.security.NoSuchAlgorithmException;
 import java.security.cert.CertificateException;
 import java.security.cert.X509Certificate;
@@ -312,6 +313,11 @@ public class PsiphonTunnel extends Psi.PsiphonProvider.Stub {
         return DEFAULT_SECONDARY_DNS_SERVER;
     }
 
+    @Override
+    public String GetNetworkID() {
+        return getNetworkID(mHostService.getContext());
+    }
+
     //----------------------------------------------------------------------------------------------
     // Psiphon Tunnel Core
     //----------------------------------------------------------------------------------------------
@@ -646,6 +652,40 @@ public class PsiphonTunnel extends Psi.PsiphonProvider.Stub {
         return networkInfo != null && networkInfo.isConnected();
     }
 
+    private static String getNetworkID(Context context) {
+        // The network ID is the active network type plus, for Wi-Fi, the
+        // network name or, for mobile, the operator code. As the ID is stored
+        // in the Psiphon datastore, a hash of the network name is used.
+        ConnectivityManager connectivityManager =
+                (ConnectivityManager)context.getSystemService(Context.CONNECTIVITY_SERVICE);
+        NetworkInfo networkInfo = connectivityManager.getActiveNetworkInfo();
+        if (networkInfo == null) {
+            return "";
+        }
+        String networkName = "";
+        if (networkInfo.getType() == ConnectivityManager.TYPE_WIFI) {
+            networkName = networkInfo.getExtraInfo();
+        } else if (networkInfo.getType() == ConnectivityManager.TYPE_MOBILE) {
+            TelephonyManager telephonyManager =
+                    (TelephonyManager)context.getSystemService(Context.TELEPHONY_SERVICE);
+            if (telephonyManager != null) {
+                networkName = telephonyManager.getNetworkOperator();
+            }
+        }
+        if (networkName == null) {
+            networkName = "";
+        }
+        try {
+            MessageDigest digest = MessageDigest.getInstance("SHA-256");
+            byte[] hash = digest.digest(networkName.getBytes("UTF-8"));
+            return networkInfo.getTypeName() + "-" + Base64.encodeToString(hash, Base64.NO_WRAP);
+        } catch (NoSuchAlgorithmException e) {
+            return networkInfo.getTypeName();
+        } catch (java.io.UnsupportedEncodingException e) {
+            return networkInfo.getTypeName();
+        }
+    }
+
     private static class PrivateAddress {
         final public String mIpAddress;
         final public String mSubnet;
@@ -45,7 +45,7 @@ func LookupIP(host string, config *DialConfig) (addrs []net.IP, err error) {
 				return addrs, err
 			}
 		}
-		NoticeAlert("retry resolve host %s: %s", host, err)
+		config.notices.Alert("retry resolve host %s: %s", host, err)
 		dnsServer := config.DnsServerGetter.GetSecondaryDnsServer()
 		if dnsServer == "" {
 			return addrs, err
@@ -143,8 +143,15 @@ func interruptibleTCPDial(addr string, config *DialConfig) (*TCPConn, error) {
 // proxiedTcpDial wraps a tcpDial call in an upstreamproxy dial.
 func proxiedTcpDial(
 	addr string, config *DialConfig, dialResult chan error) (net.Conn, error) {
+	// The upstream proxy connect phase starts once the TCP connection to
+	// the proxy is established.
+	var endPhase func(error)
 	dialer := func(network, addr string) (net.Conn, error) {
-		return tcpDial(addr, config, dialResult)
+		conn, err := tcpDial(addr, config, dialResult)
+		if err == nil {
+			endPhase = config.establishTimings.startPhase(ESTABLISH_PHASE_UPSTREAM_PROXY_CONNECT)
+		}
+		return conn, err
 	}
 	upstreamDialer := upstreamproxy.NewProxyDialFunc(
 		&upstreamproxy.UpstreamProxyConfig{
@@ -153,8 +160,11 @@ func proxiedTcpDial(
 			CustomHeaders:   config.UpstreamProxyCustomHeaders,
 		})
 	netConn, err := upstreamDialer("tcp", addr)
+	if endPhase != nil {
+		endPhase(err)
+	}
 	if _, ok := err.(*upstreamproxy.Error); ok {
-		NoticeUpstreamProxyError(err)
+		config.notices.UpstreamProxyError(err)
 	}
 	return netConn, err
 }
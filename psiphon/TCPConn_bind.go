@@ -58,7 +58,12 @@ func tcpDial(addr string, config *DialConfig, dialResult chan error) (net.Conn,
 	if err != nil {
 		return nil, ContextError(err)
 	}
+	endPhase := func(error) {}
+	if net.ParseIP(host) == nil {
+		endPhase = config.establishTimings.startPhase(ESTABLISH_PHASE_DNS_RESOLUTION)
+	}
 	ipAddrs, err := LookupIP(host, config)
+	endPhase(err)
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -99,7 +104,9 @@ func tcpDial(addr string, config *DialConfig, dialResult chan error) (net.Conn,
 	}
 
 	sockAddr := syscall.SockaddrInet4{Addr: ip, Port: port}
+	endPhase = config.establishTimings.startPhase(ESTABLISH_PHASE_TCP_CONNECT)
 	err = syscall.Connect(socketFd, &sockAddr)
+	endPhase(err)
 	if err != nil {
 		syscall.Close(socketFd)
 		return nil, ContextError(err)
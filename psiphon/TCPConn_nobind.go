@@ -33,5 +33,9 @@ func tcpDial(addr string, config *DialConfig, dialResult chan error) (net.Conn,
 		return nil, ContextError(errors.New("psiphon.interruptibleTCPDial with DeviceBinder not supported"))
 	}
 
-	return net.DialTimeout("tcp", addr, config.ConnectTimeout)
+	// Here, the TCP connect phase includes any DNS resolution
+	endPhase := config.establishTimings.startPhase(ESTABLISH_PHASE_TCP_CONNECT)
+	conn, err := net.DialTimeout("tcp", addr, config.ConnectTimeout)
+	endPhase(err)
+	return conn, err
 }
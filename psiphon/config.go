@@ -23,10 +23,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/transferstats"
 )
 
 // TODO: allow all params to be configured
@@ -35,6 +39,7 @@ const (
 	LEGACY_DATA_STORE_FILENAME                           = "psiphon.db"
 	DATA_STORE_FILENAME                                  = "psiphon.boltdb"
 	CONNECTION_WORKER_POOL_SIZE                          = 10
+	DIAL_CANDIDATES_PER_SERVER_ENTRY                     = 3
 	TUNNEL_POOL_SIZE                                     = 1
 	TUNNEL_CONNECT_TIMEOUT_SECONDS                       = 20
 	TUNNEL_OPERATE_SHUTDOWN_TIMEOUT                      = 1 * time.Second
@@ -46,12 +51,48 @@ const (
 	TUNNEL_SSH_KEEP_ALIVE_PERIODIC_INACTIVE_PERIOD       = 10 * time.Second
 	TUNNEL_SSH_KEEP_ALIVE_PROBE_TIMEOUT_SECONDS          = 5
 	TUNNEL_SSH_KEEP_ALIVE_PROBE_INACTIVE_PERIOD          = 10 * time.Second
+	TUNNEL_RTT_PROBE_PERIOD_MIN                          = 30 * time.Second
+	TUNNEL_RTT_PROBE_PERIOD_MAX                          = 60 * time.Second
+	TUNNEL_DEGRADED_ROUND_TRIP_TIME_MILLISECONDS         = 5000
+	TUNNEL_DEGRADED_ROUND_TRIP_TIME_SAMPLES              = 3
+	TUNNEL_DEGRADED_PORT_FORWARD_FAILURES                = 0
+	TUNNEL_DEGRADED_PORT_FORWARD_FAILURE_PERIOD          = 1 * time.Minute
+	TUNNEL_DEGRADED_THROUGHPUT_PERIOD                    = 1 * time.Minute
+	TUNNEL_DRAIN_TIMEOUT                                 = 5 * time.Minute
+	TUNNEL_DRAIN_POLL_PERIOD                             = 1 * time.Second
 	ESTABLISH_TUNNEL_TIMEOUT_SECONDS                     = 300
 	ESTABLISH_TUNNEL_WORK_TIME                           = 60 * time.Second
 	ESTABLISH_TUNNEL_PAUSE_PERIOD_SECONDS                = 5
+	ESTABLISH_TUNNEL_MAX_PAUSE_PERIOD_SECONDS            = 300
+	ESTABLISH_TUNNEL_PAUSE_BACKOFF_FACTOR                = 2.0
+	ESTABLISH_TUNNEL_PAUSE_JITTER_PERCENT                = 20
+	ESTABLISH_TUNNEL_PAUSE_NETWORK_CHECK_PERIOD          = 5 * time.Second
 	ESTABLISH_TUNNEL_SERVER_AFFINITY_GRACE_PERIOD        = 1 * time.Second
+	REPLAY_DIAL_PARAMETERS_TTL_SECONDS                   = 7 * 24 * 60 * 60
+	SLEEP_DETECTION_PERIOD                               = 5 * time.Second
+	SLEEP_DETECTION_THRESHOLD                            = 30 * time.Second
+	ON_DEMAND_IDLE_TIMEOUT_SECONDS                       = 300
+	ON_DEMAND_IDLE_CHECK_PERIOD                          = 10 * time.Second
+	ON_DEMAND_DIAL_TIMEOUT_SECONDS                       = 60
+	SOCKS_PROXY_REQUEST_TIMEOUT                          = 30 * time.Second
+	DNS_PROXY_RESOLVER_ADDRESS                           = "8.8.8.8:53"
+	DNS_PROXY_QUERY_TIMEOUT                              = 10 * time.Second
+	DNS_PROXY_TCP_IDLE_TIMEOUT                           = 30 * time.Second
+	DNS_PROXY_CACHE_MAX_ENTRIES                          = 4096
+	DNS_PROXY_MAX_PENDING_QUERIES                        = 256
+	PACKET_TUNNEL_MTU                                    = 1500
+	PACKET_TUNNEL_TCP_RECEIVE_WINDOW                     = 65535
+	PACKET_TUNNEL_TCP_SEND_BUFFER_SIZE                   = 131072
+	PACKET_TUNNEL_TCP_RETRANSMIT_TIMEOUT                 = 1 * time.Second
+	PACKET_TUNNEL_TCP_MAX_RETRANSMIT_TIMEOUT             = 30 * time.Second
+	PACKET_TUNNEL_TCP_MAX_RETRANSMITS                    = 8
+	PACKET_TUNNEL_TCP_IDLE_TIMEOUT                       = 30 * time.Minute
+	PACKET_TUNNEL_UDP_IDLE_TIMEOUT                       = 60 * time.Second
+	PACKET_TUNNEL_UDP_QUEUE_SIZE                         = 64
+	PACKET_TUNNEL_IDLE_CHECK_PERIOD                      = 10 * time.Second
 	HTTP_PROXY_ORIGIN_SERVER_TIMEOUT_SECONDS             = 15
 	HTTP_PROXY_MAX_IDLE_CONNECTIONS_PER_HOST             = 50
+	CONTROL_SERVER_MAX_REQUEST_BODY_SIZE                 = 64 * 1024
 	FETCH_REMOTE_SERVER_LIST_TIMEOUT_SECONDS             = 30
 	FETCH_REMOTE_SERVER_LIST_RETRY_PERIOD_SECONDS        = 30
 	FETCH_REMOTE_SERVER_LIST_STALE_PERIOD                = 6 * time.Hour
@@ -74,8 +115,29 @@ const (
 	IMPAIRED_PROTOCOL_CLASSIFICATION_DURATION            = 2 * time.Minute
 	IMPAIRED_PROTOCOL_CLASSIFICATION_THRESHOLD           = 3
 	TOTAL_BYTES_TRANSFERRED_NOTICE_PERIOD                = 5 * time.Minute
+	SERVER_ENTRY_PERFORMANCE_HALF_LIFE                   = 6 * time.Hour
+	SERVER_ENTRY_PERFORMANCE_LATENCY_SCALE               = 10 * time.Second
+	SERVER_ENTRY_PERFORMANCE_SMOOTHING                   = 0.3
+	SERVER_ENTRY_EXPLORATION_PROBABILITY                 = 0.1
+	PROTOCOL_SELECTION_EXPLORATION_PROBABILITY           = 0.1
+	NETWORK_ID_UNKNOWN                                   = "UNKNOWN"
+	TUNNEL_POOL_STICKY_HOSTS_MAX_COUNT                   = 10000
+)
+
+const (
+	TUNNEL_POOL_POLICY_ROUND_ROBIN         = "ROUND_ROBIN"
+	TUNNEL_POOL_POLICY_LEAST_PORT_FORWARDS = "LEAST_PORT_FORWARDS"
+	TUNNEL_POOL_POLICY_LOWEST_RTT          = "LOWEST_RTT"
+	TUNNEL_POOL_POLICY_STICKY_HOST         = "STICKY_HOST"
 )
 
+var SupportedTunnelPoolPolicies = []string{
+	TUNNEL_POOL_POLICY_ROUND_ROBIN,
+	TUNNEL_POOL_POLICY_LEAST_PORT_FORWARDS,
+	TUNNEL_POOL_POLICY_LOWEST_RTT,
+	TUNNEL_POOL_POLICY_STICKY_HOST,
+}
+
 // To distinguish omitted timeout params from explicit 0 value timeout
 // params, these params are int pointers. nil means no param was supplied
 // so use the default; a non-nil pointer to 0 means no timeout.
@@ -153,9 +215,31 @@ type Config struct {
 
 	// EgressRegion is a ISO 3166-1 alpha-2 country code which indicates which
 	// country to egress from. For the default, "", the best performing server
-	// in any country is selected.
+	// in any country is selected. When EgressRegions is also specified,
+	// EgressRegion is the most preferred region.
 	EgressRegion string
 
+	// EgressRegions is an ordered list of ISO 3166-1 alpha-2 country codes
+	// of preferred egress regions. Servers in the first region are selected
+	// first, followed by servers in the next region, and so on; servers in
+	// other regions aren't selected unless EgressRegionFallbackSeconds is
+	// set. For the default, an empty list, servers in any region which isn't
+	// excluded are selected.
+	EgressRegions []string
+
+	// ExcludedEgressRegions is a list of ISO 3166-1 alpha-2 country codes of
+	// egress regions which are never selected, including after falling back.
+	// A region may not be both preferred and excluded.
+	ExcludedEgressRegions []string
+
+	// EgressRegionFallbackSeconds specifies a period after which, when the
+	// establish process has not established enough tunnels with servers in
+	// the preferred egress regions, servers in any region which isn't
+	// excluded are also selected. Servers in the preferred regions are still
+	// selected first. The period starts when the establish process starts.
+	// The default, 0, disables falling back.
+	EgressRegionFallbackSeconds int
+
 	// TunnelProtocol indicates which protocol to use. Valid values include:
 	// "SSH", "OSSH", "UNFRONTED-MEEK-OSSH", "UNFRONTED-MEEK-HTTPS-OSSH",
 	// "FRONTED-MEEK-OSSH", "FRONTED-MEEK-HTTP-OSSH". For the default, "",
@@ -164,9 +248,31 @@ type Config struct {
 
 	// EstablishTunnelTimeoutSeconds specifies a time limit after which to halt
 	// the core tunnel controller if no tunnel has been established. The default
-	// is ESTABLISH_TUNNEL_TIMEOUT_SECONDS.
+	// is ESTABLISH_TUNNEL_TIMEOUT_SECONDS. When the time limit expires, an
+	// EstablishFailureReport notice summarizes the failed attempts. The time
+	// limit doesn't apply in on-demand mode; see OnDemandTunnel.
 	EstablishTunnelTimeoutSeconds *int
 
+	// OnDemandTunnel enables on-demand mode, in which the controller doesn't
+	// establish tunnels when it starts. The local proxies accept connections
+	// while no tunnel exists, and the first port forward starts establishing;
+	// port forwards block until a tunnel is established or until the
+	// OnDemandDialTimeoutSeconds time limit expires. After a period with no
+	// port forwards, all tunnels are closed, ending their API sessions, and
+	// the next port forward establishes again.
+	OnDemandTunnel bool
+
+	// OnDemandIdleTimeoutSeconds specifies how long, in on-demand mode, tunnels
+	// remain connected with no open port forwards before they're closed. The
+	// value 0 leaves tunnels connected once established. If omitted, the
+	// default value is ON_DEMAND_IDLE_TIMEOUT_SECONDS.
+	OnDemandIdleTimeoutSeconds *int
+
+	// OnDemandDialTimeoutSeconds specifies how long, in on-demand mode, a port
+	// forward waits for a tunnel to be established. The default, 0, uses
+	// ON_DEMAND_DIAL_TIMEOUT_SECONDS.
+	OnDemandDialTimeoutSeconds int
+
 	// ListenInterface specifies which interface to listen on.  If no interface
 	// is provided then listen on 127.0.0.1.
 	// If 'any' is provided then use 0.0.0.0.
@@ -178,21 +284,156 @@ type Config struct {
 	// port (a notice reporting the selected port is emitted).
 	LocalSocksProxyPort int
 
+	// LocalSocksProxyUsername and LocalSocksProxyPassword, when the username
+	// is set, require SOCKS5 clients of the local SOCKS proxy to authenticate
+	// with this username and password (RFC 1929). SOCKS4 clients, which can't
+	// send a password, are then rejected. This username is in addition to,
+	// and must differ from, the LocalProxyUsers usernames, and applies to the
+	// SOCKS proxy only.
+	LocalSocksProxyUsername string
+	LocalSocksProxyPassword string
+
+	// LocalProxyUsers, when not empty, requires clients of the local SOCKS
+	// and HTTP proxies to authenticate as one of these users: SOCKS5 clients
+	// with a username and password, and HTTP clients with a Proxy-Authorization
+	// header with Basic credentials. SOCKS4 clients are then rejected. Each
+	// user may have a connection limit, and the connections and bytes
+	// transferred for each user are reported in LocalProxyUserStats notices.
+	// Usernames and passwords are limited to 255 bytes.
+	LocalProxyUsers []LocalProxyUser
+
+	// LocalProxyAllowedSourceCIDRs, when not empty, limits the clients of the
+	// local SOCKS, HTTP, DNS, and transparent proxies to those with source
+	// addresses in these CIDR ranges, such as "192.168.0.0/16". This is
+	// intended for use with a ListenInterface other than the loopback
+	// interface; to allow loopback clients, include "127.0.0.0/8". As DNS
+	// and transparent proxy clients can't authenticate, this is the only
+	// access control for those proxies.
+	LocalProxyAllowedSourceCIDRs []string
+
+	// UdpgwServerAddress specifies the network address of the udpgw server
+	// which Psiphon servers intercept, such as "127.0.0.1:7300"; see the
+	// server UDPInterceptUdpgwServerAddress. When set, the local SOCKS proxy
+	// supports the SOCKS5 UDP ASSOCIATE command, and relays UDP packets
+	// through the tunnel using the udpgw protocol. When not set, UDP
+	// ASSOCIATE requests are rejected.
+	UdpgwServerAddress string
+
 	// LocalHttpProxyPort specifies a port number for the local HTTP proxy
 	// running at 127.0.0.1. For the default value, 0, the system selects a free
 	// port (a notice reporting the selected port is emitted).
 	LocalHttpProxyPort int
 
+	// LocalDnsProxyPort specifies a port number for the local DNS proxy, which
+	// resolves UDP and TCP DNS queries through the tunnel; see DnsProxy. The
+	// DNS proxy listens on the same interface as the SOCKS and HTTP proxies.
+	// For the default value, 0, the DNS proxy is not run.
+	LocalDnsProxyPort int
+
+	// DnsProxyResolverAddress specifies the DNS resolver, such as
+	// "8.8.8.8:53", to which the local DNS proxy sends queries through the
+	// tunnel. When UdpgwServerAddress is set, queries are sent over udpgw
+	// with the transparent DNS flag, and the Psiphon server may forward them
+	// to its own resolver instead. Otherwise, queries are sent over a TCP port
+	// forward to this resolver. The default, "", uses DNS_PROXY_RESOLVER_ADDRESS.
+	DnsProxyResolverAddress string
+
+	// DnsProxyUntunneledResolverAddress specifies a DNS resolver, such as
+	// the local network resolver, which the local DNS proxy uses to resolve
+	// domestic names directly when split tunnel mode is on. When the tunneled
+	// response to a query contains an address within the split tunnel routes,
+	// the query is sent again, untunneled, to this resolver, and the untunneled
+	// response is used. This gives domestic names the addresses, such as CDN
+	// addresses, which suit the untunneled connections made to them. When not
+	// set, all queries are resolved through the tunnel.
+	DnsProxyUntunneledResolverAddress string
+
+	// LocalTransparentProxyPort specifies a port number for the local
+	// transparent proxy, which accepts TCP connections redirected to it by
+	// iptables and relays them through the tunnel to their original
+	// destinations; see TransparentProxy. The transparent proxy is supported
+	// on Linux only. For the default value, 0, the transparent proxy is not run.
+	LocalTransparentProxyPort int
+
+	// TransparentProxyMode specifies how connections are redirected to the
+	// transparent proxy: "REDIRECT", for the nat table REDIRECT target, or
+	// "TPROXY", for the mangle table TPROXY target. The default, "", is
+	// "REDIRECT".
+	TransparentProxyMode string
+
+	// PacketTunnelFileDescriptor specifies the file descriptor of a TUN
+	// device, such as that of an Android VpnService, from which the packet
+	// tunnel reads IP packets and relays them through the tunnel; see
+	// PacketTunnel. The packet tunnel takes ownership of the file descriptor
+	// and closes it when stopped. The Psiphon client's own connections must
+	// not be routed to the TUN device; on Android, DeviceBinder is required.
+	// The packet tunnel is supported on Linux, including Android, only. For
+	// the default value, 0, the packet tunnel is not run.
+	PacketTunnelFileDescriptor int
+
+	// PacketTunnelDeviceName specifies the name of an existing TUN interface,
+	// such as "tun0", which the packet tunnel attaches to, as an alternative
+	// to PacketTunnelFileDescriptor. The interface, and the routing which
+	// excludes the Psiphon client's own connections, must be configured
+	// outside of the client. The default, "", doesn't attach to an interface.
+	PacketTunnelDeviceName string
+
+	// PacketTunnelMTU specifies the MTU of the TUN device, which limits the
+	// size of the packets the packet tunnel sends. The default, 0, uses
+	// PACKET_TUNNEL_MTU.
+	PacketTunnelMTU int
+
+	// LocalControlPort specifies a port number for the local control API
+	// running at 127.0.0.1, which reports controller status and accepts
+	// commands; see ControlServer. The control API always listens on the
+	// loopback interface, regardless of ListenInterface. For the default
+	// value, 0, the control API is not run.
+	LocalControlPort int
+
 	// ConnectionWorkerPoolSize specifies how many connection attempts to attempt
 	// in parallel. The default, 0, uses CONNECTION_WORKER_POOL_SIZE which is
 	// recommended.
 	ConnectionWorkerPoolSize int
 
+	// DialCandidatesPerServerEntry specifies how many connection attempts,
+	// with distinct dial parameters, to make for each server. Attempts may
+	// differ in tunnel protocol and, for fronted meek protocols, fronting
+	// address and fronting host, so that one blocked option doesn't exclude
+	// the server. The default, 0, uses DIAL_CANDIDATES_PER_SERVER_ENTRY.
+	DialCandidatesPerServerEntry int
+
+	// ReplayDialParametersTTLSeconds specifies how long the dial parameters
+	// of the last successful tunnel to each server are replayed. A server's
+	// first connection attempt reuses its stored dial parameters, including
+	// the tunnel protocol, fronting address and host, and obfuscation padding,
+	// until they're older than the TTL or the attempt fails; only then are
+	// the dial parameters selected at random. The value 0 disables replay.
+	// If omitted, the default value is REPLAY_DIAL_PARAMETERS_TTL_SECONDS.
+	ReplayDialParametersTTLSeconds *int
+
 	// TunnelPoolSize specifies how many tunnels to run in parallel. Port forwards
 	// are multiplexed over multiple tunnels. The default, 0, uses TUNNEL_POOL_SIZE
 	// which is recommended.
 	TunnelPoolSize int
 
+	// TunnelPoolPolicy specifies how port forwards are distributed across the
+	// pool of active tunnels. The policies are:
+	// ROUND_ROBIN: each port forward uses the next tunnel in turn.
+	// LEAST_PORT_FORWARDS: uses the tunnel with the fewest open port forwards.
+	// LOWEST_RTT: uses the tunnel with the lowest round trip time, as measured
+	// by SSH keep alives. Tunnels without a measurement are used last.
+	// STICKY_HOST: all port forwards to a destination host use the same tunnel,
+	// and so egress from the same IP address, while that tunnel is active.
+	// With any policy, a failed port forward dial is retried on the other
+	// active tunnels. The default, "", uses TUNNEL_POOL_POLICY_ROUND_ROBIN.
+	TunnelPoolPolicy string
+
+	// UseStandbyTunnel specifies whether to maintain one additional established
+	// tunnel on hot standby. The standby tunnel is kept alive but isn't used for
+	// port forwards or periodic status requests. When an active tunnel fails, the
+	// standby tunnel is promoted immediately, avoiding a full establishment.
+	UseStandbyTunnel bool
+
 	// UpstreamProxyUrl is a URL specifying an upstream proxy to use for all
 	// outbound connections. The URL should include proxy type and authentication
 	// information, as required. See example URLs here:
@@ -224,6 +465,29 @@ type Config struct {
 	// transformation circumvention strategies.
 	HostNameTransformer HostNameTransformer
 
+	// NetworkID is an identifier for the current network, such as a hash of
+	// the Wi-Fi SSID. Tunnel protocol success and failure history is recorded
+	// per network and used to weight tunnel protocol selection, so that what
+	// is learned about a network is retained when switching between networks.
+	// The value should not be a raw network name, as it is stored in the
+	// datastore. When NetworkID and NetworkIDGetter are both omitted, all
+	// networks share the same history.
+	NetworkID string
+
+	// NetworkIDGetter is an interface that enables the core tunnel to call
+	// into the host application to get an identifier for the current network.
+	// When set, NetworkIDGetter takes precedence over NetworkID. This parameter
+	// is only applicable to library deployments.
+	NetworkIDGetter NetworkIDGetter
+
+	// NoticeOutput is an optional writer to receive the JSON notices emitted by
+	// a Controller created with this config. When set, the controller's notices
+	// are written to NoticeOutput instead of the process-wide output set with
+	// SetNoticeOutput, and are not delivered to process-wide event subscriptions.
+	// This allows multiple controllers to run in one process with separate notice
+	// output. This parameter is only applicable to library deployments.
+	NoticeOutput io.Writer
+
 	// TargetServerEntry is an encoded server entry. When specified, this server entry
 	// is used exclusively and all other known servers are ignored.
 	TargetServerEntry string
@@ -304,9 +568,16 @@ type Config struct {
 
 	// DisablePeriodicSshKeepAlive indicates whether to send an SSH keepalive every
 	// 1-2 minutes, when the tunnel is idle. If the SSH keepalive times out, the tunnel
-	// is considered to have failed.
+	// is considered to have failed. This also disables the periodic round trip time
+	// probe, which sends an SSH keepalive every 30-60 seconds, whether or not the
+	// tunnel is idle.
 	DisablePeriodicSshKeepAlive bool
 
+	// DisableSleepDetection disables detecting that the host has resumed from
+	// sleep or suspend. When detected, resuming is handled as a network change,
+	// which probes the tunnels immediately; see Controller.NetworkChanged.
+	DisableSleepDetection bool
+
 	// DeviceRegion is the optional, reported region the host device is running in.
 	// This input value should be a ISO 3166-1 alpha-2 country code. The device region
 	// is reported to the server in the connected request and recorded for Psiphon
@@ -343,6 +614,32 @@ type Config struct {
 	// If omitted, the default value is TUNNEL_SSH_KEEP_ALIVE_PERIODIC_TIMEOUT_SECONDS.
 	TunnelSshKeepAlivePeriodicTimeoutSeconds *int
 
+	// TunnelDegradedRoundTripTimeMilliseconds specifies a smoothed round trip time
+	// above which a tunnel is considered degraded, when exceeded for
+	// TUNNEL_DEGRADED_ROUND_TRIP_TIME_SAMPLES consecutive SSH keep-alives.
+	// A degraded tunnel continues to operate while a replacement is established,
+	// and is then drained: it carries no new port forwards and is closed when its
+	// existing port forwards close or after TUNNEL_DRAIN_TIMEOUT.
+	// Zero value disables the round trip time check.
+	// If omitted, the default value is TUNNEL_DEGRADED_ROUND_TRIP_TIME_MILLISECONDS.
+	TunnelDegradedRoundTripTimeMilliseconds *int
+
+	// TunnelDegradedPortForwardFailures specifies a number of port forward failures,
+	// within TUNNEL_DEGRADED_PORT_FORWARD_FAILURE_PERIOD, at which a tunnel is
+	// considered degraded. Zero value disables the port forward failure check.
+	// Port forward failures include destinations which refuse or don't respond
+	// to connections, which aren't faults of the tunnel, so the check is off
+	// unless enabled here.
+	// If omitted, the default value is TUNNEL_DEGRADED_PORT_FORWARD_FAILURES.
+	TunnelDegradedPortForwardFailures *int
+
+	// TunnelDegradedThroughputBytesPerSecond specifies a received throughput below
+	// which a tunnel is considered degraded, when for TUNNEL_DEGRADED_THROUGHPUT_PERIOD
+	// the tunnel has open port forwards and is sending data. The default, 0, disables
+	// the throughput check, as low throughput may only mean that little data is
+	// being requested.
+	TunnelDegradedThroughputBytesPerSecond int
+
 	// FetchRemoteServerListTimeoutSeconds specifies a timeout value for remote server list
 	// HTTP request. Zero value means that request will not time out.
 	// If omitted, the default value is FETCH_REMOTE_SERVER_LIST_TIMEOUT_SECONDS.
@@ -381,7 +678,50 @@ type Config struct {
 	// to establish tunnels. Briefly pausing allows for network conditions to improve
 	// and for asynchronous operations such as fetch remote server list to complete.
 	// If omitted, the default value is ESTABLISH_TUNNEL_PAUSE_PERIOD_SECONDS.
+	//
+	// The pause backs off: after each consecutive round of attempts which
+	// doesn't complete establishment, the pause grows by a factor of
+	// EstablishTunnelPauseBackoffFactor, up to EstablishTunnelMaxPausePeriodSeconds.
+	// The backoff is reset when the network changes or when a remote server
+	// list fetch obtains new server entries.
 	EstablishTunnelPausePeriodSeconds *int
+
+	// EstablishTunnelMaxPausePeriodSeconds is the maximum pause between
+	// attempts to establish tunnels; see EstablishTunnelPausePeriodSeconds.
+	// A value no greater than EstablishTunnelPausePeriodSeconds disables backoff.
+	// If omitted, the default value is ESTABLISH_TUNNEL_MAX_PAUSE_PERIOD_SECONDS.
+	EstablishTunnelMaxPausePeriodSeconds *int
+
+	// EstablishTunnelPauseBackoffFactor is the factor by which the pause
+	// between attempts to establish tunnels grows. The default, 0, uses
+	// ESTABLISH_TUNNEL_PAUSE_BACKOFF_FACTOR. Values less than 1 are invalid.
+	EstablishTunnelPauseBackoffFactor float64
+
+	// EstablishTunnelPauseJitterPercent specifies the random jitter, as a
+	// percentage of the pause, applied to each pause between attempts to
+	// establish tunnels. The value 0 disables jitter.
+	// If omitted, the default value is ESTABLISH_TUNNEL_PAUSE_JITTER_PERCENT.
+	EstablishTunnelPauseJitterPercent *int
+
+	// EstablishTunnelBackoffWorkerPoolSize, when not 0, limits how many
+	// connection attempts are made in parallel in rounds after a round which
+	// failed to complete establishment, while backing off. The first round
+	// always uses ConnectionWorkerPoolSize, as does every round when the
+	// default, 0, is used.
+	EstablishTunnelBackoffWorkerPoolSize int
+
+	// dataStore, notices and transferStats are bound by NewController, in
+	// its copy of the config, to the resources for that controller instance.
+	// In a config that isn't bound to a controller, these are nil and refer to
+	// the process-wide datastore, notices and transfer stats collector.
+	dataStore     *DataStore
+	notices       *Notices
+	transferStats *transferstats.Collector
+
+	// localProxyAccessControl is bound by NewController and is shared by the
+	// local proxies of that controller. When nil, as when no local proxy
+	// access control is configured, the local proxies allow all clients.
+	localProxyAccessControl *localProxyAccessControl
 }
 
 // LoadConfig parses and validates a JSON format Psiphon config JSON
@@ -425,6 +765,65 @@ func LoadConfig(configJson []byte) (*Config, error) {
 			fmt.Errorf("invalid client version: %s", err))
 	}
 
+	// RFC 1929 limits the username and password to 255 bytes.
+	if len(config.LocalSocksProxyUsername) > 255 || len(config.LocalSocksProxyPassword) > 255 ||
+		(config.LocalSocksProxyUsername == "" && config.LocalSocksProxyPassword != "") {
+
+		return nil, ContextError(errors.New("invalid local SOCKS proxy credentials"))
+	}
+
+	for _, resolverAddress := range []string{
+		config.DnsProxyResolverAddress, config.DnsProxyUntunneledResolverAddress} {
+
+		if resolverAddress == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(resolverAddress)
+		if err == nil && net.ParseIP(host) == nil {
+			err = fmt.Errorf("DNS resolver address must be an IP address: %s", resolverAddress)
+		}
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	if config.TransparentProxyMode != "" &&
+		config.TransparentProxyMode != TRANSPARENT_PROXY_MODE_REDIRECT &&
+		config.TransparentProxyMode != TRANSPARENT_PROXY_MODE_TPROXY {
+
+		return nil, ContextError(
+			fmt.Errorf("invalid transparent proxy mode: %s", config.TransparentProxyMode))
+	}
+
+	if config.PacketTunnelFileDescriptor != 0 && config.PacketTunnelDeviceName != "" {
+		return nil, ContextError(
+			errors.New("packet tunnel file descriptor and device name are mutually exclusive"))
+	}
+
+	if config.PacketTunnelMTU != 0 &&
+		(config.PacketTunnelMTU < 576 || config.PacketTunnelMTU > 65535) {
+
+		return nil, ContextError(
+			fmt.Errorf("invalid packet tunnel MTU: %d", config.PacketTunnelMTU))
+	}
+
+	_, err = newLocalProxyAccessControl(&config)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if config.UdpgwServerAddress != "" {
+		_, _, err = net.SplitHostPort(config.UdpgwServerAddress)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	err = config.GetEgressRegionFilter().validate()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
 	if config.TunnelProtocol != "" {
 		if !Contains(SupportedTunnelProtocols, config.TunnelProtocol) {
 			return nil, ContextError(
@@ -437,14 +836,36 @@ func LoadConfig(configJson []byte) (*Config, error) {
 		config.EstablishTunnelTimeoutSeconds = &defaultEstablishTunnelTimeoutSeconds
 	}
 
+	if config.OnDemandIdleTimeoutSeconds == nil {
+		defaultOnDemandIdleTimeoutSeconds := ON_DEMAND_IDLE_TIMEOUT_SECONDS
+		config.OnDemandIdleTimeoutSeconds = &defaultOnDemandIdleTimeoutSeconds
+	}
+
+	if config.OnDemandDialTimeoutSeconds == 0 {
+		config.OnDemandDialTimeoutSeconds = ON_DEMAND_DIAL_TIMEOUT_SECONDS
+	}
+
 	if config.ConnectionWorkerPoolSize == 0 {
 		config.ConnectionWorkerPoolSize = CONNECTION_WORKER_POOL_SIZE
 	}
 
+	if config.DialCandidatesPerServerEntry == 0 {
+		config.DialCandidatesPerServerEntry = DIAL_CANDIDATES_PER_SERVER_ENTRY
+	}
+
 	if config.TunnelPoolSize == 0 {
 		config.TunnelPoolSize = TUNNEL_POOL_SIZE
 	}
 
+	if config.TunnelPoolPolicy == "" {
+		config.TunnelPoolPolicy = TUNNEL_POOL_POLICY_ROUND_ROBIN
+	}
+
+	if !Contains(SupportedTunnelPoolPolicies, config.TunnelPoolPolicy) {
+		return nil, ContextError(
+			errors.New("invalid tunnel pool policy"))
+	}
+
 	if config.NetworkConnectivityChecker != nil {
 		return nil, ContextError(errors.New("NetworkConnectivityChecker interface must be set at runtime"))
 	}
@@ -461,6 +882,14 @@ func LoadConfig(configJson []byte) (*Config, error) {
 		return nil, ContextError(errors.New("HostNameTransformer interface must be set at runtime"))
 	}
 
+	if config.NetworkIDGetter != nil {
+		return nil, ContextError(errors.New("NetworkIDGetter interface must be set at runtime"))
+	}
+
+	if config.NoticeOutput != nil {
+		return nil, ContextError(errors.New("NoticeOutput interface must be set at runtime"))
+	}
+
 	if config.UpgradeDownloadUrl != "" &&
 		(config.UpgradeDownloadClientVersionHeader == "" || config.UpgradeDownloadFilename == "") {
 		return nil, ContextError(errors.New(
@@ -487,6 +916,16 @@ func LoadConfig(configJson []byte) (*Config, error) {
 		config.TunnelSshKeepAlivePeriodicTimeoutSeconds = &defaultTunnelSshKeepAlivePeriodicTimeoutSeconds
 	}
 
+	if config.TunnelDegradedRoundTripTimeMilliseconds == nil {
+		defaultTunnelDegradedRoundTripTimeMilliseconds := TUNNEL_DEGRADED_ROUND_TRIP_TIME_MILLISECONDS
+		config.TunnelDegradedRoundTripTimeMilliseconds = &defaultTunnelDegradedRoundTripTimeMilliseconds
+	}
+
+	if config.TunnelDegradedPortForwardFailures == nil {
+		defaultTunnelDegradedPortForwardFailures := TUNNEL_DEGRADED_PORT_FORWARD_FAILURES
+		config.TunnelDegradedPortForwardFailures = &defaultTunnelDegradedPortForwardFailures
+	}
+
 	if config.FetchRemoteServerListTimeoutSeconds == nil {
 		defaultFetchRemoteServerListTimeoutSeconds := FETCH_REMOTE_SERVER_LIST_TIMEOUT_SECONDS
 		config.FetchRemoteServerListTimeoutSeconds = &defaultFetchRemoteServerListTimeoutSeconds
@@ -522,5 +961,35 @@ func LoadConfig(configJson []byte) (*Config, error) {
 		config.EstablishTunnelPausePeriodSeconds = &defaultEstablishTunnelPausePeriodSeconds
 	}
 
+	if config.EstablishTunnelMaxPausePeriodSeconds == nil {
+		defaultEstablishTunnelMaxPausePeriodSeconds := ESTABLISH_TUNNEL_MAX_PAUSE_PERIOD_SECONDS
+		config.EstablishTunnelMaxPausePeriodSeconds = &defaultEstablishTunnelMaxPausePeriodSeconds
+	}
+
+	if config.EstablishTunnelPauseBackoffFactor == 0 {
+		config.EstablishTunnelPauseBackoffFactor = ESTABLISH_TUNNEL_PAUSE_BACKOFF_FACTOR
+	}
+
+	if config.EstablishTunnelPauseBackoffFactor < 1 {
+		return nil, ContextError(
+			errors.New("invalid establish tunnel pause backoff factor"))
+	}
+
+	if config.EstablishTunnelPauseJitterPercent == nil {
+		defaultEstablishTunnelPauseJitterPercent := ESTABLISH_TUNNEL_PAUSE_JITTER_PERCENT
+		config.EstablishTunnelPauseJitterPercent = &defaultEstablishTunnelPauseJitterPercent
+	}
+
+	if *config.EstablishTunnelPauseJitterPercent < 0 ||
+		*config.EstablishTunnelPauseJitterPercent > 100 {
+		return nil, ContextError(
+			errors.New("invalid establish tunnel pause jitter percent"))
+	}
+
+	if config.ReplayDialParametersTTLSeconds == nil {
+		defaultReplayDialParametersTTLSeconds := REPLAY_DIAL_PARAMETERS_TTL_SECONDS
+		config.ReplayDialParametersTTLSeconds = &defaultReplayDialParametersTTLSeconds
+	}
+
 	return &config, nil
 }
@@ -0,0 +1,260 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// ControlServer is a local HTTP server which allows other processes, such
+// as scripts and desktop UIs, to query and steer a running controller. It
+// listens on 127.0.0.1:<LocalControlPort>. Requests and responses are JSON.
+//
+// The API is:
+//
+// - GET /status: returns a ControllerStatus.
+// - POST /stop: stops the controller; see Controller.Stop.
+// - POST /reconnect: replaces all tunnels; see Controller.Reconnect.
+// - POST /reconfigure: the request body is {"egressRegion": "<region>",
+//   "tunnelProtocol": "<protocol>"}, where an omitted field retains its
+//   current value; see Controller.Reconfigure.
+// - POST /client-verification-payload: the request body is the payload;
+//   see Controller.SetClientVerificationPayload.
+//
+// Commands are asynchronous: a 202 response indicates that the command was
+// accepted, and the outcome may be observed via /status or notices.
+//
+// POST requests must have a "Content-Type: application/json" header and
+// all requests must have a loopback Host header. This prevents web pages,
+// which can make cross-origin requests to 127.0.0.1, from sending commands.
+//
+type ControlServer struct {
+	controller             *Controller
+	listener               net.Listener
+	serveWaitGroup         *sync.WaitGroup
+	stopListeningBroadcast chan struct{}
+	notices                *Notices
+}
+
+// NewControlServer initializes and runs a new local control server.
+func NewControlServer(
+	config *Config, controller *Controller) (server *ControlServer, err error) {
+
+	listener, err := net.Listen(
+		"tcp", fmt.Sprintf("127.0.0.1:%d", config.LocalControlPort))
+	if err != nil {
+		if IsAddressInUseError(err) {
+			config.notices.ControlPortInUse(config.LocalControlPort)
+		}
+		return nil, ContextError(err)
+	}
+
+	server = &ControlServer{
+		controller:             controller,
+		listener:               listener,
+		serveWaitGroup:         new(sync.WaitGroup),
+		stopListeningBroadcast: make(chan struct{}),
+		notices:                config.notices,
+	}
+	server.serveWaitGroup.Add(1)
+	go server.serve()
+
+	config.notices.ListeningControlPort(server.listener.Addr().(*net.TCPAddr).Port)
+
+	return server, nil
+}
+
+// Close terminates the control server.
+func (server *ControlServer) Close() {
+	close(server.stopListeningBroadcast)
+	server.listener.Close()
+	server.serveWaitGroup.Wait()
+}
+
+func (server *ControlServer) serve() {
+	defer server.listener.Close()
+	defer server.serveWaitGroup.Done()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", server.statusHandler)
+	mux.HandleFunc("/stop", server.stopHandler)
+	mux.HandleFunc("/reconnect", server.reconnectHandler)
+	mux.HandleFunc("/reconfigure", server.reconfigureHandler)
+	mux.HandleFunc("/client-verification-payload", server.clientVerificationPayloadHandler)
+
+	httpServer := &http.Server{
+		Handler: server.checkRequest(mux),
+	}
+	// Note: will be interrupted by listener.Close() call made by server.Close()
+	err := httpServer.Serve(server.listener)
+	select {
+	case <-server.stopListeningBroadcast:
+	default:
+		if err != nil {
+			server.controller.SignalComponentFailure()
+			server.notices.Alert("control server failed: %s", ContextError(err))
+		}
+	}
+	server.notices.Info("control server stopped")
+}
+
+// checkRequest rejects requests which may originate from a web page; see
+// the ControlServer comment.
+func (server *ControlServer) checkRequest(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+
+		host, _, err := net.SplitHostPort(request.Host)
+		if err != nil {
+			host = request.Host
+		}
+		if host != "localhost" {
+			ip := net.ParseIP(host)
+			if ip == nil || !ip.IsLoopback() {
+				http.Error(responseWriter, "invalid host", http.StatusForbidden)
+				return
+			}
+		}
+
+		if request.Method == "POST" {
+			mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+			if mediaType != "application/json" {
+				http.Error(responseWriter, "invalid content type", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+
+		handler.ServeHTTP(responseWriter, request)
+	})
+}
+
+func (server *ControlServer) statusHandler(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	if request.Method != "GET" {
+		http.Error(responseWriter, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	responseBody, err := json.Marshal(server.controller.GetStatus())
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.Write(responseBody)
+}
+
+func (server *ControlServer) stopHandler(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	if request.Method != "POST" {
+		http.Error(responseWriter, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	server.notices.Info("control server: stop")
+	server.controller.Stop()
+	responseWriter.WriteHeader(http.StatusAccepted)
+}
+
+func (server *ControlServer) reconnectHandler(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	if request.Method != "POST" {
+		http.Error(responseWriter, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	server.notices.Info("control server: reconnect")
+	server.controller.Reconnect()
+	responseWriter.WriteHeader(http.StatusAccepted)
+}
+
+func (server *ControlServer) reconfigureHandler(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	if request.Method != "POST" {
+		http.Error(responseWriter, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requestBody struct {
+		EgressRegion   *string `json:"egressRegion"`
+		TunnelProtocol *string `json:"tunnelProtocol"`
+	}
+	err := json.NewDecoder(
+		io.LimitReader(request.Body, CONTROL_SERVER_MAX_REQUEST_BODY_SIZE)).Decode(&requestBody)
+	if err != nil {
+		http.Error(responseWriter, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	status := server.controller.GetStatus()
+	egressRegion := status.EgressRegion
+	if requestBody.EgressRegion != nil {
+		egressRegion = *requestBody.EgressRegion
+	}
+	tunnelProtocol := status.TunnelProtocol
+	if requestBody.TunnelProtocol != nil {
+		tunnelProtocol = *requestBody.TunnelProtocol
+	}
+
+	server.notices.Info(
+		"control server: reconfigure: egress region: %s, tunnel protocol: %s",
+		egressRegion, tunnelProtocol)
+	err = server.controller.Reconfigure(egressRegion, tunnelProtocol)
+	if err != nil {
+		http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	responseWriter.WriteHeader(http.StatusAccepted)
+}
+
+func (server *ControlServer) clientVerificationPayloadHandler(
+	responseWriter http.ResponseWriter, request *http.Request) {
+
+	if request.Method != "POST" {
+		http.Error(responseWriter, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := ioutil.ReadAll(
+		io.LimitReader(request.Body, CONTROL_SERVER_MAX_REQUEST_BODY_SIZE))
+	if err == nil {
+		var value interface{}
+		err = json.Unmarshal(payload, &value)
+	}
+	if err != nil {
+		http.Error(responseWriter, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	server.notices.Info("control server: client verification payload")
+	server.controller.SetClientVerificationPayload(string(payload))
+	responseWriter.WriteHeader(http.StatusAccepted)
+}
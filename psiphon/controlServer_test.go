@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestControlServer(t *testing.T) {
+
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon-control-server-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataStoreDirectory)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = dataStoreDirectory
+	config.NoticeOutput = ioutil.Discard
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+	defer controller.Close()
+
+	// With LocalControlPort 0, the system selects a free port
+	server, err := NewControlServer(controller.config, controller)
+	if err != nil {
+		t.Fatalf("NewControlServer failed: %s", err)
+	}
+	defer server.Close()
+
+	baseUrl := "http://" + server.listener.Addr().String()
+
+	request := func(method, path, contentType, body string) *http.Response {
+		httpRequest, err := http.NewRequest(method, baseUrl+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest failed: %s", err)
+		}
+		if contentType != "" {
+			httpRequest.Header.Set("Content-Type", contentType)
+		}
+		response, err := http.DefaultClient.Do(httpRequest)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		return response
+	}
+
+	response := request("GET", "/status", "", "")
+	var status ControllerStatus
+	err = json.NewDecoder(response.Body).Decode(&status)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("Decode failed: %s", err)
+	}
+	if status.SessionId != controller.sessionId || len(status.Tunnels) != 0 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// Commands require a JSON content type
+	response = request("POST", "/stop", "", "")
+	response.Body.Close()
+	if response.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	select {
+	case <-controller.signalStop:
+		t.Errorf("unexpected stop signal")
+	default:
+	}
+
+	response = request("POST", "/stop", "application/json", "")
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	select {
+	case <-controller.signalStop:
+	default:
+		t.Errorf("missing stop signal")
+	}
+
+	response = request("POST", "/reconfigure", "application/json", `{"egressRegion": "CA"}`)
+	response.Body.Close()
+	if response.StatusCode != http.StatusAccepted {
+		t.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	select {
+	case <-controller.signalReconfigure:
+		if controller.pendingReconfiguration.egressRegion != "CA" ||
+			controller.pendingReconfiguration.tunnelProtocol != "" {
+			t.Errorf("unexpected reconfiguration: %+v", controller.pendingReconfiguration)
+		}
+	default:
+		t.Errorf("missing reconfiguration")
+	}
+
+	response = request("POST", "/reconfigure", "application/json", `{"tunnelProtocol": "INVALID"}`)
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+
+	response = request("POST", "/client-verification-payload", "application/json", "not JSON")
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+
+	// Requests with a non-loopback Host, as in DNS rebinding, are rejected
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /status HTTP/1.0\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	rawResponse, _ := ioutil.ReadAll(conn)
+	if !bytes.HasPrefix(rawResponse, []byte("HTTP/1.0 403")) {
+		t.Errorf("unexpected response: %s", rawResponse)
+	}
+}
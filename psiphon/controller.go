@@ -29,6 +29,8 @@ import (
 	"net"
 	"sync"
 	"time"
+
+	"github.com/Psiphon-Labs/psiphon-tunnel-core/psiphon/transferstats"
 )
 
 // Controller is a tunnel lifecycle coordinator. It manages lists of servers to
@@ -42,10 +44,19 @@ type Controller struct {
 	runWaitGroup                   *sync.WaitGroup
 	establishedTunnels             chan *Tunnel
 	failedTunnels                  chan *Tunnel
+	degradedTunnels                chan *Tunnel
 	tunnelMutex                    sync.Mutex
 	establishedOnce                bool
 	tunnels                        []*Tunnel
 	nextTunnel                     int
+	stickyHostTunnels              map[string]*Tunnel
+	standbyTunnel                  *Tunnel
+	drainingTunnels                []*Tunnel
+	tunnelAvailableBroadcast       chan struct{}
+	onDemandLastActiveTime         time.Time
+	onDemandPendingDials           int
+	isOnDemandIdle                 bool
+	signalOnDemandEstablish        chan struct{}
 	startedConnectedReporter       bool
 	isEstablishing                 bool
 	establishWaitGroup             *sync.WaitGroup
@@ -58,14 +69,204 @@ type Controller struct {
 	signalFetchRemoteServerList    chan struct{}
 	signalDownloadUpgrade          chan string
 	impairedProtocolClassification map[string]int
+	establishStats                 *establishStats
+	establishFailureRecorder       *establishFailureRecorder
 	signalReportConnected          chan struct{}
-	serverAffinityDoneBroadcast    chan struct{}
+	serverAffinity                 *serverAffinity
+	establishLimiter               *establishLimiter
+	signalResetEstablishBackoff    chan struct{}
 	newClientVerificationPayload   chan string
+	signalStop                     chan struct{}
+	signalReconnect                chan struct{}
+	signalNetworkChanged           chan struct{}
+	reconfigureMutex               sync.Mutex
+	pendingReconfiguration         *reconfiguration
+	signalReconfigure              chan struct{}
+}
+
+type reconfiguration struct {
+	egressRegion   string
+	tunnelProtocol string
 }
 
 type candidateServerEntry struct {
-	serverEntry               *ServerEntry
+	serverEntry    *ServerEntry
+	networkID      string
+	dialParameters *DialParameters
+	group          *candidateGroup
+}
+
+// candidateGroup is shared by the candidates generated from one server
+// entry. A dial failure is recorded in the server performance history only
+// when all candidates with the same tunnel protocol have failed, so that,
+// for example, one blocked fronting address doesn't count against a server
+// which is reachable with other fronting parameters.
+//
+// When the server entry is a server affinity candidate, all of its
+// candidates are server affinity candidates, and the group holds one
+// server affinity slot; see releaseServerAffinity.
+type candidateGroup struct {
+	mutex                     sync.Mutex
+	pending                   map[string]int
+	succeeded                 map[string]bool
+	remaining                 int
 	isServerAffinityCandidate bool
+	releasedServerAffinity    bool
+}
+
+func newCandidateGroup(
+	dialParameters []*DialParameters, isServerAffinityCandidate bool) *candidateGroup {
+
+	group := &candidateGroup{
+		pending:                   make(map[string]int),
+		succeeded:                 make(map[string]bool),
+		remaining:                 len(dialParameters),
+		isServerAffinityCandidate: isServerAffinityCandidate,
+	}
+	for _, parameters := range dialParameters {
+		group.pending[parameters.TunnelProtocol] += 1
+	}
+	return group
+}
+
+// completeCandidate marks one candidate as done and returns true when its
+// outcome should be recorded: a success is always recorded; a failure is
+// recorded only when no other candidate with the same protocol is pending
+// or has succeeded. A skipped candidate, which made no dial attempt, is
+// never recorded.
+func (group *candidateGroup) completeCandidate(protocol string, succeeded, skipped bool) bool {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.pending[protocol] -= 1
+	group.remaining -= 1
+	if succeeded {
+		group.succeeded[protocol] = true
+		return true
+	}
+	return !skipped && group.pending[protocol] == 0 && !group.succeeded[protocol]
+}
+
+// releaseServerAffinity returns true, once, when the group's server affinity
+// slot is done: when a tunnel established with one of its candidates has
+// been delivered, or when all of its candidates have failed.
+func (group *candidateGroup) releaseServerAffinity(delivered bool) bool {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if !group.isServerAffinityCandidate || group.releasedServerAffinity {
+		return false
+	}
+	if delivered || (group.remaining == 0 && len(group.succeeded) == 0) {
+		group.releasedServerAffinity = true
+		return true
+	}
+	return false
+}
+
+// serverAffinity tracks the server affinity slots for one run of the
+// establish process. Each server affinity candidate group is assigned a
+// slot, and doneBroadcast is closed once all slots have been assigned and
+// released.
+type serverAffinity struct {
+	mutex         sync.Mutex
+	pendingSlots  int
+	isAssigned    bool
+	doneBroadcast chan struct{}
+}
+
+func newServerAffinity() *serverAffinity {
+	return &serverAffinity{
+		doneBroadcast: make(chan struct{}),
+	}
+}
+
+// assignSlot adds a pending slot.
+func (affinity *serverAffinity) assignSlot() {
+	affinity.mutex.Lock()
+	defer affinity.mutex.Unlock()
+	affinity.pendingSlots += 1
+}
+
+// assignmentDone indicates that no more slots will be assigned.
+func (affinity *serverAffinity) assignmentDone() {
+	affinity.mutex.Lock()
+	defer affinity.mutex.Unlock()
+	affinity.isAssigned = true
+	affinity.checkDone()
+}
+
+// releaseSlot releases a pending slot.
+func (affinity *serverAffinity) releaseSlot() {
+	affinity.mutex.Lock()
+	defer affinity.mutex.Unlock()
+	affinity.pendingSlots -= 1
+	affinity.checkDone()
+}
+
+func (affinity *serverAffinity) checkDone() {
+	if affinity.isAssigned && affinity.pendingSlots == 0 {
+		select {
+		case <-affinity.doneBroadcast:
+		default:
+			close(affinity.doneBroadcast)
+		}
+	}
+}
+
+// establishLimiter limits the number of concurrent tunnel establishment
+// attempts made by the establish workers. The limit may be changed while
+// establishing, and stop unblocks all waiting workers.
+type establishLimiter struct {
+	mutex     sync.Mutex
+	condition *sync.Cond
+	limit     int
+	active    int
+	isStopped bool
+}
+
+func newEstablishLimiter(limit int) *establishLimiter {
+	limiter := &establishLimiter{limit: limit}
+	limiter.condition = sync.NewCond(&limiter.mutex)
+	return limiter
+}
+
+// setLimit changes the limit. Attempts in progress aren't interrupted when
+// the limit is reduced.
+func (limiter *establishLimiter) setLimit(limit int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.limit = limit
+	limiter.condition.Broadcast()
+}
+
+// acquire blocks until an attempt may start. It returns false when the
+// limiter is stopped.
+func (limiter *establishLimiter) acquire() bool {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	for !limiter.isStopped && limiter.active >= limiter.limit {
+		limiter.condition.Wait()
+	}
+	if limiter.isStopped {
+		return false
+	}
+	limiter.active += 1
+	return true
+}
+
+// release ends an attempt started with acquire.
+func (limiter *establishLimiter) release() {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.active -= 1
+	limiter.condition.Broadcast()
+}
+
+// stop unblocks all waiting and future acquire calls.
+func (limiter *establishLimiter) stop() {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.isStopped = true
+	limiter.condition.Broadcast()
 }
 
 // NewController initializes a new controller.
@@ -79,13 +280,41 @@ func NewController(config *Config) (controller *Controller, err error) {
 		config.HostNameTransformer = &IdentityHostNameTransformer{}
 	}
 
+	// The controller uses its own copy of the config, which is bound to the
+	// notices, transfer stats collector and datastore handle for this controller
+	// instance. This allows multiple controllers, with different configs, to run
+	// in one process.
+	controllerConfig := *config
+	config = &controllerConfig
+
+	// Unless the config specifies a NoticeOutput, controller notices are
+	// forwarded to the process-wide notice output and event subscriptions.
+	var noticeOutput eventSubscriber = processNotices
+	if config.NoticeOutput != nil {
+		noticeOutput = newJSONNoticeWriter(config.NoticeOutput)
+	}
+	config.notices = newNotices(noticeOutput)
+
+	config.transferStats = transferstats.NewCollector()
+
+	config.localProxyAccessControl, err = newLocalProxyAccessControl(config)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
 	// Generate a session ID for the Psiphon server API. This session ID is
 	// used across all tunnels established by the controller.
 	sessionId, err := MakeSessionId()
 	if err != nil {
 		return nil, ContextError(err)
 	}
-	NoticeSessionId(sessionId)
+	config.notices.SessionId(sessionId)
+
+	// The datastore handle is closed when Run returns, or by Close.
+	config.dataStore, err = OpenDataStore(config)
+	if err != nil {
+		return nil, ContextError(err)
+	}
 
 	// untunneledPendingConns may be used to interrupt the fetch remote server list
 	// request and other untunneled connection establishments. BindToDevice may be
@@ -102,6 +331,7 @@ func NewController(config *Config) (controller *Controller, err error) {
 		UseIndistinguishableTLS:       config.UseIndistinguishableTLS,
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
 		DeviceRegion:                  config.DeviceRegion,
+		notices:                       config.notices,
 	}
 
 	controller = &Controller{
@@ -114,9 +344,11 @@ func NewController(config *Config) (controller *Controller, err error) {
 		shutdownBroadcast:      make(chan struct{}),
 		runWaitGroup:           new(sync.WaitGroup),
 		// establishedTunnels and failedTunnels buffer sizes are large enough to
-		// receive full pools of tunnels without blocking. Senders should not block.
-		establishedTunnels:             make(chan *Tunnel, config.TunnelPoolSize),
-		failedTunnels:                  make(chan *Tunnel, config.TunnelPoolSize),
+		// receive full pools of tunnels, including any standby tunnel, without
+		// blocking. Senders should not block.
+		establishedTunnels:             make(chan *Tunnel, config.TunnelPoolSize+1),
+		failedTunnels:                  make(chan *Tunnel, config.TunnelPoolSize+1),
+		degradedTunnels:                make(chan *Tunnel, config.TunnelPoolSize+1),
 		tunnels:                        make([]*Tunnel, 0),
 		establishedOnce:                false,
 		startedConnectedReporter:       false,
@@ -125,15 +357,32 @@ func NewController(config *Config) (controller *Controller, err error) {
 		untunneledPendingConns:         untunneledPendingConns,
 		untunneledDialConfig:           untunneledDialConfig,
 		impairedProtocolClassification: make(map[string]int),
+		establishStats:                 newEstablishStats(),
+		establishFailureRecorder: newEstablishFailureRecorder(
+			config.DisableRemoteServerListFetcher),
+		stickyHostTunnels:        make(map[string]*Tunnel),
+		tunnelAvailableBroadcast: make(chan struct{}),
 		// TODO: Add a buffer of 1 so we don't miss a signal while receiver is
 		// starting? Trade-off is potential back-to-back fetch remotes. As-is,
 		// establish will eventually signal another fetch remote.
 		signalFetchRemoteServerList: make(chan struct{}),
 		signalDownloadUpgrade:       make(chan string),
 		signalReportConnected:       make(chan struct{}),
+		// Buffer allows a backoff reset to be signaled while the establish
+		// candidate generator isn't pausing.
+		signalResetEstablishBackoff: make(chan struct{}, 1),
+		// Buffer allows any number of on-demand Dials to signal establishing
+		// without blocking.
+		signalOnDemandEstablish: make(chan struct{}, 1),
 		// Buffer allows SetClientVerificationPayload to submit one new payload
 		// without blocking or dropping it.
 		newClientVerificationPayload: make(chan string, 1),
+		// Buffers allow Stop, Reconnect, NetworkChanged, and Reconfigure to submit
+		// one request without blocking.
+		signalStop:           make(chan struct{}, 1),
+		signalReconnect:      make(chan struct{}, 1),
+		signalNetworkChanged: make(chan struct{}, 1),
+		signalReconfigure:    make(chan struct{}, 1),
 	}
 
 	controller.splitTunnelClassifier = NewSplitTunnelClassifier(config, controller)
@@ -141,6 +390,14 @@ func NewController(config *Config) (controller *Controller, err error) {
 	return controller, nil
 }
 
+// Close releases the resources, including the datastore handle, held by a
+// controller. Run releases these resources when it returns, so Close is
+// needed only for a controller which isn't run, as when a caller fails
+// before calling Run. Close may be called more than once.
+func (controller *Controller) Close() {
+	controller.config.dataStore.Close()
+}
+
 // Run executes the controller. It launches components and then monitors
 // for a shutdown signal; after receiving the signal it shuts down the
 // controller.
@@ -150,20 +407,35 @@ func NewController(config *Config) (controller *Controller, err error) {
 // - the tunnel manager
 // - a local SOCKS proxy that port forwards through the pool of tunnels
 // - a local HTTP proxy that port forwards through the pool of tunnels
+// - optionally, a local DNS proxy that resolves through the pool of tunnels
+// - optionally, a local transparent proxy that port forwards through the pool of tunnels
+// - optionally, a packet tunnel that relays TUN device packets through the pool of tunnels
 func (controller *Controller) Run(shutdownBroadcast <-chan struct{}) {
-	ReportAvailableRegions()
+	defer controller.Close()
+
+	// The controller owns PacketTunnelFileDescriptor. Once the packet tunnel
+	// is started, it's closed by the packet tunnel; otherwise, when Run fails
+	// first, it's closed here.
+	packetTunnelStarted := false
+	defer func() {
+		if !packetTunnelStarted && controller.config.PacketTunnelFileDescriptor != 0 {
+			closeTunFileDescriptor(controller.config.PacketTunnelFileDescriptor)
+		}
+	}()
+
+	controller.config.dataStore.ReportAvailableRegions()
 
 	// Start components
 
 	listenIP, err := GetInterfaceIPAddress(controller.config.ListenInterface)
 	if err != nil {
-		NoticeError("error getting listener IP: %s", err)
+		controller.config.notices.Error("error getting listener IP: %s", err)
 		return
 	}
 
 	socksProxy, err := NewSocksProxy(controller.config, controller, listenIP)
 	if err != nil {
-		NoticeAlert("error initializing local SOCKS proxy: %s", err)
+		controller.config.notices.Alert("error initializing local SOCKS proxy: %s", err)
 		return
 	}
 	defer socksProxy.Close()
@@ -171,11 +443,59 @@ func (controller *Controller) Run(shutdownBroadcast <-chan struct{}) {
 	httpProxy, err := NewHttpProxy(
 		controller.config, controller.untunneledDialConfig, controller, listenIP)
 	if err != nil {
-		NoticeAlert("error initializing local HTTP proxy: %s", err)
+		controller.config.notices.Alert("error initializing local HTTP proxy: %s", err)
 		return
 	}
 	defer httpProxy.Close()
 
+	if controller.config.LocalDnsProxyPort != 0 {
+		dnsProxy, err := NewDnsProxy(
+			controller.config,
+			controller.untunneledDialConfig,
+			controller,
+			controller.splitTunnelClassifier,
+			listenIP)
+		if err != nil {
+			controller.config.notices.Alert("error initializing local DNS proxy: %s", err)
+			return
+		}
+		defer dnsProxy.Close()
+	}
+
+	if controller.config.LocalTransparentProxyPort != 0 {
+		transparentProxy, err := NewTransparentProxy(controller.config, controller, listenIP)
+		if err != nil {
+			controller.config.notices.Alert("error initializing local transparent proxy: %s", err)
+			return
+		}
+		defer transparentProxy.Close()
+	}
+
+	if controller.config.PacketTunnelFileDescriptor != 0 ||
+		controller.config.PacketTunnelDeviceName != "" {
+
+		packetTunnelStarted = true
+		packetTunnel, err := NewPacketTunnel(
+			controller.config,
+			controller.untunneledDialConfig,
+			controller,
+			controller.splitTunnelClassifier)
+		if err != nil {
+			controller.config.notices.Alert("error initializing packet tunnel: %s", err)
+			return
+		}
+		defer packetTunnel.Close()
+	}
+
+	if controller.config.LocalControlPort != 0 {
+		controlServer, err := NewControlServer(controller.config, controller)
+		if err != nil {
+			controller.config.notices.Alert("error initializing local control server: %s", err)
+			return
+		}
+		defer controlServer.Close()
+	}
+
 	if !controller.config.DisableRemoteServerListFetcher {
 		controller.runWaitGroup.Add(1)
 		go controller.remoteServerListFetcher()
@@ -194,18 +514,27 @@ func (controller *Controller) Run(shutdownBroadcast <-chan struct{}) {
 	controller.runWaitGroup.Add(1)
 	go controller.runTunnels()
 
-	if *controller.config.EstablishTunnelTimeoutSeconds != 0 {
+	if *controller.config.EstablishTunnelTimeoutSeconds != 0 &&
+		!controller.config.OnDemandTunnel {
+
 		controller.runWaitGroup.Add(1)
 		go controller.establishTunnelWatcher()
 	}
 
+	if !controller.config.DisableSleepDetection {
+		controller.runWaitGroup.Add(1)
+		go controller.sleepDetector()
+	}
+
 	// Wait while running
 
 	select {
 	case <-shutdownBroadcast:
-		NoticeInfo("controller shutdown by request")
+		controller.config.notices.Info("controller shutdown by request")
+	case <-controller.signalStop:
+		controller.config.notices.Info("controller shutdown by stop request")
 	case <-controller.componentFailureSignal:
-		NoticeAlert("controller shutdown due to component failure")
+		controller.config.notices.Alert("controller shutdown due to component failure")
 	}
 
 	close(controller.shutdownBroadcast)
@@ -233,9 +562,9 @@ func (controller *Controller) Run(shutdownBroadcast <-chan struct{}) {
 
 	controller.splitTunnelClassifier.Shutdown()
 
-	NoticeInfo("exiting controller")
+	controller.config.notices.Info("exiting controller")
 
-	NoticeExiting()
+	controller.config.notices.Exiting()
 }
 
 // SignalComponentFailure notifies the controller that an associated component has failed.
@@ -272,6 +601,191 @@ func (controller *Controller) SetClientVerificationPayload(clientVerificationPay
 	}
 }
 
+// Stop signals the controller to shut down, as if the Run shutdownBroadcast
+// was closed. Stop doesn't wait for Run to return.
+func (controller *Controller) Stop() {
+	select {
+	case controller.signalStop <- *new(struct{}):
+	default:
+	}
+}
+
+// Reconnect signals the controller to terminate all active tunnels and
+// to establish new tunnels. The local proxies keep running.
+func (controller *Controller) Reconnect() {
+	select {
+	case controller.signalReconnect <- *new(struct{}):
+	default:
+	}
+}
+
+// NetworkChanged signals the controller that the host network has changed,
+// for example from Wi-Fi to cellular. The controller immediately probes its
+// tunnels, so that dead tunnels fail and are replaced without waiting for
+// an SSH keep alive timeout; resets the impaired protocol classification,
+// which was made on the previous network; and restarts any establishment
+// in progress, without pausing. The local proxies keep running.
+func (controller *Controller) NetworkChanged() {
+	select {
+	case controller.signalNetworkChanged <- *new(struct{}):
+	default:
+	}
+}
+
+// Reconfigure changes the egress region and tunnel protocol used to select
+// servers, as with Config.EgressRegion and Config.TunnelProtocol. The empty
+// string selects any region or protocol. The egress region is the most
+// preferred region, ahead of any Config.EgressRegions, and is subject to
+// Config.ExcludedEgressRegions. An error is returned, and the controller
+// is unchanged, when the new values are invalid.
+//
+// Active tunnels which don't match the new values are terminated and the
+// establish process is restarted, from the start of the server candidate
+// list, to fill the tunnel pool. Matching tunnels, and the port forwards
+// they carry, are retained. The local proxies continue to listen on the
+// same ports.
+//
+// Reconfigure doesn't wait for the change to be applied. When Reconfigure
+// is called again before a change is applied, only the last change is
+// applied.
+func (controller *Controller) Reconfigure(egressRegion, tunnelProtocol string) error {
+
+	if tunnelProtocol != "" && !Contains(SupportedTunnelProtocols, tunnelProtocol) {
+		return ContextError(errors.New("invalid tunnel protocol"))
+	}
+
+	// Config.EgressRegions and Config.ExcludedEgressRegions aren't changed
+	// after the controller is created, so they may be read here.
+	regions := NewEgressRegionFilter(
+		egressRegion, controller.config.EgressRegions, controller.config.ExcludedEgressRegions)
+	err := regions.validate()
+	if err != nil {
+		return ContextError(err)
+	}
+
+	if controller.config.TargetServerEntry != "" {
+		serverEntry, err := DecodeServerEntry(
+			controller.config.TargetServerEntry, GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_TARGET)
+		if err != nil {
+			return ContextError(err)
+		}
+		err = checkTargetServerEntry(serverEntry, regions, tunnelProtocol)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+
+	controller.reconfigureMutex.Lock()
+	controller.pendingReconfiguration = &reconfiguration{
+		egressRegion:   egressRegion,
+		tunnelProtocol: tunnelProtocol,
+	}
+	controller.reconfigureMutex.Unlock()
+
+	select {
+	case controller.signalReconfigure <- *new(struct{}):
+	default:
+	}
+
+	return nil
+}
+
+// ControllerStatus is a snapshot of the controller state, as reported
+// by GetStatus.
+type ControllerStatus struct {
+	SessionId      string         `json:"sessionId"`
+	EgressRegion   string         `json:"egressRegion"`
+	TunnelProtocol string         `json:"tunnelProtocol"`
+	ClientRegion   string         `json:"clientRegion"`
+	Homepages      []string       `json:"homepages"`
+	Tunnels        []TunnelStatus `json:"tunnels"`
+
+	// EstablishStats aggregates the phase timings of all tunnel
+	// establishment attempts, keyed by tunnel protocol.
+	EstablishStats map[string]EstablishProtocolStats `json:"establishStats"`
+}
+
+// TunnelStatus describes an active tunnel in a ControllerStatus.
+type TunnelStatus struct {
+	IpAddress     string    `json:"ipAddress"`
+	Region        string    `json:"region"`
+	Protocol      string    `json:"protocol"`
+	StartTime     time.Time `json:"startTime"`
+	BytesSent     int64     `json:"bytesSent"`
+	BytesReceived int64     `json:"bytesReceived"`
+
+	// RoundTripTimeMilliseconds and JitterMilliseconds are 0 until the
+	// first SSH keep alive completes.
+	RoundTripTimeMilliseconds int64 `json:"roundTripTimeMilliseconds"`
+	JitterMilliseconds        int64 `json:"jitterMilliseconds"`
+
+	// IsDegraded indicates that the tunnel is performing poorly and is
+	// being replaced.
+	IsDegraded bool `json:"isDegraded"`
+}
+
+// GetStatus reports the active tunnels and the client region and
+// homepages obtained in the handshake with the first active tunnel
+// server. Bytes transferred are totals for the lifetime of each tunnel.
+func (controller *Controller) GetStatus() *ControllerStatus {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+
+	status := &ControllerStatus{
+		SessionId:      controller.sessionId,
+		EgressRegion:   controller.config.EgressRegion,
+		TunnelProtocol: controller.config.TunnelProtocol,
+		Homepages:      make([]string, 0),
+		Tunnels:        make([]TunnelStatus, 0),
+		EstablishStats: controller.establishStats.snapshot(),
+	}
+
+	for _, tunnel := range controller.tunnels {
+		// Note: serverContext is nil when DisableApi is set
+		if status.ClientRegion == "" && tunnel.serverContext != nil {
+			status.ClientRegion = tunnel.serverContext.clientRegion
+			status.Homepages = append(status.Homepages, tunnel.serverContext.homepages...)
+		}
+		sent, received := tunnel.GetTotalBytesTransferred()
+		roundTripTime, jitter, _ := tunnel.GetRoundTripTimeStats()
+		status.Tunnels = append(status.Tunnels, TunnelStatus{
+			IpAddress:                 tunnel.serverEntry.IpAddress,
+			Region:                    tunnel.serverEntry.Region,
+			Protocol:                  tunnel.protocol,
+			StartTime:                 tunnel.startTime,
+			BytesSent:                 sent,
+			BytesReceived:             received,
+			RoundTripTimeMilliseconds: int64(roundTripTime / time.Millisecond),
+			JitterMilliseconds:        int64(jitter / time.Millisecond),
+			IsDegraded:                tunnel.IsDegraded(),
+		})
+	}
+
+	return status
+}
+
+// GetEstablishFailureReport summarizes the tunnel establishment attempts
+// made since the controller was created. The same report is emitted in an
+// EstablishFailureReport notice when EstablishTunnelTimeoutSeconds expires.
+func (controller *Controller) GetEstablishFailureReport() *EstablishFailureReport {
+	noNetworkConnectivity := controller.config.NetworkConnectivityChecker != nil &&
+		controller.config.NetworkConnectivityChecker.HasNetworkConnectivity() != 1
+	return controller.establishFailureRecorder.report(
+		noNetworkConnectivity, controller.establishStats.snapshot())
+}
+
+// SubscribeEvents returns a new stream of typed events, such as
+// ActiveTunnelEvent and HomepageEvent, which may be used in place of
+// parsing JSON notices. Subscribe before calling Run to receive all events
+// from the controller. Call Unsubscribe on the returned EventSubscription
+// when done. See SubscribeEvents for buffering semantics.
+//
+// The subscription receives only the events emitted by this controller;
+// events from other controllers in the same process aren't included.
+func (controller *Controller) SubscribeEvents(bufferSize int) *EventSubscription {
+	return controller.config.notices.subscribe(bufferSize)
+}
+
 // remoteServerListFetcher fetches an out-of-band list of server entries
 // for more tunnel candidates. It fetches when signalled, with retries
 // on failure.
@@ -279,11 +793,11 @@ func (controller *Controller) remoteServerListFetcher() {
 	defer controller.runWaitGroup.Done()
 
 	if controller.config.RemoteServerListUrl == "" {
-		NoticeAlert("remote server list URL is blank")
+		controller.config.notices.Alert("remote server list URL is blank")
 		return
 	}
 	if controller.config.RemoteServerListSignaturePublicKey == "" {
-		NoticeAlert("remote server list signature public key blank")
+		controller.config.notices.Alert("remote server list signature public key blank")
 		return
 	}
 
@@ -309,6 +823,7 @@ fetcherLoop:
 			// Don't attempt to fetch while there is no network connectivity,
 			// to avoid alert notice noise.
 			if !WaitForNetworkConnectivity(
+				controller.config.notices,
 				controller.config.NetworkConnectivityChecker,
 				controller.shutdownBroadcast) {
 				break fetcherLoop
@@ -318,17 +833,32 @@ fetcherLoop:
 			// no active tunnel, the untunneledDialConfig will be used.
 			tunnel := controller.getNextActiveTunnel()
 
+			// A changed ETag indicates that new server entries were fetched.
+			lastETag, _ := controller.config.dataStore.GetUrlETag(
+				controller.config.RemoteServerListUrl)
+
 			err := FetchRemoteServerList(
 				controller.config,
 				tunnel,
 				controller.untunneledDialConfig)
 
+			controller.establishFailureRecorder.setRemoteServerListFetchResult(err)
+
 			if err == nil {
 				lastFetchTime = time.Now()
+
+				// New server entries may succeed where the known server
+				// entries failed, so don't wait out the backoff.
+				eTag, _ := controller.config.dataStore.GetUrlETag(
+					controller.config.RemoteServerListUrl)
+				if eTag != lastETag {
+					controller.resetEstablishBackoff()
+				}
+
 				break retryLoop
 			}
 
-			NoticeAlert("failed to fetch remote server list: %s", err)
+			controller.config.notices.Alert("failed to fetch remote server list: %s", err)
 
 			timeout := time.After(
 				time.Duration(*controller.config.FetchRemoteServerListRetryPeriodSeconds) * time.Second)
@@ -340,7 +870,7 @@ fetcherLoop:
 		}
 	}
 
-	NoticeInfo("exiting remote server list fetcher")
+	controller.config.notices.Info("exiting remote server list fetcher")
 }
 
 // establishTunnelWatcher terminates the controller if a tunnel
@@ -356,13 +886,67 @@ func (controller *Controller) establishTunnelWatcher() {
 	select {
 	case <-timeout:
 		if !controller.hasEstablishedOnce() {
-			NoticeAlert("failed to establish tunnel before timeout")
+			controller.config.notices.Alert("failed to establish tunnel before timeout")
+			controller.config.notices.EstablishFailureReport(
+				controller.GetEstablishFailureReport())
 			controller.SignalComponentFailure()
 		}
 	case <-controller.shutdownBroadcast:
 	}
 
-	NoticeInfo("exiting establish tunnel watcher")
+	controller.config.notices.Info("exiting establish tunnel watcher")
+}
+
+// sleepDetector detects that the host has resumed from sleep or suspend
+// and then signals a network change, so that the tunnels are probed
+// immediately. Otherwise, tunnels on TCP connections which died during
+// sleep would not fail until the next SSH keep alive, and a paused
+// establishment would not resume until its pause ends.
+//
+// Timers don't account for sleep: on some platforms, the monotonic clock
+// stops during sleep, and so a sleep is detected as a wall clock jump; on
+// other platforms, a sleep is detected as a late timer.
+func (controller *Controller) sleepDetector() {
+	defer controller.runWaitGroup.Done()
+
+	ticker := time.NewTicker(SLEEP_DETECTION_PERIOD)
+	defer ticker.Stop()
+
+	lastTickTime := time.Now()
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			sleepDuration := getSleepDuration(lastTickTime, now, SLEEP_DETECTION_PERIOD)
+			if sleepDuration > SLEEP_DETECTION_THRESHOLD {
+				controller.config.notices.Info("resumed from sleep after %s", sleepDuration)
+				controller.NetworkChanged()
+			}
+			lastTickTime = now
+		case <-controller.shutdownBroadcast:
+			break loop
+		}
+	}
+
+	controller.config.notices.Info("exiting sleep detector")
+}
+
+// getSleepDuration returns the time between lastTickTime and now which isn't
+// accounted for by the expected tick period. The greater of the wall clock
+// and monotonic clock elapsed times is used; see sleepDetector.
+func getSleepDuration(lastTickTime, now time.Time, period time.Duration) time.Duration {
+	elapsed := now.Sub(lastTickTime)
+
+	// Round(0) strips the monotonic clock reading, so that Sub uses the
+	// wall clock.
+	wallClockElapsed := now.Round(0).Sub(lastTickTime.Round(0))
+	if wallClockElapsed > elapsed {
+		elapsed = wallClockElapsed
+	}
+
+	return elapsed - period
 }
 
 // connectedReporter sends periodic "connected" requests to the Psiphon API.
@@ -387,7 +971,7 @@ loop:
 			if err == nil {
 				reported = true
 			} else {
-				NoticeAlert("failed to make connected request: %s", err)
+				controller.config.notices.Alert("failed to make connected request: %s", err)
 			}
 		}
 
@@ -409,7 +993,7 @@ loop:
 		}
 	}
 
-	NoticeInfo("exiting connected reporter")
+	controller.config.notices.Info("exiting connected reporter")
 }
 
 func (controller *Controller) startOrSignalConnectedReporter() {
@@ -476,6 +1060,7 @@ downloadLoop:
 			// Don't attempt to download while there is no network connectivity,
 			// to avoid alert notice noise.
 			if !WaitForNetworkConnectivity(
+				controller.config.notices,
 				controller.config.NetworkConnectivityChecker,
 				controller.shutdownBroadcast) {
 				break downloadLoop
@@ -496,7 +1081,7 @@ downloadLoop:
 				break retryLoop
 			}
 
-			NoticeAlert("failed to download upgrade: %s", err)
+			controller.config.notices.Alert("failed to download upgrade: %s", err)
 
 			timeout := time.After(
 				time.Duration(*controller.config.DownloadUpgradeRetryPeriodSeconds) * time.Second)
@@ -508,7 +1093,7 @@ downloadLoop:
 		}
 	}
 
-	NoticeInfo("exiting upgrade downloader")
+	controller.config.notices.Info("exiting upgrade downloader")
 }
 
 // runTunnels is the controller tunnel management main loop. It starts and stops
@@ -532,12 +1117,25 @@ func (controller *Controller) runTunnels() {
 
 	// Start running
 
-	controller.startEstablishing()
+	// In on-demand mode, establishing starts with the first port forward;
+	// see selectOnDemandTunnel.
+	var onDemandIdleCheck <-chan time.Time
+	if controller.config.OnDemandTunnel {
+		controller.isOnDemandIdle = true
+		if *controller.config.OnDemandIdleTimeoutSeconds != 0 {
+			ticker := time.NewTicker(ON_DEMAND_IDLE_CHECK_PERIOD)
+			defer ticker.Stop()
+			onDemandIdleCheck = ticker.C
+		}
+	} else {
+		controller.startEstablishing()
+	}
+
 loop:
 	for {
 		select {
 		case failedTunnel := <-controller.failedTunnels:
-			NoticeAlert("tunnel failed: %s", failedTunnel.serverEntry.IpAddress)
+			controller.config.notices.Alert("tunnel failed: %s", failedTunnel.serverEntry.IpAddress)
 			controller.terminateTunnel(failedTunnel)
 
 			// Note: we make this extra check to ensure the shutdown signal takes priority
@@ -555,17 +1153,28 @@ loop:
 
 			controller.classifyImpairedProtocol(failedTunnel)
 
+			// Replace the failed tunnel with the standby tunnel, when available.
+			// The establish process is then started to replace the standby.
+			standbyTunnel, tunnelCount := controller.promoteStandbyTunnel()
+			if standbyTunnel != nil {
+				controller.activateTunnel(standbyTunnel, tunnelCount, clientVerificationPayload)
+			}
+
 			// Concurrency note: only this goroutine may call startEstablishing/stopEstablishing
 			// and access isEstablishing.
-			if !controller.isEstablishing {
+			// The pool remains full when the failed tunnel was draining.
+			if !controller.isEstablishing && !controller.isFullyEstablished() {
 				controller.startEstablishing()
 			}
 
+		case degradedTunnel := <-controller.degradedTunnels:
+			controller.replaceDegradedTunnel(degradedTunnel, clientVerificationPayload)
+
 		case establishedTunnel := <-controller.establishedTunnels:
 
 			if controller.isImpairedProtocol(establishedTunnel.protocol) {
 
-				NoticeAlert("established tunnel with impaired protocol: %s", establishedTunnel.protocol)
+				controller.config.notices.Alert("established tunnel with impaired protocol: %s", establishedTunnel.protocol)
 
 				// Protocol was classified as impaired while this tunnel
 				// established, so discard.
@@ -582,50 +1191,18 @@ loop:
 
 			tunnelCount, registered := controller.registerTunnel(establishedTunnel)
 			if !registered {
+				if controller.registerStandbyTunnel(establishedTunnel) {
+					if controller.isFullyEstablished() {
+						controller.stopEstablishing()
+					}
+					break
+				}
 				// Already fully established, so discard.
 				controller.discardTunnel(establishedTunnel)
 				break
 			}
 
-			if clientVerificationPayload != "" {
-				establishedTunnel.SetClientVerificationPayload(clientVerificationPayload)
-			}
-
-			NoticeActiveTunnel(establishedTunnel.serverEntry.IpAddress, establishedTunnel.protocol)
-
-			if tunnelCount == 1 {
-
-				// The split tunnel classifier is started once the first tunnel is
-				// established. This first tunnel is passed in to be used to make
-				// the routes data request.
-				// A long-running controller may run while the host device is present
-				// in different regions. In this case, we want the split tunnel logic
-				// to switch to routes for new regions and not classify traffic based
-				// on routes installed for older regions.
-				// We assume that when regions change, the host network will also
-				// change, and so all tunnels will fail and be re-established. Under
-				// that assumption, the classifier will be re-Start()-ed here when
-				// the region has changed.
-				controller.splitTunnelClassifier.Start(establishedTunnel)
-
-				// Signal a connected request on each 1st tunnel establishment. For
-				// multi-tunnels, the session is connected as long as at least one
-				// tunnel is established.
-				controller.startOrSignalConnectedReporter()
-
-				// If the handshake indicated that a new client version is available,
-				// trigger an upgrade download.
-				// Note: serverContext is nil when DisableApi is set
-				if establishedTunnel.serverContext != nil &&
-					establishedTunnel.serverContext.clientUpgradeVersion != "" {
-
-					handshakeVersion := establishedTunnel.serverContext.clientUpgradeVersion
-					select {
-					case controller.signalDownloadUpgrade <- handshakeVersion:
-					default:
-					}
-				}
-			}
+			controller.activateTunnel(establishedTunnel, tunnelCount, clientVerificationPayload)
 
 			// TODO: design issue -- might not be enough server entries with region/caps to ever fill tunnel slots;
 			// possible solution is establish target MIN(CountServerEntries(region, protocol), TunnelPoolSize)
@@ -636,6 +1213,47 @@ loop:
 		case clientVerificationPayload = <-controller.newClientVerificationPayload:
 			controller.setClientVerificationPayloadForActiveTunnels(clientVerificationPayload)
 
+		case <-controller.signalReconnect:
+			controller.config.notices.Info("reconnect by request")
+			controller.stopEstablishing()
+			controller.discardEstablishedTunnels()
+			controller.terminateAllTunnels()
+			if !controller.isOnDemandIdle {
+				controller.startEstablishing()
+			}
+
+		case <-controller.signalReconfigure:
+			controller.reconfigure()
+
+		case <-controller.signalNetworkChanged:
+			controller.config.notices.Info("network changed")
+			controller.impairedProtocolClassification = make(map[string]int)
+			controller.signalNetworkChangedForAllTunnels()
+			if controller.isEstablishing {
+				controller.stopEstablishing()
+				controller.startEstablishing()
+			}
+
+		case <-controller.signalOnDemandEstablish:
+			// Concurrency note: only this goroutine may access isOnDemandIdle.
+			if controller.isOnDemandIdle {
+				controller.config.notices.Info("on-demand establishing")
+				controller.isOnDemandIdle = false
+				controller.startEstablishing()
+			}
+
+		case <-onDemandIdleCheck:
+			// Closing the tunnels sends final status requests, ending the
+			// API sessions. Establishing is also stopped: no tunnel may have
+			// been established since the last port forward.
+			if !controller.isOnDemandIdle && controller.isOnDemandIdleExpired() {
+				controller.config.notices.Info("on-demand idle timeout")
+				controller.stopEstablishing()
+				controller.discardEstablishedTunnels()
+				controller.terminateAllTunnels()
+				controller.isOnDemandIdle = true
+			}
+
 		case <-controller.shutdownBroadcast:
 			break loop
 		}
@@ -656,7 +1274,129 @@ loop:
 		controller.discardTunnel(tunnel)
 	}
 
-	NoticeInfo("exiting run tunnels")
+	controller.config.notices.Info("exiting run tunnels")
+}
+
+// activateTunnel starts using a newly registered active tunnel. tunnelCount
+// is the number of active tunnels, including the new tunnel and a degraded
+// tunnel which it replaced.
+//
+// Concurrency note: only the runTunnels() goroutine may call activateTunnel
+func (controller *Controller) activateTunnel(
+	tunnel *Tunnel, tunnelCount int, clientVerificationPayload string) {
+
+	if clientVerificationPayload != "" {
+		tunnel.SetClientVerificationPayload(clientVerificationPayload)
+	}
+
+	controller.config.notices.ActiveTunnel(tunnel.serverEntry.IpAddress, tunnel.protocol)
+
+	if tunnelCount == 1 {
+
+		// The split tunnel classifier is started once the first tunnel is
+		// established. This first tunnel is passed in to be used to make
+		// the routes data request.
+		// A long-running controller may run while the host device is present
+		// in different regions. In this case, we want the split tunnel logic
+		// to switch to routes for new regions and not classify traffic based
+		// on routes installed for older regions.
+		// We assume that when regions change, the host network will also
+		// change, and so all tunnels will fail and be re-established. Under
+		// that assumption, the classifier will be re-Start()-ed here when
+		// the region has changed.
+		controller.splitTunnelClassifier.Start(tunnel)
+
+		// Signal a connected request on each 1st tunnel establishment. For
+		// multi-tunnels, the session is connected as long as at least one
+		// tunnel is established.
+		controller.startOrSignalConnectedReporter()
+
+		// If the handshake indicated that a new client version is available,
+		// trigger an upgrade download.
+		// Note: serverContext is nil when DisableApi is set
+		if tunnel.serverContext != nil &&
+			tunnel.serverContext.clientUpgradeVersion != "" {
+
+			handshakeVersion := tunnel.serverContext.clientUpgradeVersion
+			select {
+			case controller.signalDownloadUpgrade <- handshakeVersion:
+			default:
+			}
+		}
+	}
+}
+
+// discardEstablishedTunnels discards tunnels which were established but
+// not yet registered. This is used when restarting the establish process,
+// as these tunnels may not match the current config.
+//
+// Concurrency note: only the runTunnels() goroutine may call discardEstablishedTunnels
+func (controller *Controller) discardEstablishedTunnels() {
+	for {
+		select {
+		case tunnel := <-controller.establishedTunnels:
+			controller.discardTunnel(tunnel)
+		default:
+			return
+		}
+	}
+}
+
+// reconfigure applies the pending Reconfigure change.
+//
+// Concurrency note: only the runTunnels() goroutine may call reconfigure
+func (controller *Controller) reconfigure() {
+
+	controller.reconfigureMutex.Lock()
+	reconfiguration := controller.pendingReconfiguration
+	controller.pendingReconfiguration = nil
+	controller.reconfigureMutex.Unlock()
+
+	if reconfiguration == nil {
+		return
+	}
+
+	controller.config.notices.Info(
+		"reconfigure: egress region: %s, tunnel protocol: %s",
+		reconfiguration.egressRegion, reconfiguration.tunnelProtocol)
+
+	controller.stopEstablishing()
+	controller.discardEstablishedTunnels()
+
+	// The establish goroutines, which read config.EgressRegion and
+	// config.TunnelProtocol, are stopped. GetStatus reads these values
+	// while holding tunnelMutex.
+	controller.tunnelMutex.Lock()
+	controller.config.EgressRegion = reconfiguration.egressRegion
+	controller.config.TunnelProtocol = reconfiguration.tunnelProtocol
+	regions := controller.config.GetEgressRegionFilter()
+	mismatchedTunnels := make([]*Tunnel, 0)
+	tunnels := controller.tunnels
+	if controller.standbyTunnel != nil {
+		tunnels = append([]*Tunnel{controller.standbyTunnel}, tunnels...)
+	}
+	for _, activeTunnel := range tunnels {
+		if !regions.Allows(activeTunnel.serverEntry.Region) ||
+			(reconfiguration.tunnelProtocol != "" &&
+				activeTunnel.protocol != reconfiguration.tunnelProtocol) {
+
+			mismatchedTunnels = append(mismatchedTunnels, activeTunnel)
+		}
+	}
+	controller.tunnelMutex.Unlock()
+
+	for _, tunnel := range mismatchedTunnels {
+		controller.config.notices.Info("terminate mismatched tunnel: %s", tunnel.serverEntry.IpAddress)
+		controller.terminateTunnel(tunnel)
+	}
+
+	// startEstablishing creates a new candidate iterator, which selects
+	// servers using the new values. When the pool is still full, the
+	// establish process is restarted when a tunnel fails. In on-demand
+	// mode, an idle controller establishes with the next port forward.
+	if !controller.isOnDemandIdle && !controller.isFullyEstablished() {
+		controller.startEstablishing()
+	}
 }
 
 // classifyImpairedProtocol tracks "impaired" protocol classifications for failed
@@ -691,7 +1431,7 @@ func (controller *Controller) classifyImpairedProtocol(failedTunnel *Tunnel) {
 //
 // Concurrency note: only the runTunnels() goroutine may call getImpairedProtocols
 func (controller *Controller) getImpairedProtocols() []string {
-	NoticeImpairedProtocolClassification(controller.impairedProtocolClassification)
+	controller.config.notices.ImpairedProtocolClassification(controller.impairedProtocolClassification)
 	impairedProtocols := make([]string, 0)
 	for protocol, count := range controller.impairedProtocolClassification {
 		if count >= IMPAIRED_PROTOCOL_CLASSIFICATION_THRESHOLD {
@@ -725,46 +1465,145 @@ func (controller *Controller) SignalTunnelFailure(tunnel *Tunnel) {
 	}
 }
 
-// discardTunnel disposes of a successful connection that is no longer required.
-func (controller *Controller) discardTunnel(tunnel *Tunnel) {
-	NoticeInfo("discard tunnel: %s", tunnel.serverEntry.IpAddress)
-	// TODO: not calling PromoteServerEntry, since that would rank the
-	// discarded tunnel before fully active tunnels. Can a discarded tunnel
-	// be promoted (since it connects), but with lower rank than all active
-	// tunnels?
-	tunnel.Close(true)
+// SignalTunnelDegraded implements the TunnelOwner interface. This function
+// is called by Tunnel.operateTunnel when the tunnel has detected that it is
+// performing poorly. The tunnel is replaced in the background; see
+// replaceDegradedTunnel.
+func (controller *Controller) SignalTunnelDegraded(tunnel *Tunnel) {
+	// Don't block. In case there's no room, the tunnel isn't replaced until
+	// it fails, but it's only selected for port forwards when no other
+	// tunnel is available.
+	select {
+	case controller.degradedTunnels <- tunnel:
+	default:
+	}
 }
 
-// registerTunnel adds the connected tunnel to the pool of active tunnels
-// which are candidates for port forwarding. Returns true if the pool has an
-// empty slot and false if the pool is full (caller should discard the tunnel).
-func (controller *Controller) registerTunnel(tunnel *Tunnel) (int, bool) {
-	controller.tunnelMutex.Lock()
-	defer controller.tunnelMutex.Unlock()
-	if len(controller.tunnels) >= controller.config.TunnelPoolSize {
-		return len(controller.tunnels), false
+// replaceDegradedTunnel replaces a degraded tunnel. A degraded standby
+// tunnel is closed. A degraded active tunnel is replaced by the standby
+// tunnel, when available, or else by the next established tunnel; see
+// registerTunnel. Once replaced, the degraded tunnel is drained. As the
+// degraded tunnel is still connected, a replacement which is the only active
+// tunnel doesn't repeat the first tunnel activation, such as the connected
+// request and starting the split tunnel classifier; see activateTunnel.
+//
+// Concurrency note: only the runTunnels() goroutine may call replaceDegradedTunnel
+func (controller *Controller) replaceDegradedTunnel(
+	tunnel *Tunnel, clientVerificationPayload string) {
+
+	controller.config.notices.Info("replacing degraded tunnel: %s", tunnel.serverEntry.IpAddress)
+
+	if tunnel.IsStandby() {
+		controller.terminateTunnel(tunnel)
+	} else {
+		standbyTunnel, tunnelCount := controller.promoteStandbyTunnel()
+		if standbyTunnel != nil {
+			controller.activateTunnel(standbyTunnel, tunnelCount, clientVerificationPayload)
+		}
+	}
+
+	if !controller.isEstablishing && !controller.isFullyEstablished() {
+		controller.startEstablishing()
+	}
+}
+
+// discardTunnel disposes of a successful connection that is no longer required.
+func (controller *Controller) discardTunnel(tunnel *Tunnel) {
+	controller.config.notices.Info("discard tunnel: %s", tunnel.serverEntry.IpAddress)
+	// Not calling PromoteServerEntry, since that would make the discarded
+	// tunnel the server affinity candidate in place of a fully active tunnel.
+	// The successful connection is still recorded in the server performance
+	// history by establishTunnelWorker.
+	tunnel.Close(true)
+}
+
+// registerTunnel adds the connected tunnel to the pool of active tunnels
+// which are candidates for port forwarding. Returns true if the pool has an
+// empty slot and false if the pool is full (caller should discard the tunnel).
+// Degraded tunnels don't occupy slots, and the new tunnel replaces a degraded
+// tunnel, if any; see drainDegradedTunnel. The returned number of active
+// tunnels includes a replaced degraded tunnel, which remains connected while
+// draining, so that its replacement isn't activated as the first tunnel.
+func (controller *Controller) registerTunnel(tunnel *Tunnel) (int, bool) {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if controller.countNonDegradedTunnels() >= controller.config.TunnelPoolSize {
+		return len(controller.tunnels), false
 	}
 	// Perform a final check just in case we've established
 	// a duplicate connection.
 	for _, activeTunnel := range controller.tunnels {
 		if activeTunnel.serverEntry.IpAddress == tunnel.serverEntry.IpAddress {
-			NoticeAlert("duplicate tunnel: %s", tunnel.serverEntry.IpAddress)
+			controller.config.notices.Alert("duplicate tunnel: %s", tunnel.serverEntry.IpAddress)
 			return len(controller.tunnels), false
 		}
 	}
 	controller.establishedOnce = true
 	controller.tunnels = append(controller.tunnels, tunnel)
-	NoticeTunnels(len(controller.tunnels))
+	tunnelCount := len(controller.tunnels)
+	controller.drainDegradedTunnel()
+	controller.broadcastTunnelAvailable()
+	controller.config.notices.Tunnels(len(controller.tunnels))
 
-	// Promote this successful tunnel to first rank so it's one
-	// of the first candidates next time establish runs.
+	// Promote this successful tunnel to server affinity candidate
+	// so it's the first candidate next time establish runs.
 	// Connecting to a TargetServerEntry does not change the
-	// ranking.
+	// server affinity candidate.
+	if controller.config.TargetServerEntry == "" {
+		controller.config.dataStore.PromoteServerEntry(tunnel.serverEntry.IpAddress)
+	}
+
+	return tunnelCount, true
+}
+
+// registerStandbyTunnel sets the connected tunnel as the standby tunnel,
+// when UseStandbyTunnel is set and there's no standby tunnel. Returns true
+// if the tunnel is the new standby tunnel; otherwise the caller should
+// discard the tunnel.
+func (controller *Controller) registerStandbyTunnel(tunnel *Tunnel) bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	if !controller.config.UseStandbyTunnel || controller.standbyTunnel != nil {
+		return false
+	}
+	for _, activeTunnel := range controller.tunnels {
+		if activeTunnel.serverEntry.IpAddress == tunnel.serverEntry.IpAddress {
+			controller.config.notices.Alert("duplicate tunnel: %s", tunnel.serverEntry.IpAddress)
+			return false
+		}
+	}
+	tunnel.setStandby(true)
+	controller.standbyTunnel = tunnel
+	controller.config.notices.Info("standby tunnel: %s", tunnel.serverEntry.IpAddress)
+	return true
+}
+
+// promoteStandbyTunnel moves the standby tunnel, if any, into the pool of
+// active tunnels when the pool has an empty slot. Returns the promoted
+// tunnel, or nil, and the number of active tunnels, which, as with
+// registerTunnel, includes a replaced degraded tunnel.
+func (controller *Controller) promoteStandbyTunnel() (*Tunnel, int) {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	tunnel := controller.standbyTunnel
+	if tunnel == nil ||
+		controller.countNonDegradedTunnels() >= controller.config.TunnelPoolSize {
+		return nil, len(controller.tunnels)
+	}
+	controller.standbyTunnel = nil
+	tunnel.setStandby(false)
+	controller.tunnels = append(controller.tunnels, tunnel)
+	tunnelCount := len(controller.tunnels)
+	controller.config.notices.Info("promoted standby tunnel: %s", tunnel.serverEntry.IpAddress)
+	controller.drainDegradedTunnel()
+	controller.broadcastTunnelAvailable()
+	controller.config.notices.Tunnels(len(controller.tunnels))
+
 	if controller.config.TargetServerEntry == "" {
-		PromoteServerEntry(tunnel.serverEntry.IpAddress)
+		controller.config.dataStore.PromoteServerEntry(tunnel.serverEntry.IpAddress)
 	}
 
-	return len(controller.tunnels), true
+	return tunnel, tunnelCount
 }
 
 // hasEstablishedOnce indicates if at least one active tunnel has
@@ -776,36 +1615,143 @@ func (controller *Controller) hasEstablishedOnce() bool {
 	return controller.establishedOnce
 }
 
-// isFullyEstablished indicates if the pool of active tunnels is full.
+// isFullyEstablished indicates if the pool of active tunnels is full, not
+// counting degraded tunnels, and, when UseStandbyTunnel is set, there's a
+// standby tunnel.
 func (controller *Controller) isFullyEstablished() bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	return len(controller.tunnels) >= controller.config.TunnelPoolSize
+	return controller.countNonDegradedTunnels() >= controller.config.TunnelPoolSize &&
+		(!controller.config.UseStandbyTunnel || controller.standbyTunnel != nil)
+}
+
+// countNonDegradedTunnels returns the number of active tunnels which aren't
+// degraded. The caller must hold tunnelMutex.
+func (controller *Controller) countNonDegradedTunnels() int {
+	count := 0
+	for _, activeTunnel := range controller.tunnels {
+		if !activeTunnel.IsDegraded() {
+			count++
+		}
+	}
+	return count
+}
+
+// drainDegradedTunnel moves the first degraded tunnel, if any, from the pool
+// of active tunnels to the list of draining tunnels. A draining tunnel isn't
+// selected for new port forwards and is closed by drainTunnel. The caller
+// must hold tunnelMutex.
+//
+// Concurrency note: only the runTunnels() goroutine may call drainDegradedTunnel
+func (controller *Controller) drainDegradedTunnel() {
+	for index, activeTunnel := range controller.tunnels {
+		if activeTunnel.IsDegraded() {
+			controller.removeTunnel(index)
+			controller.drainingTunnels = append(controller.drainingTunnels, activeTunnel)
+			controller.config.notices.Info("draining degraded tunnel: %s", activeTunnel.serverEntry.IpAddress)
+			controller.runWaitGroup.Add(1)
+			go controller.drainTunnel(activeTunnel)
+			return
+		}
+	}
+}
+
+// drainTunnel closes a draining tunnel once it has no open port forwards,
+// or after TUNNEL_DRAIN_TIMEOUT. A draining tunnel which fails is closed by
+// terminateTunnel, and all draining tunnels are closed by terminateAllTunnels.
+func (controller *Controller) drainTunnel(tunnel *Tunnel) {
+	defer controller.runWaitGroup.Done()
+
+	timeout := time.NewTimer(TUNNEL_DRAIN_TIMEOUT)
+	defer timeout.Stop()
+	ticker := time.NewTicker(TUNNEL_DRAIN_POLL_PERIOD)
+	defer ticker.Stop()
+
+loop:
+	for {
+		select {
+		case <-ticker.C:
+			if tunnel.IsClosed() {
+				return
+			}
+			if tunnel.GetOpenPortForwardCount() == 0 {
+				break loop
+			}
+		case <-timeout.C:
+			break loop
+		case <-controller.shutdownBroadcast:
+			return
+		}
+	}
+
+	controller.config.notices.Info("drained tunnel: %s", tunnel.serverEntry.IpAddress)
+	controller.terminateTunnel(tunnel)
 }
 
 // terminateTunnel removes a tunnel from the pool of active tunnels
-// and closes the tunnel. The next-tunnel state used by getNextActiveTunnel
-// is adjusted as required.
+// and closes the tunnel. The next-tunnel and sticky host state used by
+// selectActiveTunnel is adjusted as required.
 func (controller *Controller) terminateTunnel(tunnel *Tunnel) {
+
+	// A draining tunnel is closed without holding tunnelMutex, as
+	// drainTunnel calls terminateTunnel from its own goroutine.
+	if controller.removeDrainingTunnel(tunnel) {
+		tunnel.Close(false)
+		return
+	}
+
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
+	if tunnel == controller.standbyTunnel {
+		controller.standbyTunnel = nil
+		tunnel.Close(true)
+		return
+	}
 	for index, activeTunnel := range controller.tunnels {
 		if tunnel == activeTunnel {
-			controller.tunnels = append(
-				controller.tunnels[:index], controller.tunnels[index+1:]...)
-			if controller.nextTunnel > index {
-				controller.nextTunnel--
-			}
-			if controller.nextTunnel >= len(controller.tunnels) {
-				controller.nextTunnel = 0
-			}
+			controller.removeTunnel(index)
 			activeTunnel.Close(false)
-			NoticeTunnels(len(controller.tunnels))
+			controller.config.notices.Tunnels(len(controller.tunnels))
 			break
 		}
 	}
 }
 
+// removeTunnel removes the tunnel at index from the pool of active tunnels,
+// adjusting the next-tunnel and sticky host state. The caller must hold
+// tunnelMutex.
+func (controller *Controller) removeTunnel(index int) {
+	tunnel := controller.tunnels[index]
+	controller.tunnels = append(
+		controller.tunnels[:index], controller.tunnels[index+1:]...)
+	if controller.nextTunnel > index {
+		controller.nextTunnel--
+	}
+	if controller.nextTunnel >= len(controller.tunnels) {
+		controller.nextTunnel = 0
+	}
+	for host, stickyTunnel := range controller.stickyHostTunnels {
+		if stickyTunnel == tunnel {
+			delete(controller.stickyHostTunnels, host)
+		}
+	}
+}
+
+// removeDrainingTunnel removes the tunnel from the list of draining tunnels.
+// Returns false if the tunnel isn't draining.
+func (controller *Controller) removeDrainingTunnel(tunnel *Tunnel) bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+	for index, drainingTunnel := range controller.drainingTunnels {
+		if tunnel == drainingTunnel {
+			controller.drainingTunnels = append(
+				controller.drainingTunnels[:index], controller.drainingTunnels[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 // terminateAllTunnels empties the tunnel pool, closing all active tunnels.
 // This is used when shutting down the controller.
 func (controller *Controller) terminateAllTunnels() {
@@ -815,6 +1761,8 @@ func (controller *Controller) terminateAllTunnels() {
 	// may take a few seconds to send a final status request. We only want
 	// to wait as long as the single slowest tunnel.
 	closeWaitGroup := new(sync.WaitGroup)
+	controller.tunnels = append(controller.tunnels, controller.drainingTunnels...)
+	controller.drainingTunnels = nil
 	closeWaitGroup.Add(len(controller.tunnels))
 	for _, activeTunnel := range controller.tunnels {
 		tunnel := activeTunnel
@@ -823,10 +1771,21 @@ func (controller *Controller) terminateAllTunnels() {
 			tunnel.Close(false)
 		}()
 	}
+	// The idle standby tunnel is discarded, so no tunnel stats are recorded.
+	if controller.standbyTunnel != nil {
+		standbyTunnel := controller.standbyTunnel
+		closeWaitGroup.Add(1)
+		go func() {
+			defer closeWaitGroup.Done()
+			standbyTunnel.Close(true)
+		}()
+		controller.standbyTunnel = nil
+	}
 	closeWaitGroup.Wait()
 	controller.tunnels = make([]*Tunnel, 0)
 	controller.nextTunnel = 0
-	NoticeTunnels(len(controller.tunnels))
+	controller.stickyHostTunnels = make(map[string]*Tunnel)
+	controller.config.notices.Tunnels(len(controller.tunnels))
 }
 
 // getNextActiveTunnel returns the next tunnel from the pool of active
@@ -834,13 +1793,119 @@ func (controller *Controller) terminateAllTunnels() {
 func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
-	for i := len(controller.tunnels); i > 0; i-- {
-		tunnel = controller.tunnels[controller.nextTunnel]
-		controller.nextTunnel =
-			(controller.nextTunnel + 1) % len(controller.tunnels)
+	return controller.nextActiveTunnel(nil, nil)
+}
+
+// nextActiveTunnel returns the next tunnel from the pool of active tunnels,
+// in round-robin order, skipping excludedTunnels. When isPreferred is not nil,
+// the first tunnel for which no other tunnel is preferred is returned; the
+// round-robin order breaks ties. Degraded tunnels, which are awaiting
+// replacement, are returned only when no other tunnel is eligible. Returns
+// nil when there's no eligible tunnel. The caller must hold tunnelMutex.
+func (controller *Controller) nextActiveTunnel(
+	excludedTunnels []*Tunnel, isPreferred func(tunnel, other *Tunnel) bool) (tunnel *Tunnel) {
+
+	if len(controller.tunnels) == 0 {
+		return nil
+	}
+	for i := 0; i < len(controller.tunnels); i++ {
+		candidate := controller.tunnels[(controller.nextTunnel+i)%len(controller.tunnels)]
+		if containsTunnel(excludedTunnels, candidate) {
+			continue
+		}
+		if tunnel == nil {
+			tunnel = candidate
+			continue
+		}
+		if candidate.IsDegraded() != tunnel.IsDegraded() {
+			if !candidate.IsDegraded() {
+				tunnel = candidate
+			}
+			continue
+		}
+		if isPreferred != nil && isPreferred(candidate, tunnel) {
+			tunnel = candidate
+		}
+	}
+	controller.nextTunnel = (controller.nextTunnel + 1) % len(controller.tunnels)
+	return tunnel
+}
+
+// selectActiveTunnel selects a tunnel from the pool of active tunnels for a
+// port forward to remoteAddr, according to the TunnelPoolPolicy config.
+// Tunnels in excludedTunnels, on which the port forward has already failed,
+// aren't selected. Returns nil when there's no eligible tunnel.
+func (controller *Controller) selectActiveTunnel(
+	remoteAddr string, excludedTunnels []*Tunnel) *Tunnel {
+
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+
+	switch controller.config.TunnelPoolPolicy {
+
+	case TUNNEL_POOL_POLICY_LEAST_PORT_FORWARDS:
+		return controller.nextActiveTunnel(
+			excludedTunnels,
+			func(tunnel, other *Tunnel) bool {
+				return tunnel.GetOpenPortForwardCount() < other.GetOpenPortForwardCount()
+			})
+
+	case TUNNEL_POOL_POLICY_LOWEST_RTT:
+		return controller.nextActiveTunnel(
+			excludedTunnels,
+			func(tunnel, other *Tunnel) bool {
+				tunnelRtt := tunnel.GetRoundTripTime()
+				otherRtt := other.GetRoundTripTime()
+				return tunnelRtt > 0 && (otherRtt == 0 || tunnelRtt < otherRtt)
+			})
+
+	case TUNNEL_POOL_POLICY_STICKY_HOST:
+		host, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			host = remoteAddr
+		}
+		// The host remains assigned to its tunnel when the tunnel is only
+		// excluded for this port forward. Assignments are removed when the
+		// tunnel is terminated or drained, and a host assigned to a degraded
+		// tunnel is reassigned.
+		stickyTunnel, ok := controller.stickyHostTunnels[host]
+		if ok && stickyTunnel.IsDegraded() {
+			tunnel := controller.nextActiveTunnel(excludedTunnels, nil)
+			if tunnel != nil && !tunnel.IsDegraded() {
+				controller.stickyHostTunnels[host] = tunnel
+			}
+			return tunnel
+		}
+		if ok {
+			if !containsTunnel(excludedTunnels, stickyTunnel) {
+				return stickyTunnel
+			}
+			return controller.nextActiveTunnel(excludedTunnels, nil)
+		}
+		tunnel := controller.nextActiveTunnel(excludedTunnels, nil)
+		if tunnel != nil {
+			if len(controller.stickyHostTunnels) >= TUNNEL_POOL_STICKY_HOSTS_MAX_COUNT {
+				// Evict an arbitrary assignment
+				for evictHost := range controller.stickyHostTunnels {
+					delete(controller.stickyHostTunnels, evictHost)
+					break
+				}
+			}
+			controller.stickyHostTunnels[host] = tunnel
+		}
 		return tunnel
 	}
-	return nil
+
+	return controller.nextActiveTunnel(excludedTunnels, nil)
+}
+
+func containsTunnel(tunnels []*Tunnel, tunnel *Tunnel) bool {
+	for _, listTunnel := range tunnels {
+		if listTunnel == tunnel {
+			return true
+		}
+	}
+	return false
 }
 
 // isActiveTunnelServerEntry is used to check if there's already
@@ -848,11 +1913,20 @@ func (controller *Controller) getNextActiveTunnel() (tunnel *Tunnel) {
 func (controller *Controller) isActiveTunnelServerEntry(serverEntry *ServerEntry) bool {
 	controller.tunnelMutex.Lock()
 	defer controller.tunnelMutex.Unlock()
+	if controller.standbyTunnel != nil &&
+		controller.standbyTunnel.serverEntry.IpAddress == serverEntry.IpAddress {
+		return true
+	}
 	for _, activeTunnel := range controller.tunnels {
 		if activeTunnel.serverEntry.IpAddress == serverEntry.IpAddress {
 			return true
 		}
 	}
+	for _, drainingTunnel := range controller.drainingTunnels {
+		if drainingTunnel.serverEntry.IpAddress == serverEntry.IpAddress {
+			return true
+		}
+	}
 	return false
 }
 
@@ -869,13 +1943,34 @@ func (controller *Controller) setClientVerificationPayloadForActiveTunnels(
 	}
 }
 
-// Dial selects an active tunnel and establishes a port forward
-// connection through the selected tunnel. Failure to connect is considered
-// a port foward failure, for the purpose of monitoring tunnel health.
+// signalNetworkChangedForAllTunnels probes the active and standby tunnels;
+// see Tunnel.SignalNetworkChanged.
+func (controller *Controller) signalNetworkChangedForAllTunnels() {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+
+	for _, activeTunnel := range controller.tunnels {
+		activeTunnel.SignalNetworkChanged()
+	}
+	if controller.standbyTunnel != nil {
+		controller.standbyTunnel.SignalNetworkChanged()
+	}
+}
+
+// Dial selects an active tunnel, according to the TunnelPoolPolicy config,
+// and establishes a port forward connection through the selected tunnel.
+// Failure to connect is considered a port foward failure, for the purpose of
+// monitoring tunnel health. When the failure is due to the tunnel rather than
+// the destination, the port forward is retried on the other active tunnels.
 func (controller *Controller) Dial(
 	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (conn net.Conn, err error) {
 
-	tunnel := controller.getNextActiveTunnel()
+	var tunnel *Tunnel
+	if controller.config.OnDemandTunnel {
+		tunnel = controller.selectOnDemandTunnel(remoteAddr)
+	} else {
+		tunnel = controller.selectActiveTunnel(remoteAddr, nil)
+	}
 	if tunnel == nil {
 		return nil, ContextError(errors.New("no active tunnels"))
 	}
@@ -901,12 +1996,106 @@ func (controller *Controller) Dial(
 		}
 	}
 
-	tunneledConn, err := tunnel.Dial(remoteAddr, alwaysTunnel, downstreamConn)
-	if err != nil {
-		return nil, ContextError(err)
+	// When the port forward dial fails due to the tunnel, retry on each other
+	// active tunnel before failing. A destination which refuses or doesn't
+	// respond to the connection isn't retried, as that would also count
+	// port forward failures against each other tunnel.
+	excludedTunnels := make([]*Tunnel, 0)
+	for {
+		tunneledConn, isRetriable, err := tunnel.dial(remoteAddr, downstreamConn)
+		if err == nil {
+			return tunneledConn, nil
+		}
+		if !isRetriable {
+			return nil, ContextError(err)
+		}
+		excludedTunnels = append(excludedTunnels, tunnel)
+		tunnel = controller.selectActiveTunnel(remoteAddr, excludedTunnels)
+		if tunnel == nil {
+			return nil, ContextError(err)
+		}
 	}
+}
+
+// selectOnDemandTunnel selects an active tunnel in on-demand mode. When
+// there's no active tunnel, runTunnels is signaled to start establishing
+// and the Dial waits, up to OnDemandDialTimeoutSeconds, for a tunnel to be
+// established. Returns nil when the wait times out or the controller shuts
+// down. Dials, including waiting Dials, postpone the idle timeout.
+func (controller *Controller) selectOnDemandTunnel(remoteAddr string) *Tunnel {
 
-	return tunneledConn, nil
+	controller.tunnelMutex.Lock()
+	controller.onDemandLastActiveTime = time.Now()
+	controller.onDemandPendingDials++
+	controller.tunnelMutex.Unlock()
+
+	defer func() {
+		controller.tunnelMutex.Lock()
+		controller.onDemandLastActiveTime = time.Now()
+		controller.onDemandPendingDials--
+		controller.tunnelMutex.Unlock()
+	}()
+
+	timeout := time.NewTimer(
+		time.Duration(controller.config.OnDemandDialTimeoutSeconds) * time.Second)
+	defer timeout.Stop()
+
+	for {
+		// The broadcast channel is read before selecting, so a tunnel which
+		// is registered after selecting still wakes this Dial.
+		controller.tunnelMutex.Lock()
+		tunnelAvailableBroadcast := controller.tunnelAvailableBroadcast
+		controller.tunnelMutex.Unlock()
+
+		tunnel := controller.selectActiveTunnel(remoteAddr, nil)
+		if tunnel != nil {
+			return tunnel
+		}
+
+		select {
+		case controller.signalOnDemandEstablish <- *new(struct{}):
+		default:
+		}
+
+		select {
+		case <-tunnelAvailableBroadcast:
+		case <-timeout.C:
+			controller.config.notices.Alert("on-demand tunnel wait timed out")
+			return nil
+		case <-controller.shutdownBroadcast:
+			return nil
+		}
+	}
+}
+
+// broadcastTunnelAvailable wakes all Dials waiting in selectOnDemandTunnel.
+// The caller must hold tunnelMutex.
+func (controller *Controller) broadcastTunnelAvailable() {
+	close(controller.tunnelAvailableBroadcast)
+	controller.tunnelAvailableBroadcast = make(chan struct{})
+}
+
+// isOnDemandIdleExpired returns true when no port forward has been open or
+// pending for the OnDemandIdleTimeoutSeconds period.
+func (controller *Controller) isOnDemandIdleExpired() bool {
+	controller.tunnelMutex.Lock()
+	defer controller.tunnelMutex.Unlock()
+
+	if controller.onDemandPendingDials > 0 {
+		return false
+	}
+
+	for _, tunnels := range [][]*Tunnel{controller.tunnels, controller.drainingTunnels} {
+		for _, tunnel := range tunnels {
+			if tunnel.GetOpenPortForwardCount() > 0 {
+				controller.onDemandLastActiveTime = time.Now()
+				return false
+			}
+		}
+	}
+
+	idleTimeout := time.Duration(*controller.config.OnDemandIdleTimeoutSeconds) * time.Second
+	return time.Since(controller.onDemandLastActiveTime) >= idleTimeout
 }
 
 // startEstablishing creates a pool of worker goroutines which will
@@ -916,7 +2105,7 @@ func (controller *Controller) startEstablishing() {
 	if controller.isEstablishing {
 		return
 	}
-	NoticeInfo("start establishing")
+	controller.config.notices.Info("start establishing")
 	controller.isEstablishing = true
 	controller.establishWaitGroup = new(sync.WaitGroup)
 	controller.stopEstablishingBroadcast = make(chan struct{})
@@ -924,31 +2113,36 @@ func (controller *Controller) startEstablishing() {
 	controller.establishPendingConns.Reset()
 
 	// The server affinity mechanism attempts to favor the previously
-	// used server when reconnecting. This is beneficial for user
+	// used servers when reconnecting. This is beneficial for user
 	// applications which expect consistency in user IP address (for
 	// example, a web site which prompts for additional user
 	// authentication when the IP address changes).
 	//
-	// Only the very first server, as determined by
-	// datastore.PromoteServerEntry(), is the server affinity candidate.
+	// The first TunnelPoolSize servers, which are the server promoted
+	// by datastore.PromoteServerEntry() followed by the top ranked
+	// servers, are the server affinity candidates. Each such server
+	// holds one server affinity slot.
 	// Concurrent connections attempts to many servers are launched
-	// without delay, in case the affinity server connection fails.
-	// While the affinity server connection is outstanding, when any
+	// without delay, in case the affinity server connections fail.
+	// While any affinity server connection is outstanding, when any
 	// other connection is established, there is a short grace period
 	// delay before delivering the established tunnel; this allows some
-	// time for the affinity server connection to succeed first.
-	// When the affinity server connection fails, any other established
-	// tunnel is registered without delay.
+	// time for the affinity server connections to succeed first.
+	// When all affinity server connections have either been delivered or
+	// failed, any other established tunnel is registered without delay.
 	//
-	// Note: the establishTunnelWorker that receives the affinity
-	// candidate is solely resonsible for closing
-	// controller.serverAffinityDoneBroadcast.
+	// Note: establishCandidateGenerator assigns the slots, and the
+	// establishTunnelWorkers that receive the affinity candidates
+	// release the slots.
 	//
 	// Note: if config.EgressRegion or config.TunnelProtocol has changed
 	// since the top server was promoted, the first server may not actually
 	// be the last connected server.
 	// TODO: should not favor the first server in this case
-	controller.serverAffinityDoneBroadcast = make(chan struct{})
+	controller.serverAffinity = newServerAffinity()
+
+	controller.establishLimiter = newEstablishLimiter(
+		controller.config.ConnectionWorkerPoolSize)
 
 	for i := 0; i < controller.config.ConnectionWorkerPoolSize; i++ {
 		controller.establishWaitGroup.Add(1)
@@ -967,8 +2161,9 @@ func (controller *Controller) stopEstablishing() {
 	if !controller.isEstablishing {
 		return
 	}
-	NoticeInfo("stop establishing")
+	controller.config.notices.Info("stop establishing")
 	close(controller.stopEstablishingBroadcast)
+	controller.establishLimiter.stop()
 	// Note: interruptibleTCPClose doesn't really interrupt socket connects
 	// and may leave goroutines running for a time after the Wait call.
 	controller.establishPendingConns.CloseAll()
@@ -976,53 +2171,75 @@ func (controller *Controller) stopEstablishing() {
 	// (as it may be sending to that channel).
 	controller.establishWaitGroup.Wait()
 
+	controller.config.notices.EstablishStats(controller.establishStats.snapshot())
+
 	controller.isEstablishing = false
 	controller.establishWaitGroup = nil
 	controller.stopEstablishingBroadcast = nil
 	controller.candidateServerEntries = nil
-	controller.serverAffinityDoneBroadcast = nil
+	controller.serverAffinity = nil
+	controller.establishLimiter = nil
 }
 
 // establishCandidateGenerator populates the candidate queue with server entries
-// from the data store. Server entries are iterated in rank order, so that promoted
-// servers with higher rank are priority candidates.
+// from the data store. Server entries are iterated in score order, so that
+// servers with a better performance history are priority candidates.
 func (controller *Controller) establishCandidateGenerator(impairedProtocols []string) {
 	defer controller.establishWaitGroup.Done()
 	defer close(controller.candidateServerEntries)
 
 	iterator, err := NewServerEntryIterator(controller.config)
 	if err != nil {
-		NoticeAlert("failed to iterate over candidates: %s", err)
+		controller.config.notices.Alert("failed to iterate over candidates: %s", err)
 		controller.SignalComponentFailure()
 		return
 	}
 	defer iterator.Close()
 
-	isServerAffinityCandidate := true
+	// Server affinity slots are assigned to the first candidate servers,
+	// one for each tunnel in the pool.
+	serverAffinitySlots := controller.config.TunnelPoolSize
 
-	// TODO: reconcile server affinity scheme with multi-tunnel mode
-	if controller.config.TunnelPoolSize > 1 {
-		isServerAffinityCandidate = false
-		close(controller.serverAffinityDoneBroadcast)
-	}
+	// failedRounds counts the consecutive rounds, each a complete iteration
+	// of candidate servers, which haven't completed establishment. The
+	// pause between rounds backs off as failedRounds grows.
+	failedRounds := 0
+	lastNetworkID := ""
+
+	// After the fallback period, servers in egress regions which aren't
+	// preferred are also candidates.
+	egressRegionFallbackTime := time.Now().Add(
+		time.Duration(controller.config.EgressRegionFallbackSeconds) * time.Second)
 
 loop:
 	// Repeat until stopped
 	for i := 0; ; i++ {
 
 		if !WaitForNetworkConnectivity(
+			controller.config.notices,
 			controller.config.NetworkConnectivityChecker,
 			controller.stopEstablishingBroadcast,
 			controller.shutdownBroadcast) {
 			break loop
 		}
 
+		networkID := getNetworkID(controller.config)
+
+		// Reset the backoff when the network changes.
+		if i > 0 && networkID != lastNetworkID {
+			failedRounds = 0
+		}
+		lastNetworkID = networkID
+
+		controller.establishLimiter.setLimit(
+			controller.getEstablishWorkerPoolSize(failedRounds))
+
 		// Send each iterator server entry to the establish workers
 		startTime := time.Now()
 		for {
 			serverEntry, err := iterator.Next()
 			if err != nil {
-				NoticeAlert("failed to get next candidate: %s", err)
+				controller.config.notices.Alert("failed to get next candidate: %s", err)
 				controller.SignalComponentFailure()
 				break loop
 			}
@@ -1051,20 +2268,48 @@ loop:
 				}
 			}
 
-			// Note: there must be only one server affinity candidate, as it
-			// closes the serverAffinityDoneBroadcast channel.
-			candidate := &candidateServerEntry{serverEntry, isServerAffinityCandidate}
-			isServerAffinityCandidate = false
+			// Generate multiple candidates from the server entry, with
+			// distinct dial parameters, which are spread across the establish
+			// workers.
+			dialParameters, err := selectDialParameters(
+				controller.config,
+				networkID,
+				serverEntry,
+				controller.config.DialCandidatesPerServerEntry)
+			if err != nil {
+				controller.config.notices.Info(
+					"failed to select dial parameters for %s: %s", serverEntry.IpAddress, err)
+				continue
+			}
 
-			// TODO: here we could generate multiple candidates from the
-			// server entry when there are many MeekFrontingAddresses.
+			isServerAffinityCandidate := false
+			if serverAffinitySlots > 0 {
+				isServerAffinityCandidate = true
+				controller.serverAffinity.assignSlot()
+				serverAffinitySlots -= 1
+				if serverAffinitySlots == 0 {
+					controller.serverAffinity.assignmentDone()
+				}
+			}
 
-			select {
-			case controller.candidateServerEntries <- candidate:
-			case <-controller.stopEstablishingBroadcast:
-				break loop
-			case <-controller.shutdownBroadcast:
-				break loop
+			group := newCandidateGroup(dialParameters, isServerAffinityCandidate)
+
+			for _, parameters := range dialParameters {
+
+				candidate := &candidateServerEntry{
+					serverEntry:    serverEntry,
+					networkID:      networkID,
+					dialParameters: parameters,
+					group:          group,
+				}
+
+				select {
+				case controller.candidateServerEntries <- candidate:
+				case <-controller.stopEstablishingBroadcast:
+					break loop
+				case <-controller.shutdownBroadcast:
+					break loop
+				}
 			}
 
 			if time.Now().After(startTime.Add(ESTABLISH_TUNNEL_WORK_TIME)) {
@@ -1076,6 +2321,13 @@ loop:
 		// Free up resources now, but don't reset until after the pause.
 		iterator.Close()
 
+		// When there are fewer candidate servers than server affinity slots,
+		// stop waiting for the unassigned slots.
+		if serverAffinitySlots > 0 {
+			serverAffinitySlots = 0
+			controller.serverAffinity.assignmentDone()
+		}
+
 		// Trigger a fetch remote server list, since we may have failed to
 		// connect with all known servers. Don't block sending signal, since
 		// this signal may have already been sent.
@@ -1101,21 +2353,103 @@ loop:
 		// network conditions to change. Also allows for fetch remote to complete,
 		// in typical conditions (it isn't strictly necessary to wait for this, there will
 		// be more rounds if required).
-		timeout := time.After(
-			time.Duration(*controller.config.EstablishTunnelPausePeriodSeconds) * time.Second)
-		select {
-		case <-timeout:
-			// Retry iterating
-		case <-controller.stopEstablishingBroadcast:
-			break loop
-		case <-controller.shutdownBroadcast:
+		// The pause backs off after consecutive failed rounds, and ends early,
+		// resetting the backoff, when the backoff reset is signaled or the
+		// network changes. A network change signaled with NetworkChanged
+		// restarts establishing, which also ends the pause; a network change
+		// observed only through the network ID is checked for periodically.
+		failedRounds += 1
+		pausePeriod := getEstablishPausePeriod(controller.config, failedRounds)
+		controller.config.notices.Info(
+			"pausing establish for %s after %d failed rounds", pausePeriod, failedRounds)
+		timeout := time.After(pausePeriod)
+		networkCheckTicker := time.NewTicker(ESTABLISH_TUNNEL_PAUSE_NETWORK_CHECK_PERIOD)
+		isStopped := false
+	pause:
+		for {
+			select {
+			case <-timeout:
+				// Retry iterating
+				break pause
+			case <-networkCheckTicker.C:
+				if getNetworkID(controller.config) != networkID {
+					controller.config.notices.Info("network changed, ending establish pause")
+					failedRounds = 0
+					break pause
+				}
+			case <-controller.signalResetEstablishBackoff:
+				controller.config.notices.Info("establish backoff reset")
+				failedRounds = 0
+				break pause
+			case <-controller.stopEstablishingBroadcast:
+				isStopped = true
+				break pause
+			case <-controller.shutdownBroadcast:
+				isStopped = true
+				break pause
+			}
+		}
+		networkCheckTicker.Stop()
+		if isStopped {
 			break loop
 		}
 
+		if controller.config.EgressRegionFallbackSeconds > 0 &&
+			time.Now().After(egressRegionFallbackTime) &&
+			iterator.enableEgressRegionFallback() {
+
+			controller.config.notices.Info("falling back to servers in any allowed egress region")
+		}
+
 		iterator.Reset()
 	}
 
-	NoticeInfo("stopped candidate generator")
+	controller.config.notices.Info("stopped candidate generator")
+}
+
+// resetEstablishBackoff signals the establish candidate generator to reset
+// the pause backoff and to end any current pause. Don't block sending the
+// signal, since a reset may already be pending.
+func (controller *Controller) resetEstablishBackoff() {
+	select {
+	case controller.signalResetEstablishBackoff <- *new(struct{}):
+	default:
+	}
+}
+
+// getEstablishWorkerPoolSize returns how many concurrent establish attempts
+// to allow in a round, after the specified number of consecutive failed
+// rounds; see EstablishTunnelBackoffWorkerPoolSize.
+func (controller *Controller) getEstablishWorkerPoolSize(failedRounds int) int {
+	poolSize := controller.config.ConnectionWorkerPoolSize
+	backoffPoolSize := controller.config.EstablishTunnelBackoffWorkerPoolSize
+	if failedRounds > 0 && backoffPoolSize > 0 && backoffPoolSize < poolSize {
+		poolSize = backoffPoolSize
+	}
+	return poolSize
+}
+
+// getEstablishPausePeriod returns the pause before the next establish
+// round, after the specified number of consecutive failed rounds. The pause
+// grows by EstablishTunnelPauseBackoffFactor for each failed round after the
+// first, up to EstablishTunnelMaxPausePeriodSeconds, with random jitter of
+// EstablishTunnelPauseJitterPercent.
+func getEstablishPausePeriod(config *Config, failedRounds int) time.Duration {
+	pausePeriod := time.Duration(*config.EstablishTunnelPausePeriodSeconds) * time.Second
+	maxPausePeriod := time.Duration(*config.EstablishTunnelMaxPausePeriodSeconds) * time.Second
+
+	for i := 1; i < failedRounds && pausePeriod < maxPausePeriod; i++ {
+		pausePeriod = time.Duration(float64(pausePeriod) * config.EstablishTunnelPauseBackoffFactor)
+		if pausePeriod > maxPausePeriod {
+			pausePeriod = maxPausePeriod
+		}
+	}
+
+	jitter := pausePeriod * time.Duration(*config.EstablishTunnelPauseJitterPercent) / 100
+	if jitter > 0 {
+		pausePeriod = MakeRandomPeriod(config.notices, pausePeriod-jitter, pausePeriod+jitter)
+	}
+	return pausePeriod
 }
 
 // establishTunnelWorker pulls candidates from the candidate queue, establishes
@@ -1130,24 +2464,61 @@ loop:
 			break loop
 		}
 
-		// There may already be a tunnel to this candidate. If so, skip it.
-		if controller.isActiveTunnelServerEntry(candidateServerEntry.serverEntry) {
+		serverEntry := candidateServerEntry.serverEntry
+		dialParameters := candidateServerEntry.dialParameters
+		group := candidateServerEntry.group
+
+		// There may already be a tunnel to this candidate, including a tunnel
+		// established with another candidate from the same server entry. If
+		// so, skip it.
+		if controller.isActiveTunnelServerEntry(serverEntry) {
+			group.completeCandidate(dialParameters.TunnelProtocol, false, true)
+			if group.releaseServerAffinity(false) {
+				controller.serverAffinity.releaseSlot()
+			}
 			continue
 		}
 
+		// While backing off, fewer concurrent attempts may be allowed.
+		if !controller.establishLimiter.acquire() {
+			break loop
+		}
+
+		establishStartTime := time.Now()
+		establishTimings := newEstablishTimings()
+
 		tunnel, err := EstablishTunnel(
 			controller.config,
 			controller.untunneledDialConfig,
 			controller.sessionId,
 			controller.establishPendingConns,
-			candidateServerEntry.serverEntry,
+			serverEntry,
+			dialParameters,
+			establishTimings,
 			controller) // TunnelOwner
+
+		controller.establishLimiter.release()
+
+		establishTimings.complete(err)
+
+		// Attempts interrupted by stopping establishment aren't recorded, as
+		// their failed phase is noise.
+		if err == nil || !controller.isStopEstablishingBroadcast() {
+			controller.config.notices.EstablishAttempt(
+				serverEntry.IpAddress, dialParameters.TunnelProtocol, establishTimings)
+			controller.establishStats.add(
+				dialParameters.TunnelProtocol, establishTimings, err == nil)
+			controller.establishFailureRecorder.addAttempt(serverEntry, dialParameters, err)
+		}
+
 		if err != nil {
 
-			// Unblock other candidates immediately when
-			// server affinity candidate fails.
-			if candidateServerEntry.isServerAffinityCandidate {
-				close(controller.serverAffinityDoneBroadcast)
+			recordFailure := group.completeCandidate(dialParameters.TunnelProtocol, false, false)
+
+			// Unblock other candidates immediately when all of the
+			// candidates for a server affinity slot fail.
+			if group.releaseServerAffinity(false) {
+				controller.serverAffinity.releaseSlot()
 			}
 
 			// Before emitting error, check if establish interrupted, in which
@@ -1155,16 +2526,34 @@ loop:
 			if controller.isStopEstablishingBroadcast() {
 				break loop
 			}
-			NoticeInfo("failed to connect to %s: %s", candidateServerEntry.serverEntry.IpAddress, err)
+			controller.config.notices.Info("failed to connect to %s: %s", serverEntry.IpAddress, err)
+
+			if dialParameters.isReplay {
+				controller.recordReplayDialParameters(serverEntry, nil)
+			}
+
+			if recordFailure {
+				controller.recordServerEntryDialResult(
+					candidateServerEntry.networkID, serverEntry, dialParameters.TunnelProtocol, 0, err)
+			}
 			continue
 		}
 
+		group.completeCandidate(dialParameters.TunnelProtocol, true, false)
+		controller.recordServerEntryDialResult(
+			candidateServerEntry.networkID,
+			serverEntry,
+			dialParameters.TunnelProtocol,
+			time.Now().Sub(establishStartTime),
+			nil)
+		controller.recordReplayDialParameters(serverEntry, tunnel.dialParameters)
+
 		// Block for server affinity grace period before delivering.
-		if !candidateServerEntry.isServerAffinityCandidate {
+		if !group.isServerAffinityCandidate {
 			timer := time.NewTimer(ESTABLISH_TUNNEL_SERVER_AFFINITY_GRACE_PERIOD)
 			select {
 			case <-timer.C:
-			case <-controller.serverAffinityDoneBroadcast:
+			case <-controller.serverAffinity.doneBroadcast:
 			case <-controller.stopEstablishingBroadcast:
 			}
 		}
@@ -1181,11 +2570,59 @@ loop:
 
 		// Unblock other candidates only after delivering when
 		// server affinity candidate succeeds.
-		if candidateServerEntry.isServerAffinityCandidate {
-			close(controller.serverAffinityDoneBroadcast)
+		if group.releaseServerAffinity(true) {
+			controller.serverAffinity.releaseSlot()
 		}
 	}
-	NoticeInfo("stopped establish worker")
+	controller.config.notices.Info("stopped establish worker")
+}
+
+// recordServerEntryDialResult adds the outcome of a tunnel establishment
+// attempt to the server and network performance histories. dialErr is nil
+// for a successful attempt. Attempts to connect to a TargetServerEntry are
+// not recorded.
+func (controller *Controller) recordServerEntryDialResult(
+	networkID string, serverEntry *ServerEntry, protocol string,
+	establishDuration time.Duration, dialErr error) {
+
+	if controller.config.TargetServerEntry != "" {
+		return
+	}
+
+	var err error
+	if dialErr == nil {
+		err = controller.config.dataStore.RecordServerEntryDialSuccess(
+			networkID, serverEntry.IpAddress, protocol, establishDuration)
+	} else {
+		err = controller.config.dataStore.RecordServerEntryDialFailure(
+			networkID, serverEntry.IpAddress, protocol, dialErr.Error())
+	}
+	if err != nil {
+		controller.config.notices.Alert("failed to record server performance: %s", err)
+	}
+}
+
+// recordReplayDialParameters stores the dial parameters of a successful
+// tunnel to the server, for replay. When dialParameters is nil, as when a
+// replay fails, the stored dial parameters for the server are deleted.
+func (controller *Controller) recordReplayDialParameters(
+	serverEntry *ServerEntry, dialParameters *DialParameters) {
+
+	if *controller.config.ReplayDialParametersTTLSeconds == 0 {
+		return
+	}
+
+	var err error
+	if dialParameters != nil {
+		err = controller.config.dataStore.SetReplayDialParameters(
+			serverEntry.IpAddress, dialParameters)
+	} else {
+		err = controller.config.dataStore.DeleteReplayDialParameters(
+			serverEntry.IpAddress)
+	}
+	if err != nil {
+		controller.config.notices.Alert("failed to record replay dial parameters: %s", err)
+	}
 }
 
 func (controller *Controller) isStopEstablishingBroadcast() bool {
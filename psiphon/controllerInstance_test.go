@@ -0,0 +1,579 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultipleControllers(t *testing.T) {
+
+	var processOutput bytes.Buffer
+	SetNoticeOutput(&processOutput)
+	defer SetNoticeOutput(os.Stderr)
+
+	var outputs [2]bytes.Buffer
+	var controllers [2]*Controller
+
+	for i := range controllers {
+		dataStoreDirectory, err := ioutil.TempDir("", "psiphon-controller-test")
+		if err != nil {
+			t.Fatalf("TempDir failed: %s", err)
+		}
+		defer os.RemoveAll(dataStoreDirectory)
+
+		config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+		if err != nil {
+			t.Fatalf("LoadConfig failed: %s", err)
+		}
+		config.DataStoreDirectory = dataStoreDirectory
+		config.NoticeOutput = &outputs[i]
+
+		controllers[i], err = NewController(config)
+		if err != nil {
+			t.Fatalf("NewController failed: %s", err)
+		}
+		defer controllers[i].Close()
+	}
+
+	// Each controller has its own notice output
+
+	for i, controller := range controllers {
+		noticeType, payload, err := GetNotice(outputs[i].Bytes())
+		if err != nil {
+			t.Fatalf("GetNotice failed: %s", err)
+		}
+		if noticeType != "SessionId" || payload["sessionId"] != controller.sessionId {
+			t.Errorf("unexpected notice: %s", outputs[i].String())
+		}
+	}
+
+	if processOutput.Len() != 0 {
+		t.Errorf("unexpected process notices: %s", processOutput.String())
+	}
+
+	// Each controller has its own datastore
+
+	err := controllers[0].config.dataStore.StoreServerEntry(
+		&ServerEntry{IpAddress: "192.0.2.1", Region: "CA"}, false)
+	if err != nil {
+		t.Fatalf("StoreServerEntry failed: %s", err)
+	}
+
+	if controllers[0].config.dataStore.CountServerEntries("", "") != 1 ||
+		controllers[1].config.dataStore.CountServerEntries("", "") != 0 {
+		t.Errorf("unexpected server entry counts")
+	}
+
+	// Each controller has its own event subscriptions
+
+	subscription := controllers[1].SubscribeEvents(10)
+	controllers[0].config.notices.Tunnels(1)
+	controllers[1].config.notices.Tunnels(2)
+	subscription.Unsubscribe()
+
+	var events []Event
+	for event := range subscription.Events() {
+		events = append(events, event.Event)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("unexpected event count: %d", len(events))
+	}
+	tunnels, ok := events[0].(*TunnelsEvent)
+	if !ok || tunnels.Count != 2 {
+		t.Errorf("unexpected event: %+v", events[0])
+	}
+}
+
+func TestStandbyTunnel(t *testing.T) {
+
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon-controller-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataStoreDirectory)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = dataStoreDirectory
+	config.NoticeOutput = ioutil.Discard
+	config.TunnelPoolSize = 1
+	config.UseStandbyTunnel = true
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+	defer controller.Close()
+
+	newTunnel := func(ipAddress string) *Tunnel {
+		return &Tunnel{
+			mutex:       new(sync.Mutex),
+			serverEntry: &ServerEntry{IpAddress: ipAddress},
+		}
+	}
+
+	activeTunnel := newTunnel("192.0.2.1")
+	if _, ok := controller.registerTunnel(activeTunnel); !ok {
+		t.Fatalf("registerTunnel failed")
+	}
+	if controller.isFullyEstablished() {
+		t.Errorf("should not be fully established without a standby tunnel")
+	}
+
+	// A duplicate of an active tunnel isn't a standby tunnel
+	if controller.registerStandbyTunnel(newTunnel("192.0.2.1")) {
+		t.Errorf("duplicate tunnel should not be a standby tunnel")
+	}
+
+	standbyTunnel := newTunnel("192.0.2.2")
+	if _, ok := controller.registerTunnel(standbyTunnel); ok {
+		t.Fatalf("registerTunnel should fail with a full pool")
+	}
+	if !controller.registerStandbyTunnel(standbyTunnel) || !standbyTunnel.IsStandby() {
+		t.Fatalf("registerStandbyTunnel failed")
+	}
+	if !controller.isFullyEstablished() {
+		t.Errorf("should be fully established with a standby tunnel")
+	}
+	if controller.registerStandbyTunnel(newTunnel("192.0.2.3")) {
+		t.Errorf("there should be only one standby tunnel")
+	}
+
+	// The standby tunnel is promoted only when the pool has room
+	if tunnel, _ := controller.promoteStandbyTunnel(); tunnel != nil {
+		t.Errorf("standby tunnel should not be promoted into a full pool")
+	}
+
+	controller.tunnelMutex.Lock()
+	controller.tunnels = nil
+	controller.tunnelMutex.Unlock()
+
+	promotionTime := time.Now()
+	tunnel, tunnelCount := controller.promoteStandbyTunnel()
+	if tunnel != standbyTunnel || tunnelCount != 1 || tunnel.IsStandby() {
+		t.Errorf("standby tunnel should be promoted")
+	}
+
+	// The promoted tunnel's duration is measured from its promotion
+	if tunnel.getActiveTime().Before(promotionTime) {
+		t.Errorf("unexpected active time: %s", tunnel.getActiveTime())
+	}
+	if controller.isFullyEstablished() {
+		t.Errorf("should not be fully established after promotion")
+	}
+}
+
+func TestTunnelPoolPolicies(t *testing.T) {
+
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon-controller-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataStoreDirectory)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = dataStoreDirectory
+	config.NoticeOutput = ioutil.Discard
+	config.TunnelPoolSize = 3
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+	defer controller.Close()
+
+	tunnels := make([]*Tunnel, 3)
+	for i := range tunnels {
+		tunnels[i] = &Tunnel{
+			mutex:       new(sync.Mutex),
+			serverEntry: &ServerEntry{IpAddress: fmt.Sprintf("192.0.2.%d", i+1)},
+		}
+		if _, ok := controller.registerTunnel(tunnels[i]); !ok {
+			t.Fatalf("registerTunnel failed")
+		}
+	}
+
+	// Round robin skips excluded tunnels
+	controller.config.TunnelPoolPolicy = TUNNEL_POOL_POLICY_ROUND_ROBIN
+	for i := 0; i < 6; i++ {
+		tunnel := controller.selectActiveTunnel("example.com:443", tunnels[:1])
+		if tunnel == nil || tunnel == tunnels[0] {
+			t.Errorf("unexpected tunnel: %+v", tunnel)
+		}
+	}
+	if controller.selectActiveTunnel("example.com:443", tunnels) != nil {
+		t.Errorf("all tunnels are excluded")
+	}
+
+	controller.config.TunnelPoolPolicy = TUNNEL_POOL_POLICY_LEAST_PORT_FORWARDS
+	tunnels[0].openPortForwardCount = 2
+	tunnels[1].openPortForwardCount = 1
+	tunnels[2].openPortForwardCount = 3
+	for i := 0; i < 3; i++ {
+		if controller.selectActiveTunnel("example.com:443", nil) != tunnels[1] {
+			t.Errorf("expected tunnel with fewest port forwards")
+		}
+	}
+	if controller.selectActiveTunnel("example.com:443", tunnels[1:2]) != tunnels[0] {
+		t.Errorf("expected next tunnel with fewest port forwards")
+	}
+
+	// Tunnels without a round trip time measurement are used last
+	controller.config.TunnelPoolPolicy = TUNNEL_POOL_POLICY_LOWEST_RTT
+	tunnels[0].roundTripTime = 200 * time.Millisecond
+	tunnels[2].roundTripTime = 100 * time.Millisecond
+	for i := 0; i < 3; i++ {
+		if controller.selectActiveTunnel("example.com:443", nil) != tunnels[2] {
+			t.Errorf("expected tunnel with lowest round trip time")
+		}
+	}
+	if controller.selectActiveTunnel("example.com:443", tunnels[0:1]) != tunnels[2] {
+		t.Errorf("expected tunnel with lowest round trip time")
+	}
+	if controller.selectActiveTunnel("example.com:443", tunnels[2:3]) != tunnels[0] {
+		t.Errorf("expected measured tunnel")
+	}
+
+	controller.config.TunnelPoolPolicy = TUNNEL_POOL_POLICY_STICKY_HOST
+	stickyTunnel := controller.selectActiveTunnel("example.com:443", nil)
+	for i := 0; i < 6; i++ {
+		if controller.selectActiveTunnel("example.com:80", nil) != stickyTunnel {
+			t.Errorf("expected sticky tunnel")
+		}
+	}
+
+	// An excluded sticky tunnel is used again by later port forwards
+	otherTunnel := controller.selectActiveTunnel("example.com:443", []*Tunnel{stickyTunnel})
+	if otherTunnel == nil || otherTunnel == stickyTunnel {
+		t.Errorf("unexpected tunnel: %+v", otherTunnel)
+	}
+	if controller.selectActiveTunnel("example.com:443", nil) != stickyTunnel {
+		t.Errorf("expected sticky tunnel")
+	}
+}
+
+func TestDegradedTunnelReplacement(t *testing.T) {
+
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon-controller-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataStoreDirectory)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = dataStoreDirectory
+	config.NoticeOutput = ioutil.Discard
+	config.TunnelPoolSize = 2
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+	defer controller.Close()
+
+	// Stops the drainTunnel goroutine, which would close the test tunnel
+	close(controller.shutdownBroadcast)
+
+	tunnels := make([]*Tunnel, 3)
+	for i := range tunnels {
+		tunnels[i] = &Tunnel{
+			mutex:       new(sync.Mutex),
+			serverEntry: &ServerEntry{IpAddress: fmt.Sprintf("192.0.2.%d", i+1)},
+		}
+	}
+	for _, tunnel := range tunnels[:2] {
+		if _, ok := controller.registerTunnel(tunnel); !ok {
+			t.Fatalf("registerTunnel failed")
+		}
+	}
+
+	tunnels[0].setDegraded()
+	if controller.isFullyEstablished() {
+		t.Errorf("degraded tunnel should not fill a slot")
+	}
+
+	// New port forwards avoid the degraded tunnel
+	for _, policy := range SupportedTunnelPoolPolicies {
+		controller.config.TunnelPoolPolicy = policy
+		for i := 0; i < 4; i++ {
+			if controller.selectActiveTunnel("example.com:443", nil) != tunnels[1] {
+				t.Errorf("expected non-degraded tunnel with policy %s", policy)
+			}
+		}
+	}
+	if controller.selectActiveTunnel("example.com:443", tunnels[1:2]) != tunnels[0] {
+		t.Errorf("expected degraded tunnel as the last resort")
+	}
+
+	// The replacement drains the degraded tunnel. The draining tunnel is
+	// still counted, so that the replacement isn't activated as a first
+	// tunnel.
+	tunnelCount, ok := controller.registerTunnel(tunnels[2])
+	if !ok || tunnelCount != 3 {
+		t.Fatalf("registerTunnel failed")
+	}
+	if !controller.isFullyEstablished() {
+		t.Errorf("should be fully established after replacement")
+	}
+	if len(controller.drainingTunnels) != 1 || controller.drainingTunnels[0] != tunnels[0] ||
+		containsTunnel(controller.tunnels, tunnels[0]) {
+		t.Errorf("degraded tunnel should be draining")
+	}
+	if !controller.isActiveTunnelServerEntry(tunnels[0].serverEntry) {
+		t.Errorf("draining tunnel server should not be a candidate")
+	}
+
+	controller.runWaitGroup.Wait()
+}
+
+func TestEstablishBackoff(t *testing.T) {
+	config, err := LoadConfig([]byte(`
+	{
+		"PropagationChannelId": "0",
+		"SponsorId": "0",
+		"EstablishTunnelPausePeriodSeconds": 5,
+		"EstablishTunnelMaxPausePeriodSeconds": 30,
+		"EstablishTunnelPauseJitterPercent": 0
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+
+	for failedRounds, expectedPausePeriod := range []time.Duration{
+		5 * time.Second, 5 * time.Second, 10 * time.Second, 20 * time.Second, 30 * time.Second, 30 * time.Second} {
+
+		pausePeriod := getEstablishPausePeriod(config, failedRounds)
+		if pausePeriod != expectedPausePeriod {
+			t.Errorf("unexpected pause period after %d rounds: %s", failedRounds, pausePeriod)
+		}
+	}
+
+	jitterPercent := 20
+	config.EstablishTunnelPauseJitterPercent = &jitterPercent
+	for i := 0; i < 100; i++ {
+		pausePeriod := getEstablishPausePeriod(config, 2)
+		if pausePeriod < 8*time.Second || pausePeriod > 12*time.Second {
+			t.Errorf("unexpected pause period with jitter: %s", pausePeriod)
+		}
+	}
+
+	// A stopped limiter unblocks waiting attempts
+	limiter := newEstablishLimiter(1)
+	if !limiter.acquire() {
+		t.Fatalf("acquire failed")
+	}
+	acquired := make(chan bool)
+	go func() {
+		acquired <- limiter.acquire()
+	}()
+	select {
+	case <-acquired:
+		t.Errorf("acquire should block at the limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	limiter.setLimit(2)
+	if !<-acquired {
+		t.Errorf("acquire should succeed after the limit is raised")
+	}
+	go func() {
+		acquired <- limiter.acquire()
+	}()
+	limiter.stop()
+	if <-acquired {
+		t.Errorf("acquire should fail after stop")
+	}
+}
+
+func TestNetworkChanged(t *testing.T) {
+
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon-controller-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataStoreDirectory)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = dataStoreDirectory
+	config.NoticeOutput = ioutil.Discard
+	config.UseStandbyTunnel = true
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+	defer controller.Close()
+
+	newTunnel := func(ipAddress string) *Tunnel {
+		return &Tunnel{
+			mutex:                new(sync.Mutex),
+			serverEntry:          &ServerEntry{IpAddress: ipAddress},
+			signalNetworkChanged: make(chan struct{}, 1),
+		}
+	}
+
+	activeTunnel := newTunnel("192.0.2.1")
+	standbyTunnel := newTunnel("192.0.2.2")
+	controller.tunnels = append(controller.tunnels, activeTunnel)
+	controller.standbyTunnel = standbyTunnel
+
+	// Repeated signals don't block
+	controller.NetworkChanged()
+	controller.NetworkChanged()
+	select {
+	case <-controller.signalNetworkChanged:
+	default:
+		t.Errorf("missing network changed signal")
+	}
+
+	controller.signalNetworkChangedForAllTunnels()
+	controller.signalNetworkChangedForAllTunnels()
+	for _, tunnel := range []*Tunnel{activeTunnel, standbyTunnel} {
+		select {
+		case <-tunnel.signalNetworkChanged:
+		default:
+			t.Errorf("missing network changed signal for %s", tunnel.serverEntry.IpAddress)
+		}
+	}
+}
+
+func TestSleepDetection(t *testing.T) {
+	lastTickTime := time.Now()
+
+	sleepDuration := getSleepDuration(
+		lastTickTime, lastTickTime.Add(SLEEP_DETECTION_PERIOD), SLEEP_DETECTION_PERIOD)
+	if sleepDuration != 0 {
+		t.Errorf("unexpected sleep duration for an on-time tick: %s", sleepDuration)
+	}
+
+	sleepDuration = getSleepDuration(
+		lastTickTime, lastTickTime.Add(10*time.Minute), SLEEP_DETECTION_PERIOD)
+	if sleepDuration != 10*time.Minute-SLEEP_DETECTION_PERIOD {
+		t.Errorf("unexpected sleep duration for a late tick: %s", sleepDuration)
+	}
+
+	// Times without monotonic clock readings compare by wall clock
+	sleepDuration = getSleepDuration(
+		time.Unix(1000, 0), time.Unix(1100, 0), SLEEP_DETECTION_PERIOD)
+	if sleepDuration != 100*time.Second-SLEEP_DETECTION_PERIOD {
+		t.Errorf("unexpected sleep duration for a wall clock jump: %s", sleepDuration)
+	}
+}
+
+func TestOnDemandTunnel(t *testing.T) {
+
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon-controller-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataStoreDirectory)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = dataStoreDirectory
+	config.NoticeOutput = ioutil.Discard
+	config.OnDemandTunnel = true
+	config.OnDemandDialTimeoutSeconds = 1
+
+	controller, err := NewController(config)
+	if err != nil {
+		t.Fatalf("NewController failed: %s", err)
+	}
+	defer controller.Close()
+
+	// Without a tunnel, the Dial signals establishing and times out
+	startTime := time.Now()
+	if controller.selectOnDemandTunnel("example.com:443") != nil {
+		t.Fatalf("unexpected tunnel")
+	}
+	if time.Since(startTime) < 1*time.Second {
+		t.Errorf("Dial should wait for a tunnel")
+	}
+	select {
+	case <-controller.signalOnDemandEstablish:
+	default:
+		t.Errorf("missing on-demand establish signal")
+	}
+
+	// A waiting Dial selects the tunnel when it's established
+	controller.config.OnDemandDialTimeoutSeconds = 10
+	selectedTunnel := make(chan *Tunnel, 1)
+	go func() {
+		selectedTunnel <- controller.selectOnDemandTunnel("example.com:443")
+	}()
+	select {
+	case <-controller.signalOnDemandEstablish:
+	case <-time.After(1 * time.Second):
+		t.Fatalf("missing on-demand establish signal")
+	}
+	tunnel := &Tunnel{
+		mutex:       new(sync.Mutex),
+		serverEntry: &ServerEntry{IpAddress: "192.0.2.1"},
+	}
+	if _, ok := controller.registerTunnel(tunnel); !ok {
+		t.Fatalf("registerTunnel failed")
+	}
+	select {
+	case selected := <-selectedTunnel:
+		if selected != tunnel {
+			t.Errorf("unexpected selected tunnel")
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatalf("Dial should select the established tunnel")
+	}
+
+	// Tunnels idle out only when no port forward has been open for the
+	// idle timeout period
+	idleTimeoutSeconds := 1
+	controller.config.OnDemandIdleTimeoutSeconds = &idleTimeoutSeconds
+	if controller.isOnDemandIdleExpired() {
+		t.Errorf("unexpected idle after a recent Dial")
+	}
+	tunnel.openPortForwardCount = 1
+	time.Sleep(1100 * time.Millisecond)
+	if controller.isOnDemandIdleExpired() {
+		t.Errorf("unexpected idle with an open port forward")
+	}
+	tunnel.openPortForwardCount = 0
+	time.Sleep(1100 * time.Millisecond)
+	if !controller.isOnDemandIdleExpired() {
+		t.Errorf("missing idle after the idle timeout")
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -42,126 +43,226 @@ import (
 // https://github.com/mattn/go-sqlite3/issues/201), and perhaps ultimately as
 // the primary dataStore implementation.
 //
-type dataStore struct {
-	init sync.Once
-	db   *bolt.DB
+//
+// A DataStore is a handle to the datastore in a DataStoreDirectory. Each
+// Controller opens its own handle, so that multiple controllers with
+// different configs may run in one process. Handles for the same directory
+// share one underlying database, as the BoltDB file may only be opened once.
+// The database is closed when its last handle is closed.
+//
+// A nil *DataStore refers to the process-wide datastore initialized by
+// InitDataStore.
+type DataStore struct {
+	filename  string
+	db        *bolt.DB
+	notices   *Notices
+	closeOnce sync.Once
 }
 
 const (
-	serverEntriesBucket         = "serverEntries"
-	rankedServerEntriesBucket   = "rankedServerEntries"
-	rankedServerEntriesKey      = "rankedServerEntries"
-	splitTunnelRouteETagsBucket = "splitTunnelRouteETags"
-	splitTunnelRouteDataBucket  = "splitTunnelRouteData"
-	urlETagsBucket              = "urlETags"
-	keyValueBucket              = "keyValues"
-	tunnelStatsBucket           = "tunnelStats"
-	rankedServerEntryCount      = 100
+	serverEntriesBucket             = "serverEntries"
+	legacyRankedServerEntriesBucket = "rankedServerEntries"
+	serverEntryPerformanceBucket    = "serverEntryPerformance"
+	networkPerformanceBucket        = "networkPerformance"
+	splitTunnelRouteETagsBucket     = "splitTunnelRouteETags"
+	splitTunnelRouteDataBucket      = "splitTunnelRouteData"
+	urlETagsBucket                  = "urlETags"
+	keyValueBucket                  = "keyValues"
+	tunnelStatsBucket               = "tunnelStats"
+	replayDialParametersBucket      = "replayDialParameters"
+	affinityServerEntryKey          = "affinityServerEntry"
 )
 
-var singleton dataStore
+// openDatabase is a BoltDB database shared by all open
+// DataStore handles for the same file.
+type openDatabase struct {
+	db       *bolt.DB
+	refCount int
+}
 
-// InitDataStore initializes the singleton instance of dataStore. This
-// function uses a sync.Once and is safe for use by concurrent goroutines.
-// The underlying sql.DB connection pool is also safe.
-//
-// Note: the sync.Once was more useful when initDataStore was private and
-// called on-demand by the public functions below. Now we require an explicit
-// InitDataStore() call with the filename passed in. The on-demand calls
-// have been replaced by checkInitDataStore() to assert that Init was called.
-func InitDataStore(config *Config) (err error) {
-	singleton.init.Do(func() {
-		// Need to gather the list of migratable server entries before
-		// initializing the boltdb store (as prepareMigrationEntries
-		// checks for the existence of the bolt db file)
-		migratableServerEntries := prepareMigrationEntries(config)
+var openDatabasesMutex sync.Mutex
+var openDatabases = make(map[string]*openDatabase)
 
-		filename := filepath.Join(config.DataStoreDirectory, DATA_STORE_FILENAME)
-		var db *bolt.DB
-		db, err = bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+// OpenDataStore opens a handle to the datastore in config.DataStoreDirectory,
+// initializing the datastore if it's not already open in this process.
+// Notices for datastore operations are emitted with the config notices.
+// The handle should be closed with Close when no longer needed.
+func OpenDataStore(config *Config) (*DataStore, error) {
 
-		// The datastore file may be corrupt, so attempt to delete and try again
+	filename := filepath.Join(config.DataStoreDirectory, DATA_STORE_FILENAME)
+
+	openDatabasesMutex.Lock()
+	defer openDatabasesMutex.Unlock()
+
+	database, ok := openDatabases[filename]
+	if !ok {
+		db, err := openBoltDatabase(config, filename)
 		if err != nil {
-			NoticeAlert("retry on initDataStore error: %s", err)
-			os.Remove(filename)
-			db, err = bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+			return nil, err
 		}
+		database = &openDatabase{db: db}
+		openDatabases[filename] = database
+	}
+	database.refCount += 1
 
-		if err != nil {
-			// Note: intending to set the err return value for InitDataStore
-			err = fmt.Errorf("initDataStore failed to open database: %s", err)
-			return
-		}
-
-		err = db.Update(func(tx *bolt.Tx) error {
-			requiredBuckets := []string{
-				serverEntriesBucket,
-				rankedServerEntriesBucket,
-				splitTunnelRouteETagsBucket,
-				splitTunnelRouteDataBucket,
-				urlETagsBucket,
-				keyValueBucket,
-				tunnelStatsBucket,
+	return &DataStore{
+		filename: filename,
+		db:       database.db,
+		notices:  config.notices,
+	}, nil
+}
+
+// Close releases the datastore handle. The underlying database is
+// closed when no other handles refer to it.
+func (store *DataStore) Close() {
+	store.closeOnce.Do(func() {
+		openDatabasesMutex.Lock()
+		defer openDatabasesMutex.Unlock()
+
+		database := openDatabases[store.filename]
+		database.refCount -= 1
+		if database.refCount == 0 {
+			database.db.Close()
+			delete(openDatabases, store.filename)
+		}
+	})
+}
+
+func openBoltDatabase(config *Config, filename string) (db *bolt.DB, err error) {
+
+	// Need to gather the list of migratable server entries before
+	// initializing the boltdb store (as prepareMigrationEntries
+	// checks for the existence of the bolt db file)
+	migratableServerEntries := prepareMigrationEntries(config)
+
+	db, err = bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+
+	// The datastore file may be corrupt, so attempt to delete and try again
+	if err != nil {
+		config.notices.Alert("retry on initDataStore error: %s", err)
+		os.Remove(filename)
+		db, err = bolt.Open(filename, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("initDataStore failed to open database: %s", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		requiredBuckets := []string{
+			serverEntriesBucket,
+			serverEntryPerformanceBucket,
+			networkPerformanceBucket,
+			splitTunnelRouteETagsBucket,
+			splitTunnelRouteDataBucket,
+			urlETagsBucket,
+			keyValueBucket,
+			tunnelStatsBucket,
+			replayDialParametersBucket,
+		}
+		for _, bucket := range requiredBuckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(bucket))
+			if err != nil {
+				return err
 			}
-			for _, bucket := range requiredBuckets {
-				_, err := tx.CreateBucketIfNotExists([]byte(bucket))
-				if err != nil {
-					return err
-				}
+		}
+		// The rank list is superseded by serverEntryPerformanceBucket.
+		if tx.Bucket([]byte(legacyRankedServerEntriesBucket)) != nil {
+			err := tx.DeleteBucket([]byte(legacyRankedServerEntriesBucket))
+			if err != nil {
+				return err
 			}
-			return nil
-		})
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initDataStore failed to create buckets: %s", err)
+	}
+
+	// Run consistency checks on datastore and emit errors for diagnostics purposes
+	// We assume this will complete quickly for typical size Psiphon datastores.
+	db.View(func(tx *bolt.Tx) error {
+		err := <-tx.Check()
 		if err != nil {
-			err = fmt.Errorf("initDataStore failed to create buckets: %s", err)
-			return
+			config.notices.Alert("boltdb Check(): %s", err)
 		}
+		return nil
+	})
 
-		// Run consistency checks on datastore and emit errors for diagnostics purposes
-		// We assume this will complete quickly for typical size Psiphon datastores.
-		db.View(func(tx *bolt.Tx) error {
-			err := <-tx.Check()
-			if err != nil {
-				NoticeAlert("boltdb Check(): %s", err)
-			}
-			return nil
-		})
+	store := &DataStore{db: db, notices: config.notices}
 
-		singleton.db = db
+	// The migrateServerEntries function requires the data store is
+	// initialized prior to execution so that migrated entries can be stored
 
-		// The migrateServerEntries function requires the data store is
-		// initialized prior to execution so that migrated entries can be stored
+	if len(migratableServerEntries) > 0 {
+		migrateEntries(
+			store,
+			migratableServerEntries,
+			filepath.Join(config.DataStoreDirectory, LEGACY_DATA_STORE_FILENAME))
+	}
 
-		if len(migratableServerEntries) > 0 {
-			migrateEntries(migratableServerEntries, filepath.Join(config.DataStoreDirectory, LEGACY_DATA_STORE_FILENAME))
-		}
+	store.resetAllTunnelStatsToUnreported()
+
+	return db, nil
+}
+
+var singleton struct {
+	init  sync.Once
+	store *DataStore
+}
 
-		resetAllTunnelStatsToUnreported()
+// InitDataStore initializes the process-wide datastore, which is used
+// by the package-level datastore functions and by any operations with a
+// Config that isn't bound to a Controller. This function uses a sync.Once
+// and is safe for use by concurrent goroutines.
+//
+// Note: the sync.Once was more useful when initDataStore was private and
+// called on-demand by the public functions below. Now we require an explicit
+// InitDataStore() call with the filename passed in. The on-demand calls
+// have been replaced by checkInitDataStore(), called via DataStore.get(), to
+// assert that Init was called.
+func InitDataStore(config *Config) (err error) {
+	singleton.init.Do(func() {
+		singleton.store, err = OpenDataStore(config)
 	})
 
 	return err
 }
 
 func checkInitDataStore() {
-	if singleton.db == nil {
+	if singleton.store == nil {
 		panic("checkInitDataStore: datastore not initialized")
 	}
 }
 
+func (store *DataStore) get() *DataStore {
+	if store == nil {
+		checkInitDataStore()
+		return singleton.store
+	}
+	return store
+}
+
+// StoreServerEntry adds the server entry to the process-wide datastore.
+// See DataStore.StoreServerEntry.
+func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
+	return singleton.store.StoreServerEntry(serverEntry, replaceIfExists)
+}
+
 // StoreServerEntry adds the server entry to the data store.
-// A newly stored (or re-stored) server entry is assigned the next-to-top
-// rank for iteration order (the previous top ranked entry is promoted). The
-// purpose of inserting at next-to-top is to keep the last selected server
-// as the top ranked server.
+// A newly stored server entry has no performance history and so is
+// assigned a neutral score for iteration order (see ServerEntryIterator).
 // When replaceIfExists is true, an existing server entry record is
 // overwritten; otherwise, the existing record is unchanged.
 // If the server entry data is malformed, an alert notice is issued and
 // the entry is skipped; no error is returned.
-func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
-	checkInitDataStore()
+func (store *DataStore) StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
+	store = store.get()
 
 	// Server entries should already be validated before this point,
 	// so instead of skipping we fail with an error.
-	err := ValidateServerEntry(serverEntry)
+	err := ValidateServerEntry(store.notices, serverEntry)
 	if err != nil {
 		return ContextError(errors.New("invalid server entry"))
 	}
@@ -174,7 +275,7 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 	// values (e.g., many servers support all protocols), performance
 	// is expected to be acceptable.
 
-	err = singleton.db.Update(func(tx *bolt.Tx) error {
+	err = store.db.Update(func(tx *bolt.Tx) error {
 
 		serverEntries := tx.Bucket([]byte(serverEntriesBucket))
 
@@ -206,12 +307,7 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 			return ContextError(err)
 		}
 
-		err = insertRankedServerEntry(tx, serverEntry.IpAddress, 1)
-		if err != nil {
-			return ContextError(err)
-		}
-
-		NoticeInfo("updated server %s", serverEntry.IpAddress)
+		store.notices.Info("updated server %s", serverEntry.IpAddress)
 
 		return nil
 	})
@@ -222,12 +318,18 @@ func StoreServerEntry(serverEntry *ServerEntry, replaceIfExists bool) error {
 	return nil
 }
 
+// StoreServerEntries shuffles and stores a list of server entries in the
+// process-wide datastore. See DataStore.StoreServerEntries.
+func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) error {
+	return singleton.store.StoreServerEntries(serverEntries, replaceIfExists)
+}
+
 // StoreServerEntries shuffles and stores a list of server entries.
 // Shuffling is performed on imported server entrues as part of client-side
 // load balancing.
 // There is an independent transaction for each entry insert/update.
-func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) error {
-	checkInitDataStore()
+func (store *DataStore) StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) error {
+	store = store.get()
 
 	for index := len(serverEntries) - 1; index > 0; index-- {
 		swapIndex := rand.Intn(index + 1)
@@ -235,7 +337,7 @@ func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) erro
 	}
 
 	for _, serverEntry := range serverEntries {
-		err := StoreServerEntry(serverEntry, replaceIfExists)
+		err := store.StoreServerEntry(serverEntry, replaceIfExists)
 		if err != nil {
 			return ContextError(err)
 		}
@@ -243,32 +345,40 @@ func StoreServerEntries(serverEntries []*ServerEntry, replaceIfExists bool) erro
 
 	// Since there has possibly been a significant change in the server entries,
 	// take this opportunity to update the available egress regions.
-	ReportAvailableRegions()
+	store.ReportAvailableRegions()
 
 	return nil
 }
 
-// PromoteServerEntry assigns the top rank (one more than current
-// max rank) to the specified server entry. Server candidates are
-// iterated in decending rank order, so this server entry will be
-// the first candidate in a subsequent tunnel establishment.
+// PromoteServerEntry promotes the server entry in the process-wide
+// datastore. See DataStore.PromoteServerEntry.
 func PromoteServerEntry(ipAddress string) error {
-	checkInitDataStore()
+	return singleton.store.PromoteServerEntry(ipAddress)
+}
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+// PromoteServerEntry marks the specified server entry as the server
+// affinity candidate. Server candidates are otherwise iterated in
+// descending score order, but this server entry will be the first
+// candidate in a subsequent tunnel establishment unless it has failed
+// since it was promoted.
+func (store *DataStore) PromoteServerEntry(ipAddress string) error {
+	store = store.get()
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
 
 		// Ensure the corresponding entry exists before
-		// inserting into rank.
+		// promoting it.
 		bucket := tx.Bucket([]byte(serverEntriesBucket))
 		data := bucket.Get([]byte(ipAddress))
 		if data == nil {
-			NoticeAlert(
+			store.notices.Alert(
 				"PromoteServerEntry: ignoring unknown server entry: %s",
 				ipAddress)
 			return nil
 		}
 
-		return insertRankedServerEntry(tx, ipAddress, 0)
+		bucket = tx.Bucket([]byte(keyValueBucket))
+		return bucket.Put([]byte(affinityServerEntryKey), []byte(ipAddress))
 	})
 
 	if err != nil {
@@ -277,81 +387,281 @@ func PromoteServerEntry(ipAddress string) error {
 	return nil
 }
 
-func getRankedServerEntries(tx *bolt.Tx) ([]string, error) {
-	bucket := tx.Bucket([]byte(rankedServerEntriesBucket))
-	data := bucket.Get([]byte(rankedServerEntriesKey))
+// RecordServerEntryDialSuccess adds a successful tunnel establishment,
+// using the specified protocol, to the server entry performance history
+// and to the performance history for the specified network.
+// establishDuration is the time taken to establish the tunnel.
+func (store *DataStore) RecordServerEntryDialSuccess(
+	networkID, ipAddress, protocol string, establishDuration time.Duration) error {
+
+	return store.updateServerEntryPerformance(
+		networkID, ipAddress, protocol,
+		func(record *ProtocolPerformance, now time.Time) {
+			record.recordDialSuccess(now, establishDuration)
+		})
+}
+
+// RecordServerEntryDialFailure adds a failed tunnel establishment, using
+// the specified protocol, to the server entry performance history and to
+// the performance history for the specified network. The failure reason
+// is retained for diagnostics.
+func (store *DataStore) RecordServerEntryDialFailure(
+	networkID, ipAddress, protocol, reason string) error {
+
+	return store.updateServerEntryPerformance(
+		networkID, ipAddress, protocol,
+		func(record *ProtocolPerformance, now time.Time) {
+			record.recordDialFailure(now, reason)
+		})
+}
+
+// RecordServerEntryTunnelClosed adds the lifetime of an established tunnel
+// to the server entry performance history and to the performance history
+// for the specified network. failureReason is blank when the tunnel was
+// closed in an orderly shutdown.
+func (store *DataStore) RecordServerEntryTunnelClosed(
+	networkID, ipAddress, protocol string,
+	tunnelDuration time.Duration, failureReason string) error {
+
+	return store.updateServerEntryPerformance(
+		networkID, ipAddress, protocol,
+		func(record *ProtocolPerformance, now time.Time) {
+			record.recordTunnelClosed(now, tunnelDuration, failureReason)
+		})
+}
+
+// GetServerEntryPerformance returns the performance history for the
+// specified server entry. If no history has been recorded, an empty
+// ServerEntryPerformance is returned.
+func (store *DataStore) GetServerEntryPerformance(ipAddress string) (*ServerEntryPerformance, error) {
+	store = store.get()
+
+	var performance *ServerEntryPerformance
+	err := store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		performance, err = getServerEntryPerformance(tx, ipAddress)
+		return err
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return performance, nil
+}
+
+func getServerEntryPerformance(tx *bolt.Tx, ipAddress string) (*ServerEntryPerformance, error) {
+	bucket := tx.Bucket([]byte(serverEntryPerformanceBucket))
+	data := bucket.Get([]byte(ipAddress))
 
+	performance := newServerEntryPerformance()
 	if data == nil {
-		return []string{}, nil
+		return performance, nil
 	}
 
-	rankedServerEntries := make([]string, 0)
-	err := json.Unmarshal(data, &rankedServerEntries)
+	err := json.Unmarshal(data, performance)
 	if err != nil {
 		return nil, ContextError(err)
 	}
-	return rankedServerEntries, nil
+	return performance, nil
 }
 
-func setRankedServerEntries(tx *bolt.Tx, rankedServerEntries []string) error {
-	data, err := json.Marshal(rankedServerEntries)
+func (store *DataStore) updateServerEntryPerformance(
+	networkID, ipAddress, protocol string,
+	update func(*ProtocolPerformance, time.Time)) error {
+
+	store = store.get()
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+
+		// Ensure the corresponding entry exists before
+		// recording history.
+		bucket := tx.Bucket([]byte(serverEntriesBucket))
+		if bucket.Get([]byte(ipAddress)) == nil {
+			store.notices.Alert(
+				"updateServerEntryPerformance: ignoring unknown server entry: %s",
+				ipAddress)
+			return nil
+		}
+
+		performance, err := getServerEntryPerformance(tx, ipAddress)
+		if err != nil {
+			// In case of data corruption, start over with
+			// an empty history.
+			store.notices.Alert("updateServerEntryPerformance: %s", err)
+			performance = newServerEntryPerformance()
+		}
+
+		networkPerformance, err := getNetworkPerformance(tx, networkID)
+		if err != nil {
+			store.notices.Alert("updateServerEntryPerformance: %s", err)
+			networkPerformance = newNetworkPerformance()
+		}
+
+		now := time.Now()
+		update(performance.getProtocol(protocol), now)
+		update(networkPerformance.getProtocol(protocol), now)
+
+		data, err := json.Marshal(performance)
+		if err != nil {
+			return ContextError(err)
+		}
+
+		bucket = tx.Bucket([]byte(serverEntryPerformanceBucket))
+		err = bucket.Put([]byte(ipAddress), data)
+		if err != nil {
+			return ContextError(err)
+		}
+
+		data, err = json.Marshal(networkPerformance)
+		if err != nil {
+			return ContextError(err)
+		}
+
+		bucket = tx.Bucket([]byte(networkPerformanceBucket))
+		return bucket.Put([]byte(networkID), data)
+	})
+
 	if err != nil {
 		return ContextError(err)
 	}
+	return nil
+}
+
+// GetNetworkPerformance returns the tunnel protocol performance history
+// for the specified network. If no history has been recorded, an empty
+// NetworkPerformance is returned.
+func (store *DataStore) GetNetworkPerformance(networkID string) (*NetworkPerformance, error) {
+	store = store.get()
+
+	var performance *NetworkPerformance
+	err := store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		performance, err = getNetworkPerformance(tx, networkID)
+		return err
+	})
+
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return performance, nil
+}
 
-	bucket := tx.Bucket([]byte(rankedServerEntriesBucket))
-	err = bucket.Put([]byte(rankedServerEntriesKey), data)
+func getNetworkPerformance(tx *bolt.Tx, networkID string) (*NetworkPerformance, error) {
+	bucket := tx.Bucket([]byte(networkPerformanceBucket))
+	data := bucket.Get([]byte(networkID))
+
+	performance := newNetworkPerformance()
+	if data == nil {
+		return performance, nil
+	}
+
+	err := json.Unmarshal(data, performance)
 	if err != nil {
-		return ContextError(err)
+		return nil, ContextError(err)
 	}
+	return performance, nil
+}
 
-	return nil
+// replayDialParametersRecord is a stored set of dial parameters for replay.
+type replayDialParametersRecord struct {
+	DialParameters *DialParameters
+	StoredTime     time.Time
 }
 
-func insertRankedServerEntry(tx *bolt.Tx, serverEntryId string, position int) error {
-	rankedServerEntries, err := getRankedServerEntries(tx)
+// SetReplayDialParameters stores the dial parameters of a successful
+// tunnel to the specified server, replacing any previously stored dial
+// parameters for the server.
+func (store *DataStore) SetReplayDialParameters(
+	ipAddress string, dialParameters *DialParameters) error {
+
+	store = store.get()
+
+	data, err := json.Marshal(&replayDialParametersRecord{
+		DialParameters: dialParameters,
+		StoredTime:     time.Now(),
+	})
 	if err != nil {
 		return ContextError(err)
 	}
 
-	// BoltDB implementation note:
-	// For simplicity, we store the ranked server ids in an array serialized to
-	// a single key value. To ensure this value doesn't grow without bound,
-	// it's capped at rankedServerEntryCount. For now, this cap should be large
-	// enough to meet the shuffleHeadLength = config.TunnelPoolSize criteria, for
-	// any reasonable configuration of config.TunnelPoolSize.
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(replayDialParametersBucket))
+		return bucket.Put([]byte(ipAddress), data)
+	})
 
-	// Using: https://github.com/golang/go/wiki/SliceTricks
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
 
-	// When serverEntryId is already ranked, remove it first to avoid duplicates
+// GetReplayDialParameters retrieves the stored dial parameters for the
+// specified server. If not found, or when the dial parameters were stored
+// more than ttl ago, nil is returned.
+func (store *DataStore) GetReplayDialParameters(
+	ipAddress string, ttl time.Duration) (*DialParameters, error) {
 
-	for i, rankedServerEntryId := range rankedServerEntries {
-		if rankedServerEntryId == serverEntryId {
-			rankedServerEntries = append(
-				rankedServerEntries[:i], rankedServerEntries[i+1:]...)
-			break
-		}
-	}
+	store = store.get()
 
-	// SliceTricks insert, with length cap enforced
+	var record *replayDialParametersRecord
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(replayDialParametersBucket))
+		data := bucket.Get([]byte(ipAddress))
+		if data == nil {
+			return nil
+		}
+		record = new(replayDialParametersRecord)
+		return json.Unmarshal(data, record)
+	})
 
-	if len(rankedServerEntries) < rankedServerEntryCount {
-		rankedServerEntries = append(rankedServerEntries, "")
+	if err != nil {
+		return nil, ContextError(err)
 	}
-	if position >= len(rankedServerEntries) {
-		position = len(rankedServerEntries) - 1
+	if record == nil || record.DialParameters == nil ||
+		time.Since(record.StoredTime) > ttl {
+		return nil, nil
 	}
-	copy(rankedServerEntries[position+1:], rankedServerEntries[position:])
-	rankedServerEntries[position] = serverEntryId
+	return record.DialParameters, nil
+}
+
+// DeleteReplayDialParameters deletes any stored dial parameters for the
+// specified server.
+func (store *DataStore) DeleteReplayDialParameters(ipAddress string) error {
+	store = store.get()
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(replayDialParametersBucket))
+		return bucket.Delete([]byte(ipAddress))
+	})
 
-	err = setRankedServerEntries(tx, rankedServerEntries)
 	if err != nil {
 		return ContextError(err)
 	}
-
 	return nil
 }
 
+// scoredServerEntryId is used to sort server entry ids by score and
+// by egress region preference.
+type scoredServerEntryId struct {
+	id         string
+	score      float64
+	preference int
+}
+
+type scoredServerEntryIds []scoredServerEntryId
+
+func (ids scoredServerEntryIds) Len() int           { return len(ids) }
+func (ids scoredServerEntryIds) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
+func (ids scoredServerEntryIds) Less(i, j int) bool { return ids[i].score > ids[j].score }
+
+type preferredServerEntryIds []scoredServerEntryId
+
+func (ids preferredServerEntryIds) Len() int      { return len(ids) }
+func (ids preferredServerEntryIds) Swap(i, j int) { ids[i], ids[j] = ids[j], ids[i] }
+func (ids preferredServerEntryIds) Less(i, j int) bool {
+	return ids[i].preference < ids[j].preference
+}
+
 func serverEntrySupportsProtocol(serverEntry *ServerEntry, protocol string) bool {
 	// Note: for meek, the capabilities are FRONTED-MEEK and UNFRONTED-MEEK
 	// and the additonal OSSH service is assumed to be available internally.
@@ -360,9 +670,10 @@ func serverEntrySupportsProtocol(serverEntry *ServerEntry, protocol string) bool
 }
 
 // ServerEntryIterator is used to iterate over
-// stored server entries in rank order.
+// stored server entries in score order.
 type ServerEntryIterator struct {
-	region                      string
+	dataStore                   *DataStore
+	regions                     *EgressRegionFilter
 	protocol                    string
 	shuffleHeadLength           int
 	serverEntryIds              []string
@@ -380,9 +691,9 @@ func NewServerEntryIterator(config *Config) (iterator *ServerEntryIterator, err
 		return newTargetServerEntryIterator(config)
 	}
 
-	checkInitDataStore()
 	iterator = &ServerEntryIterator{
-		region:                      config.EgressRegion,
+		dataStore:                   config.dataStore.get(),
+		regions:                     config.GetEgressRegionFilter(),
 		protocol:                    config.TunnelProtocol,
 		shuffleHeadLength:           config.TunnelPoolSize,
 		isTargetServerEntryIterator: false,
@@ -401,25 +712,38 @@ func newTargetServerEntryIterator(config *Config) (iterator *ServerEntryIterator
 	if err != nil {
 		return nil, err
 	}
-	if config.EgressRegion != "" && serverEntry.Region != config.EgressRegion {
-		return nil, errors.New("TargetServerEntry does not support EgressRegion")
-	}
-	if config.TunnelProtocol != "" {
-		// Note: same capability/protocol mapping as in StoreServerEntry
-		requiredCapability := strings.TrimSuffix(config.TunnelProtocol, "-OSSH")
-		if !Contains(serverEntry.Capabilities, requiredCapability) {
-			return nil, errors.New("TargetServerEntry does not support TunnelProtocol")
-		}
+	err = checkTargetServerEntry(
+		serverEntry, config.GetEgressRegionFilter(), config.TunnelProtocol)
+	if err != nil {
+		return nil, err
 	}
 	iterator = &ServerEntryIterator{
 		isTargetServerEntryIterator: true,
 		hasNextTargetServerEntry:    true,
 		targetServerEntry:           serverEntry,
 	}
-	NoticeInfo("using TargetServerEntry: %s", serverEntry.IpAddress)
+	config.notices.Info("using TargetServerEntry: %s", serverEntry.IpAddress)
 	return iterator, nil
 }
 
+// checkTargetServerEntry checks that a TargetServerEntry supports the
+// specified egress regions and tunnel protocol.
+func checkTargetServerEntry(
+	serverEntry *ServerEntry, regions *EgressRegionFilter, tunnelProtocol string) error {
+
+	if !regions.Allows(serverEntry.Region) {
+		return errors.New("TargetServerEntry does not support EgressRegion")
+	}
+	if tunnelProtocol != "" {
+		// Note: same capability/protocol mapping as in StoreServerEntry
+		requiredCapability := strings.TrimSuffix(tunnelProtocol, "-OSSH")
+		if !Contains(serverEntry.Capabilities, requiredCapability) {
+			return errors.New("TargetServerEntry does not support TunnelProtocol")
+		}
+	}
+	return nil
+}
+
 // Reset a NewServerEntryIterator to the start of its cycle. The next
 // call to Next will return the first server entry.
 func (iterator *ServerEntryIterator) Reset() error {
@@ -430,13 +754,27 @@ func (iterator *ServerEntryIterator) Reset() error {
 		return nil
 	}
 
-	count := CountServerEntries(iterator.region, iterator.protocol)
-	NoticeCandidateServers(iterator.region, iterator.protocol, count)
+	store := iterator.dataStore
+
+	count := store.CountServerEntriesInRegions(iterator.regions, iterator.protocol)
+	store.notices.CandidateServers(iterator.regions, iterator.protocol, count)
 
 	// This query implements the Psiphon server candidate selection
-	// algorithm: the first TunnelPoolSize server candidates are in rank
-	// (priority) order, to favor previously successful servers; then the
-	// remaining long tail is shuffled to raise up less recent candidates.
+	// algorithm: server candidates are ordered by their performance
+	// history score (see ServerEntryPerformance.Score), to favor servers
+	// that have recently succeeded and avoid servers that have recently
+	// failed. The affinity server, the server of the most recently
+	// established tunnel, is first unless it has since failed.
+	//
+	// The first TunnelPoolSize server candidates are in strict score order.
+	// For the remaining long tail, each candidate is, with probability
+	// SERVER_ENTRY_EXPLORATION_PROBABILITY, assigned a random score instead,
+	// to raise up less recent and lower scored candidates; and ties, such as
+	// among candidates with no history, are broken at random.
+	//
+	// With preferred egress regions, candidates are then ordered by region
+	// preference, retaining the score order within each region. Candidates
+	// in regions which the egress region filter doesn't allow are omitted.
 
 	// BoltDB implementation note:
 	// We don't keep a transaction open for the duration of the iterator
@@ -452,28 +790,62 @@ func (iterator *ServerEntryIterator) Reset() error {
 	// So the underlying serverEntriesBucket could change after the serverEntryIds
 	// list is built.
 
-	var serverEntryIds []string
+	var scoredIds scoredServerEntryIds
+	affinityServerEntryId := ""
+	affinityServerEntryValid := false
 
-	err := singleton.db.View(func(tx *bolt.Tx) error {
-		var err error
-		serverEntryIds, err = getRankedServerEntries(tx)
-		if err != nil {
-			return err
-		}
+	err := store.db.View(func(tx *bolt.Tx) error {
 
-		skipServerEntryIds := make(map[string]bool)
-		for _, serverEntryId := range serverEntryIds {
-			skipServerEntryIds[serverEntryId] = true
-		}
+		now := time.Now()
 
-		bucket := tx.Bucket([]byte(serverEntriesBucket))
+		bucket := tx.Bucket([]byte(keyValueBucket))
+		affinityServerEntryId = string(bucket.Get([]byte(affinityServerEntryKey)))
+
+		bucket = tx.Bucket([]byte(serverEntriesBucket))
 		cursor := bucket.Cursor()
-		for key, _ := cursor.Last(); key != nil; key, _ = cursor.Prev() {
+		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
 			serverEntryId := string(key)
-			if _, ok := skipServerEntryIds[serverEntryId]; ok {
-				continue
+
+			// Only the region is decoded here; Next decodes and checks the
+			// full server entry.
+			preference := 0
+			if iterator.regions.isFiltering() {
+				var serverEntryRegion struct {
+					Region string `json:"region"`
+				}
+				err := json.Unmarshal(value, &serverEntryRegion)
+				if err != nil {
+					// In case of data corruption or a bug causing this condition,
+					// do not stop iterating.
+					store.notices.Alert("ServerEntryIterator.Reset: %s", ContextError(err))
+					continue
+				}
+				if !iterator.regions.Allows(serverEntryRegion.Region) {
+					continue
+				}
+				preference = iterator.regions.preference(serverEntryRegion.Region)
+			}
+
+			performance, err := getServerEntryPerformance(tx, serverEntryId)
+			if err != nil {
+				// In case of data corruption or a bug causing this condition,
+				// do not stop iterating.
+				store.notices.Alert("ServerEntryIterator.Reset: %s", err)
+				performance = newServerEntryPerformance()
 			}
-			serverEntryIds = append(serverEntryIds, serverEntryId)
+
+			if serverEntryId == affinityServerEntryId {
+				lastSuccessTime, lastFailureTime := performance.LastResult(iterator.protocol)
+				affinityServerEntryValid = !lastFailureTime.After(lastSuccessTime)
+			}
+
+			scoredIds = append(
+				scoredIds,
+				scoredServerEntryId{
+					id:         serverEntryId,
+					score:      performance.Score(iterator.protocol, now),
+					preference: preference,
+				})
 		}
 		return nil
 	})
@@ -481,9 +853,41 @@ func (iterator *ServerEntryIterator) Reset() error {
 		return ContextError(err)
 	}
 
-	for i := len(serverEntryIds) - 1; i > iterator.shuffleHeadLength-1; i-- {
-		j := rand.Intn(i+1-iterator.shuffleHeadLength) + iterator.shuffleHeadLength
-		serverEntryIds[i], serverEntryIds[j] = serverEntryIds[j], serverEntryIds[i]
+	if !affinityServerEntryValid {
+		affinityServerEntryId = ""
+	}
+
+	for i := len(scoredIds) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		scoredIds[i], scoredIds[j] = scoredIds[j], scoredIds[i]
+	}
+
+	sort.Stable(scoredIds)
+
+	if len(scoredIds) > iterator.shuffleHeadLength {
+		tail := scoredIds[iterator.shuffleHeadLength:]
+		for i := range tail {
+			if rand.Float64() < SERVER_ENTRY_EXPLORATION_PROBABILITY {
+				tail[i].score = rand.Float64()
+			}
+		}
+		sort.Stable(tail)
+	}
+
+	// The affinity server is first among the candidates in its region.
+	orderedIds := make(scoredServerEntryIds, 0, len(scoredIds))
+	for _, scoredId := range scoredIds {
+		if scoredId.id == affinityServerEntryId {
+			orderedIds = append(scoredServerEntryIds{scoredId}, orderedIds...)
+		} else {
+			orderedIds = append(orderedIds, scoredId)
+		}
+	}
+	sort.Stable(preferredServerEntryIds(orderedIds))
+
+	serverEntryIds := make([]string, 0, len(orderedIds))
+	for _, orderedId := range orderedIds {
+		serverEntryIds = append(serverEntryIds, orderedId.id)
 	}
 
 	iterator.serverEntryIds = serverEntryIds
@@ -498,7 +902,23 @@ func (iterator *ServerEntryIterator) Close() {
 	iterator.serverEntryIndex = 0
 }
 
-// Next returns the next server entry, by rank, for a ServerEntryIterator.
+// enableEgressRegionFallback extends the iterator, from its next Reset, to
+// servers in any egress region which isn't excluded; see
+// Config.EgressRegionFallbackSeconds. Returns false when there's nothing to
+// fall back from.
+func (iterator *ServerEntryIterator) enableEgressRegionFallback() bool {
+	if iterator.isTargetServerEntryIterator {
+		return false
+	}
+	fallbackRegions := iterator.regions.withFallback()
+	if fallbackRegions == nil {
+		return false
+	}
+	iterator.regions = fallbackRegions
+	return true
+}
+
+// Next returns the next server entry, by score, for a ServerEntryIterator.
 // Returns nil with no error when there is no next item.
 func (iterator *ServerEntryIterator) Next() (serverEntry *ServerEntry, err error) {
 	defer func() {
@@ -527,8 +947,10 @@ func (iterator *ServerEntryIterator) Next() (serverEntry *ServerEntry, err error
 		serverEntryId := iterator.serverEntryIds[iterator.serverEntryIndex]
 		iterator.serverEntryIndex += 1
 
+		store := iterator.dataStore
+
 		var data []byte
-		err = singleton.db.View(func(tx *bolt.Tx) error {
+		err = store.db.View(func(tx *bolt.Tx) error {
 			bucket := tx.Bucket([]byte(serverEntriesBucket))
 			value := bucket.Get([]byte(serverEntryId))
 			if value != nil {
@@ -545,7 +967,7 @@ func (iterator *ServerEntryIterator) Next() (serverEntry *ServerEntry, err error
 		if data == nil {
 			// In case of data corruption or a bug causing this condition,
 			// do not stop iterating.
-			NoticeAlert("ServerEntryIterator.Next: unexpected missing server entry: %s", serverEntryId)
+			store.notices.Alert("ServerEntryIterator.Next: unexpected missing server entry: %s", serverEntryId)
 			continue
 		}
 
@@ -554,12 +976,12 @@ func (iterator *ServerEntryIterator) Next() (serverEntry *ServerEntry, err error
 		if err != nil {
 			// In case of data corruption or a bug causing this condition,
 			// do not stop iterating.
-			NoticeAlert("ServerEntryIterator.Next: %s", ContextError(err))
+			store.notices.Alert("ServerEntryIterator.Next: %s", ContextError(err))
 			continue
 		}
 
 		// Check filter requirements
-		if (iterator.region == "" || serverEntry.Region == iterator.region) &&
+		if iterator.regions.Allows(serverEntry.Region) &&
 			(iterator.protocol == "" || serverEntrySupportsProtocol(serverEntry, iterator.protocol)) {
 
 			break
@@ -582,8 +1004,10 @@ func MakeCompatibleServerEntry(serverEntry *ServerEntry) *ServerEntry {
 	return serverEntry
 }
 
-func scanServerEntries(scanner func(*ServerEntry)) error {
-	err := singleton.db.View(func(tx *bolt.Tx) error {
+func (store *DataStore) scanServerEntries(scanner func(*ServerEntry)) error {
+	store = store.get()
+
+	err := store.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(serverEntriesBucket))
 		cursor := bucket.Cursor()
 
@@ -593,7 +1017,7 @@ func scanServerEntries(scanner func(*ServerEntry)) error {
 			if err != nil {
 				// In case of data corruption or a bug causing this condition,
 				// do not stop iterating.
-				NoticeAlert("scanServerEntries: %s", ContextError(err))
+				store.notices.Alert("scanServerEntries: %s", ContextError(err))
 				continue
 			}
 			scanner(serverEntry)
@@ -609,39 +1033,65 @@ func scanServerEntries(scanner func(*ServerEntry)) error {
 	return nil
 }
 
+// CountServerEntries returns a count of servers stored in the process-wide
+// datastore for the specified region and protocol. A region of "" counts
+// servers in any region.
+func CountServerEntries(region, protocol string) int {
+	return singleton.store.CountServerEntries(region, protocol)
+}
+
 // CountServerEntries returns a count of stored servers for the
 // specified region and protocol.
-func CountServerEntries(region, protocol string) int {
-	checkInitDataStore()
+func (store *DataStore) CountServerEntries(region, protocol string) int {
+	return store.CountServerEntriesInRegions(NewEgressRegionFilter(region, nil, nil), protocol)
+}
+
+// CountServerEntriesInRegions returns a count of servers stored in the
+// process-wide datastore for the specified egress regions and protocol.
+// A nil regions filter counts servers in any region.
+func CountServerEntriesInRegions(regions *EgressRegionFilter, protocol string) int {
+	return singleton.store.CountServerEntriesInRegions(regions, protocol)
+}
+
+// CountServerEntriesInRegions returns a count of stored servers for the
+// specified egress regions and protocol.
+func (store *DataStore) CountServerEntriesInRegions(regions *EgressRegionFilter, protocol string) int {
+	store = store.get()
 
 	count := 0
-	err := scanServerEntries(func(serverEntry *ServerEntry) {
-		if (region == "" || serverEntry.Region == region) &&
+	err := store.scanServerEntries(func(serverEntry *ServerEntry) {
+		if regions.Allows(serverEntry.Region) &&
 			(protocol == "" || serverEntrySupportsProtocol(serverEntry, protocol)) {
 			count += 1
 		}
 	})
 
 	if err != nil {
-		NoticeAlert("CountServerEntries failed: %s", err)
+		store.notices.Alert("CountServerEntries failed: %s", err)
 		return 0
 	}
 
 	return count
 }
 
+// ReportAvailableRegions reports the egress regions available in the
+// process-wide datastore. See DataStore.ReportAvailableRegions.
+func ReportAvailableRegions() {
+	singleton.store.ReportAvailableRegions()
+}
+
 // ReportAvailableRegions prints a notice with the available egress regions.
 // Note that this report ignores config.TunnelProtocol.
-func ReportAvailableRegions() {
-	checkInitDataStore()
+func (store *DataStore) ReportAvailableRegions() {
+	store = store.get()
 
 	regions := make(map[string]bool)
-	err := scanServerEntries(func(serverEntry *ServerEntry) {
+	err := store.scanServerEntries(func(serverEntry *ServerEntry) {
 		regions[serverEntry.Region] = true
 	})
 
 	if err != nil {
-		NoticeAlert("ReportAvailableRegions failed: %s", err)
+		store.notices.Alert("ReportAvailableRegions failed: %s", err)
 		return
 	}
 
@@ -654,16 +1104,22 @@ func ReportAvailableRegions() {
 		}
 	}
 
-	NoticeAvailableEgressRegions(regionList)
+	store.notices.AvailableEgressRegions(regionList)
+}
+
+// GetServerEntryIpAddresses returns all server IP addresses stored in the
+// process-wide datastore. See DataStore.GetServerEntryIpAddresses.
+func GetServerEntryIpAddresses() (ipAddresses []string, err error) {
+	return singleton.store.GetServerEntryIpAddresses()
 }
 
 // GetServerEntryIpAddresses returns an array containing
 // all stored server IP addresses.
-func GetServerEntryIpAddresses() (ipAddresses []string, err error) {
-	checkInitDataStore()
+func (store *DataStore) GetServerEntryIpAddresses() (ipAddresses []string, err error) {
+	store = store.get()
 
 	ipAddresses = make([]string, 0)
-	err = scanServerEntries(func(serverEntry *ServerEntry) {
+	err = store.scanServerEntries(func(serverEntry *ServerEntry) {
 		ipAddresses = append(ipAddresses, serverEntry.IpAddress)
 	})
 
@@ -674,13 +1130,19 @@ func GetServerEntryIpAddresses() (ipAddresses []string, err error) {
 	return ipAddresses, nil
 }
 
+// SetSplitTunnelRoutes updates the cached routes data for the region in
+// the process-wide datastore. See DataStore.SetSplitTunnelRoutes.
+func SetSplitTunnelRoutes(region, etag string, data []byte) error {
+	return singleton.store.SetSplitTunnelRoutes(region, etag, data)
+}
+
 // SetSplitTunnelRoutes updates the cached routes data for
 // the given region. The associated etag is also stored and
 // used to make efficient web requests for updates to the data.
-func SetSplitTunnelRoutes(region, etag string, data []byte) error {
-	checkInitDataStore()
+func (store *DataStore) SetSplitTunnelRoutes(region, etag string, data []byte) error {
+	store = store.get()
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(splitTunnelRouteETagsBucket))
 		err := bucket.Put([]byte(region), []byte(etag))
 
@@ -695,12 +1157,18 @@ func SetSplitTunnelRoutes(region, etag string, data []byte) error {
 	return nil
 }
 
+// GetSplitTunnelRoutesETag retrieves the routes etag for the region from
+// the process-wide datastore. See DataStore.GetSplitTunnelRoutesETag.
+func GetSplitTunnelRoutesETag(region string) (etag string, err error) {
+	return singleton.store.GetSplitTunnelRoutesETag(region)
+}
+
 // GetSplitTunnelRoutesETag retrieves the etag for cached routes
 // data for the specified region. If not found, it returns an empty string value.
-func GetSplitTunnelRoutesETag(region string) (etag string, err error) {
-	checkInitDataStore()
+func (store *DataStore) GetSplitTunnelRoutesETag(region string) (etag string, err error) {
+	store = store.get()
 
-	err = singleton.db.View(func(tx *bolt.Tx) error {
+	err = store.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(splitTunnelRouteETagsBucket))
 		etag = string(bucket.Get([]byte(region)))
 		return nil
@@ -712,12 +1180,18 @@ func GetSplitTunnelRoutesETag(region string) (etag string, err error) {
 	return etag, nil
 }
 
+// GetSplitTunnelRoutesData retrieves the cached routes data for the region
+// from the process-wide datastore. See DataStore.GetSplitTunnelRoutesData.
+func GetSplitTunnelRoutesData(region string) (data []byte, err error) {
+	return singleton.store.GetSplitTunnelRoutesData(region)
+}
+
 // GetSplitTunnelRoutesData retrieves the cached routes data
 // for the specified region. If not found, it returns a nil value.
-func GetSplitTunnelRoutesData(region string) (data []byte, err error) {
-	checkInitDataStore()
+func (store *DataStore) GetSplitTunnelRoutesData(region string) (data []byte, err error) {
+	store = store.get()
 
-	err = singleton.db.View(func(tx *bolt.Tx) error {
+	err = store.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(splitTunnelRouteDataBucket))
 		value := bucket.Get([]byte(region))
 		if value != nil {
@@ -734,13 +1208,19 @@ func GetSplitTunnelRoutesData(region string) (data []byte, err error) {
 	return data, nil
 }
 
+// SetUrlETag stores an ETag for the URL in the process-wide datastore. See
+// DataStore.SetUrlETag.
+func SetUrlETag(url, etag string) error {
+	return singleton.store.SetUrlETag(url, etag)
+}
+
 // SetUrlETag stores an ETag for the specfied URL.
 // Note: input URL is treated as a string, and is not
 // encoded or decoded or otherwise canonicalized.
-func SetUrlETag(url, etag string) error {
-	checkInitDataStore()
+func (store *DataStore) SetUrlETag(url, etag string) error {
+	store = store.get()
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(urlETagsBucket))
 		err := bucket.Put([]byte(url), []byte(etag))
 		return err
@@ -752,12 +1232,18 @@ func SetUrlETag(url, etag string) error {
 	return nil
 }
 
+// GetUrlETag retrieves the ETag for the URL from the process-wide
+// datastore. See DataStore.GetUrlETag.
+func GetUrlETag(url string) (etag string, err error) {
+	return singleton.store.GetUrlETag(url)
+}
+
 // GetUrlETag retrieves a previously stored an ETag for the
 // specfied URL. If not found, it returns an empty string value.
-func GetUrlETag(url string) (etag string, err error) {
-	checkInitDataStore()
+func (store *DataStore) GetUrlETag(url string) (etag string, err error) {
+	store = store.get()
 
-	err = singleton.db.View(func(tx *bolt.Tx) error {
+	err = store.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(urlETagsBucket))
 		etag = string(bucket.Get([]byte(url)))
 		return nil
@@ -769,11 +1255,17 @@ func GetUrlETag(url string) (etag string, err error) {
 	return etag, nil
 }
 
-// SetKeyValue stores a key/value pair.
+// SetKeyValue stores a key/value pair in the process-wide datastore. See
+// DataStore.SetKeyValue.
 func SetKeyValue(key, value string) error {
-	checkInitDataStore()
+	return singleton.store.SetKeyValue(key, value)
+}
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+// SetKeyValue stores a key/value pair.
+func (store *DataStore) SetKeyValue(key, value string) error {
+	store = store.get()
+
+	err := store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(keyValueBucket))
 		err := bucket.Put([]byte(key), []byte(value))
 		return err
@@ -785,12 +1277,18 @@ func SetKeyValue(key, value string) error {
 	return nil
 }
 
+// GetKeyValue retrieves the value for the key from the process-wide
+// datastore. See DataStore.GetKeyValue.
+func GetKeyValue(key string) (value string, err error) {
+	return singleton.store.GetKeyValue(key)
+}
+
 // GetKeyValue retrieves the value for a given key. If not found,
 // it returns an empty string value.
-func GetKeyValue(key string) (value string, err error) {
-	checkInitDataStore()
+func (store *DataStore) GetKeyValue(key string) (value string, err error) {
+	store = store.get()
 
-	err = singleton.db.View(func(tx *bolt.Tx) error {
+	err = store.db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(keyValueBucket))
 		value = string(bucket.Get([]byte(key)))
 		return nil
@@ -814,6 +1312,12 @@ func GetKeyValue(key string) (value string, err error) {
 var tunnelStatsStateUnreported = []byte("0")
 var tunnelStatsStateReporting = []byte("1")
 
+// StoreTunnelStats adds tunnel stats to the process-wide datastore. See
+// DataStore.StoreTunnelStats.
+func StoreTunnelStats(tunnelStats []byte) error {
+	return singleton.store.StoreTunnelStats(tunnelStats)
+}
+
 // StoreTunnelStats adds a new tunnel stats record, which is
 // set to StateUnreported and is an immediate candidate for
 // reporting.
@@ -823,10 +1327,10 @@ var tunnelStatsStateReporting = []byte("1")
 // information for the value to function as a key in the
 // key/value datastore. This assumption is currently satisfied
 // by the fields sessionId + tunnelNumber.
-func StoreTunnelStats(tunnelStats []byte) error {
-	checkInitDataStore()
+func (store *DataStore) StoreTunnelStats(tunnelStats []byte) error {
+	store = store.get()
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(tunnelStatsBucket))
 		err := bucket.Put(tunnelStats, tunnelStatsStateUnreported)
 		return err
@@ -838,14 +1342,20 @@ func StoreTunnelStats(tunnelStats []byte) error {
 	return nil
 }
 
+// CountUnreportedTunnelStats counts the unreported tunnel stats in the
+// process-wide datastore. See DataStore.CountUnreportedTunnelStats.
+func CountUnreportedTunnelStats() int {
+	return singleton.store.CountUnreportedTunnelStats()
+}
+
 // CountUnreportedTunnelStats returns the number of tunnel
 // stats records in StateUnreported.
-func CountUnreportedTunnelStats() int {
-	checkInitDataStore()
+func (store *DataStore) CountUnreportedTunnelStats() int {
+	store = store.get()
 
 	unreported := 0
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(tunnelStatsBucket))
 		cursor := bucket.Cursor()
 		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
@@ -858,25 +1368,31 @@ func CountUnreportedTunnelStats() int {
 	})
 
 	if err != nil {
-		NoticeAlert("CountUnreportedTunnelStats failed: %s", err)
+		store.notices.Alert("CountUnreportedTunnelStats failed: %s", err)
 		return 0
 	}
 
 	return unreported
 }
 
+// TakeOutUnreportedTunnelStats takes out unreported tunnel stats from the
+// process-wide datastore. See DataStore.TakeOutUnreportedTunnelStats.
+func TakeOutUnreportedTunnelStats(maxCount int) ([][]byte, error) {
+	return singleton.store.TakeOutUnreportedTunnelStats(maxCount)
+}
+
 // TakeOutUnreportedTunnelStats returns up to maxCount tunnel
 // stats records that are in StateUnreported. The records are set
 // to StateReporting. If the records are successfully reported,
 // clear them with ClearReportedTunnelStats. If the records are
 // not successfully reported, restore them with
 // PutBackUnreportedTunnelStats.
-func TakeOutUnreportedTunnelStats(maxCount int) ([][]byte, error) {
-	checkInitDataStore()
+func (store *DataStore) TakeOutUnreportedTunnelStats(maxCount int) ([][]byte, error) {
+	store = store.get()
 
 	tunnelStats := make([][]byte, 0)
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(tunnelStatsBucket))
 		cursor := bucket.Cursor()
 		for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
@@ -886,7 +1402,7 @@ func TakeOutUnreportedTunnelStats(maxCount int) ([][]byte, error) {
 			var jsonData interface{}
 			err := json.Unmarshal(key, &jsonData)
 			if err != nil {
-				NoticeAlert(
+				store.notices.Alert(
 					"Invalid key in TakeOutUnreportedTunnelStats: %s: %s",
 					string(key), err)
 				continue
@@ -918,12 +1434,18 @@ func TakeOutUnreportedTunnelStats(maxCount int) ([][]byte, error) {
 	return tunnelStats, nil
 }
 
+// PutBackUnreportedTunnelStats restores tunnel stats to unreported in the
+// process-wide datastore. See DataStore.PutBackUnreportedTunnelStats.
+func PutBackUnreportedTunnelStats(tunnelStats [][]byte) error {
+	return singleton.store.PutBackUnreportedTunnelStats(tunnelStats)
+}
+
 // PutBackUnreportedTunnelStats restores a list of tunnel
 // stats records to StateUnreported.
-func PutBackUnreportedTunnelStats(tunnelStats [][]byte) error {
-	checkInitDataStore()
+func (store *DataStore) PutBackUnreportedTunnelStats(tunnelStats [][]byte) error {
+	store = store.get()
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(tunnelStatsBucket))
 		for _, key := range tunnelStats {
 			err := bucket.Put(key, tunnelStatsStateUnreported)
@@ -940,12 +1462,18 @@ func PutBackUnreportedTunnelStats(tunnelStats [][]byte) error {
 	return nil
 }
 
+// ClearReportedTunnelStats deletes reported tunnel stats from the process-
+// wide datastore. See DataStore.ClearReportedTunnelStats.
+func ClearReportedTunnelStats(tunnelStats [][]byte) error {
+	return singleton.store.ClearReportedTunnelStats(tunnelStats)
+}
+
 // ClearReportedTunnelStats deletes a list of tunnel
 // stats records that were succesdfully reported.
-func ClearReportedTunnelStats(tunnelStats [][]byte) error {
-	checkInitDataStore()
+func (store *DataStore) ClearReportedTunnelStats(tunnelStats [][]byte) error {
+	store = store.get()
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(tunnelStatsBucket))
 		for _, key := range tunnelStats {
 			err := bucket.Delete(key)
@@ -967,10 +1495,10 @@ func ClearReportedTunnelStats(tunnelStats [][]byte) error {
 // when the datastore is initialized at start up, as we do
 // not know if tunnel records in StateReporting were reported
 // or not.
-func resetAllTunnelStatsToUnreported() error {
-	checkInitDataStore()
+func (store *DataStore) resetAllTunnelStatsToUnreported() error {
+	store = store.get()
 
-	err := singleton.db.Update(func(tx *bolt.Tx) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(tunnelStatsBucket))
 		resetKeys := make([][]byte, 0)
 		cursor := bucket.Cursor()
@@ -0,0 +1,624 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Inc/dns"
+)
+
+// DnsProxy is a local DNS server which resolves names through the tunnel.
+// It accepts queries over both UDP and TCP. In whole device configurations,
+// where DNS traffic is directed to the DNS proxy, this ensures that DNS
+// queries don't leak outside of the tunnel.
+//
+// Queries are sent through the tunnel over udpgw, with the transparent DNS
+// flag, when a udpgw server address is configured; otherwise, over a TCP
+// port forward to the configured resolver. Responses are cached for their
+// TTL.
+//
+// When split tunnel mode is on and an untunneled resolver is configured,
+// names which resolve to domestic addresses are resolved again directly;
+// see Config.DnsProxyUntunneledResolverAddress.
+type DnsProxy struct {
+	tunneler               Tunneler
+	resolver               *dnsResolver
+	accessControl          *localProxyAccessControl
+	packetConn             net.PacketConn
+	listener               net.Listener
+	serveWaitGroup         *sync.WaitGroup
+	openConns              *Conns
+	stopListeningBroadcast chan struct{}
+	notices                *Notices
+}
+
+var _DNS_PROXY_TYPE = "DNS"
+
+// NewDnsProxy initializes and runs a new DNS proxy, listening for UDP and
+// TCP queries on the same port. When LocalDnsProxyPort is 0, the system
+// selects a free port. splitTunnelClassifier may be nil, in which case all
+// queries are resolved through the tunnel.
+func NewDnsProxy(
+	config *Config,
+	untunneledDialConfig *DialConfig,
+	tunneler Tunneler,
+	splitTunnelClassifier *SplitTunnelClassifier,
+	listenIP string) (proxy *DnsProxy, err error) {
+
+	packetConn, err := net.ListenPacket(
+		"udp", fmt.Sprintf("%s:%d", listenIP, config.LocalDnsProxyPort))
+	if err != nil {
+		if IsAddressInUseError(err) {
+			config.notices.DnsProxyPortInUse(config.LocalDnsProxyPort)
+		}
+		return nil, ContextError(err)
+	}
+
+	// The TCP listener uses the UDP port, which the system may have selected.
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		packetConn.Close()
+		if IsAddressInUseError(err) {
+			config.notices.DnsProxyPortInUse(config.LocalDnsProxyPort)
+		}
+		return nil, ContextError(err)
+	}
+
+	proxy = &DnsProxy{
+		tunneler:      tunneler,
+		resolver:      newDnsResolver(config, untunneledDialConfig, tunneler, splitTunnelClassifier),
+		accessControl: config.localProxyAccessControl,
+		packetConn:    packetConn,
+		listener: newLocalProxyListener(
+			listener, config.localProxyAccessControl, _DNS_PROXY_TYPE, config.notices),
+		serveWaitGroup:         new(sync.WaitGroup),
+		openConns:              new(Conns),
+		stopListeningBroadcast: make(chan struct{}),
+		notices:                config.notices,
+	}
+	proxy.serveWaitGroup.Add(2)
+	go proxy.serveUDP()
+	go proxy.serveTCP()
+
+	config.notices.ListeningDnsProxyPort(packetConn.LocalAddr().(*net.UDPAddr).Port)
+
+	return proxy, nil
+}
+
+// Close terminates the DNS proxy.
+func (proxy *DnsProxy) Close() {
+	close(proxy.stopListeningBroadcast)
+	proxy.packetConn.Close()
+	proxy.listener.Close()
+	proxy.serveWaitGroup.Wait()
+	proxy.openConns.CloseAll()
+}
+
+func (proxy *DnsProxy) serveUDP() {
+	defer proxy.packetConn.Close()
+	defer proxy.serveWaitGroup.Done()
+
+	buffer := make([]byte, dns.MaxMsgSize)
+	for {
+		// Note: will be interrupted by packetConn.Close() call made by proxy.Close()
+		n, addr, err := proxy.packetConn.ReadFrom(buffer)
+		select {
+		case <-proxy.stopListeningBroadcast:
+			return
+		default:
+		}
+		if err != nil {
+			proxy.notices.Alert("DNS proxy read error: %s", err)
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			proxy.tunneler.SignalComponentFailure()
+			return
+		}
+		if !proxy.accessControl.isAllowedSource(addr) {
+			continue
+		}
+
+		query := new(dns.Msg)
+		err = query.Unpack(buffer[:n])
+		if err != nil {
+			proxy.notices.LocalProxyError(_DNS_PROXY_TYPE, ContextError(err))
+			continue
+		}
+
+		proxy.resolver.resolveAsync(query, func(response *dns.Msg) {
+			packedResponse, err := packUDPDnsResponse(query, response)
+			if err != nil {
+				proxy.notices.LocalProxyError(_DNS_PROXY_TYPE, ContextError(err))
+				return
+			}
+			proxy.packetConn.WriteTo(packedResponse, addr)
+		})
+	}
+}
+
+// packUDPDnsResponse packs a response to a UDP query. When the response is
+// larger than the client's UDP payload size, it's truncated so that the
+// client retries over TCP.
+func packUDPDnsResponse(query, response *dns.Msg) ([]byte, error) {
+
+	maxSize := dns.MinMsgSize
+	if opt := query.IsEdns0(); opt != nil && int(opt.UDPSize()) > maxSize {
+		maxSize = int(opt.UDPSize())
+	}
+
+	packedResponse, err := response.Pack()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if len(packedResponse) <= maxSize {
+		return packedResponse, nil
+	}
+
+	response.Truncated = true
+	response.Answer = nil
+	response.Ns = nil
+	response.Extra = nil
+	packedResponse, err = response.Pack()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return packedResponse, nil
+}
+
+func (proxy *DnsProxy) serveTCP() {
+	defer proxy.listener.Close()
+	defer proxy.serveWaitGroup.Done()
+	for {
+		// Note: will be interrupted by listener.Close() call made by proxy.Close()
+		conn, err := proxy.listener.Accept()
+		select {
+		case <-proxy.stopListeningBroadcast:
+			return
+		default:
+		}
+		if err != nil {
+			proxy.notices.Alert("DNS proxy accept error: %s", err)
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			proxy.tunneler.SignalComponentFailure()
+			return
+		}
+		go func() {
+			err := proxy.tcpConnectionHandler(conn)
+			if err != nil {
+				proxy.notices.LocalProxyError(_DNS_PROXY_TYPE, ContextError(err))
+			}
+		}()
+	}
+}
+
+// tcpConnectionHandler answers the queries sent on one TCP connection,
+// until the client closes the connection or it's idle for
+// DNS_PROXY_TCP_IDLE_TIMEOUT.
+func (proxy *DnsProxy) tcpConnectionHandler(conn net.Conn) error {
+	defer conn.Close()
+	defer proxy.openConns.Remove(conn)
+	proxy.openConns.Add(conn)
+
+	dnsConn := &dns.Conn{Conn: conn}
+	for {
+		conn.SetDeadline(time.Now().Add(DNS_PROXY_TCP_IDLE_TIMEOUT))
+		query, err := dnsConn.ReadMsg()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return ContextError(err)
+		}
+
+		response := proxy.resolver.resolve(query)
+
+		conn.SetDeadline(time.Now().Add(DNS_PROXY_TCP_IDLE_TIMEOUT))
+		err = dnsConn.WriteMsg(response)
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+}
+
+// dnsResolver resolves DNS queries through the tunnel, with caching, as
+// described in the DnsProxy comment. It's shared by DnsProxy and
+// PacketTunnel.
+type dnsResolver struct {
+	tunneler                  Tunneler
+	splitTunnelClassifier     *SplitTunnelClassifier
+	untunneledDialConfig      *DialConfig
+	resolverAddress           string
+	udpgwServerAddress        string
+	untunneledResolverAddress string
+	cache                     *dnsCache
+	pendingQueries            chan struct{}
+	notices                   *Notices
+}
+
+// newDnsResolver creates a dnsResolver. splitTunnelClassifier may be nil, in
+// which case all queries are resolved through the tunnel.
+func newDnsResolver(
+	config *Config,
+	untunneledDialConfig *DialConfig,
+	tunneler Tunneler,
+	splitTunnelClassifier *SplitTunnelClassifier) *dnsResolver {
+
+	resolverAddress := config.DnsProxyResolverAddress
+	if resolverAddress == "" {
+		resolverAddress = DNS_PROXY_RESOLVER_ADDRESS
+	}
+
+	return &dnsResolver{
+		tunneler:                  tunneler,
+		splitTunnelClassifier:     splitTunnelClassifier,
+		untunneledDialConfig:      untunneledDialConfig,
+		resolverAddress:           resolverAddress,
+		udpgwServerAddress:        config.UdpgwServerAddress,
+		untunneledResolverAddress: config.DnsProxyUntunneledResolverAddress,
+		cache:                     newDnsCache(),
+		pendingQueries:            make(chan struct{}, DNS_PROXY_MAX_PENDING_QUERIES),
+		notices:                   config.notices,
+	}
+}
+
+// resolveAsync resolves the query in a new goroutine and calls
+// handleResponse with the response. At most DNS_PROXY_MAX_PENDING_QUERIES
+// queries, received as datagrams, are resolved at once; beyond that, the
+// query is dropped, as a lost datagram would be, and the client retries.
+func (resolver *dnsResolver) resolveAsync(query *dns.Msg, handleResponse func(*dns.Msg)) {
+	select {
+	case resolver.pendingQueries <- *new(struct{}):
+	default:
+		return
+	}
+	go func() {
+		defer func() { <-resolver.pendingQueries }()
+		handleResponse(resolver.resolve(query))
+	}()
+}
+
+// resolve returns the response to a query, from the cache or by sending the
+// query through the tunnel. resolve always returns a response, which has a
+// failure response code when the query can't be resolved.
+func (resolver *dnsResolver) resolve(query *dns.Msg) *dns.Msg {
+
+	if query.Response || query.Opcode != dns.OpcodeQuery {
+		return new(dns.Msg).SetRcode(query, dns.RcodeNotImplemented)
+	}
+	if len(query.Question) != 1 {
+		return new(dns.Msg).SetRcodeFormatError(query)
+	}
+
+	response := resolver.cache.get(query.Question[0])
+	if response == nil {
+		var err error
+		response, err = resolver.forward(query)
+		if err != nil {
+			resolver.notices.LocalProxyError(_DNS_PROXY_TYPE, ContextError(err))
+			return new(dns.Msg).SetRcode(query, dns.RcodeServerFailure)
+		}
+		resolver.cache.put(query.Question[0], response)
+	}
+
+	response.Id = query.Id
+	return response
+}
+
+// forward sends the query through the tunnel and, for domestic names when
+// an untunneled resolver is configured, sends the query again directly.
+func (resolver *dnsResolver) forward(query *dns.Msg) (*dns.Msg, error) {
+
+	var response *dns.Msg
+	var err error
+	if resolver.udpgwServerAddress != "" {
+		response, err = resolver.exchangeUdpgw(query)
+	} else {
+		response, err = resolver.exchangeTunneled(query)
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if resolver.untunneledResolverAddress != "" && resolver.isDomestic(response) {
+
+		untunneledResponse, err := resolver.exchangeUntunneled(query)
+		if err == nil {
+			return untunneledResponse, nil
+		}
+
+		// Fall back to the tunneled response.
+		resolver.notices.LocalProxyError(_DNS_PROXY_TYPE, ContextError(err))
+	}
+
+	return response, nil
+}
+
+// isDomestic indicates whether the response contains an IPv4 address which
+// is within the split tunnel routes.
+func (resolver *dnsResolver) isDomestic(response *dns.Msg) bool {
+	if resolver.splitTunnelClassifier == nil || !resolver.splitTunnelClassifier.hasRoutes() {
+		return false
+	}
+	for _, record := range response.Answer {
+		if a, ok := record.(*dns.A); ok && resolver.splitTunnelClassifier.ipAddressInRoutes(a.A) {
+			return true
+		}
+	}
+	return false
+}
+
+// exchangeTunneled sends the query over a TCP port forward to the resolver.
+func (resolver *dnsResolver) exchangeTunneled(query *dns.Msg) (*dns.Msg, error) {
+
+	// Dial's alwaysTunnel is set to true to ensure this connection is
+	// tunneled and not subject to split tunnel classification.
+	conn, err := resolver.tunneler.Dial(resolver.resolverAddress, true, nil)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	response, err := exchangeDnsQuery(conn, query)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return response, nil
+}
+
+// exchangeUntunneled sends the query over a direct TCP connection to the
+// untunneled resolver.
+func (resolver *dnsResolver) exchangeUntunneled(query *dns.Msg) (*dns.Msg, error) {
+
+	dialConfig := *resolver.untunneledDialConfig
+	dialConfig.ConnectTimeout = DNS_PROXY_QUERY_TIMEOUT
+	conn, err := DialTCP(resolver.untunneledResolverAddress, &dialConfig)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	response, err := exchangeDnsQuery(conn, query)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return response, nil
+}
+
+// exchangeDnsQuery sends the query on conn, using the TCP DNS message
+// framing, and reads the response. conn is closed when the exchange
+// completes or after DNS_PROXY_QUERY_TIMEOUT, as port forward conns don't
+// support deadlines.
+func exchangeDnsQuery(conn net.Conn, query *dns.Msg) (*dns.Msg, error) {
+
+	timer := time.AfterFunc(DNS_PROXY_QUERY_TIMEOUT, func() { conn.Close() })
+	defer timer.Stop()
+
+	dnsConn := &dns.Conn{Conn: conn}
+	defer dnsConn.Close()
+
+	err := dnsConn.WriteMsg(query)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	for {
+		response, err := dnsConn.ReadMsg()
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		if response.Id == query.Id {
+			return response, nil
+		}
+	}
+}
+
+// exchangeUdpgw sends the query through udpgw, with the transparent DNS
+// flag, and reads the response.
+func (resolver *dnsResolver) exchangeUdpgw(query *dns.Msg) (*dns.Msg, error) {
+
+	host, portString, err := net.SplitHostPort(resolver.resolverAddress)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	resolverAddr := &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+
+	packedQuery, err := query.Pack()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	// The udpgw server address is a special address which must be tunneled
+	// and not subject to split tunnel classification.
+	conn, err := resolver.tunneler.Dial(resolver.udpgwServerAddress, true, nil)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	defer conn.Close()
+
+	timer := time.AfterFunc(DNS_PROXY_QUERY_TIMEOUT, func() { conn.Close() })
+	defer timer.Stop()
+
+	udpgw := newUdpgwClient(conn)
+	err = udpgw.sendDNS(resolverAddr, packedQuery)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	buffer := make([]byte, udpgwProtocolMaxMessageSize)
+	for {
+		_, packet, err := udpgw.receive(buffer)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		response := new(dns.Msg)
+		err = response.Unpack(packet)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		if response.Id == query.Id {
+			return response, nil
+		}
+	}
+}
+
+// dnsCache caches DNS responses, keyed by question, until their TTL expires.
+// At most DNS_PROXY_CACHE_MAX_ENTRIES responses are cached.
+type dnsCache struct {
+	mutex   sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+}
+
+type dnsCacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+type dnsCacheEntry struct {
+	response   *dns.Msg
+	storedTime time.Time
+	expiry     time.Time
+}
+
+func newDnsCache() *dnsCache {
+	return &dnsCache{
+		entries: make(map[dnsCacheKey]*dnsCacheEntry),
+	}
+}
+
+func makeDnsCacheKey(question dns.Question) dnsCacheKey {
+	return dnsCacheKey{
+		name:   strings.ToLower(question.Name),
+		qtype:  question.Qtype,
+		qclass: question.Qclass,
+	}
+}
+
+// get returns a copy of the cached response to the question, with its TTLs
+// reduced by the time it's been cached, or nil when there's no unexpired
+// cached response.
+func (cache *dnsCache) get(question dns.Question) *dns.Msg {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	key := makeDnsCacheKey(question)
+	entry, ok := cache.entries[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if !now.Before(entry.expiry) {
+		delete(cache.entries, key)
+		return nil
+	}
+
+	// All record TTLs are at least the cache TTL, so this doesn't underflow.
+	elapsed := uint32(now.Sub(entry.storedTime) / time.Second)
+	response := entry.response.Copy()
+	for _, records := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range records {
+			header := record.Header()
+			if header.Rrtype != dns.TypeOPT {
+				header.Ttl -= elapsed
+			}
+		}
+	}
+	return response
+}
+
+// put caches a copy of the response to the question, when it's cacheable.
+func (cache *dnsCache) put(question dns.Question, response *dns.Msg) {
+
+	ttl, ok := getDnsResponseTTL(response)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now := time.Now()
+	if len(cache.entries) >= DNS_PROXY_CACHE_MAX_ENTRIES {
+		for key, entry := range cache.entries {
+			if !now.Before(entry.expiry) {
+				delete(cache.entries, key)
+			}
+		}
+	}
+	if len(cache.entries) >= DNS_PROXY_CACHE_MAX_ENTRIES {
+		// Evict an arbitrary entry.
+		for key := range cache.entries {
+			delete(cache.entries, key)
+			break
+		}
+	}
+
+	cache.entries[makeDnsCacheKey(question)] = &dnsCacheEntry{
+		response:   response.Copy(),
+		storedTime: now,
+		expiry:     now.Add(ttl),
+	}
+}
+
+// getDnsResponseTTL returns the time for which a response may be cached:
+// the minimum TTL of its records, where, as in RFC 2308, the TTL of an SOA
+// record is limited by its minimum field. Only complete NOERROR and NXDOMAIN
+// responses with records are cacheable.
+func getDnsResponseTTL(response *dns.Msg) (time.Duration, bool) {
+
+	if response.Truncated ||
+		(response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError) {
+		return 0, false
+	}
+
+	var minTTL uint32
+	hasTTL := false
+	for _, records := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, record := range records {
+			header := record.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			ttl := header.Ttl
+			if soa, ok := record.(*dns.SOA); ok && soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			if !hasTTL || ttl < minTTL {
+				minTTL = ttl
+				hasTTL = true
+			}
+		}
+	}
+	if !hasTTL {
+		return 0, false
+	}
+	return time.Duration(minTTL) * time.Second, true
+}
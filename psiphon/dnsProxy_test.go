@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Inc/dns"
+)
+
+// makeTestDnsResponse answers A queries for "large.example." with many
+// records, queries for "missing.example." with NXDOMAIN, and other A
+// queries with 192.0.2.1.
+func makeTestDnsResponse(query *dns.Msg) *dns.Msg {
+	response := new(dns.Msg).SetReply(query)
+	name := query.Question[0].Name
+	switch name {
+	case "missing.example.":
+		response.Rcode = dns.RcodeNameError
+		response.Ns = []dns.RR{&dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:     "ns.example.",
+			Mbox:   "hostmaster.example.",
+			Minttl: 30,
+		}}
+	default:
+		count := 1
+		if name == "large.example." {
+			count = 100
+		}
+		for i := 0; i < count; i++ {
+			response.Answer = append(response.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(192, 0, 2, byte(1+i)),
+			})
+		}
+	}
+	return response
+}
+
+func TestDnsProxy(t *testing.T) {
+
+	var queryCount int32
+	resolver := runTestServer(t, func(conn net.Conn) {
+		dnsConn := &dns.Conn{Conn: conn}
+		query, err := dnsConn.ReadMsg()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&queryCount, 1)
+		if query.Question[0].Name == "fail.example." {
+			return
+		}
+		dnsConn.WriteMsg(makeTestDnsResponse(query))
+	})
+	defer resolver.Close()
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+	config.DnsProxyResolverAddress = resolver.Addr().String()
+
+	proxy, err := NewDnsProxy(config, &DialConfig{}, testTunneler{}, nil, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewDnsProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	proxyAddress := proxy.packetConn.LocalAddr().String()
+
+	exchange := func(network, name string) *dns.Msg {
+		query := new(dns.Msg)
+		query.SetQuestion(name, dns.TypeA)
+		client := &dns.Client{Net: network, Timeout: 5 * time.Second}
+		response, _, err := client.Exchange(query, proxyAddress)
+		if err != nil {
+			t.Fatalf("Exchange failed: %s", err)
+		}
+		return response
+	}
+
+	response := exchange("udp", "www.example.")
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 ||
+		!response.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("unexpected response: %s", response)
+	}
+
+	// The second query, over TCP and with a different name case, is
+	// answered from the cache
+	response = exchange("tcp", "WWW.example.")
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 ||
+		response.Answer[0].Header().Ttl > 60 {
+		t.Errorf("unexpected response: %s", response)
+	}
+	if atomic.LoadInt32(&queryCount) != 1 {
+		t.Errorf("unexpected query count: %d", atomic.LoadInt32(&queryCount))
+	}
+
+	// Negative responses are cached for the SOA minimum TTL
+	response = exchange("udp", "missing.example.")
+	if response.Rcode != dns.RcodeNameError {
+		t.Errorf("unexpected response: %s", response)
+	}
+	ttl, ok := getDnsResponseTTL(response)
+	if !ok || ttl != 30*time.Second {
+		t.Errorf("unexpected TTL: %s, %t", ttl, ok)
+	}
+
+	// Large UDP responses are truncated, and complete over TCP. The header
+	// of the truncated response is checked directly, as the DNS client
+	// fails to exchange truncated responses.
+	conn, err := net.Dial("udp", proxyAddress)
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	query := new(dns.Msg)
+	query.SetQuestion("large.example.", dns.TypeA)
+	packedQuery, _ := query.Pack()
+	conn.Write(packedQuery)
+	packedResponse := make([]byte, dns.MaxMsgSize)
+	n, err := conn.Read(packedResponse)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	// | ID | flags | QDCOUNT | ANCOUNT | ...
+	if n > dns.MinMsgSize || packedResponse[2]&0x02 == 0 ||
+		binary.BigEndian.Uint16(packedResponse[6:8]) != 0 {
+		t.Errorf("unexpected truncated response: %x", packedResponse[:n])
+	}
+	response = exchange("tcp", "large.example.")
+	if response.Truncated || len(response.Answer) != 100 {
+		t.Errorf("unexpected response: %s", response)
+	}
+
+	// Failures aren't cached
+	for i := 0; i < 2; i++ {
+		response = exchange("udp", "fail.example.")
+		if response.Rcode != dns.RcodeServerFailure {
+			t.Errorf("unexpected response: %s", response)
+		}
+	}
+	// The TCP query for "large.example." is answered from the cache
+	if atomic.LoadInt32(&queryCount) != 5 {
+		t.Errorf("unexpected query count: %d", atomic.LoadInt32(&queryCount))
+	}
+}
+
+func TestDnsProxyUdpgw(t *testing.T) {
+
+	// The fake udpgw server answers DNS queries which have the transparent
+	// DNS flag.
+	udpgwServer := runTestServer(t, func(conn net.Conn) {
+		buffer := make([]byte, udpgwProtocolMaxMessageSize)
+		for {
+			_, err := io.ReadFull(conn, buffer[0:2])
+			if err != nil {
+				return
+			}
+			size := int(binary.LittleEndian.Uint16(buffer[0:2]))
+			_, err = io.ReadFull(conn, buffer[2:2+size])
+			if err != nil {
+				return
+			}
+			flags := buffer[2]
+			if flags&udpgwProtocolFlagDNS == 0 || flags&udpgwProtocolFlagIPv6 != 0 {
+				return
+			}
+			preambleSize := 2 + 3 + net.IPv4len + 2
+			query := new(dns.Msg)
+			err = query.Unpack(buffer[preambleSize : 2+size])
+			if err != nil {
+				return
+			}
+			packedResponse, err := makeTestDnsResponse(query).Pack()
+			if err != nil {
+				return
+			}
+			message := append([]byte(nil), buffer[0:preambleSize]...)
+			message = append(message, packedResponse...)
+			binary.LittleEndian.PutUint16(message[0:2], uint16(len(message)-2))
+			message[2] = 0
+			conn.Write(message)
+		}
+	})
+	defer udpgwServer.Close()
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+	config.UdpgwServerAddress = udpgwServer.Addr().String()
+
+	proxy, err := NewDnsProxy(config, &DialConfig{}, testTunneler{}, nil, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewDnsProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	response, err := dns.Exchange(query, proxy.packetConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Exchange failed: %s", err)
+	}
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 1 {
+		t.Errorf("unexpected response: %s", response)
+	}
+}
+
+func TestDnsResolverPendingQueries(t *testing.T) {
+
+	// A resolver address which refuses connections fails queries quickly
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	listener.Close()
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+	config.DnsProxyResolverAddress = listener.Addr().String()
+	resolver := newDnsResolver(config, &DialConfig{}, testTunneler{}, nil)
+
+	responses := make(chan *dns.Msg, 1)
+	handleResponse := func(response *dns.Msg) { responses <- response }
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+
+	// Queries beyond the pending query limit are dropped
+	for i := 0; i < DNS_PROXY_MAX_PENDING_QUERIES; i++ {
+		resolver.pendingQueries <- *new(struct{})
+	}
+	resolver.resolveAsync(query, handleResponse)
+	select {
+	case <-responses:
+		t.Fatalf("query should be dropped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	<-resolver.pendingQueries
+	resolver.resolveAsync(query, handleResponse)
+	select {
+	case response := <-responses:
+		if response.Rcode != dns.RcodeServerFailure {
+			t.Errorf("unexpected response: %s", response)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("query should be resolved")
+	}
+}
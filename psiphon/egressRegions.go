@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+)
+
+// EgressRegionFilter selects servers by egress region. Servers in the
+// preferred regions are selected in the order of preference; with no
+// preferred regions, servers in any region are selected. Servers in the
+// excluded regions are never selected. A nil *EgressRegionFilter selects
+// servers in any region.
+type EgressRegionFilter struct {
+	PreferredRegions []string
+	ExcludedRegions  []string
+
+	// allowOtherRegions is set when falling back to servers in regions
+	// which aren't preferred; see withFallback.
+	allowOtherRegions bool
+}
+
+// NewEgressRegionFilter creates an EgressRegionFilter. egressRegion, when
+// not "", is the most preferred region, ahead of preferredRegions.
+func NewEgressRegionFilter(
+	egressRegion string, preferredRegions, excludedRegions []string) *EgressRegionFilter {
+
+	filter := &EgressRegionFilter{
+		PreferredRegions: make([]string, 0),
+		ExcludedRegions:  append([]string(nil), excludedRegions...),
+	}
+	for _, region := range append([]string{egressRegion}, preferredRegions...) {
+		if region != "" && !Contains(filter.PreferredRegions, region) {
+			filter.PreferredRegions = append(filter.PreferredRegions, region)
+		}
+	}
+	return filter
+}
+
+// GetEgressRegionFilter returns the filter specified by EgressRegion,
+// EgressRegions, and ExcludedEgressRegions.
+func (config *Config) GetEgressRegionFilter() *EgressRegionFilter {
+	return NewEgressRegionFilter(
+		config.EgressRegion, config.EgressRegions, config.ExcludedEgressRegions)
+}
+
+// validate checks that no preferred region is also excluded.
+func (filter *EgressRegionFilter) validate() error {
+	for _, region := range filter.PreferredRegions {
+		if Contains(filter.ExcludedRegions, region) {
+			return ContextError(errors.New("preferred egress region is excluded"))
+		}
+	}
+	return nil
+}
+
+// Allows indicates whether servers in the specified region may be selected.
+func (filter *EgressRegionFilter) Allows(region string) bool {
+	if filter == nil {
+		return true
+	}
+	if Contains(filter.ExcludedRegions, region) {
+		return false
+	}
+	return filter.allowOtherRegions ||
+		len(filter.PreferredRegions) == 0 ||
+		Contains(filter.PreferredRegions, region)
+}
+
+// isFiltering indicates whether the filter may reject or reorder servers.
+func (filter *EgressRegionFilter) isFiltering() bool {
+	return filter != nil &&
+		(len(filter.PreferredRegions) > 0 || len(filter.ExcludedRegions) > 0)
+}
+
+// getMostPreferredRegion returns the first preferred region, or "" when
+// servers in any region are selected.
+func (filter *EgressRegionFilter) getMostPreferredRegion() string {
+	if filter == nil || len(filter.PreferredRegions) == 0 {
+		return ""
+	}
+	return filter.PreferredRegions[0]
+}
+
+// preference ranks the region in the order of preference, where 0 is the
+// most preferred. Regions which aren't preferred rank after all preferred
+// regions.
+func (filter *EgressRegionFilter) preference(region string) int {
+	if filter == nil {
+		return 0
+	}
+	for i, preferredRegion := range filter.PreferredRegions {
+		if region == preferredRegion {
+			return i
+		}
+	}
+	return len(filter.PreferredRegions)
+}
+
+// withFallback returns a filter which also selects servers in any region
+// which isn't excluded, after servers in the preferred regions. Returns
+// nil when the filter has no preferred regions, as there's nothing to fall
+// back from.
+func (filter *EgressRegionFilter) withFallback() *EgressRegionFilter {
+	if filter == nil || len(filter.PreferredRegions) == 0 || filter.allowOtherRegions {
+		return nil
+	}
+	fallbackFilter := *filter
+	fallbackFilter.allowOtherRegions = true
+	return &fallbackFilter
+}
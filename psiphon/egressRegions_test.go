@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEgressRegionFilter(t *testing.T) {
+
+	filter := NewEgressRegionFilter("US", []string{"CA", "US", "GB"}, []string{"DE"})
+	if fmt.Sprintf("%v", filter.PreferredRegions) != "[US CA GB]" {
+		t.Errorf("unexpected preferred regions: %v", filter.PreferredRegions)
+	}
+	if !filter.Allows("CA") || filter.Allows("DE") || filter.Allows("FR") {
+		t.Errorf("unexpected allowed regions")
+	}
+	if filter.preference("US") != 0 || filter.preference("GB") != 2 || filter.preference("FR") != 3 {
+		t.Errorf("unexpected region preferences")
+	}
+
+	// Falling back allows any region which isn't excluded
+	fallbackFilter := filter.withFallback()
+	if fallbackFilter == nil || !fallbackFilter.Allows("FR") || fallbackFilter.Allows("DE") {
+		t.Errorf("unexpected fallback allowed regions")
+	}
+	if filter.Allows("FR") {
+		t.Errorf("falling back should not change the original filter")
+	}
+	if NewEgressRegionFilter("", nil, []string{"DE"}).withFallback() != nil {
+		t.Errorf("unexpected fallback without preferred regions")
+	}
+
+	var nilFilter *EgressRegionFilter
+	if !nilFilter.Allows("DE") || nilFilter.isFiltering() {
+		t.Errorf("nil filter should allow any region")
+	}
+
+	if NewEgressRegionFilter("DE", nil, []string{"DE"}).validate() == nil {
+		t.Errorf("a preferred region should not be excluded")
+	}
+}
+
+func TestEgressRegionIterator(t *testing.T) {
+
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon-egress-regions-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataStoreDirectory)
+
+	config, err := LoadConfig([]byte(`
+		{
+			"PropagationChannelId": "0",
+			"SponsorId": "0",
+			"EgressRegions": ["US", "CA"],
+			"ExcludedEgressRegions": ["DE"]
+		}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = dataStoreDirectory
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+
+	config.dataStore, err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer config.dataStore.Close()
+
+	regions := []string{"CA", "US", "GB", "DE"}
+	for i := 0; i < 8; i++ {
+		err := config.dataStore.StoreServerEntry(
+			&ServerEntry{
+				IpAddress: fmt.Sprintf("192.0.2.%d", i+1),
+				Region:    regions[i%len(regions)],
+			},
+			false)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	if count := config.dataStore.CountServerEntriesInRegions(config.GetEgressRegionFilter(), ""); count != 4 {
+		t.Errorf("unexpected server entry count: %d", count)
+	}
+
+	iterator, err := NewServerEntryIterator(config)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	defer iterator.Close()
+
+	iterate := func() string {
+		iteratedRegions := ""
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				return iteratedRegions
+			}
+			iteratedRegions += serverEntry.Region
+		}
+	}
+
+	if iteratedRegions := iterate(); iteratedRegions != "USUSCACA" {
+		t.Errorf("unexpected iterated regions: %s", iteratedRegions)
+	}
+
+	if !iterator.enableEgressRegionFallback() {
+		t.Fatalf("enableEgressRegionFallback failed")
+	}
+	iterator.Reset()
+	if iteratedRegions := iterate(); iteratedRegions != "USUSCACAGBGB" {
+		t.Errorf("unexpected iterated fallback regions: %s", iteratedRegions)
+	}
+}
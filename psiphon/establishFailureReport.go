@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The error categories of failed tunnel establishment attempts, as
+// reported in EstablishFailureReport.
+const (
+	ESTABLISH_ERROR_CONNECTION_RESET            = "CONNECTION_RESET"
+	ESTABLISH_ERROR_CONNECTION_REFUSED          = "CONNECTION_REFUSED"
+	ESTABLISH_ERROR_TIMEOUT                     = "TIMEOUT"
+	ESTABLISH_ERROR_TLS_ALERT                   = "TLS_ALERT"
+	ESTABLISH_ERROR_SSH_AUTH_FAILURE            = "SSH_AUTH_FAILURE"
+	ESTABLISH_ERROR_UPSTREAM_PROXY_AUTH_FAILURE = "UPSTREAM_PROXY_AUTH_FAILURE"
+	ESTABLISH_ERROR_UPSTREAM_PROXY_FAILURE      = "UPSTREAM_PROXY_FAILURE"
+	ESTABLISH_ERROR_DNS_FAILURE                 = "DNS_FAILURE"
+	ESTABLISH_ERROR_NO_NETWORK                  = "NO_NETWORK"
+	ESTABLISH_ERROR_OTHER                       = "OTHER"
+)
+
+// The remote server list fetch outcomes reported in EstablishFailureReport.
+const (
+	REMOTE_SERVER_LIST_FETCH_DISABLED      = "DISABLED"
+	REMOTE_SERVER_LIST_FETCH_NOT_ATTEMPTED = "NOT_ATTEMPTED"
+	REMOTE_SERVER_LIST_FETCH_SUCCEEDED     = "SUCCEEDED"
+	REMOTE_SERVER_LIST_FETCH_FAILED        = "FAILED"
+)
+
+// EstablishFailureReport summarizes the tunnel establishment attempts made
+// by a controller, to explain why no tunnel could be established. It's
+// emitted in an EstablishFailureReport notice when EstablishTunnelTimeoutSeconds
+// expires, and is available at any time with Controller.GetEstablishFailureReport,
+// for example to attach to feedback.
+//
+// Candidates counts the attempts for each tunnel protocol and server region.
+// ErrorCategories counts failed attempts by ESTABLISH_ERROR_* category.
+// FrontingAddresses lists the meek fronting addresses which were dialed.
+// RemoteServerListFetch is the outcome, a REMOTE_SERVER_LIST_FETCH_* value,
+// of the most recent remote server list fetch. NoNetworkConnectivity is set
+// when the NetworkConnectivityChecker reports no connectivity at the time of
+// the report.
+type EstablishFailureReport struct {
+	ElapsedSeconds        int64                             `json:"elapsedSeconds"`
+	Candidates            []EstablishCandidateCount         `json:"candidates"`
+	ErrorCategories       map[string]int                    `json:"errorCategories"`
+	FrontingAddresses     []string                          `json:"frontingAddresses"`
+	RemoteServerListFetch string                            `json:"remoteServerListFetch"`
+	NoNetworkConnectivity bool                              `json:"noNetworkConnectivity"`
+	EstablishStats        map[string]EstablishProtocolStats `json:"establishStats"`
+}
+
+// EstablishCandidateCount is the number of establishment attempts made
+// with a tunnel protocol to servers in a region, and how many failed.
+type EstablishCandidateCount struct {
+	Protocol string `json:"protocol"`
+	Region   string `json:"region"`
+	Attempts int    `json:"attempts"`
+	Failures int    `json:"failures"`
+}
+
+type establishCandidateKey struct {
+	protocol string
+	region   string
+}
+
+// establishFailureRecorder accumulates the inputs to an
+// EstablishFailureReport.
+type establishFailureRecorder struct {
+	mutex                 sync.Mutex
+	startTime             time.Time
+	candidates            map[establishCandidateKey]*EstablishCandidateCount
+	errorCategories       map[string]int
+	frontingAddresses     map[string]bool
+	remoteServerListFetch string
+}
+
+func newEstablishFailureRecorder(isRemoteServerListFetchDisabled bool) *establishFailureRecorder {
+	remoteServerListFetch := REMOTE_SERVER_LIST_FETCH_NOT_ATTEMPTED
+	if isRemoteServerListFetchDisabled {
+		remoteServerListFetch = REMOTE_SERVER_LIST_FETCH_DISABLED
+	}
+	return &establishFailureRecorder{
+		startTime:             time.Now(),
+		candidates:            make(map[establishCandidateKey]*EstablishCandidateCount),
+		errorCategories:       make(map[string]int),
+		frontingAddresses:     make(map[string]bool),
+		remoteServerListFetch: remoteServerListFetch,
+	}
+}
+
+// addAttempt records a completed establishment attempt. err is nil for a
+// successful attempt.
+func (recorder *establishFailureRecorder) addAttempt(
+	serverEntry *ServerEntry, dialParameters *DialParameters, err error) {
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	key := establishCandidateKey{
+		protocol: dialParameters.TunnelProtocol,
+		region:   serverEntry.Region,
+	}
+	candidate, ok := recorder.candidates[key]
+	if !ok {
+		candidate = &EstablishCandidateCount{Protocol: key.protocol, Region: key.region}
+		recorder.candidates[key] = candidate
+	}
+	candidate.Attempts++
+
+	if dialParameters.FrontingAddress != "" {
+		recorder.frontingAddresses[dialParameters.FrontingAddress] = true
+	}
+
+	if err != nil {
+		candidate.Failures++
+		recorder.errorCategories[classifyEstablishError(err)]++
+	}
+}
+
+// setRemoteServerListFetchResult records the outcome of a remote server
+// list fetch. err is nil for a successful fetch.
+func (recorder *establishFailureRecorder) setRemoteServerListFetchResult(err error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	if err == nil {
+		recorder.remoteServerListFetch = REMOTE_SERVER_LIST_FETCH_SUCCEEDED
+	} else {
+		recorder.remoteServerListFetch = REMOTE_SERVER_LIST_FETCH_FAILED
+	}
+}
+
+// report creates a new EstablishFailureReport. The candidates are sorted
+// by protocol and region.
+func (recorder *establishFailureRecorder) report(
+	noNetworkConnectivity bool,
+	establishStats map[string]EstablishProtocolStats) *EstablishFailureReport {
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	report := &EstablishFailureReport{
+		ElapsedSeconds:        int64(time.Since(recorder.startTime) / time.Second),
+		Candidates:            make([]EstablishCandidateCount, 0),
+		ErrorCategories:       make(map[string]int),
+		FrontingAddresses:     make([]string, 0),
+		RemoteServerListFetch: recorder.remoteServerListFetch,
+		NoNetworkConnectivity: noNetworkConnectivity,
+		EstablishStats:        establishStats,
+	}
+
+	for _, candidate := range recorder.candidates {
+		report.Candidates = append(report.Candidates, *candidate)
+	}
+	sort.Sort(establishCandidateCounts(report.Candidates))
+
+	for category, count := range recorder.errorCategories {
+		report.ErrorCategories[category] = count
+	}
+
+	for frontingAddress := range recorder.frontingAddresses {
+		report.FrontingAddresses = append(report.FrontingAddresses, frontingAddress)
+	}
+	sort.Strings(report.FrontingAddresses)
+
+	return report
+}
+
+type establishCandidateCounts []EstablishCandidateCount
+
+func (counts establishCandidateCounts) Len() int      { return len(counts) }
+func (counts establishCandidateCounts) Swap(i, j int) { counts[i], counts[j] = counts[j], counts[i] }
+func (counts establishCandidateCounts) Less(i, j int) bool {
+	if counts[i].Protocol != counts[j].Protocol {
+		return counts[i].Protocol < counts[j].Protocol
+	}
+	return counts[i].Region < counts[j].Region
+}
+
+// classifyEstablishError maps an establishment error to an ESTABLISH_ERROR_*
+// category. As errors are wrapped with ContextError, which doesn't retain
+// the underlying error type, errors are classified by their messages. Only
+// specific messages are matched, as an error message may include a host
+// name or other text which happens to contain a shorter token; and timeouts
+// are checked before other causes, so that, for example, a DNS lookup which
+// times out is a timeout.
+func classifyEstablishError(err error) string {
+	message := strings.ToLower(err.Error())
+
+	contains := func(substrings ...string) bool {
+		for _, substring := range substrings {
+			if strings.Contains(message, substring) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case contains("upstreamproxy error"):
+		if contains(
+			"407 proxy authentication required",
+			"authorization is not accepted by the proxy server",
+			"no username credentials provided for proxy auth",
+			"unsupported proxy authentication scheme",
+			"rejected username/password") {
+			return ESTABLISH_ERROR_UPSTREAM_PROXY_AUTH_FAILURE
+		}
+		return ESTABLISH_ERROR_UPSTREAM_PROXY_FAILURE
+	case contains("ssh: unable to authenticate"):
+		return ESTABLISH_ERROR_SSH_AUTH_FAILURE
+	case contains(
+		"i/o timeout",
+		"timed out",
+		"dial timeout",
+		"connect timeout",
+		"handshake timeout",
+		"timeout awaiting response",
+		"client.timeout exceeded"):
+		return ESTABLISH_ERROR_TIMEOUT
+	case contains("remote error: tls:", "tls: alert", "sslv3 alert", "tlsv1 alert"):
+		return ESTABLISH_ERROR_TLS_ALERT
+	case contains("connection reset by peer"):
+		return ESTABLISH_ERROR_CONNECTION_RESET
+	case contains("connection refused"):
+		return ESTABLISH_ERROR_CONNECTION_REFUSED
+	case contains("network is unreachable", "no route to host", "network is down"):
+		return ESTABLISH_ERROR_NO_NETWORK
+	case contains("no such host", "server misbehaving"):
+		return ESTABLISH_ERROR_DNS_FAILURE
+	}
+	return ESTABLISH_ERROR_OTHER
+}
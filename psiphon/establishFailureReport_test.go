@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEstablishFailureReport(t *testing.T) {
+	recorder := newEstablishFailureRecorder(false)
+
+	caServerEntry := &ServerEntry{IpAddress: "192.0.2.1", Region: "CA"}
+	usServerEntry := &ServerEntry{IpAddress: "192.0.2.2", Region: "US"}
+	meekParameters := &DialParameters{
+		TunnelProtocol:  TUNNEL_PROTOCOL_FRONTED_MEEK,
+		FrontingAddress: "a.example.com",
+	}
+	osshParameters := &DialParameters{TunnelProtocol: TUNNEL_PROTOCOL_OBFUSCATED_SSH}
+
+	recorder.addAttempt(caServerEntry, meekParameters, errors.New(
+		"psiphon.dialSsh#1: read tcp 10.0.0.1:1234->192.0.2.1:443: read: connection reset by peer"))
+	recorder.addAttempt(caServerEntry, meekParameters, errors.New(
+		"psiphon.NewServerContext#1: remote error: tls: handshake failure"))
+	recorder.addAttempt(usServerEntry, osshParameters, errors.New(
+		"psiphon.dialSsh#1: ssh dial timeout"))
+	recorder.addAttempt(usServerEntry, osshParameters, nil)
+	recorder.setRemoteServerListFetchResult(errors.New("fetch failed"))
+
+	report := recorder.report(true, nil)
+
+	if len(report.Candidates) != 2 ||
+		report.Candidates[0] != (EstablishCandidateCount{
+			Protocol: TUNNEL_PROTOCOL_FRONTED_MEEK, Region: "CA", Attempts: 2, Failures: 2}) ||
+		report.Candidates[1] != (EstablishCandidateCount{
+			Protocol: TUNNEL_PROTOCOL_OBFUSCATED_SSH, Region: "US", Attempts: 2, Failures: 1}) {
+		t.Errorf("unexpected candidates: %+v", report.Candidates)
+	}
+	if len(report.ErrorCategories) != 3 ||
+		report.ErrorCategories[ESTABLISH_ERROR_CONNECTION_RESET] != 1 ||
+		report.ErrorCategories[ESTABLISH_ERROR_TLS_ALERT] != 1 ||
+		report.ErrorCategories[ESTABLISH_ERROR_TIMEOUT] != 1 {
+		t.Errorf("unexpected error categories: %+v", report.ErrorCategories)
+	}
+	if len(report.FrontingAddresses) != 1 || report.FrontingAddresses[0] != "a.example.com" {
+		t.Errorf("unexpected fronting addresses: %+v", report.FrontingAddresses)
+	}
+	if report.RemoteServerListFetch != REMOTE_SERVER_LIST_FETCH_FAILED ||
+		!report.NoNetworkConnectivity {
+		t.Errorf("unexpected report: %+v", report)
+	}
+
+	for message, expectedCategory := range map[string]string{
+		"upstreamproxy error: Handshake error: <nil>, response status: 407 Proxy Authentication Required": ESTABLISH_ERROR_UPSTREAM_PROXY_AUTH_FAILURE,
+		"ssh: handshake failed: ssh: unable to authenticate, attempted methods [none]":                    ESTABLISH_ERROR_SSH_AUTH_FAILURE,
+		"dial tcp 192.0.2.1:443: connect: network is unreachable":                                         ESTABLISH_ERROR_NO_NETWORK,
+		"upstreamproxy error: Authorization is not accepted by the proxy server":                          ESTABLISH_ERROR_UPSTREAM_PROXY_AUTH_FAILURE,
+		"upstreamproxy error: making proxy request: dial tcp: lookup auth.example.com: no such host":      ESTABLISH_ERROR_UPSTREAM_PROXY_FAILURE,
+		"dial tcp: lookup a.example.com: no such host":                                                    ESTABLISH_ERROR_DNS_FAILURE,
+		"dial tcp: lookup a.example.com on 192.0.2.53:53: server misbehaving":                             ESTABLISH_ERROR_DNS_FAILURE,
+		"dial tcp: lookup a.example.com: i/o timeout":                                                     ESTABLISH_ERROR_TIMEOUT,
+		"dial tcp 192.0.2.1:443: i/o timeout":                                                             ESTABLISH_ERROR_TIMEOUT,
+		"remote error: tls: handshake failure":                                                            ESTABLISH_ERROR_TLS_ALERT,
+		"read tcp 192.0.2.2:40000->192.0.2.1:443: read: connection reset by peer":                         ESTABLISH_ERROR_CONNECTION_RESET,
+		"dial tcp timeout.example.com:443: connect: connection refused":                                   ESTABLISH_ERROR_CONNECTION_REFUSED,
+		"unexpected EOF": ESTABLISH_ERROR_OTHER,
+	} {
+		category := classifyEstablishError(errors.New(message))
+		if category != expectedCategory {
+			t.Errorf("unexpected category for %s: %s", message, category)
+		}
+	}
+}
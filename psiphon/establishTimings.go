@@ -0,0 +1,225 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"time"
+)
+
+// The phases of a tunnel establishment attempt. Depending on the tunnel
+// protocol and configuration, not all phases occur. Phases may be nested:
+// for meek protocols, the SSH handshake includes the meek round trips,
+// which include the TCP connect and TLS handshake.
+const (
+	ESTABLISH_PHASE_DNS_RESOLUTION         = "DNS_RESOLUTION"
+	ESTABLISH_PHASE_TCP_CONNECT            = "TCP_CONNECT"
+	ESTABLISH_PHASE_UPSTREAM_PROXY_CONNECT = "UPSTREAM_PROXY_CONNECT"
+	ESTABLISH_PHASE_TLS_HANDSHAKE          = "TLS_HANDSHAKE"
+	ESTABLISH_PHASE_MEEK_ROUND_TRIP        = "MEEK_ROUND_TRIP"
+	ESTABLISH_PHASE_SSH_HANDSHAKE          = "SSH_HANDSHAKE"
+	ESTABLISH_PHASE_PSIPHON_HANDSHAKE      = "PSIPHON_HANDSHAKE"
+)
+
+// EstablishTimings records the duration of each phase of one tunnel
+// establishment attempt and, for a failed attempt, the phase that failed.
+// EstablishTimings is passed down through the dial stack, in DialConfig,
+// CustomTLSConfig and MeekConn. A nil *EstablishTimings records nothing.
+type EstablishTimings struct {
+	mutex         sync.Mutex
+	phases        map[string]time.Duration
+	pendingPhases map[string]time.Time
+	failedPhase   string
+	isComplete    bool
+}
+
+func newEstablishTimings() *EstablishTimings {
+	return &EstablishTimings{
+		phases:        make(map[string]time.Duration),
+		pendingPhases: make(map[string]time.Time),
+	}
+}
+
+// startPhase starts timing a phase. It returns a function which ends the
+// phase and which records the phase as failed when its error is not nil.
+// Only the first occurrence of each phase is recorded; for example, the
+// first of many meek round trips.
+func (timings *EstablishTimings) startPhase(phase string) func(err error) {
+	if timings == nil {
+		return func(error) {}
+	}
+
+	timings.mutex.Lock()
+	defer timings.mutex.Unlock()
+
+	_, isRecorded := timings.phases[phase]
+	_, isPending := timings.pendingPhases[phase]
+	if timings.isComplete || isRecorded || isPending {
+		return func(error) {}
+	}
+
+	startTime := time.Now()
+	timings.pendingPhases[phase] = startTime
+
+	return func(err error) {
+		timings.mutex.Lock()
+		defer timings.mutex.Unlock()
+
+		// Dial goroutines may outlive an attempt that timed out or was
+		// interrupted; their results are ignored.
+		if timings.isComplete {
+			return
+		}
+		delete(timings.pendingPhases, phase)
+		timings.phases[phase] = time.Since(startTime)
+		if err != nil && timings.failedPhase == "" {
+			timings.failedPhase = phase
+		}
+	}
+}
+
+// complete stops recording, with the attempt result. For a failed attempt
+// where no phase has failed, the failed phase is the most recently started
+// phase which hasn't ended, such as a phase interrupted by a timeout.
+// For a successful attempt, any failed phase, which was retried, is cleared.
+func (timings *EstablishTimings) complete(err error) {
+	timings.mutex.Lock()
+	defer timings.mutex.Unlock()
+
+	timings.isComplete = true
+
+	if err == nil {
+		timings.failedPhase = ""
+		return
+	}
+
+	if timings.failedPhase == "" {
+		var failedPhaseStartTime time.Time
+		for phase, startTime := range timings.pendingPhases {
+			if startTime.After(failedPhaseStartTime) {
+				timings.failedPhase = phase
+				failedPhaseStartTime = startTime
+			}
+		}
+	}
+}
+
+// GetPhases returns the duration of each completed phase and the failed
+// phase, which is "" when no phase failed.
+func (timings *EstablishTimings) GetPhases() (map[string]time.Duration, string) {
+	timings.mutex.Lock()
+	defer timings.mutex.Unlock()
+
+	phases := make(map[string]time.Duration)
+	for phase, duration := range timings.phases {
+		phases[phase] = duration
+	}
+	return phases, timings.failedPhase
+}
+
+// EstablishPhaseStats aggregates the timings of one establishment phase.
+// Count is the number of attempts in which the phase completed, whether it
+// succeeded or failed, and the duration stats cover these attempts.
+type EstablishPhaseStats struct {
+	Count             int   `json:"count"`
+	Failures          int   `json:"failures"`
+	TotalMilliseconds int64 `json:"totalMilliseconds"`
+	MeanMilliseconds  int64 `json:"meanMilliseconds"`
+	MaxMilliseconds   int64 `json:"maxMilliseconds"`
+}
+
+// EstablishProtocolStats aggregates the establishment attempts for one
+// tunnel protocol.
+type EstablishProtocolStats struct {
+	Attempts  int                            `json:"attempts"`
+	Successes int                            `json:"successes"`
+	Phases    map[string]EstablishPhaseStats `json:"phases"`
+}
+
+// establishStats aggregates establishment attempts by tunnel protocol.
+type establishStats struct {
+	mutex     sync.Mutex
+	protocols map[string]*EstablishProtocolStats
+}
+
+func newEstablishStats() *establishStats {
+	return &establishStats{
+		protocols: make(map[string]*EstablishProtocolStats),
+	}
+}
+
+// add aggregates a completed establishment attempt.
+func (stats *establishStats) add(protocol string, timings *EstablishTimings, succeeded bool) {
+	phases, failedPhase := timings.GetPhases()
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	protocolStats, ok := stats.protocols[protocol]
+	if !ok {
+		protocolStats = &EstablishProtocolStats{
+			Phases: make(map[string]EstablishPhaseStats),
+		}
+		stats.protocols[protocol] = protocolStats
+	}
+
+	protocolStats.Attempts++
+	if succeeded {
+		protocolStats.Successes++
+	}
+
+	for phase, duration := range phases {
+		phaseStats := protocolStats.Phases[phase]
+		milliseconds := int64(duration / time.Millisecond)
+		phaseStats.Count++
+		phaseStats.TotalMilliseconds += milliseconds
+		phaseStats.MeanMilliseconds = phaseStats.TotalMilliseconds / int64(phaseStats.Count)
+		if milliseconds > phaseStats.MaxMilliseconds {
+			phaseStats.MaxMilliseconds = milliseconds
+		}
+		protocolStats.Phases[phase] = phaseStats
+	}
+
+	if failedPhase != "" {
+		phaseStats := protocolStats.Phases[failedPhase]
+		phaseStats.Failures++
+		protocolStats.Phases[failedPhase] = phaseStats
+	}
+}
+
+// snapshot returns a copy of the aggregated stats, keyed by tunnel protocol.
+func (stats *establishStats) snapshot() map[string]EstablishProtocolStats {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	snapshot := make(map[string]EstablishProtocolStats)
+	for protocol, protocolStats := range stats.protocols {
+		phases := make(map[string]EstablishPhaseStats)
+		for phase, phaseStats := range protocolStats.Phases {
+			phases[phase] = phaseStats
+		}
+		snapshot[protocol] = EstablishProtocolStats{
+			Attempts:  protocolStats.Attempts,
+			Successes: protocolStats.Successes,
+			Phases:    phases,
+		}
+	}
+	return snapshot
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEstablishTimings(t *testing.T) {
+	timings := newEstablishTimings()
+
+	// Only the first occurrence of a phase is recorded
+	endPhase := timings.startPhase(ESTABLISH_PHASE_TCP_CONNECT)
+	endRepeatedPhase := timings.startPhase(ESTABLISH_PHASE_TCP_CONNECT)
+	endPhase(nil)
+	endRepeatedPhase(errors.New("repeated phase failed"))
+
+	// A phase which doesn't end, due to a timeout, is the failed phase
+	timings.startPhase(ESTABLISH_PHASE_SSH_HANDSHAKE)
+	timings.complete(errors.New("timeout"))
+
+	// Results after completion are ignored
+	timings.startPhase(ESTABLISH_PHASE_PSIPHON_HANDSHAKE)(nil)
+
+	phases, failedPhase := timings.GetPhases()
+	if _, ok := phases[ESTABLISH_PHASE_TCP_CONNECT]; !ok || len(phases) != 1 {
+		t.Errorf("unexpected phases: %+v", phases)
+	}
+	if failedPhase != ESTABLISH_PHASE_SSH_HANDSHAKE {
+		t.Errorf("unexpected failed phase: %s", failedPhase)
+	}
+
+	// A phase which returns an error is the failed phase
+	failedTimings := newEstablishTimings()
+	failedTimings.startPhase(ESTABLISH_PHASE_TLS_HANDSHAKE)(errors.New("handshake failed"))
+	failedTimings.complete(errors.New("dial failed"))
+	_, failedPhase = failedTimings.GetPhases()
+	if failedPhase != ESTABLISH_PHASE_TLS_HANDSHAKE {
+		t.Errorf("unexpected failed phase: %s", failedPhase)
+	}
+
+	// A nil EstablishTimings records nothing
+	var nilTimings *EstablishTimings
+	nilTimings.startPhase(ESTABLISH_PHASE_DNS_RESOLUTION)(nil)
+
+	stats := newEstablishStats()
+	stats.add(TUNNEL_PROTOCOL_OBFUSCATED_SSH, timings, false)
+	stats.add(TUNNEL_PROTOCOL_OBFUSCATED_SSH, failedTimings, false)
+	snapshot := stats.snapshot()
+	protocolStats := snapshot[TUNNEL_PROTOCOL_OBFUSCATED_SSH]
+	if protocolStats.Attempts != 2 || protocolStats.Successes != 0 {
+		t.Errorf("unexpected stats: %+v", protocolStats)
+	}
+	if protocolStats.Phases[ESTABLISH_PHASE_TCP_CONNECT].Count != 1 ||
+		protocolStats.Phases[ESTABLISH_PHASE_SSH_HANDSHAKE].Count != 0 ||
+		protocolStats.Phases[ESTABLISH_PHASE_SSH_HANDSHAKE].Failures != 1 ||
+		protocolStats.Phases[ESTABLISH_PHASE_TLS_HANDSHAKE].Failures != 1 {
+		t.Errorf("unexpected phase stats: %+v", protocolStats.Phases)
+	}
+}
@@ -0,0 +1,578 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event is a typed notice. Each Notice* function emits a corresponding
+// Event, such as ActiveTunnelEvent for NoticeActiveTunnel, to all event
+// subscribers. The JSON notice output configured with SetNoticeOutput is
+// one such subscriber; Go applications which embed this package may use
+// SubscribeEvents to receive events directly, without parsing JSON notices.
+//
+// Event fields are the same as the JSON notice "data" payload fields, and
+// NoticeType, IsDiagnostic, and ShowUser correspond to the JSON notice
+// "noticeType" field, the diagnostic notice classification (see
+// SetEmitDiagnosticNotices), and the "showUser" field.
+//
+// Use a type switch to handle specific events:
+//
+//     switch event := event.(type) {
+//     case *psiphon.TunnelsEvent:
+//         connected = event.Count > 0
+//     case *psiphon.HomepageEvent:
+//         openBrowser(event.Url)
+//     }
+//
+type Event interface {
+	NoticeType() string
+	IsDiagnostic() bool
+	ShowUser() bool
+}
+
+// These types are embedded in event types to implement the
+// IsDiagnostic and ShowUser classification.
+
+type generalEvent struct{}
+
+func (generalEvent) IsDiagnostic() bool { return false }
+func (generalEvent) ShowUser() bool     { return false }
+
+type diagnosticEvent struct{}
+
+func (diagnosticEvent) IsDiagnostic() bool { return true }
+func (diagnosticEvent) ShowUser() bool     { return false }
+
+type showUserEvent struct{}
+
+func (showUserEvent) IsDiagnostic() bool { return false }
+func (showUserEvent) ShowUser() bool     { return true }
+
+// noticeRedacter is implemented by events which include fields that
+// are omitted from JSON notices when diagnostic notices are disabled.
+type noticeRedacter interface {
+	redacted() Event
+}
+
+type InfoEvent struct {
+	diagnosticEvent
+	Message string `json:"message"`
+}
+
+type AlertEvent struct {
+	diagnosticEvent
+	Message string `json:"message"`
+}
+
+type ErrorEvent struct {
+	diagnosticEvent
+	Message string `json:"message"`
+}
+
+// CandidateServersEvent has Region set to the most preferred egress
+// region, or "" for any region; Regions lists all preferred regions, in
+// order. IsFallback indicates that servers in regions which aren't
+// preferred are also candidates.
+type CandidateServersEvent struct {
+	generalEvent
+	Region          string   `json:"region"`
+	Regions         []string `json:"regions,omitempty"`
+	ExcludedRegions []string `json:"excludedRegions,omitempty"`
+	IsFallback      bool     `json:"isFallback,omitempty"`
+	Protocol        string   `json:"protocol"`
+	Count           int      `json:"count"`
+}
+
+type AvailableEgressRegionsEvent struct {
+	generalEvent
+	Regions []string `json:"regions"`
+	Repeats int      `json:"repeats,omitempty"`
+}
+
+// ConnectingServerEvent has MeekParameters set only when the
+// connection attempt uses a meek protocol; otherwise,
+// DirectTCPDialAddress is set.
+type ConnectingServerEvent struct {
+	diagnosticEvent
+	IpAddress            string `json:"ipAddress"`
+	Region               string `json:"region"`
+	Protocol             string `json:"protocol"`
+	DirectTCPDialAddress string `json:"directTCPDialAddress,omitempty"`
+	*MeekParameters
+}
+
+// MeekParameters are the meek dial parameters reported in
+// ConnectingServerEvent.
+type MeekParameters struct {
+	MeekDialAddress         string `json:"meekDialAddress"`
+	MeekUseHTTPS            bool   `json:"meekUseHTTPS"`
+	MeekSNIServerName       string `json:"meekSNIServerName"`
+	MeekHostHeader          string `json:"meekHostHeader"`
+	MeekTransformedHostName bool   `json:"meekTransformedHostName"`
+}
+
+// EstablishAttemptEvent Phases are the phase durations, in
+// milliseconds. FailedPhase is set only for a failed attempt.
+type EstablishAttemptEvent struct {
+	diagnosticEvent
+	IpAddress   string           `json:"ipAddress"`
+	Protocol    string           `json:"protocol"`
+	Phases      map[string]int64 `json:"phases"`
+	FailedPhase string           `json:"failedPhase,omitempty"`
+}
+
+type EstablishStatsEvent struct {
+	diagnosticEvent
+	Stats map[string]EstablishProtocolStats `json:"stats"`
+}
+
+type EstablishFailureReportEvent struct {
+	showUserEvent
+	*EstablishFailureReport
+}
+
+type ActiveTunnelEvent struct {
+	diagnosticEvent
+	IpAddress string `json:"ipAddress"`
+	Protocol  string `json:"protocol"`
+}
+
+type SocksProxyPortInUseEvent struct {
+	showUserEvent
+	Port int `json:"port"`
+}
+
+type ListeningSocksProxyPortEvent struct {
+	generalEvent
+	Port int `json:"port"`
+}
+
+type HttpProxyPortInUseEvent struct {
+	showUserEvent
+	Port int `json:"port"`
+}
+
+type ListeningHttpProxyPortEvent struct {
+	generalEvent
+	Port int `json:"port"`
+}
+
+type ControlPortInUseEvent struct {
+	showUserEvent
+	Port int `json:"port"`
+}
+
+type ListeningControlPortEvent struct {
+	generalEvent
+	Port int `json:"port"`
+}
+
+type DnsProxyPortInUseEvent struct {
+	showUserEvent
+	Port int `json:"port"`
+}
+
+type ListeningDnsProxyPortEvent struct {
+	generalEvent
+	Port int `json:"port"`
+}
+
+type TransparentProxyPortInUseEvent struct {
+	showUserEvent
+	Port int `json:"port"`
+}
+
+type ListeningTransparentProxyPortEvent struct {
+	generalEvent
+	Port int `json:"port"`
+}
+
+type ClientUpgradeAvailableEvent struct {
+	generalEvent
+	Version string `json:"version"`
+}
+
+type ClientIsLatestVersionEvent struct {
+	generalEvent
+	AvailableVersion string `json:"availableVersion"`
+}
+
+type HomepageEvent struct {
+	generalEvent
+	Url string `json:"url"`
+}
+
+type ClientVerificationRequiredEvent struct {
+	generalEvent
+}
+
+type ClientRegionEvent struct {
+	generalEvent
+	Region string `json:"region"`
+}
+
+type TunnelsEvent struct {
+	generalEvent
+	Count int `json:"count"`
+}
+
+type SessionIdEvent struct {
+	diagnosticEvent
+	SessionId string `json:"sessionId"`
+}
+
+type ImpairedProtocolClassificationEvent struct {
+	diagnosticEvent
+	Classification map[string]int `json:"classification"`
+}
+
+type UntunneledEvent struct {
+	showUserEvent
+	Address string `json:"address"`
+}
+
+type SplitTunnelRegionEvent struct {
+	showUserEvent
+	Region string `json:"region"`
+}
+
+type UpstreamProxyErrorEvent struct {
+	showUserEvent
+	Message string `json:"message"`
+}
+
+type ClientUpgradeDownloadedBytesEvent struct {
+	diagnosticEvent
+	Bytes int64 `json:"bytes"`
+}
+
+type ClientUpgradeDownloadedEvent struct {
+	generalEvent
+	Filename string `json:"filename"`
+}
+
+// BytesTransferredEvent IpAddress is omitted from JSON
+// notices when diagnostic notices are disabled.
+type BytesTransferredEvent struct {
+	generalEvent
+	IpAddress string `json:"ipAddress,omitempty"`
+	Sent      int64  `json:"sent"`
+	Received  int64  `json:"received"`
+}
+
+func (event *BytesTransferredEvent) redacted() Event {
+	redacted := *event
+	redacted.IpAddress = ""
+	return &redacted
+}
+
+// TotalBytesTransferredEvent IpAddress is omitted from JSON
+// notices when diagnostic notices are disabled.
+type TotalBytesTransferredEvent struct {
+	generalEvent
+	IpAddress string `json:"ipAddress,omitempty"`
+	Sent      int64  `json:"sent"`
+	Received  int64  `json:"received"`
+}
+
+func (event *TotalBytesTransferredEvent) redacted() Event {
+	redacted := *event
+	redacted.IpAddress = ""
+	return &redacted
+}
+
+// TunnelHealthEvent IpAddress is omitted from JSON
+// notices when diagnostic notices are disabled.
+type TunnelHealthEvent struct {
+	generalEvent
+	IpAddress                 string `json:"ipAddress,omitempty"`
+	RoundTripTimeMilliseconds int64  `json:"roundTripTimeMilliseconds"`
+	JitterMilliseconds        int64  `json:"jitterMilliseconds"`
+}
+
+func (event *TunnelHealthEvent) redacted() Event {
+	redacted := *event
+	redacted.IpAddress = ""
+	return &redacted
+}
+
+type LocalProxyErrorEvent struct {
+	diagnosticEvent
+	Message string `json:"message"`
+	Repeats int    `json:"repeats,omitempty"`
+}
+
+// LocalProxyUserStatsEvent Sent and Received are the totals for the user,
+// and Connections is the number of the user's connections which remain open.
+type LocalProxyUserStatsEvent struct {
+	generalEvent
+	Username    string `json:"username"`
+	Connections int    `json:"connections"`
+	Sent        int64  `json:"sent"`
+	Received    int64  `json:"received"`
+}
+
+type ConnectedMeekStatsEvent struct {
+	diagnosticEvent
+	IpAddress           string `json:"ipAddress"`
+	DialAddress         string `json:"dialAddress"`
+	ResolvedIPAddress   string `json:"resolvedIPAddress"`
+	SNIServerName       string `json:"sniServerName"`
+	HostHeader          string `json:"hostHeader"`
+	TransformedHostName bool   `json:"transformedHostName"`
+}
+
+type BuildInfoEvent struct {
+	generalEvent
+	BuildDate       string `json:"buildDate"`
+	BuildRepo       string `json:"buildRepo"`
+	BuildRev        string `json:"buildRev"`
+	GoVersion       string `json:"goVersion"`
+	GomobileVersion string `json:"gomobileVersion"`
+}
+
+type ExitingEvent struct {
+	generalEvent
+}
+
+type RemoteServerListDownloadedBytesEvent struct {
+	diagnosticEvent
+	Bytes int64 `json:"bytes"`
+}
+
+type RemoteServerListDownloadedEvent struct {
+	diagnosticEvent
+	Filename string `json:"filename"`
+}
+
+type ClientVerificationRequestCompletedEvent struct {
+	diagnosticEvent
+	IpAddress string `json:"ipAddress"`
+}
+
+func (*InfoEvent) NoticeType() string                   { return "Info" }
+func (*AlertEvent) NoticeType() string                  { return "Alert" }
+func (*ErrorEvent) NoticeType() string                  { return "Error" }
+func (*CandidateServersEvent) NoticeType() string       { return "CandidateServers" }
+func (*AvailableEgressRegionsEvent) NoticeType() string { return "AvailableEgressRegions" }
+func (*ConnectingServerEvent) NoticeType() string       { return "ConnectingServer" }
+func (*EstablishAttemptEvent) NoticeType() string       { return "EstablishAttempt" }
+func (*EstablishStatsEvent) NoticeType() string         { return "EstablishStats" }
+func (*ActiveTunnelEvent) NoticeType() string           { return "ActiveTunnel" }
+func (*SocksProxyPortInUseEvent) NoticeType() string    { return "SocksProxyPortInUse" }
+func (*ListeningSocksProxyPortEvent) NoticeType() string {
+	return "ListeningSocksProxyPort"
+}
+func (*HttpProxyPortInUseEvent) NoticeType() string { return "HttpProxyPortInUse" }
+func (*ListeningHttpProxyPortEvent) NoticeType() string {
+	return "ListeningHttpProxyPort"
+}
+func (*ControlPortInUseEvent) NoticeType() string      { return "ControlPortInUse" }
+func (*ListeningControlPortEvent) NoticeType() string  { return "ListeningControlPort" }
+func (*DnsProxyPortInUseEvent) NoticeType() string     { return "DnsProxyPortInUse" }
+func (*ListeningDnsProxyPortEvent) NoticeType() string { return "ListeningDnsProxyPort" }
+func (*TransparentProxyPortInUseEvent) NoticeType() string {
+	return "TransparentProxyPortInUse"
+}
+func (*ListeningTransparentProxyPortEvent) NoticeType() string {
+	return "ListeningTransparentProxyPort"
+}
+func (*ClientUpgradeAvailableEvent) NoticeType() string { return "ClientUpgradeAvailable" }
+func (*ClientIsLatestVersionEvent) NoticeType() string  { return "ClientIsLatestVersion" }
+func (*HomepageEvent) NoticeType() string               { return "Homepage" }
+func (*ClientVerificationRequiredEvent) NoticeType() string {
+	return "ClientVerificationRequired"
+}
+func (*ClientRegionEvent) NoticeType() string { return "ClientRegion" }
+func (*TunnelsEvent) NoticeType() string      { return "Tunnels" }
+func (*SessionIdEvent) NoticeType() string    { return "SessionId" }
+func (*ImpairedProtocolClassificationEvent) NoticeType() string {
+	return "ImpairedProtocolClassification"
+}
+func (*UntunneledEvent) NoticeType() string         { return "Untunneled" }
+func (*SplitTunnelRegionEvent) NoticeType() string  { return "SplitTunnelRegion" }
+func (*UpstreamProxyErrorEvent) NoticeType() string { return "UpstreamProxyError" }
+func (*ClientUpgradeDownloadedBytesEvent) NoticeType() string {
+	return "ClientUpgradeDownloadedBytes"
+}
+func (*ClientUpgradeDownloadedEvent) NoticeType() string { return "ClientUpgradeDownloaded" }
+func (*BytesTransferredEvent) NoticeType() string        { return "BytesTransferred" }
+func (*TotalBytesTransferredEvent) NoticeType() string   { return "TotalBytesTransferred" }
+func (*TunnelHealthEvent) NoticeType() string            { return "TunnelHealth" }
+func (*LocalProxyErrorEvent) NoticeType() string         { return "LocalProxyError" }
+func (*ConnectedMeekStatsEvent) NoticeType() string      { return "ConnectedMeekStats" }
+func (*BuildInfoEvent) NoticeType() string               { return "BuildInfo" }
+func (*ExitingEvent) NoticeType() string                 { return "Exiting" }
+func (*RemoteServerListDownloadedBytesEvent) NoticeType() string {
+	return "RemoteServerListDownloadedBytes"
+}
+func (*RemoteServerListDownloadedEvent) NoticeType() string {
+	return "RemoteServerListDownloaded"
+}
+func (*ClientVerificationRequestCompletedEvent) NoticeType() string {
+	return "NoticeClientVerificationRequestCompleted"
+}
+func (*EstablishFailureReportEvent) NoticeType() string {
+	return "EstablishFailureReport"
+}
+func (*LocalProxyUserStatsEvent) NoticeType() string {
+	return "LocalProxyUserStats"
+}
+
+// eventSubscriber receives events from Notices. handleEvent is invoked
+// synchronously, in the goroutine emitting the event, and must not block.
+type eventSubscriber interface {
+	handleEvent(timestamp time.Time, event Event)
+}
+
+// Notices emits events to a set of subscribers.
+//
+// The package-level Notice* functions use the process-wide Notices, whose
+// subscribers are the JSON notice output set with SetNoticeOutput and the
+// subscriptions made with SubscribeEvents.
+//
+// Each Controller has its own Notices, which is used for the notices it
+// emits, including notices from its tunnels, local proxies and datastore
+// operations; see Controller.SubscribeEvents. Lower level functions which
+// emit notices, such as LookupIP and WaitForNetworkConnectivity, take the
+// Notices to use from their caller.
+//
+// A nil *Notices refers to the process-wide Notices.
+type Notices struct {
+	subscribersMutex       sync.RWMutex
+	subscribers            []eventSubscriber
+	repetitiveNoticeMutex  sync.Mutex
+	repetitiveNoticeStates map[string]*repetitiveNoticeState
+}
+
+var processNotices = newNotices(jsonNoticeSubscriber)
+
+func newNotices(subscribers ...eventSubscriber) *Notices {
+	return &Notices{
+		subscribers:            subscribers,
+		repetitiveNoticeStates: make(map[string]*repetitiveNoticeState),
+	}
+}
+
+func (notices *Notices) get() *Notices {
+	if notices == nil {
+		return processNotices
+	}
+	return notices
+}
+
+// emit delivers a new event to all subscribers.
+func (notices *Notices) emit(event Event) {
+	notices.handleEvent(time.Now(), event)
+}
+
+// handleEvent delivers an event to all subscribers. As Notices is itself
+// an eventSubscriber, one Notices may forward events to another.
+func (notices *Notices) handleEvent(timestamp time.Time, event Event) {
+	notices = notices.get()
+
+	notices.subscribersMutex.RLock()
+	defer notices.subscribersMutex.RUnlock()
+
+	for _, subscriber := range notices.subscribers {
+		subscriber.handleEvent(timestamp, event)
+	}
+}
+
+// TimestampedEvent is an Event delivered to an EventSubscription
+// along with the time it was emitted.
+type TimestampedEvent struct {
+	Timestamp time.Time
+	Event     Event
+}
+
+// EventSubscription is a stream of events. See SubscribeEvents.
+type EventSubscription struct {
+	notices      *Notices
+	events       chan TimestampedEvent
+	droppedCount int64
+}
+
+// SubscribeEvents creates a new EventSubscription which receives all
+// events emitted in the process, including diagnostic events and events
+// from all controllers which don't have their own NoticeOutput, until
+// Unsubscribe is called. Events are buffered, up to bufferSize; when the
+// buffer is full, events are dropped rather than blocking the tunnel core.
+func SubscribeEvents(bufferSize int) *EventSubscription {
+	return processNotices.subscribe(bufferSize)
+}
+
+// subscribe creates a new EventSubscription which receives all events
+// emitted with these Notices. See SubscribeEvents.
+func (notices *Notices) subscribe(bufferSize int) *EventSubscription {
+	notices = notices.get()
+
+	subscription := &EventSubscription{
+		notices: notices,
+		events:  make(chan TimestampedEvent, bufferSize),
+	}
+
+	notices.subscribersMutex.Lock()
+	defer notices.subscribersMutex.Unlock()
+
+	notices.subscribers = append(notices.subscribers, subscription)
+
+	return subscription
+}
+
+// Events returns the event channel. The channel is closed by Unsubscribe.
+func (subscription *EventSubscription) Events() <-chan TimestampedEvent {
+	return subscription.events
+}
+
+// DroppedCount returns the number of events which were dropped because
+// the subscription buffer was full.
+func (subscription *EventSubscription) DroppedCount() int64 {
+	return atomic.LoadInt64(&subscription.droppedCount)
+}
+
+// Unsubscribe stops delivery of events and closes the event channel.
+// Unsubscribe may be called more than once.
+func (subscription *EventSubscription) Unsubscribe() {
+	notices := subscription.notices
+
+	notices.subscribersMutex.Lock()
+	defer notices.subscribersMutex.Unlock()
+
+	for i, subscriber := range notices.subscribers {
+		if subscriber == subscription {
+			notices.subscribers = append(notices.subscribers[:i], notices.subscribers[i+1:]...)
+			close(subscription.events)
+			break
+		}
+	}
+}
+
+func (subscription *EventSubscription) handleEvent(timestamp time.Time, event Event) {
+	select {
+	case subscription.events <- TimestampedEvent{Timestamp: timestamp, Event: event}:
+	default:
+		atomic.AddInt64(&subscription.droppedCount, 1)
+	}
+}
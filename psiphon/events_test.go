@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestEventSubscription(t *testing.T) {
+
+	var output bytes.Buffer
+	SetNoticeOutput(&output)
+	defer SetNoticeOutput(os.Stderr)
+
+	subscription := SubscribeEvents(10)
+
+	NoticeHomepage("https://example.com/")
+	NoticeBytesTransferred("192.0.2.1", 1, 2)
+
+	subscription.Unsubscribe()
+
+	// Not delivered after Unsubscribe
+	NoticeTunnels(1)
+
+	var events []Event
+	for event := range subscription.Events() {
+		events = append(events, event.Event)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("unexpected event count: %d", len(events))
+	}
+
+	homepage, ok := events[0].(*HomepageEvent)
+	if !ok || homepage.Url != "https://example.com/" {
+		t.Errorf("unexpected event: %+v", events[0])
+	}
+
+	// Typed events are not redacted
+	bytesTransferred, ok := events[1].(*BytesTransferredEvent)
+	if !ok || bytesTransferred.IpAddress != "192.0.2.1" || bytesTransferred.Received != 2 {
+		t.Errorf("unexpected event: %+v", events[1])
+	}
+
+	// The JSON notice subscriber receives all events
+
+	receiver := NewNoticeReceiver(func(notice []byte) {
+		noticeType, payload, err := GetNotice(notice)
+		if err != nil {
+			t.Errorf("GetNotice failed: %s", err)
+			return
+		}
+		switch noticeType {
+		case "Homepage":
+			if payload["url"] != "https://example.com/" {
+				t.Errorf("unexpected payload: %+v", payload)
+			}
+		case "BytesTransferred":
+			if _, ok := payload["ipAddress"]; ok && !GetEmitDiagnoticNotices() {
+				t.Errorf("unexpected payload: %+v", payload)
+			}
+			if payload["sent"] != float64(1) {
+				t.Errorf("unexpected payload: %+v", payload)
+			}
+		case "Tunnels":
+			if payload["count"] != float64(1) {
+				t.Errorf("unexpected payload: %+v", payload)
+			}
+		default:
+			t.Errorf("unexpected notice type: %s", noticeType)
+		}
+	})
+	noticeCount := 0
+	for _, line := range bytes.SplitAfter(output.Bytes(), []byte("\n")) {
+		if len(line) > 0 {
+			receiver.Write(line)
+			noticeCount += 1
+		}
+	}
+	if noticeCount != 3 {
+		t.Errorf("unexpected notice count: %d", noticeCount)
+	}
+}
@@ -20,6 +20,8 @@
 package psiphon
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -53,9 +55,14 @@ import (
 // Origin URLs must include the scheme prefix ("http://" or "https://") and must be
 // URL encoded.
 //
+// When local proxy users are configured, all requests, including URL proxy
+// requests, must have a Proxy-Authorization header with Basic credentials;
+// see localProxyAccessControl.
+//
 type HttpProxy struct {
 	tunneler               Tunneler
 	listener               net.Listener
+	accessControl          *localProxyAccessControl
 	serveWaitGroup         *sync.WaitGroup
 	httpProxyTunneledRelay *http.Transport
 	urlProxyTunneledRelay  *http.Transport
@@ -64,6 +71,7 @@ type HttpProxy struct {
 	urlProxyDirectClient   *http.Client
 	openConns              *Conns
 	stopListeningBroadcast chan struct{}
+	notices                *Notices
 }
 
 var _HTTP_PROXY_TYPE = "HTTP"
@@ -79,7 +87,7 @@ func NewHttpProxy(
 		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalHttpProxyPort))
 	if err != nil {
 		if IsAddressInUseError(err) {
-			NoticeHttpProxyPortInUse(config.LocalHttpProxyPort)
+			config.notices.HttpProxyPortInUse(config.LocalHttpProxyPort)
 		}
 		return nil, ContextError(err)
 	}
@@ -133,8 +141,10 @@ func NewHttpProxy(
 	}
 
 	proxy = &HttpProxy{
-		tunneler:               tunneler,
-		listener:               listener,
+		tunneler: tunneler,
+		listener: newLocalProxyListener(
+			listener, config.localProxyAccessControl, _HTTP_PROXY_TYPE, config.notices),
+		accessControl:          config.localProxyAccessControl,
 		serveWaitGroup:         new(sync.WaitGroup),
 		httpProxyTunneledRelay: httpProxyTunneledRelay,
 		urlProxyTunneledRelay:  urlProxyTunneledRelay,
@@ -143,6 +153,7 @@ func NewHttpProxy(
 		urlProxyDirectClient:   urlProxyDirectClient,
 		openConns:              new(Conns),
 		stopListeningBroadcast: make(chan struct{}),
+		notices:                config.notices,
 	}
 	proxy.serveWaitGroup.Add(1)
 	go proxy.serve()
@@ -158,7 +169,7 @@ func NewHttpProxy(
 	// NoticeListeningHttpProxyPort after that call.
 	// Also, check the listen backlog queue length -- shouldn't it be possible
 	// to enqueue pending connections between net.Listen() and httpServer.Serve()?
-	NoticeListeningHttpProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
+	config.notices.ListeningHttpProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
 
 	return proxy, nil
 }
@@ -194,25 +205,67 @@ func (proxy *HttpProxy) Close() {
 // license that can be found in the LICENSE file.
 //
 func (proxy *HttpProxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	var user *localProxyUser
+	if proxy.accessControl.requiresAuthentication(_HTTP_PROXY_TYPE) {
+		username, password, ok := parseProxyAuthorization(request.Header.Get("Proxy-Authorization"))
+		if ok {
+			user = proxy.accessControl.authenticate(_HTTP_PROXY_TYPE, username, password)
+		}
+		if user == nil {
+			responseWriter.Header().Set("Proxy-Authenticate", `Basic realm="Psiphon"`)
+			http.Error(responseWriter, "", http.StatusProxyAuthRequired)
+			return
+		}
+	}
+	if !user.openConnection() {
+		http.Error(responseWriter, "", http.StatusTooManyRequests)
+		return
+	}
+
 	if request.Method == "CONNECT" {
 		hijacker, _ := responseWriter.(http.Hijacker)
 		conn, _, err := hijacker.Hijack()
 		if err != nil {
-			NoticeAlert("%s", ContextError(err))
+			user.closeConnection()
+			proxy.notices.Alert("%s", ContextError(err))
 			http.Error(responseWriter, "", http.StatusInternalServerError)
 			return
 		}
 		go func() {
-			err := proxy.httpConnectHandler(conn, request.URL.Host)
+			defer user.closeConnection()
+			err := proxy.httpConnectHandler(user.wrapConn(conn), request.URL.Host)
 			if err != nil {
-				NoticeAlert("%s", ContextError(err))
+				proxy.notices.Alert("%s", ContextError(err))
 			}
 		}()
-	} else if request.URL.IsAbs() {
-		proxy.httpProxyHandler(responseWriter, request)
+		return
+	}
+
+	// Other requests count as a connection for the duration of the request.
+	defer user.closeConnection()
+	if request.URL.IsAbs() {
+		proxy.httpProxyHandler(responseWriter, user, request)
 	} else {
-		proxy.urlProxyHandler(responseWriter, request)
+		proxy.urlProxyHandler(responseWriter, user, request)
+	}
+}
+
+// parseProxyAuthorization parses a Proxy-Authorization header with Basic
+// credentials.
+func parseProxyAuthorization(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	credentials, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	index := bytes.IndexByte(credentials, ':')
+	if index == -1 {
+		return "", "", false
 	}
+	return string(credentials[:index]), string(credentials[index+1:]), true
 }
 
 func (proxy *HttpProxy) httpConnectHandler(localConn net.Conn, target string) (err error) {
@@ -231,12 +284,14 @@ func (proxy *HttpProxy) httpConnectHandler(localConn net.Conn, target string) (e
 	if err != nil {
 		return ContextError(err)
 	}
-	LocalProxyRelay(_HTTP_PROXY_TYPE, localConn, remoteConn)
+	LocalProxyRelay(proxy.notices, _HTTP_PROXY_TYPE, localConn, remoteConn)
 	return nil
 }
 
-func (proxy *HttpProxy) httpProxyHandler(responseWriter http.ResponseWriter, request *http.Request) {
-	relayHttpRequest(nil, proxy.httpProxyTunneledRelay, request, responseWriter)
+func (proxy *HttpProxy) httpProxyHandler(
+	responseWriter http.ResponseWriter, user *localProxyUser, request *http.Request) {
+
+	proxy.relayHttpRequest(nil, proxy.httpProxyTunneledRelay, user, request, responseWriter)
 }
 
 const (
@@ -244,7 +299,8 @@ const (
 	URL_PROXY_DIRECT_REQUEST_PATH   = "/direct/"
 )
 
-func (proxy *HttpProxy) urlProxyHandler(responseWriter http.ResponseWriter, request *http.Request) {
+func (proxy *HttpProxy) urlProxyHandler(
+	responseWriter http.ResponseWriter, user *localProxyUser, request *http.Request) {
 
 	var client *http.Client
 	var originUrl string
@@ -263,7 +319,7 @@ func (proxy *HttpProxy) urlProxyHandler(responseWriter http.ResponseWriter, requ
 		err = errors.New("missing origin URL")
 	}
 	if err != nil {
-		NoticeAlert("%s", ContextError(FilterUrlError(err)))
+		proxy.notices.Alert("%s", ContextError(FilterUrlError(err)))
 		forceClose(responseWriter)
 		return
 	}
@@ -271,12 +327,12 @@ func (proxy *HttpProxy) urlProxyHandler(responseWriter http.ResponseWriter, requ
 	// Origin URL must be well-formed, absolute, and have a scheme of  "http" or "https"
 	url, err := url.ParseRequestURI(originUrl)
 	if err != nil {
-		NoticeAlert("%s", ContextError(FilterUrlError(err)))
+		proxy.notices.Alert("%s", ContextError(FilterUrlError(err)))
 		forceClose(responseWriter)
 		return
 	}
 	if !url.IsAbs() || (url.Scheme != "http" && url.Scheme != "https") {
-		NoticeAlert("invalid origin URL")
+		proxy.notices.Alert("invalid origin URL")
 		forceClose(responseWriter)
 		return
 	}
@@ -285,12 +341,13 @@ func (proxy *HttpProxy) urlProxyHandler(responseWriter http.ResponseWriter, requ
 	request.Host = url.Host
 	request.URL = url
 
-	relayHttpRequest(client, nil, request, responseWriter)
+	proxy.relayHttpRequest(client, nil, user, request, responseWriter)
 }
 
-func relayHttpRequest(
+func (proxy *HttpProxy) relayHttpRequest(
 	client *http.Client,
 	transport *http.Transport,
+	user *localProxyUser,
 	request *http.Request,
 	responseWriter http.ResponseWriter) {
 
@@ -301,6 +358,12 @@ func relayHttpRequest(
 		request.Header.Del(key)
 	}
 
+	// For per-user stats, the request and response bodies are counted. Headers
+	// are not counted.
+	if request.Body != nil {
+		request.Body = user.wrapReadCloser(request.Body)
+	}
+
 	// Relay the HTTP request and get the response. Use a client when supplied,
 	// otherwise a transport. A client handles cookies and redirects, and a
 	// transport does not.
@@ -313,7 +376,7 @@ func relayHttpRequest(
 	}
 
 	if err != nil {
-		NoticeAlert("%s", ContextError(FilterUrlError(err)))
+		proxy.notices.Alert("%s", ContextError(FilterUrlError(err)))
 		forceClose(responseWriter)
 		return
 	}
@@ -334,9 +397,10 @@ func relayHttpRequest(
 
 	// Relay the response code and body
 	responseWriter.WriteHeader(response.StatusCode)
-	_, err = io.Copy(responseWriter, response.Body)
+	n, err := io.Copy(responseWriter, response.Body)
+	user.addBytesTransferred(0, n)
 	if err != nil {
-		NoticeAlert("%s", ContextError(err))
+		proxy.notices.Alert("%s", ContextError(err))
 		forceClose(responseWriter)
 		return
 	}
@@ -402,8 +466,8 @@ func (proxy *HttpProxy) serve() {
 	default:
 		if err != nil {
 			proxy.tunneler.SignalComponentFailure()
-			NoticeLocalProxyError(_HTTP_PROXY_TYPE, ContextError(err))
+			proxy.notices.LocalProxyError(_HTTP_PROXY_TYPE, ContextError(err))
 		}
 	}
-	NoticeInfo("HTTP proxy stopped")
+	proxy.notices.Info("HTTP proxy stopped")
 }
@@ -0,0 +1,329 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// LocalProxyUser is a user of the local proxies; see Config.LocalProxyUsers.
+type LocalProxyUser struct {
+	Username string
+	Password string
+
+	// MaxConnections limits the number of concurrent connections which the
+	// user may have open, in total, through the local proxies. The default,
+	// 0, is no limit.
+	MaxConnections int
+}
+
+// localProxyAccessControl implements the local proxy source address allow
+// list and user authentication, and enforces and tracks per-user limits and
+// usage. It's shared by the local proxies of one controller, so per-user
+// limits apply across the proxies. A nil *localProxyAccessControl allows
+// all connections.
+type localProxyAccessControl struct {
+	notices         *Notices
+	allowedNetworks []*net.IPNet
+	users           map[string]*localProxyUser
+}
+
+// localProxyUser tracks the open connections and bytes transferred for
+// one user.
+type localProxyUser struct {
+	accessControl   *localProxyAccessControl
+	username        string
+	password        string
+	maxConnections  int
+	isSocksOnly     bool
+	mutex           sync.Mutex
+	connectionCount int
+	bytesSent       int64
+	bytesReceived   int64
+}
+
+// newLocalProxyAccessControl creates the access control specified by
+// LocalProxyAllowedSourceCIDRs, LocalProxyUsers, and, for the SOCKS proxy
+// only, LocalSocksProxyUsername. Returns nil when no access control is
+// specified.
+func newLocalProxyAccessControl(config *Config) (*localProxyAccessControl, error) {
+
+	if len(config.LocalProxyAllowedSourceCIDRs) == 0 &&
+		len(config.LocalProxyUsers) == 0 &&
+		config.LocalSocksProxyUsername == "" {
+
+		return nil, nil
+	}
+
+	accessControl := &localProxyAccessControl{
+		notices: config.notices,
+		users:   make(map[string]*localProxyUser),
+	}
+
+	for _, cidr := range config.LocalProxyAllowedSourceCIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		accessControl.allowedNetworks = append(accessControl.allowedNetworks, network)
+	}
+
+	addUser := func(user *localProxyUser) error {
+		// SOCKS5 (RFC 1929) limits the username and password to 255 bytes.
+		if user.username == "" || len(user.username) > 255 ||
+			len(user.password) > 255 || user.maxConnections < 0 {
+
+			return ContextError(errors.New("invalid local proxy user"))
+		}
+		if _, ok := accessControl.users[user.username]; ok {
+			return ContextError(fmt.Errorf("duplicate local proxy user: %s", user.username))
+		}
+		user.accessControl = accessControl
+		accessControl.users[user.username] = user
+		return nil
+	}
+
+	for _, user := range config.LocalProxyUsers {
+		err := addUser(&localProxyUser{
+			username:       user.Username,
+			password:       user.Password,
+			maxConnections: user.MaxConnections,
+		})
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	if config.LocalSocksProxyUsername != "" {
+		err := addUser(&localProxyUser{
+			username:    config.LocalSocksProxyUsername,
+			password:    config.LocalSocksProxyPassword,
+			isSocksOnly: true,
+		})
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	return accessControl, nil
+}
+
+// isAllowedSource checks the source address of a local proxy connection
+// against the allow list. With no allow list, all sources are allowed.
+func (accessControl *localProxyAccessControl) isAllowedSource(addr net.Addr) bool {
+	if accessControl == nil || len(accessControl.allowedNetworks) == 0 {
+		return true
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	for _, network := range accessControl.allowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requiresAuthentication indicates whether clients of the specified local
+// proxy type must authenticate.
+func (accessControl *localProxyAccessControl) requiresAuthentication(proxyType string) bool {
+	if accessControl == nil {
+		return false
+	}
+	for _, user := range accessControl.users {
+		if !user.isSocksOnly || proxyType == _SOCKS_PROXY_TYPE {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the user with the specified credentials, or nil
+// when the credentials are invalid for the specified local proxy type.
+func (accessControl *localProxyAccessControl) authenticate(
+	proxyType, username, password string) *localProxyUser {
+
+	if accessControl == nil {
+		return nil
+	}
+	user, ok := accessControl.users[username]
+
+	// Evaluate the password comparison even for an unknown user, against a
+	// dummy password of the same length, so that the time taken doesn't
+	// indicate whether the username is valid.
+	expectedPassword := make([]byte, len(password))
+	if ok {
+		expectedPassword = []byte(user.password)
+	}
+	passwordMatches := subtle.ConstantTimeCompare(
+		[]byte(password), expectedPassword) == 1
+
+	if !ok || !passwordMatches ||
+		(user.isSocksOnly && proxyType != _SOCKS_PROXY_TYPE) {
+		return nil
+	}
+	return user
+}
+
+// localProxyListener is a net.Listener which closes connections from
+// sources which aren't allowed by the local proxy access control.
+type localProxyListener struct {
+	net.Listener
+	accessControl *localProxyAccessControl
+	proxyType     string
+	notices       *Notices
+}
+
+func newLocalProxyListener(
+	listener net.Listener,
+	accessControl *localProxyAccessControl,
+	proxyType string,
+	notices *Notices) net.Listener {
+
+	if accessControl == nil {
+		return listener
+	}
+	return &localProxyListener{
+		Listener:      listener,
+		accessControl: accessControl,
+		proxyType:     proxyType,
+		notices:       notices,
+	}
+}
+
+func (listener *localProxyListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if listener.accessControl.isAllowedSource(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		conn.Close()
+		listener.notices.LocalProxyError(
+			listener.proxyType,
+			ContextError(fmt.Errorf("source not allowed: %s", conn.RemoteAddr())))
+	}
+}
+
+// openConnection counts a new connection for the user. Returns false,
+// and doesn't count the connection, when the user is at the connection
+// limit. A nil *localProxyUser, for unauthenticated connections, always
+// returns true, as do the other localProxyUser methods.
+func (user *localProxyUser) openConnection() bool {
+	if user == nil {
+		return true
+	}
+	user.mutex.Lock()
+	defer user.mutex.Unlock()
+	if user.maxConnections > 0 && user.connectionCount >= user.maxConnections {
+		return false
+	}
+	user.connectionCount += 1
+	return true
+}
+
+// closeConnection uncounts a connection counted by openConnection and
+// reports the user's usage.
+func (user *localProxyUser) closeConnection() {
+	if user == nil {
+		return
+	}
+	user.mutex.Lock()
+	user.connectionCount -= 1
+	connectionCount := user.connectionCount
+	user.mutex.Unlock()
+
+	user.accessControl.notices.LocalProxyUserStats(
+		user.username,
+		connectionCount,
+		atomic.LoadInt64(&user.bytesSent),
+		atomic.LoadInt64(&user.bytesReceived))
+}
+
+// addBytesTransferred counts bytes sent by, and received by, the user's
+// local proxy clients.
+func (user *localProxyUser) addBytesTransferred(sent, received int64) {
+	if user == nil {
+		return
+	}
+	atomic.AddInt64(&user.bytesSent, sent)
+	atomic.AddInt64(&user.bytesReceived, received)
+}
+
+// wrapConn returns a conn which counts the bytes transferred through the
+// local proxy client conn.
+func (user *localProxyUser) wrapConn(conn net.Conn) net.Conn {
+	if user == nil {
+		return conn
+	}
+	return &localProxyUserConn{Conn: conn, user: user}
+}
+
+type localProxyUserConn struct {
+	net.Conn
+	user *localProxyUser
+}
+
+func (conn *localProxyUserConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	conn.user.addBytesTransferred(int64(n), 0)
+	return n, err
+}
+
+func (conn *localProxyUserConn) Write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	conn.user.addBytesTransferred(0, int64(n))
+	return n, err
+}
+
+// wrapReadCloser returns a reader which counts the bytes read, from the
+// local proxy client, through reader.
+func (user *localProxyUser) wrapReadCloser(reader io.ReadCloser) io.ReadCloser {
+	if user == nil {
+		return reader
+	}
+	return &localProxyUserReadCloser{ReadCloser: reader, user: user}
+}
+
+type localProxyUserReadCloser struct {
+	io.ReadCloser
+	user *localProxyUser
+}
+
+func (reader *localProxyUserReadCloser) Read(buffer []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(buffer)
+	reader.user.addBytesTransferred(int64(n), 0)
+	return n, err
+}
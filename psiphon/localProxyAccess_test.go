@@ -0,0 +1,282 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLocalProxyAccessControl(t *testing.T) {
+
+	for _, configJson := range []string{
+		`{"LocalProxyAllowedSourceCIDRs": ["192.0.2.0"]}`,
+		`{"LocalProxyUsers": [{"Username": ""}]}`,
+		`{"LocalProxyUsers": [{"Username": "a"}, {"Username": "a"}]}`,
+		`{"LocalProxyUsers": [{"Username": "a", "MaxConnections": -1}]}`,
+		`{"LocalProxyUsers": [{"Username": "a"}], "LocalSocksProxyUsername": "a"}`,
+	} {
+		_, err := LoadConfig([]byte(
+			`{"PropagationChannelId": "0", "SponsorId": "0", ` + configJson[1:]))
+		if err == nil {
+			t.Errorf("LoadConfig unexpectedly succeeded: %s", configJson)
+		}
+	}
+
+	config, err := LoadConfig([]byte(`
+	{
+		"PropagationChannelId": "0",
+		"SponsorId": "0",
+		"LocalProxyAllowedSourceCIDRs": ["192.0.2.0/24", "2001:db8::/32"],
+		"LocalProxyUsers": [{"Username": "user", "Password": "password", "MaxConnections": 2}],
+		"LocalSocksProxyUsername": "socks-user",
+		"LocalSocksProxyPassword": "socks-password"
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+	accessControl, err := newLocalProxyAccessControl(config)
+	if err != nil {
+		t.Fatalf("newLocalProxyAccessControl failed: %s", err)
+	}
+
+	for address, isAllowed := range map[string]bool{
+		"192.0.2.1":   true,
+		"2001:db8::1": true,
+		"127.0.0.1":   false,
+		"192.0.3.1":   false,
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(address), Port: 1080}
+		if accessControl.isAllowedSource(addr) != isAllowed {
+			t.Errorf("unexpected source check result: %s", address)
+		}
+	}
+
+	if !accessControl.requiresAuthentication(_HTTP_PROXY_TYPE) ||
+		!accessControl.requiresAuthentication(_SOCKS_PROXY_TYPE) {
+		t.Errorf("authentication should be required")
+	}
+	if accessControl.authenticate(_HTTP_PROXY_TYPE, "user", "wrong") != nil {
+		t.Errorf("unexpected authentication with wrong password")
+	}
+	if accessControl.authenticate(_HTTP_PROXY_TYPE, "socks-user", "socks-password") != nil {
+		t.Errorf("unexpected authentication of SOCKS user for HTTP proxy")
+	}
+	if accessControl.authenticate(_SOCKS_PROXY_TYPE, "socks-user", "socks-password") == nil {
+		t.Errorf("SOCKS user authentication failed")
+	}
+	user := accessControl.authenticate(_SOCKS_PROXY_TYPE, "user", "password")
+	if user == nil {
+		t.Fatalf("user authentication failed")
+	}
+
+	// The connection limit is enforced, and stats are reported as
+	// connections close
+	if !user.openConnection() || !user.openConnection() {
+		t.Fatalf("openConnection failed under limit")
+	}
+	if user.openConnection() {
+		t.Errorf("openConnection succeeded over limit")
+	}
+	user.addBytesTransferred(10, 20)
+
+	subscription := config.notices.subscribe(10)
+	user.closeConnection()
+	subscription.Unsubscribe()
+	event := <-subscription.Events()
+	stats, ok := event.Event.(*LocalProxyUserStatsEvent)
+	if !ok || stats.Username != "user" || stats.Connections != 1 ||
+		stats.Sent != 10 || stats.Received != 20 {
+		t.Errorf("unexpected event: %+v", event.Event)
+	}
+	if !user.openConnection() {
+		t.Errorf("openConnection failed after close")
+	}
+
+	// With no access control configured, all clients are allowed
+	config, err = LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	accessControl, err = newLocalProxyAccessControl(config)
+	if err != nil || accessControl != nil {
+		t.Fatalf("unexpected access control: %+v, %v", accessControl, err)
+	}
+	var noUser *localProxyUser
+	if !accessControl.isAllowedSource(&net.TCPAddr{IP: net.ParseIP("192.0.3.1")}) ||
+		accessControl.requiresAuthentication(_HTTP_PROXY_TYPE) ||
+		!noUser.openConnection() {
+		t.Errorf("nil access control should allow all clients")
+	}
+}
+
+func TestHttpProxyAccessControl(t *testing.T) {
+
+	// The echo server closes after one message, which ends the relay.
+	echoServer := runTestServer(t, func(conn net.Conn) {
+		message := make([]byte, 5)
+		_, err := io.ReadFull(conn, message)
+		if err == nil {
+			conn.Write(message)
+		}
+	})
+	defer echoServer.Close()
+	echoAddress := echoServer.Addr().String()
+
+	config, err := LoadConfig([]byte(`
+	{
+		"PropagationChannelId": "0",
+		"SponsorId": "0",
+		"LocalProxyUsers": [{"Username": "user", "Password": "password", "MaxConnections": 1}]
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+	config.localProxyAccessControl, err = newLocalProxyAccessControl(config)
+	if err != nil {
+		t.Fatalf("newLocalProxyAccessControl failed: %s", err)
+	}
+
+	proxy, err := NewHttpProxy(config, &DialConfig{}, testTunneler{}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewHttpProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	connect := func(password string) (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		request := "CONNECT " + echoAddress + " HTTP/1.1\r\nHost: " + echoAddress + "\r\n"
+		if password != "" {
+			request += "Proxy-Authorization: Basic " +
+				base64.StdEncoding.EncodeToString([]byte("user:"+password)) + "\r\n"
+		}
+		_, err = conn.Write([]byte(request + "\r\n"))
+		if err != nil {
+			t.Fatalf("Write failed: %s", err)
+		}
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("ReadResponse failed: %s", err)
+		}
+		return conn, response
+	}
+
+	for _, password := range []string{"", "wrong"} {
+		conn, response := connect(password)
+		conn.Close()
+		if response.StatusCode != http.StatusProxyAuthRequired ||
+			response.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("unexpected response: %+v", response)
+		}
+	}
+
+	subscription := config.notices.subscribe(10)
+
+	conn, response := connect("password")
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", response.StatusCode)
+	}
+	_, err = conn.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || string(reply) != "hello" {
+		t.Fatalf("unexpected reply: %s, %v", reply, err)
+	}
+
+	// The user is at the connection limit
+	limitedConn, response := connect("password")
+	limitedConn.Close()
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+
+	conn.Close()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-subscription.Events():
+			stats, ok := event.Event.(*LocalProxyUserStatsEvent)
+			if !ok {
+				continue
+			}
+			subscription.Unsubscribe()
+			if stats.Username != "user" || stats.Connections != 0 ||
+				stats.Sent != 5 || stats.Received < 5 {
+				t.Errorf("unexpected stats: %+v", stats)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("missing LocalProxyUserStats notice")
+		}
+	}
+}
+
+func TestLocalProxyAllowedSource(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+	{
+		"PropagationChannelId": "0",
+		"SponsorId": "0",
+		"LocalProxyAllowedSourceCIDRs": ["192.0.2.0/24"]
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+	config.localProxyAccessControl, err = newLocalProxyAccessControl(config)
+	if err != nil {
+		t.Fatalf("newLocalProxyAccessControl failed: %s", err)
+	}
+
+	proxy, err := NewSocksProxy(config, testTunneler{}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	// The loopback source isn't allowed, so the proxy closes the connection
+	conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{socks5Version, 1, socks5MethodNoAuthentication})
+	_, err = conn.Read(make([]byte, 2))
+	if err == nil {
+		t.Errorf("connection from disallowed source should be closed")
+	}
+}
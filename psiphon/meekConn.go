@@ -117,6 +117,8 @@ type MeekConn struct {
 	emptySendBuffer      chan *bytes.Buffer
 	partialSendBuffer    chan *bytes.Buffer
 	fullSendBuffer       chan *bytes.Buffer
+	notices              *Notices
+	establishTimings     *EstablishTimings
 }
 
 // transporter is implemented by both http.Transport and upstreamproxy.ProxyAuthTransport.
@@ -194,6 +196,7 @@ func DialMeek(
 			SkipVerify:                    true,
 			UseIndistinguishableTLS:       meekDialConfig.UseIndistinguishableTLS,
 			TrustedCACertificatesFilename: meekDialConfig.TrustedCACertificatesFilename,
+			establishTimings:              meekDialConfig.establishTimings,
 		})
 
 		transport = &http.Transport{
@@ -300,6 +303,8 @@ func DialMeek(
 		emptySendBuffer:      make(chan *bytes.Buffer, 1),
 		partialSendBuffer:    make(chan *bytes.Buffer, 1),
 		fullSendBuffer:       make(chan *bytes.Buffer, 1),
+		notices:              dialConfig.notices,
+		establishTimings:     dialConfig.establishTimings,
 	}
 	// TODO: benchmark bytes.Buffer vs. built-in append with slices?
 	meek.emptyReceiveBuffer <- new(bytes.Buffer)
@@ -470,14 +475,14 @@ func (meek *MeekConn) relay() {
 			sendPayloadSize, err = sendBuffer.Read(sendPayload)
 			meek.replaceSendBuffer(sendBuffer)
 			if err != nil {
-				NoticeAlert("%s", ContextError(err))
+				meek.notices.Alert("%s", ContextError(err))
 				go meek.Close()
 				return
 			}
 		}
 		receivedPayload, err := meek.roundTrip(sendPayload[:sendPayloadSize])
 		if err != nil {
-			NoticeAlert("%s", ContextError(err))
+			meek.notices.Alert("%s", ContextError(err))
 			go meek.Close()
 			return
 		}
@@ -487,7 +492,7 @@ func (meek *MeekConn) relay() {
 		}
 		receivedPayloadSize, err := meek.readPayload(receivedPayload)
 		if err != nil {
-			NoticeAlert("%s", ContextError(err))
+			meek.notices.Alert("%s", ContextError(err))
 			go meek.Close()
 			return
 		}
@@ -537,6 +542,14 @@ func (meek *MeekConn) readPayload(receivedPayload io.ReadCloser) (totalSize int6
 
 // roundTrip configures and makes the actual HTTP POST request
 func (meek *MeekConn) roundTrip(sendPayload []byte) (receivedPayload io.ReadCloser, err error) {
+
+	// When establishing a tunnel, the first round trip is timed. The phase
+	// includes any TCP connect and TLS handshake made by the transport.
+	endPhase := meek.establishTimings.startPhase(ESTABLISH_PHASE_MEEK_ROUND_TRIP)
+	defer func() {
+		endPhase(err)
+	}()
+
 	request, err := http.NewRequest("POST", meek.url.String(), bytes.NewReader(sendPayload))
 	if err != nil {
 		return nil, ContextError(err)
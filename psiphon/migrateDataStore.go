@@ -27,5 +27,5 @@ func prepareMigrationEntries(config *Config) []*ServerEntry {
 }
 
 // Stub function to return immediately for non-Windows builds
-func migrateEntries(serverEntries []*ServerEntry, legacyDataStoreFilename string) {
+func migrateEntries(store *DataStore, serverEntries []*ServerEntry, legacyDataStoreFilename string) {
 }
@@ -43,20 +43,20 @@ func prepareMigrationEntries(config *Config) []*ServerEntry {
 			defer legacyDb.Close()
 
 			if err != nil {
-				NoticeAlert("prepareMigrationEntries: sql.Open failed: %s", err)
+				config.notices.Alert("prepareMigrationEntries: sql.Open failed: %s", err)
 				return nil
 			}
 
 			initialization := "pragma journal_mode=WAL;\n"
 			_, err = legacyDb.Exec(initialization)
 			if err != nil {
-				NoticeAlert("prepareMigrationEntries: sql.DB.Exec failed: %s", err)
+				config.notices.Alert("prepareMigrationEntries: sql.DB.Exec failed: %s", err)
 				return nil
 			}
 
 			iterator, err := newlegacyServerEntryIterator(config)
 			if err != nil {
-				NoticeAlert("prepareMigrationEntries: newlegacyServerEntryIterator failed: %s", err)
+				config.notices.Alert("prepareMigrationEntries: newlegacyServerEntryIterator failed: %s", err)
 				return nil
 			}
 			defer iterator.Close()
@@ -64,7 +64,7 @@ func prepareMigrationEntries(config *Config) []*ServerEntry {
 			for {
 				serverEntry, err := iterator.Next()
 				if err != nil {
-					NoticeAlert("prepareMigrationEntries: legacyServerEntryIterator.Next failed: %s", err)
+					config.notices.Alert("prepareMigrationEntries: legacyServerEntryIterator.Next failed: %s", err)
 					break
 				}
 				if serverEntry == nil {
@@ -73,7 +73,7 @@ func prepareMigrationEntries(config *Config) []*ServerEntry {
 
 				migratableServerEntries = append(migratableServerEntries, serverEntry)
 			}
-			NoticeInfo("%d server entries prepared for data store migration", len(migratableServerEntries))
+			config.notices.Info("%d server entries prepared for data store migration", len(migratableServerEntries))
 		}
 	}
 
@@ -83,27 +83,27 @@ func prepareMigrationEntries(config *Config) []*ServerEntry {
 // migrateEntries calls the BoltDB data store method to shuffle
 // and store an array of server entries (StoreServerEntries)
 // Failing to migrate entries, or delete the legacy file is never fatal
-func migrateEntries(serverEntries []*ServerEntry, legacyDataStoreFilename string) {
-	checkInitDataStore()
+func migrateEntries(store *DataStore, serverEntries []*ServerEntry, legacyDataStoreFilename string) {
 
-	err := StoreServerEntries(serverEntries, false)
+	err := store.StoreServerEntries(serverEntries, false)
 	if err != nil {
-		NoticeAlert("migrateEntries: StoreServerEntries failed: %s", err)
+		store.notices.Alert("migrateEntries: StoreServerEntries failed: %s", err)
 	} else {
 		// Retain server affinity from old datastore by taking the first
 		// array element (previous top ranked server) and promoting it
-		// to the top rank before the server selection process begins
-		err = PromoteServerEntry(serverEntries[0].IpAddress)
+		// to server affinity candidate before the server selection
+		// process begins
+		err = store.PromoteServerEntry(serverEntries[0].IpAddress)
 		if err != nil {
-			NoticeAlert("migrateEntries: PromoteServerEntry failed: %s", err)
+			store.notices.Alert("migrateEntries: PromoteServerEntry failed: %s", err)
 		}
 
-		NoticeAlert("%d server entries successfully migrated to new data store", len(serverEntries))
+		store.notices.Alert("%d server entries successfully migrated to new data store", len(serverEntries))
 	}
 
 	err = os.Remove(legacyDataStoreFilename)
 	if err != nil {
-		NoticeAlert("migrateEntries: failed to delete legacy data store file '%s': %s", legacyDataStoreFilename, err)
+		store.notices.Alert("migrateEntries: failed to delete legacy data store file '%s': %s", legacyDataStoreFilename, err)
 	}
 
 	return
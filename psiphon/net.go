@@ -136,6 +136,14 @@ type DialConfig struct {
 	// domain name.
 	// The callback may be invoked by a concurrent goroutine.
 	ResolvedIPCallback func(string)
+
+	// notices is used for notices emitted by dialed connections, such as
+	// UpstreamProxyError. When nil, the process-wide Notices is used.
+	notices *Notices
+
+	// establishTimings, when set, records the phase timings of a tunnel
+	// establishment attempt.
+	establishTimings *EstablishTimings
 }
 
 // NetworkConnectivityChecker defines the interface to the external
@@ -156,6 +164,28 @@ type DnsServerGetter interface {
 	GetSecondaryDnsServer() string
 }
 
+// NetworkIDGetter defines the interface to the external GetNetworkID provider
+type NetworkIDGetter interface {
+	GetNetworkID() string
+}
+
+// getNetworkID returns the identifier for the current network, as
+// provided by config.NetworkIDGetter or config.NetworkID. When no
+// identifier is provided, NETWORK_ID_UNKNOWN is returned.
+func getNetworkID(config *Config) string {
+	networkID := ""
+	if config.NetworkIDGetter != nil {
+		networkID = config.NetworkIDGetter.GetNetworkID()
+	}
+	if networkID == "" {
+		networkID = config.NetworkID
+	}
+	if networkID == "" {
+		networkID = NETWORK_ID_UNKNOWN
+	}
+	return networkID
+}
+
 // HostNameTransformer defines the interface for pluggable hostname
 // transformation circumvention strategies.
 type HostNameTransformer interface {
@@ -314,8 +344,9 @@ func (entry *LRUConnsEntry) Touch() {
 }
 
 // LocalProxyRelay sends to remoteConn bytes received from localConn,
-// and sends to localConn bytes received from remoteConn.
-func LocalProxyRelay(proxyType string, localConn, remoteConn net.Conn) {
+// and sends to localConn bytes received from remoteConn. Relay errors
+// are emitted with the specified notices.
+func LocalProxyRelay(notices *Notices, proxyType string, localConn, remoteConn net.Conn) {
 	copyWaitGroup := new(sync.WaitGroup)
 	copyWaitGroup.Add(1)
 	go func() {
@@ -323,13 +354,13 @@ func LocalProxyRelay(proxyType string, localConn, remoteConn net.Conn) {
 		_, err := io.Copy(localConn, remoteConn)
 		if err != nil {
 			err = fmt.Errorf("Relay failed: %s", ContextError(err))
-			NoticeLocalProxyError(proxyType, err)
+			notices.LocalProxyError(proxyType, err)
 		}
 	}()
 	_, err := io.Copy(remoteConn, localConn)
 	if err != nil {
 		err = fmt.Errorf("Relay failed: %s", ContextError(err))
-		NoticeLocalProxyError(proxyType, err)
+		notices.LocalProxyError(proxyType, err)
 	}
 	copyWaitGroup.Wait()
 }
@@ -340,12 +371,16 @@ func LocalProxyRelay(proxyType string, localConn, remoteConn net.Conn) {
 // or when NetworkConnectivityChecker.HasNetworkConnectivity()
 // indicates connectivity. It waits and polls the checker once a second.
 // If any stop is broadcast, false is returned immediately.
+// The waiting notice is emitted with the specified notices.
 func WaitForNetworkConnectivity(
-	connectivityChecker NetworkConnectivityChecker, stopBroadcasts ...<-chan struct{}) bool {
+	notices *Notices,
+	connectivityChecker NetworkConnectivityChecker,
+	stopBroadcasts ...<-chan struct{}) bool {
+
 	if connectivityChecker == nil || 1 == connectivityChecker.HasNetworkConnectivity() {
 		return true
 	}
-	NoticeInfo("waiting for network connectivity")
+	notices.Info("waiting for network connectivity")
 	ticker := time.NewTicker(1 * time.Second)
 	for {
 		if 1 == connectivityChecker.HasNetworkConnectivity() {
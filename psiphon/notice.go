@@ -33,8 +33,6 @@ import (
 	"time"
 )
 
-var noticeLoggerMutex sync.Mutex
-var noticeLogger = log.New(os.Stderr, "", 0)
 var noticeLogDiagnostics = int32(0)
 
 // SetEmitDiagnosticNotices toggles whether diagnostic notices
@@ -42,6 +40,9 @@ var noticeLogDiagnostics = int32(0)
 // circumvention network information; only enable this in environments
 // where notices are handled securely (for example, don't include these
 // notices in log files which users could post to public forums).
+//
+// This setting applies to JSON notice output; typed events are always
+// delivered to event subscribers, which may check Event.IsDiagnostic.
 func SetEmitDiagnosticNotices(enable bool) {
 	if enable {
 		atomic.StoreInt32(&noticeLogDiagnostics, 1)
@@ -74,37 +75,49 @@ func GetEmitDiagnoticNotices() bool {
 //
 // See the Notice* functions for details on each notice meaning and payload.
 //
+// The JSON notice output is a subscriber to the typed event stream; see Event.
+// A Controller may have its own notice output; see Config.NoticeOutput.
+//
 func SetNoticeOutput(output io.Writer) {
-	noticeLoggerMutex.Lock()
-	defer noticeLoggerMutex.Unlock()
-	noticeLogger = log.New(output, "", 0)
+	jsonNoticeSubscriber.setOutput(output)
 }
 
-const (
-	noticeIsDiagnostic = 1
-	noticeShowUser     = 2
-)
+// jsonNoticeWriter is the event subscriber which encodes
+// events as JSON notices.
+type jsonNoticeWriter struct {
+	mutex  sync.Mutex
+	logger *log.Logger
+}
 
-// outputNotice encodes a notice in JSON and writes it to the output writer.
-func outputNotice(noticeType string, noticeFlags uint32, args ...interface{}) {
+var jsonNoticeSubscriber = newJSONNoticeWriter(os.Stderr)
 
-	if (noticeFlags&noticeIsDiagnostic != 0) && !GetEmitDiagnoticNotices() {
-		return
-	}
+func newJSONNoticeWriter(output io.Writer) *jsonNoticeWriter {
+	return &jsonNoticeWriter{logger: log.New(output, "", 0)}
+}
 
-	obj := make(map[string]interface{})
-	noticeData := make(map[string]interface{})
-	obj["noticeType"] = noticeType
-	obj["showUser"] = (noticeFlags&noticeShowUser != 0)
-	obj["data"] = noticeData
-	obj["timestamp"] = time.Now().UTC().Format(time.RFC3339)
-	for i := 0; i < len(args)-1; i += 2 {
-		name, ok := args[i].(string)
-		value := args[i+1]
-		if ok {
-			noticeData[name] = value
+func (writer *jsonNoticeWriter) setOutput(output io.Writer) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.logger = log.New(output, "", 0)
+}
+
+// handleEvent encodes an event in JSON and writes it to the output writer.
+func (writer *jsonNoticeWriter) handleEvent(timestamp time.Time, event Event) {
+
+	if !GetEmitDiagnoticNotices() {
+		if event.IsDiagnostic() {
+			return
+		}
+		if redacter, ok := event.(noticeRedacter); ok {
+			event = redacter.redacted()
 		}
 	}
+
+	obj := make(map[string]interface{})
+	obj["noticeType"] = event.NoticeType()
+	obj["showUser"] = event.ShowUser()
+	obj["data"] = event
+	obj["timestamp"] = timestamp.UTC().Format(time.RFC3339)
 	encodedJson, err := json.Marshal(obj)
 	var output string
 	if err == nil {
@@ -112,134 +125,345 @@ func outputNotice(noticeType string, noticeFlags uint32, args ...interface{}) {
 	} else {
 		output = fmt.Sprintf("{\"Alert\":{\"message\":\"%s\"}}", ContextError(err))
 	}
-	noticeLoggerMutex.Lock()
-	defer noticeLoggerMutex.Unlock()
-	noticeLogger.Print(output)
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	writer.logger.Print(output)
 }
 
 // NoticeInfo is an informational message
 func NoticeInfo(format string, args ...interface{}) {
-	outputNotice("Info", noticeIsDiagnostic, "message", fmt.Sprintf(format, args...))
+	processNotices.Info(format, args...)
+}
+
+// Info emits the Info notice; see NoticeInfo.
+func (notices *Notices) Info(format string, args ...interface{}) {
+	notices.emit(&InfoEvent{Message: fmt.Sprintf(format, args...)})
 }
 
 // NoticeAlert is an alert message; typically a recoverable error condition
 func NoticeAlert(format string, args ...interface{}) {
-	outputNotice("Alert", noticeIsDiagnostic, "message", fmt.Sprintf(format, args...))
+	processNotices.Alert(format, args...)
+}
+
+// Alert emits the Alert notice; see NoticeAlert.
+func (notices *Notices) Alert(format string, args ...interface{}) {
+	notices.emit(&AlertEvent{Message: fmt.Sprintf(format, args...)})
 }
 
 // NoticeError is an error message; typically an unrecoverable error condition
 func NoticeError(format string, args ...interface{}) {
-	outputNotice("Error", noticeIsDiagnostic, "message", fmt.Sprintf(format, args...))
+	processNotices.Error(format, args...)
+}
+
+// Error emits the Error notice; see NoticeError.
+func (notices *Notices) Error(format string, args ...interface{}) {
+	notices.emit(&ErrorEvent{Message: fmt.Sprintf(format, args...)})
+}
+
+// NoticeCandidateServers is how many possible servers are available for the selected regions and protocol
+func NoticeCandidateServers(regions *EgressRegionFilter, protocol string, count int) {
+	processNotices.CandidateServers(regions, protocol, count)
 }
 
-// NoticeCandidateServers is how many possible servers are available for the selected region and protocol
-func NoticeCandidateServers(region, protocol string, count int) {
-	outputNotice("CandidateServers", 0, "region", region, "protocol", protocol, "count", count)
+// CandidateServers emits the CandidateServers notice; see NoticeCandidateServers.
+func (notices *Notices) CandidateServers(regions *EgressRegionFilter, protocol string, count int) {
+	event := &CandidateServersEvent{
+		Region:   regions.getMostPreferredRegion(),
+		Protocol: protocol,
+		Count:    count,
+	}
+	if regions != nil {
+		event.Regions = regions.PreferredRegions
+		event.ExcludedRegions = regions.ExcludedRegions
+		event.IsFallback = regions.allowOtherRegions
+	}
+	notices.emit(event)
 }
 
 // NoticeAvailableEgressRegions is what regions are available for egress from.
 // Consecutive reports of the same list of regions are suppressed.
 func NoticeAvailableEgressRegions(regions []string) {
+	processNotices.AvailableEgressRegions(regions)
+}
+
+// AvailableEgressRegions emits the AvailableEgressRegions notice; see NoticeAvailableEgressRegions.
+func (notices *Notices) AvailableEgressRegions(regions []string) {
 	sortedRegions := append([]string(nil), regions...)
 	sort.Strings(sortedRegions)
 	repetitionMessage := strings.Join(sortedRegions, "")
-	outputRepetitiveNotice(
-		"AvailableEgressRegions", repetitionMessage, 0,
-		"AvailableEgressRegions", 0, "regions", sortedRegions)
+	emit, repeats := notices.checkRepetitiveNotice(
+		"AvailableEgressRegions", repetitionMessage, 0)
+	if emit {
+		notices.emit(&AvailableEgressRegionsEvent{Regions: sortedRegions, Repeats: repeats})
+	}
 }
 
 // NoticeConnectingServer is details on a connection attempt
 func NoticeConnectingServer(ipAddress, region, protocol, directTCPDialAddress string, meekConfig *MeekConfig) {
+	processNotices.ConnectingServer(ipAddress, region, protocol, directTCPDialAddress, meekConfig)
+}
+
+// ConnectingServer emits the ConnectingServer notice; see NoticeConnectingServer.
+func (notices *Notices) ConnectingServer(ipAddress, region, protocol, directTCPDialAddress string, meekConfig *MeekConfig) {
+	event := &ConnectingServerEvent{
+		IpAddress: ipAddress,
+		Region:    region,
+		Protocol:  protocol,
+	}
 	if meekConfig == nil {
-		outputNotice("ConnectingServer", noticeIsDiagnostic,
-			"ipAddress", ipAddress,
-			"region", region,
-			"protocol", protocol,
-			"directTCPDialAddress", directTCPDialAddress)
+		event.DirectTCPDialAddress = directTCPDialAddress
 	} else {
-		outputNotice("ConnectingServer", noticeIsDiagnostic,
-			"ipAddress", ipAddress,
-			"region", region,
-			"protocol", protocol,
-			"meekDialAddress", meekConfig.DialAddress,
-			"meekUseHTTPS", meekConfig.UseHTTPS,
-			"meekSNIServerName", meekConfig.SNIServerName,
-			"meekHostHeader", meekConfig.HostHeader,
-			"meekTransformedHostName", meekConfig.TransformedHostName)
+		event.MeekParameters = &MeekParameters{
+			MeekDialAddress:         meekConfig.DialAddress,
+			MeekUseHTTPS:            meekConfig.UseHTTPS,
+			MeekSNIServerName:       meekConfig.SNIServerName,
+			MeekHostHeader:          meekConfig.HostHeader,
+			MeekTransformedHostName: meekConfig.TransformedHostName,
+		}
+	}
+	notices.emit(event)
+}
+
+// NoticeEstablishAttempt reports the phase timings of a tunnel
+// establishment attempt and, for a failed attempt, the phase that failed
+func NoticeEstablishAttempt(ipAddress, protocol string, timings *EstablishTimings) {
+	processNotices.EstablishAttempt(ipAddress, protocol, timings)
+}
+
+// EstablishAttempt emits the EstablishAttempt notice; see NoticeEstablishAttempt.
+func (notices *Notices) EstablishAttempt(ipAddress, protocol string, timings *EstablishTimings) {
+	phases, failedPhase := timings.GetPhases()
+	phaseMilliseconds := make(map[string]int64)
+	for phase, duration := range phases {
+		phaseMilliseconds[phase] = int64(duration / time.Millisecond)
 	}
+	notices.emit(&EstablishAttemptEvent{
+		IpAddress:   ipAddress,
+		Protocol:    protocol,
+		Phases:      phaseMilliseconds,
+		FailedPhase: failedPhase,
+	})
+}
+
+// NoticeEstablishStats reports the establishment attempt timings
+// aggregated by tunnel protocol
+func NoticeEstablishStats(stats map[string]EstablishProtocolStats) {
+	processNotices.EstablishStats(stats)
+}
+
+// EstablishStats emits the EstablishStats notice; see NoticeEstablishStats.
+func (notices *Notices) EstablishStats(stats map[string]EstablishProtocolStats) {
+	notices.emit(&EstablishStatsEvent{Stats: stats})
+}
+
+// NoticeEstablishFailureReport is a summary of the tunnel establishment
+// attempts which failed to establish a tunnel before the establish timeout
+func NoticeEstablishFailureReport(report *EstablishFailureReport) {
+	processNotices.EstablishFailureReport(report)
+}
+
+// EstablishFailureReport emits the EstablishFailureReport notice; see NoticeEstablishFailureReport.
+func (notices *Notices) EstablishFailureReport(report *EstablishFailureReport) {
+	notices.emit(&EstablishFailureReportEvent{EstablishFailureReport: report})
 }
 
 // NoticeActiveTunnel is a successful connection that is used as an active tunnel for port forwarding
 func NoticeActiveTunnel(ipAddress, protocol string) {
-	outputNotice("ActiveTunnel", noticeIsDiagnostic, "ipAddress", ipAddress, "protocol", protocol)
+	processNotices.ActiveTunnel(ipAddress, protocol)
+}
+
+// ActiveTunnel emits the ActiveTunnel notice; see NoticeActiveTunnel.
+func (notices *Notices) ActiveTunnel(ipAddress, protocol string) {
+	notices.emit(&ActiveTunnelEvent{IpAddress: ipAddress, Protocol: protocol})
 }
 
 // NoticeSocksProxyPortInUse is a failure to use the configured LocalSocksProxyPort
 func NoticeSocksProxyPortInUse(port int) {
-	outputNotice("SocksProxyPortInUse", noticeShowUser, "port", port)
+	processNotices.SocksProxyPortInUse(port)
+}
+
+// SocksProxyPortInUse emits the SocksProxyPortInUse notice; see NoticeSocksProxyPortInUse.
+func (notices *Notices) SocksProxyPortInUse(port int) {
+	notices.emit(&SocksProxyPortInUseEvent{Port: port})
 }
 
 // NoticeListeningSocksProxyPort is the selected port for the listening local SOCKS proxy
 func NoticeListeningSocksProxyPort(port int) {
-	outputNotice("ListeningSocksProxyPort", 0, "port", port)
+	processNotices.ListeningSocksProxyPort(port)
+}
+
+// ListeningSocksProxyPort emits the ListeningSocksProxyPort notice; see NoticeListeningSocksProxyPort.
+func (notices *Notices) ListeningSocksProxyPort(port int) {
+	notices.emit(&ListeningSocksProxyPortEvent{Port: port})
 }
 
 // NoticeSocksProxyPortInUse is a failure to use the configured LocalHttpProxyPort
 func NoticeHttpProxyPortInUse(port int) {
-	outputNotice("HttpProxyPortInUse", noticeShowUser, "port", port)
+	processNotices.HttpProxyPortInUse(port)
+}
+
+// HttpProxyPortInUse emits the HttpProxyPortInUse notice; see NoticeHttpProxyPortInUse.
+func (notices *Notices) HttpProxyPortInUse(port int) {
+	notices.emit(&HttpProxyPortInUseEvent{Port: port})
 }
 
 // NoticeListeningSocksProxyPort is the selected port for the listening local HTTP proxy
 func NoticeListeningHttpProxyPort(port int) {
-	outputNotice("ListeningHttpProxyPort", 0, "port", port)
+	processNotices.ListeningHttpProxyPort(port)
+}
+
+// ListeningHttpProxyPort emits the ListeningHttpProxyPort notice; see NoticeListeningHttpProxyPort.
+func (notices *Notices) ListeningHttpProxyPort(port int) {
+	notices.emit(&ListeningHttpProxyPortEvent{Port: port})
+}
+
+// NoticeControlPortInUse is a failure to use the configured LocalControlPort
+func NoticeControlPortInUse(port int) {
+	processNotices.ControlPortInUse(port)
+}
+
+// ControlPortInUse emits the ControlPortInUse notice; see NoticeControlPortInUse.
+func (notices *Notices) ControlPortInUse(port int) {
+	notices.emit(&ControlPortInUseEvent{Port: port})
+}
+
+// NoticeListeningControlPort is the port for the listening local control API
+func NoticeListeningControlPort(port int) {
+	processNotices.ListeningControlPort(port)
+}
+
+// ListeningControlPort emits the ListeningControlPort notice; see NoticeListeningControlPort.
+func (notices *Notices) ListeningControlPort(port int) {
+	notices.emit(&ListeningControlPortEvent{Port: port})
+}
+
+// NoticeDnsProxyPortInUse is a failure to use the configured LocalDnsProxyPort
+func NoticeDnsProxyPortInUse(port int) {
+	processNotices.DnsProxyPortInUse(port)
+}
+
+// DnsProxyPortInUse emits the DnsProxyPortInUse notice; see NoticeDnsProxyPortInUse.
+func (notices *Notices) DnsProxyPortInUse(port int) {
+	notices.emit(&DnsProxyPortInUseEvent{Port: port})
+}
+
+// NoticeListeningDnsProxyPort is the port for the listening local DNS proxy
+func NoticeListeningDnsProxyPort(port int) {
+	processNotices.ListeningDnsProxyPort(port)
+}
+
+// ListeningDnsProxyPort emits the ListeningDnsProxyPort notice; see NoticeListeningDnsProxyPort.
+func (notices *Notices) ListeningDnsProxyPort(port int) {
+	notices.emit(&ListeningDnsProxyPortEvent{Port: port})
+}
+
+// NoticeTransparentProxyPortInUse is a failure to use the configured LocalTransparentProxyPort
+func NoticeTransparentProxyPortInUse(port int) {
+	processNotices.TransparentProxyPortInUse(port)
+}
+
+// TransparentProxyPortInUse emits the TransparentProxyPortInUse notice; see
+// NoticeTransparentProxyPortInUse.
+func (notices *Notices) TransparentProxyPortInUse(port int) {
+	notices.emit(&TransparentProxyPortInUseEvent{Port: port})
+}
+
+// NoticeListeningTransparentProxyPort is the port for the listening local transparent proxy
+func NoticeListeningTransparentProxyPort(port int) {
+	processNotices.ListeningTransparentProxyPort(port)
+}
+
+// ListeningTransparentProxyPort emits the ListeningTransparentProxyPort notice; see
+// NoticeListeningTransparentProxyPort.
+func (notices *Notices) ListeningTransparentProxyPort(port int) {
+	notices.emit(&ListeningTransparentProxyPortEvent{Port: port})
 }
 
 // NoticeClientUpgradeAvailable is an available client upgrade, as per the handshake. The
 // client should download and install an upgrade.
 func NoticeClientUpgradeAvailable(version string) {
-	outputNotice("ClientUpgradeAvailable", 0, "version", version)
+	processNotices.ClientUpgradeAvailable(version)
+}
+
+// ClientUpgradeAvailable emits the ClientUpgradeAvailable notice; see NoticeClientUpgradeAvailable.
+func (notices *Notices) ClientUpgradeAvailable(version string) {
+	notices.emit(&ClientUpgradeAvailableEvent{Version: version})
 }
 
 // NoticeClientIsLatestVersion reports that an upgrade check was made and the client
 // is already the latest version. availableVersion is the version available for download,
 // if known.
 func NoticeClientIsLatestVersion(availableVersion string) {
-	outputNotice("ClientIsLatestVersion", 0, "availableVersion", availableVersion)
+	processNotices.ClientIsLatestVersion(availableVersion)
+}
+
+// ClientIsLatestVersion emits the ClientIsLatestVersion notice; see NoticeClientIsLatestVersion.
+func (notices *Notices) ClientIsLatestVersion(availableVersion string) {
+	notices.emit(&ClientIsLatestVersionEvent{AvailableVersion: availableVersion})
 }
 
 // NoticeHomepage is a sponsor homepage, as per the handshake. The client
 // should display the sponsor's homepage.
 func NoticeHomepage(url string) {
-	outputNotice("Homepage", 0, "url", url)
+	processNotices.Homepage(url)
+}
+
+// Homepage emits the Homepage notice; see NoticeHomepage.
+func (notices *Notices) Homepage(url string) {
+	notices.emit(&HomepageEvent{Url: url})
 }
 
 // NoticeClientVerificationRequired indicates that client verification is required, as
 // indicated bythe handshake. The client should submit a client verification payload.
 func NoticeClientVerificationRequired() {
-	outputNotice("ClientVerificationRequired", 0)
+	processNotices.ClientVerificationRequired()
+}
+
+// ClientVerificationRequired emits the ClientVerificationRequired notice; see NoticeClientVerificationRequired.
+func (notices *Notices) ClientVerificationRequired() {
+	notices.emit(&ClientVerificationRequiredEvent{})
 }
 
 // NoticeClientRegion is the client's region, as determined by the server and
 // reported to the client in the handshake.
 func NoticeClientRegion(region string) {
-	outputNotice("ClientRegion", 0, "region", region)
+	processNotices.ClientRegion(region)
+}
+
+// ClientRegion emits the ClientRegion notice; see NoticeClientRegion.
+func (notices *Notices) ClientRegion(region string) {
+	notices.emit(&ClientRegionEvent{Region: region})
 }
 
 // NoticeTunnels is how many active tunnels are available. The client should use this to
 // determine connecting/unexpected disconnect state transitions. When count is 0, the core is
 // disconnected; when count > 1, the core is connected.
 func NoticeTunnels(count int) {
-	outputNotice("Tunnels", 0, "count", count)
+	processNotices.Tunnels(count)
+}
+
+// Tunnels emits the Tunnels notice; see NoticeTunnels.
+func (notices *Notices) Tunnels(count int) {
+	notices.emit(&TunnelsEvent{Count: count})
 }
 
 // NoticeSessionId is the session ID used across all tunnels established by the controller.
 func NoticeSessionId(sessionId string) {
-	outputNotice("SessionId", noticeIsDiagnostic, "sessionId", sessionId)
+	processNotices.SessionId(sessionId)
+}
+
+// SessionId emits the SessionId notice; see NoticeSessionId.
+func (notices *Notices) SessionId(sessionId string) {
+	notices.emit(&SessionIdEvent{SessionId: sessionId})
 }
 
 func NoticeImpairedProtocolClassification(impairedProtocolClassification map[string]int) {
-	outputNotice("ImpairedProtocolClassification", noticeIsDiagnostic,
-		"classification", impairedProtocolClassification)
+	processNotices.ImpairedProtocolClassification(impairedProtocolClassification)
+}
+
+// ImpairedProtocolClassification emits the ImpairedProtocolClassification notice; see NoticeImpairedProtocolClassification.
+func (notices *Notices) ImpairedProtocolClassification(impairedProtocolClassification map[string]int) {
+	notices.emit(&ImpairedProtocolClassificationEvent{Classification: impairedProtocolClassification})
 }
 
 // NoticeUntunneled indicates than an address has been classified as untunneled and is being
@@ -249,58 +473,111 @@ func NoticeImpairedProtocolClassification(impairedProtocolClassification map[str
 // users, not for diagnostics logs.
 //
 func NoticeUntunneled(address string) {
-	outputNotice("Untunneled", noticeShowUser, "address", address)
+	processNotices.Untunneled(address)
+}
+
+// Untunneled emits the Untunneled notice; see NoticeUntunneled.
+func (notices *Notices) Untunneled(address string) {
+	notices.emit(&UntunneledEvent{Address: address})
 }
 
 // NoticeSplitTunnelRegion reports that split tunnel is on for the given region.
 func NoticeSplitTunnelRegion(region string) {
-	outputNotice("SplitTunnelRegion", noticeShowUser, "region", region)
+	processNotices.SplitTunnelRegion(region)
+}
+
+// SplitTunnelRegion emits the SplitTunnelRegion notice; see NoticeSplitTunnelRegion.
+func (notices *Notices) SplitTunnelRegion(region string) {
+	notices.emit(&SplitTunnelRegionEvent{Region: region})
 }
 
 // NoticeUpstreamProxyError reports an error when connecting to an upstream proxy. The
 // user may have input, for example, an incorrect address or incorrect credentials.
 func NoticeUpstreamProxyError(err error) {
-	outputNotice("UpstreamProxyError", noticeShowUser, "message", err.Error())
+	processNotices.UpstreamProxyError(err)
+}
+
+// UpstreamProxyError emits the UpstreamProxyError notice; see NoticeUpstreamProxyError.
+func (notices *Notices) UpstreamProxyError(err error) {
+	notices.emit(&UpstreamProxyErrorEvent{Message: err.Error()})
 }
 
 // NoticeClientUpgradeDownloadedBytes reports client upgrade download progress.
 func NoticeClientUpgradeDownloadedBytes(bytes int64) {
-	outputNotice("ClientUpgradeDownloadedBytes", noticeIsDiagnostic, "bytes", bytes)
+	processNotices.ClientUpgradeDownloadedBytes(bytes)
+}
+
+// ClientUpgradeDownloadedBytes emits the ClientUpgradeDownloadedBytes notice; see NoticeClientUpgradeDownloadedBytes.
+func (notices *Notices) ClientUpgradeDownloadedBytes(bytes int64) {
+	notices.emit(&ClientUpgradeDownloadedBytesEvent{Bytes: bytes})
 }
 
 // NoticeClientUpgradeDownloaded indicates that a client upgrade download
 // is complete and available at the destination specified.
 func NoticeClientUpgradeDownloaded(filename string) {
-	outputNotice("ClientUpgradeDownloaded", 0, "filename", filename)
+	processNotices.ClientUpgradeDownloaded(filename)
+}
+
+// ClientUpgradeDownloaded emits the ClientUpgradeDownloaded notice; see NoticeClientUpgradeDownloaded.
+func (notices *Notices) ClientUpgradeDownloaded(filename string) {
+	notices.emit(&ClientUpgradeDownloadedEvent{Filename: filename})
 }
 
 // NoticeBytesTransferred reports how many tunneled bytes have been
 // transferred since the last NoticeBytesTransferred, for the tunnel
 // to the server at ipAddress.
 func NoticeBytesTransferred(ipAddress string, sent, received int64) {
-	if GetEmitDiagnoticNotices() {
-		outputNotice("BytesTransferred", noticeIsDiagnostic, "ipAddress", ipAddress, "sent", sent, "received", received)
-	} else {
-		// This case keeps the EmitBytesTransferred and EmitDiagnosticNotices config options independent
-		outputNotice("BytesTransferred", 0, "sent", sent, "received", received)
-	}
+	processNotices.BytesTransferred(ipAddress, sent, received)
+}
+
+// BytesTransferred emits the BytesTransferred notice; see NoticeBytesTransferred.
+func (notices *Notices) BytesTransferred(ipAddress string, sent, received int64) {
+	// The ipAddress is omitted from JSON notices when diagnostic notices are
+	// disabled. This keeps the EmitBytesTransferred and EmitDiagnosticNotices
+	// config options independent.
+	notices.emit(&BytesTransferredEvent{IpAddress: ipAddress, Sent: sent, Received: received})
 }
 
 // NoticeTotalBytesTransferred reports how many tunneled bytes have been
 // transferred in total up to this point, for the tunnel to the server
 // at ipAddress.
 func NoticeTotalBytesTransferred(ipAddress string, sent, received int64) {
-	if GetEmitDiagnoticNotices() {
-		outputNotice("TotalBytesTransferred", noticeIsDiagnostic, "ipAddress", ipAddress, "sent", sent, "received", received)
-	} else {
-		// This case keeps the EmitBytesTransferred and EmitDiagnosticNotices config options independent
-		outputNotice("TotalBytesTransferred", 0, "sent", sent, "received", received)
-	}
+	processNotices.TotalBytesTransferred(ipAddress, sent, received)
+}
+
+// TotalBytesTransferred emits the TotalBytesTransferred notice; see NoticeTotalBytesTransferred.
+func (notices *Notices) TotalBytesTransferred(ipAddress string, sent, received int64) {
+	// The ipAddress is omitted from JSON notices when diagnostic notices are
+	// disabled. This keeps the EmitBytesTransferred and EmitDiagnosticNotices
+	// config options independent.
+	notices.emit(&TotalBytesTransferredEvent{IpAddress: ipAddress, Sent: sent, Received: received})
+}
+
+// NoticeTunnelHealth reports the smoothed round trip time and jitter measured
+// by SSH keep alives, for the tunnel to the server at ipAddress.
+func NoticeTunnelHealth(ipAddress string, roundTripTime, jitter time.Duration) {
+	processNotices.TunnelHealth(ipAddress, roundTripTime, jitter)
+}
+
+// TunnelHealth emits the TunnelHealth notice; see NoticeTunnelHealth.
+func (notices *Notices) TunnelHealth(ipAddress string, roundTripTime, jitter time.Duration) {
+	// As with BytesTransferred, the ipAddress is omitted from JSON notices
+	// when diagnostic notices are disabled.
+	notices.emit(&TunnelHealthEvent{
+		IpAddress:                 ipAddress,
+		RoundTripTimeMilliseconds: int64(roundTripTime / time.Millisecond),
+		JitterMilliseconds:        int64(jitter / time.Millisecond),
+	})
 }
 
 // NoticeLocalProxyError reports a local proxy error message. Repetitive
 // errors for a given proxy type are suppressed.
 func NoticeLocalProxyError(proxyType string, err error) {
+	processNotices.LocalProxyError(proxyType, err)
+}
+
+// LocalProxyError emits the LocalProxyError notice; see NoticeLocalProxyError.
+func (notices *Notices) LocalProxyError(proxyType string, err error) {
 
 	// For repeats, only consider the base error message, which is
 	// the root error that repeats (the full error often contains
@@ -313,50 +590,103 @@ func NoticeLocalProxyError(proxyType string, err error) {
 		repetitionMessage = repetitionMessage[index+2:]
 	}
 
-	outputRepetitiveNotice(
-		"LocalProxyError"+proxyType, repetitionMessage, 1,
-		"LocalProxyError", noticeIsDiagnostic, "message", err.Error())
+	emit, repeats := notices.checkRepetitiveNotice(
+		"LocalProxyError"+proxyType, repetitionMessage, 1)
+	if emit {
+		notices.emit(&LocalProxyErrorEvent{Message: err.Error(), Repeats: repeats})
+	}
+}
+
+// NoticeLocalProxyUserStats reports the open connections and the total bytes
+// sent and received by a local proxy user; see Config.LocalProxyUsers. It's
+// emitted when one of the user's connections closes.
+func NoticeLocalProxyUserStats(username string, connections int, sent, received int64) {
+	processNotices.LocalProxyUserStats(username, connections, sent, received)
+}
+
+// LocalProxyUserStats emits the LocalProxyUserStats notice; see NoticeLocalProxyUserStats.
+func (notices *Notices) LocalProxyUserStats(
+	username string, connections int, sent, received int64) {
+
+	notices.emit(&LocalProxyUserStatsEvent{
+		Username:    username,
+		Connections: connections,
+		Sent:        sent,
+		Received:    received,
+	})
 }
 
 // NoticeConnectedMeekStats reports extra network details for a meek tunnel connection.
 func NoticeConnectedMeekStats(ipAddress string, meekStats *MeekStats) {
-	outputNotice("ConnectedMeekStats", noticeIsDiagnostic,
-		"ipAddress", ipAddress,
-		"dialAddress", meekStats.DialAddress,
-		"resolvedIPAddress", meekStats.ResolvedIPAddress,
-		"sniServerName", meekStats.SNIServerName,
-		"hostHeader", meekStats.HostHeader,
-		"transformedHostName", meekStats.TransformedHostName)
+	processNotices.ConnectedMeekStats(ipAddress, meekStats)
+}
+
+// ConnectedMeekStats emits the ConnectedMeekStats notice; see NoticeConnectedMeekStats.
+func (notices *Notices) ConnectedMeekStats(ipAddress string, meekStats *MeekStats) {
+	notices.emit(&ConnectedMeekStatsEvent{
+		IpAddress:           ipAddress,
+		DialAddress:         meekStats.DialAddress,
+		ResolvedIPAddress:   meekStats.ResolvedIPAddress,
+		SNIServerName:       meekStats.SNIServerName,
+		HostHeader:          meekStats.HostHeader,
+		TransformedHostName: meekStats.TransformedHostName,
+	})
 }
 
 // NoticeBuildInfo reports build version info.
 func NoticeBuildInfo(buildDate, buildRepo, buildRev, goVersion, gomobileVersion string) {
-	outputNotice("BuildInfo", 0,
-		"buildDate", buildDate,
-		"buildRepo", buildRepo,
-		"buildRev", buildRev,
-		"goVersion", goVersion,
-		"gomobileVersion", gomobileVersion)
+	processNotices.BuildInfo(buildDate, buildRepo, buildRev, goVersion, gomobileVersion)
+}
+
+// BuildInfo emits the BuildInfo notice; see NoticeBuildInfo.
+func (notices *Notices) BuildInfo(buildDate, buildRepo, buildRev, goVersion, gomobileVersion string) {
+	notices.emit(&BuildInfoEvent{
+		BuildDate:       buildDate,
+		BuildRepo:       buildRepo,
+		BuildRev:        buildRev,
+		GoVersion:       goVersion,
+		GomobileVersion: gomobileVersion,
+	})
 }
 
 // NoticeExiting indicates that tunnel-core is exiting imminently.
 func NoticeExiting() {
-	outputNotice("Exiting", 0)
+	processNotices.Exiting()
+}
+
+// Exiting emits the Exiting notice; see NoticeExiting.
+func (notices *Notices) Exiting() {
+	notices.emit(&ExitingEvent{})
 }
 
 // NoticeRemoteServerListDownloadedBytes reports remote server list download progress.
 func NoticeRemoteServerListDownloadedBytes(bytes int64) {
-	outputNotice("RemoteServerListDownloadedBytes", noticeIsDiagnostic, "bytes", bytes)
+	processNotices.RemoteServerListDownloadedBytes(bytes)
+}
+
+// RemoteServerListDownloadedBytes emits the RemoteServerListDownloadedBytes notice; see NoticeRemoteServerListDownloadedBytes.
+func (notices *Notices) RemoteServerListDownloadedBytes(bytes int64) {
+	notices.emit(&RemoteServerListDownloadedBytesEvent{Bytes: bytes})
 }
 
 // NoticeRemoteServerListDownloaded indicates that a remote server list download
 // completed successfully.
 func NoticeRemoteServerListDownloaded(filename string) {
-	outputNotice("RemoteServerListDownloaded", noticeIsDiagnostic, "filename", filename)
+	processNotices.RemoteServerListDownloaded(filename)
+}
+
+// RemoteServerListDownloaded emits the RemoteServerListDownloaded notice; see NoticeRemoteServerListDownloaded.
+func (notices *Notices) RemoteServerListDownloaded(filename string) {
+	notices.emit(&RemoteServerListDownloadedEvent{Filename: filename})
 }
 
 func NoticeClientVerificationRequestCompleted(ipAddress string) {
-	outputNotice("NoticeClientVerificationRequestCompleted", noticeIsDiagnostic, "ipAddress", ipAddress)
+	processNotices.ClientVerificationRequestCompleted(ipAddress)
+}
+
+// ClientVerificationRequestCompleted emits the ClientVerificationRequestCompleted notice; see NoticeClientVerificationRequestCompleted.
+func (notices *Notices) ClientVerificationRequestCompleted(ipAddress string) {
+	notices.emit(&ClientVerificationRequestCompletedEvent{IpAddress: ipAddress})
 }
 
 type repetitiveNoticeState struct {
@@ -364,24 +694,21 @@ type repetitiveNoticeState struct {
 	repeats int
 }
 
-var repetitiveNoticeMutex sync.Mutex
-var repetitiveNoticeStates = make(map[string]*repetitiveNoticeState)
+// checkRepetitiveNotice determines whether to emit a notice. Used for noticies
+// which often repeat in noisy bursts. For a repeat limit of N, the notice is
+// emitted with a "repeats" count on consecutive repeats up to the limit and then
+// suppressed until the repetitionMessage differs.
+func (notices *Notices) checkRepetitiveNotice(
+	repetitionKey, repetitionMessage string, repeatLimit int) (bool, int) {
 
-// outputRepetitiveNotice conditionally outputs a notice. Used for noticies which
-// often repeat in noisy bursts. For a repeat limit of N, the notice is emitted
-// with a "repeats" count on consecutive repeats up to the limit and then suppressed
-// until the repetitionMessage differs.
-func outputRepetitiveNotice(
-	repetitionKey, repetitionMessage string, repeatLimit int,
-	noticeType string, noticeFlags uint32, args ...interface{}) {
+	notices = notices.get()
+	notices.repetitiveNoticeMutex.Lock()
+	defer notices.repetitiveNoticeMutex.Unlock()
 
-	repetitiveNoticeMutex.Lock()
-	defer repetitiveNoticeMutex.Unlock()
-
-	state, ok := repetitiveNoticeStates[repetitionKey]
+	state, ok := notices.repetitiveNoticeStates[repetitionKey]
 	if !ok {
 		state = new(repetitiveNoticeState)
-		repetitiveNoticeStates[repetitionKey] = state
+		notices.repetitiveNoticeStates[repetitionKey] = state
 	}
 
 	emit := true
@@ -395,12 +722,7 @@ func outputRepetitiveNotice(
 		}
 	}
 
-	if emit {
-		if state.repeats > 0 {
-			args = append(args, "repeats", state.repeats)
-		}
-		outputNotice(noticeType, noticeFlags, args...)
-	}
+	return emit, state.repeats
 }
 
 type noticeObject struct {
@@ -96,16 +96,19 @@ const (
 //
 // In client mode, NewObfuscatedSshConn does not block or initiate network
 // I/O. The obfuscation seed message is sent when Write() is first called.
+// obfuscatorPaddingLength, when not nil, specifies the seed message padding
+// length; otherwise the padding length is random.
 //
 // In server mode, NewObfuscatedSshConn cannot completely initialize itself
 // without the seed message from the client to derive obfuscation keys. So
 // NewObfuscatedSshConn blocks on reading the client seed message from the
-// underlying conn.
+// underlying conn. obfuscatorPaddingLength is ignored in server mode.
 //
 func NewObfuscatedSshConn(
 	mode ObfuscatedSshConnMode,
 	conn net.Conn,
-	obfuscationKeyword string) (*ObfuscatedSshConn, error) {
+	obfuscationKeyword string,
+	obfuscatorPaddingLength *int) (*ObfuscatedSshConn, error) {
 
 	var err error
 	var obfuscator *Obfuscator
@@ -113,7 +116,10 @@ func NewObfuscatedSshConn(
 	var writeState ObfuscatedSshWriteState
 
 	if mode == OBFUSCATION_CONN_MODE_CLIENT {
-		obfuscator, err = NewClientObfuscator(&ObfuscatorConfig{Keyword: obfuscationKeyword})
+		obfuscator, err = NewClientObfuscator(&ObfuscatorConfig{
+			Keyword:       obfuscationKeyword,
+			PaddingLength: obfuscatorPaddingLength,
+		})
 		if err != nil {
 			return nil, ContextError(err)
 		}
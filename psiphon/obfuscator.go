@@ -47,9 +47,13 @@ type Obfuscator struct {
 	serverToClientCipher *rc4.Cipher
 }
 
+// ObfuscatorConfig specifies an Obfuscator. The client seed message
+// padding length is PaddingLength, when not nil and in range; otherwise,
+// it's random, up to MaxPadding.
 type ObfuscatorConfig struct {
-	Keyword    string
-	MaxPadding int
+	Keyword       string
+	MaxPadding    int
+	PaddingLength *int
 }
 
 // NewClientObfuscator creates a new Obfuscator, staging a seed message to be
@@ -73,7 +77,20 @@ func NewClientObfuscator(
 		maxPadding = config.MaxPadding
 	}
 
-	seedMessage, err := makeSeedMessage(maxPadding, seed, clientToServerCipher)
+	var paddingLength int
+	if config.PaddingLength != nil &&
+		*config.PaddingLength >= 0 && *config.PaddingLength <= maxPadding {
+
+		paddingLength = *config.PaddingLength
+	} else {
+		// paddingLength is integer in range [0, maxPadding]
+		paddingLength, err = MakeSecureRandomInt(maxPadding + 1)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	seedMessage, err := makeSeedMessage(paddingLength, seed, clientToServerCipher)
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -161,12 +178,7 @@ func deriveKey(seed, keyword, iv []byte) ([]byte, error) {
 	return digest[0:OBFUSCATE_KEY_LENGTH], nil
 }
 
-func makeSeedMessage(maxPadding int, seed []byte, clientToServerCipher *rc4.Cipher) ([]byte, error) {
-	// paddingLength is integer in range [0, maxPadding]
-	paddingLength, err := MakeSecureRandomInt(maxPadding + 1)
-	if err != nil {
-		return nil, ContextError(err)
-	}
+func makeSeedMessage(paddingLength int, seed []byte, clientToServerCipher *rc4.Cipher) ([]byte, error) {
 	padding, err := MakeSecureRandomBytes(paddingLength)
 	if err != nil {
 		return nil, ContextError(err)
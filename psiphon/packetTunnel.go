@@ -0,0 +1,743 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Psiphon-Inc/dns"
+)
+
+// PacketTunnel is a packet-level alternative to the local proxies, for
+// whole device tunneling. It reads IP packets from a TUN device, such as
+// the file descriptor of an Android VpnService or a Linux TUN interface,
+// and terminates them with a minimal userspace TCP/IP stack:
+//
+// - each TCP connection is accepted locally and relayed through a port
+//   forward made with Controller.Dial, so split tunnel classification
+//   applies; see packetTunnelTCPFlow.
+// - DNS queries, to UDP or TCP port 53 of any address, are answered locally
+//   and resolved through the tunnel as with DnsProxy. The host's resolver
+//   address, which may be a virtual address of the VPN, needn't be
+//   reachable.
+// - other UDP packets are relayed through the tunnel over udpgw when a
+//   udpgw server address is configured, and are otherwise answered with an
+//   ICMP port unreachable.
+//
+// Only IPv4 is supported. IPv6 isn't tunneled: so that applications fall
+// back to IPv4 promptly, instead of waiting for a timeout, IPv6 TCP segments
+// are answered with a RST and IPv6 UDP packets with an ICMPv6 port
+// unreachable. Other IPv6 packets, IP fragments, and protocols other than
+// TCP and UDP, including ICMP, are dropped.
+//
+// The Psiphon client's own connections, including tunnel connections and
+// untunneled split tunnel connections, must not be routed to the TUN
+// device. On Android, this is done with VpnService.protect, through
+// DeviceBinder; on Linux, with policy routing, for example by UID.
+type PacketTunnel struct {
+	tunneler           Tunneler
+	resolver           *dnsResolver
+	udpgwServerAddress string
+	device             io.ReadWriteCloser
+	mtu                int
+	writeMutex         sync.Mutex
+	flowsMutex         sync.Mutex
+	tcpFlows           map[packetTunnelFlowID]*packetTunnelTCPFlow
+	udpFlows           map[packetTunnelFlowID]*packetTunnelUDPFlow
+	runWaitGroup       *sync.WaitGroup
+	stopBroadcast      chan struct{}
+	notices            *Notices
+}
+
+var _PACKET_TUNNEL_TYPE = "PACKET_TUNNEL"
+
+const (
+	ipv4HeaderSize   = 20
+	ipv6HeaderSize   = 40
+	ipv6MinimumMTU   = 1280
+	ipProtocolICMP   = 1
+	ipProtocolTCP    = 6
+	ipProtocolUDP    = 17
+	ipProtocolICMPv6 = 58
+	icmpHeaderSize   = 8
+	udpHeaderSize    = 8
+	dnsPort          = 53
+)
+
+// packetTunnelFlowID identifies a TCP or UDP flow. The local address is the
+// address of the application on the host, which is the source address of
+// packets read from the device, and the remote address is the destination.
+type packetTunnelFlowID struct {
+	localIP    [4]byte
+	localPort  uint16
+	remoteIP   [4]byte
+	remotePort uint16
+}
+
+func (id packetTunnelFlowID) remoteAddr() string {
+	return net.JoinHostPort(
+		net.IP(id.remoteIP[:]).String(), strconv.Itoa(int(id.remotePort)))
+}
+
+// NewPacketTunnel opens the configured TUN device and runs a new packet
+// tunnel. The packet tunnel takes ownership of PacketTunnelFileDescriptor,
+// which is closed when the packet tunnel is closed. splitTunnelClassifier
+// may be nil, in which case all DNS queries are resolved through the tunnel.
+func NewPacketTunnel(
+	config *Config,
+	untunneledDialConfig *DialConfig,
+	tunneler Tunneler,
+	splitTunnelClassifier *SplitTunnelClassifier) (*PacketTunnel, error) {
+
+	var device io.ReadWriteCloser
+	var err error
+	if config.PacketTunnelFileDescriptor != 0 {
+		device, err = newTunDevice(config.PacketTunnelFileDescriptor)
+	} else {
+		device, err = openTunDevice(config.PacketTunnelDeviceName)
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	return newPacketTunnel(
+		config, untunneledDialConfig, tunneler, splitTunnelClassifier, device), nil
+}
+
+func newPacketTunnel(
+	config *Config,
+	untunneledDialConfig *DialConfig,
+	tunneler Tunneler,
+	splitTunnelClassifier *SplitTunnelClassifier,
+	device io.ReadWriteCloser) *PacketTunnel {
+
+	mtu := config.PacketTunnelMTU
+	if mtu == 0 {
+		mtu = PACKET_TUNNEL_MTU
+	}
+
+	tunnel := &PacketTunnel{
+		tunneler:           tunneler,
+		resolver:           newDnsResolver(config, untunneledDialConfig, tunneler, splitTunnelClassifier),
+		udpgwServerAddress: config.UdpgwServerAddress,
+		device:             device,
+		mtu:                mtu,
+		tcpFlows:           make(map[packetTunnelFlowID]*packetTunnelTCPFlow),
+		udpFlows:           make(map[packetTunnelFlowID]*packetTunnelUDPFlow),
+		runWaitGroup:       new(sync.WaitGroup),
+		stopBroadcast:      make(chan struct{}),
+		notices:            config.notices,
+	}
+	tunnel.runWaitGroup.Add(2)
+	go tunnel.readPackets()
+	go tunnel.closeIdleFlows()
+
+	config.notices.Info("packet tunnel started: MTU %d", mtu)
+
+	return tunnel
+}
+
+// Close closes the TUN device and terminates the packet tunnel and all of
+// its flows.
+func (tunnel *PacketTunnel) Close() {
+	close(tunnel.stopBroadcast)
+	tunnel.device.Close()
+	tunnel.runWaitGroup.Wait()
+
+	tunnel.flowsMutex.Lock()
+	tcpFlows, udpFlows := tunnel.getFlows()
+	tunnel.flowsMutex.Unlock()
+
+	for _, flow := range tcpFlows {
+		flow.reset()
+	}
+	for _, flow := range udpFlows {
+		flow.close()
+	}
+}
+
+// getFlows returns copies of the flow maps, so that flows may be closed,
+// which requires flowsMutex, without holding flowsMutex.
+func (tunnel *PacketTunnel) getFlows() ([]*packetTunnelTCPFlow, []*packetTunnelUDPFlow) {
+	tcpFlows := make([]*packetTunnelTCPFlow, 0, len(tunnel.tcpFlows))
+	for _, flow := range tunnel.tcpFlows {
+		tcpFlows = append(tcpFlows, flow)
+	}
+	udpFlows := make([]*packetTunnelUDPFlow, 0, len(tunnel.udpFlows))
+	for _, flow := range tunnel.udpFlows {
+		udpFlows = append(udpFlows, flow)
+	}
+	return tcpFlows, udpFlows
+}
+
+func (tunnel *PacketTunnel) readPackets() {
+	defer tunnel.runWaitGroup.Done()
+
+	// A TUN device returns one packet per read.
+	buffer := make([]byte, 65536)
+	for {
+		// Note: will be interrupted by device.Close() call made by tunnel.Close()
+		n, err := tunnel.device.Read(buffer)
+		select {
+		case <-tunnel.stopBroadcast:
+			tunnel.notices.Info("packet tunnel stopped")
+			return
+		default:
+		}
+		if err != nil {
+			tunnel.notices.Alert("packet tunnel read error: %s", err)
+			tunnel.tunneler.SignalComponentFailure()
+			return
+		}
+		tunnel.handlePacket(buffer[:n])
+	}
+}
+
+// writePacket writes one packet to the device. Write errors are ignored, as
+// with any lost packet; a failed device is reported by readPackets.
+func (tunnel *PacketTunnel) writePacket(packet []byte) {
+	tunnel.writeMutex.Lock()
+	defer tunnel.writeMutex.Unlock()
+	tunnel.device.Write(packet)
+}
+
+// handlePacket dispatches a packet read from the device. The packet
+// references the read buffer, so handlers must copy any data they retain.
+func (tunnel *PacketTunnel) handlePacket(packet []byte) {
+
+	if len(packet) > 0 && packet[0]>>4 == 6 {
+		tunnel.handleIPv6Packet(packet)
+		return
+	}
+
+	if len(packet) < ipv4HeaderSize || packet[0]>>4 != 4 {
+		return
+	}
+	headerSize := int(packet[0]&0x0f) * 4
+	totalLength := int(binary.BigEndian.Uint16(packet[2:4]))
+	if headerSize < ipv4HeaderSize || totalLength < headerSize || totalLength > len(packet) {
+		return
+	}
+
+	// Fragments aren't reassembled: the More Fragments flag or a non-zero
+	// fragment offset indicates a fragment.
+	if binary.BigEndian.Uint16(packet[6:8])&0x3fff != 0 {
+		return
+	}
+
+	var id packetTunnelFlowID
+	copy(id.localIP[:], packet[12:16])
+	copy(id.remoteIP[:], packet[16:20])
+	payload := packet[headerSize:totalLength]
+
+	switch packet[9] {
+	case ipProtocolTCP:
+		tunnel.handleTCPSegment(id, payload)
+	case ipProtocolUDP:
+		tunnel.handleUDPDatagram(id, packet[:totalLength], headerSize)
+	}
+}
+
+// handleIPv6Packet answers an IPv6 TCP segment with a RST and an IPv6 UDP
+// packet with an ICMPv6 port unreachable. Packets with extension headers
+// and packets sent to multicast addresses are dropped.
+func (tunnel *PacketTunnel) handleIPv6Packet(packet []byte) {
+
+	if len(packet) < ipv6HeaderSize {
+		return
+	}
+	payloadLength := int(binary.BigEndian.Uint16(packet[4:6]))
+	if ipv6HeaderSize+payloadLength > len(packet) {
+		return
+	}
+	packet = packet[:ipv6HeaderSize+payloadLength]
+	if net.IP(packet[24:40]).IsMulticast() {
+		return
+	}
+	payload := packet[ipv6HeaderSize:]
+
+	switch packet[6] {
+	case ipProtocolTCP:
+		localPort, remotePort, segment, _ := parseTCPSegment(payload)
+		if segment != nil && segment.flags&tcpFlagRST == 0 {
+			tunnel.writePacket(makeIPv6TCPResetPacket(packet, localPort, remotePort, segment))
+		}
+	case ipProtocolUDP:
+		if len(payload) >= udpHeaderSize {
+			tunnel.writePacket(makeICMPv6PortUnreachablePacket(packet))
+		}
+	}
+}
+
+// handleUDPDatagram handles the UDP datagram in the IPv4 packet, which has
+// an IP header of headerSize bytes.
+func (tunnel *PacketTunnel) handleUDPDatagram(
+	id packetTunnelFlowID, packet []byte, headerSize int) {
+
+	datagram := packet[headerSize:]
+	if len(datagram) < udpHeaderSize {
+		return
+	}
+	id.localPort = binary.BigEndian.Uint16(datagram[0:2])
+	id.remotePort = binary.BigEndian.Uint16(datagram[2:4])
+	length := int(binary.BigEndian.Uint16(datagram[4:6]))
+	if length < udpHeaderSize || length > len(datagram) {
+		return
+	}
+	data := datagram[udpHeaderSize:length]
+
+	if id.remotePort == dnsPort {
+		tunnel.handleDnsQuery(id, data)
+		return
+	}
+
+	if tunnel.udpgwServerAddress == "" {
+		remoteIP := net.IP(id.remoteIP[:])
+		if !remoteIP.IsMulticast() && !remoteIP.Equal(net.IPv4bcast) {
+			tunnel.writePacket(makeICMPPortUnreachablePacket(id, packet, headerSize))
+		}
+		return
+	}
+
+	tunnel.flowsMutex.Lock()
+	flow, ok := tunnel.udpFlows[id]
+	if !ok {
+		flow = newPacketTunnelUDPFlow(tunnel, id)
+		tunnel.udpFlows[id] = flow
+		go flow.relay()
+	}
+	tunnel.flowsMutex.Unlock()
+
+	flow.enqueue(data)
+}
+
+func (tunnel *PacketTunnel) handleDnsQuery(id packetTunnelFlowID, data []byte) {
+
+	query := new(dns.Msg)
+	err := query.Unpack(data)
+	if err != nil {
+		tunnel.notices.LocalProxyError(_PACKET_TUNNEL_TYPE, ContextError(err))
+		return
+	}
+
+	// As IP fragments aren't supported, the response must fit in a single
+	// packet. A larger response is truncated and the host retries over TCP.
+	maxSize := tunnel.mtu - ipv4HeaderSize - udpHeaderSize
+	if opt := query.IsEdns0(); opt != nil && int(opt.UDPSize()) > maxSize {
+		opt.SetUDPSize(uint16(maxSize))
+	}
+
+	tunnel.resolver.resolveAsync(query, func(response *dns.Msg) {
+		packedResponse, err := packUDPDnsResponse(query, response)
+		if err != nil {
+			tunnel.notices.LocalProxyError(_PACKET_TUNNEL_TYPE, ContextError(err))
+			return
+		}
+		tunnel.writePacket(makeUDPPacket(id, packedResponse))
+	})
+}
+
+// localDnsConn is the connection of a TCP flow to port 53, in place of a
+// port forward. The queries written to it are answered by the packet
+// tunnel's resolver, and the responses are read from it, using the TCP DNS
+// message framing.
+type localDnsConn struct {
+	queryReader    *io.PipeReader
+	queryWriter    *io.PipeWriter
+	responseReader *io.PipeReader
+	responseWriter *io.PipeWriter
+}
+
+func (tunnel *PacketTunnel) newLocalDnsConn() *localDnsConn {
+	conn := new(localDnsConn)
+	conn.queryReader, conn.queryWriter = io.Pipe()
+	conn.responseReader, conn.responseWriter = io.Pipe()
+	go func() {
+		err := tunnel.serveLocalDnsConn(conn)
+		if err != nil {
+			tunnel.notices.LocalProxyError(_PACKET_TUNNEL_TYPE, ContextError(err))
+		}
+	}()
+	return conn
+}
+
+func (conn *localDnsConn) Read(buffer []byte) (int, error) {
+	return conn.responseReader.Read(buffer)
+}
+
+func (conn *localDnsConn) Write(buffer []byte) (int, error) {
+	return conn.queryWriter.Write(buffer)
+}
+
+// CloseWrite ends the queries. The responses to the queries already
+// written may still be read, followed by EOF.
+func (conn *localDnsConn) CloseWrite() error {
+	return conn.queryWriter.Close()
+}
+
+func (conn *localDnsConn) Close() error {
+	conn.queryWriter.Close()
+	return conn.responseReader.Close()
+}
+
+// serveLocalDnsConn answers the queries written to conn until the queries
+// end or conn is closed.
+func (tunnel *PacketTunnel) serveLocalDnsConn(conn *localDnsConn) error {
+	defer conn.responseWriter.Close()
+
+	var length [2]byte
+	for {
+		_, err := io.ReadFull(conn.queryReader, length[:])
+		if err == io.EOF || err == io.ErrClosedPipe {
+			return nil
+		}
+		if err != nil {
+			return ContextError(err)
+		}
+		packedQuery := make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err = io.ReadFull(conn.queryReader, packedQuery)
+		if err == io.ErrClosedPipe {
+			return nil
+		}
+		if err != nil {
+			return ContextError(err)
+		}
+
+		query := new(dns.Msg)
+		err = query.Unpack(packedQuery)
+		if err != nil {
+			return ContextError(err)
+		}
+		packedResponse, err := tunnel.resolver.resolve(query).Pack()
+		if err != nil {
+			return ContextError(err)
+		}
+
+		message := make([]byte, 2+len(packedResponse))
+		binary.BigEndian.PutUint16(message[0:2], uint16(len(packedResponse)))
+		copy(message[2:], packedResponse)
+		_, err = conn.responseWriter.Write(message)
+		if err == io.ErrClosedPipe {
+			return nil
+		}
+		if err != nil {
+			return ContextError(err)
+		}
+	}
+}
+
+// closeIdleFlows periodically closes TCP and UDP flows which have had no
+// activity, in either direction, for their idle timeout.
+func (tunnel *PacketTunnel) closeIdleFlows() {
+	defer tunnel.runWaitGroup.Done()
+
+	ticker := time.NewTicker(PACKET_TUNNEL_IDLE_CHECK_PERIOD)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-tunnel.stopBroadcast:
+			return
+		}
+		tunnel.closeIdleFlowsNow()
+	}
+}
+
+func (tunnel *PacketTunnel) closeIdleFlowsNow() {
+
+	tunnel.flowsMutex.Lock()
+	tcpFlows, udpFlows := tunnel.getFlows()
+	tunnel.flowsMutex.Unlock()
+
+	for _, flow := range tcpFlows {
+		if flow.isIdle(PACKET_TUNNEL_TCP_IDLE_TIMEOUT) {
+			flow.reset()
+		}
+	}
+	for _, flow := range udpFlows {
+		if flow.isIdle(PACKET_TUNNEL_UDP_IDLE_TIMEOUT) {
+			flow.close()
+		}
+	}
+}
+
+// makeIPv4Packet makes a packet, sent from the remote address to the local
+// address of the flow, with an IPv4 header followed by payloadSize bytes
+// for the caller to fill in.
+func makeIPv4Packet(id packetTunnelFlowID, protocol byte, payloadSize int) []byte {
+	packet := make([]byte, ipv4HeaderSize+payloadSize)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[6] = 0x40 // Don't Fragment
+	packet[8] = 64   // TTL
+	packet[9] = protocol
+	copy(packet[12:16], id.remoteIP[:])
+	copy(packet[16:20], id.localIP[:])
+	binary.BigEndian.PutUint16(
+		packet[10:12], ^foldChecksum(addChecksum(0, packet[:ipv4HeaderSize])))
+	return packet
+}
+
+// setTransportChecksum sets the TCP or UDP checksum, which covers the
+// IPv4 pseudo header, at checksumOffset in the payload of packet.
+func setTransportChecksum(packet []byte, checksumOffset int) {
+	protocol := packet[9]
+	payload := packet[ipv4HeaderSize:]
+	sum := addChecksum(0, packet[12:20])
+	sum += uint32(protocol) + uint32(len(payload))
+	sum = addChecksum(sum, payload)
+	checksum := ^foldChecksum(sum)
+	if checksum == 0 && protocol == ipProtocolUDP {
+		// For UDP, a zero checksum means no checksum.
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(payload[checksumOffset:checksumOffset+2], checksum)
+}
+
+// addChecksum adds data, as big endian 16-bit words, to the ones' complement
+// sum. An odd trailing byte is padded with zero.
+func addChecksum(sum uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
+
+// makeIPv6Packet makes a packet, in reply to the IPv6 packet request, sent
+// from the destination address to the source address of the request, with
+// an IPv6 header followed by payloadSize bytes for the caller to fill in.
+func makeIPv6Packet(request []byte, nextHeader byte, payloadSize int) []byte {
+	packet := make([]byte, ipv6HeaderSize+payloadSize)
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(payloadSize))
+	packet[6] = nextHeader
+	packet[7] = 64 // Hop Limit
+	copy(packet[8:24], request[24:40])
+	copy(packet[24:40], request[8:24])
+	return packet
+}
+
+// setIPv6Checksum sets the TCP or ICMPv6 checksum, which covers the IPv6
+// pseudo header, at checksumOffset in the payload of packet.
+func setIPv6Checksum(packet []byte, checksumOffset int) {
+	payload := packet[ipv6HeaderSize:]
+	sum := addChecksum(0, packet[8:40])
+	sum += uint32(packet[6]) + uint32(len(payload))
+	sum = addChecksum(sum, payload)
+	binary.BigEndian.PutUint16(
+		payload[checksumOffset:checksumOffset+2], ^foldChecksum(sum))
+}
+
+// makeICMPPortUnreachablePacket makes an ICMP port unreachable in response
+// to the UDP datagram in the IPv4 packet request, which has an IP header of
+// headerSize bytes. As specified in RFC 792, the message quotes the IP
+// header and the first 8 bytes of the datagram.
+func makeICMPPortUnreachablePacket(
+	id packetTunnelFlowID, request []byte, headerSize int) []byte {
+
+	quote := request[:headerSize+udpHeaderSize]
+	packet := makeIPv4Packet(id, ipProtocolICMP, icmpHeaderSize+len(quote))
+	message := packet[ipv4HeaderSize:]
+	message[0] = 3 // Destination Unreachable
+	message[1] = 3 // Port Unreachable
+	copy(message[icmpHeaderSize:], quote)
+	binary.BigEndian.PutUint16(message[2:4], ^foldChecksum(addChecksum(0, message)))
+	return packet
+}
+
+// makeICMPv6PortUnreachablePacket makes an ICMPv6 port unreachable in
+// response to the IPv6 packet request. As specified in RFC 4443, the message
+// quotes as much of the request as fits in the IPv6 minimum MTU.
+func makeICMPv6PortUnreachablePacket(request []byte) []byte {
+	quote := request
+	if len(quote) > ipv6MinimumMTU-ipv6HeaderSize-icmpHeaderSize {
+		quote = quote[:ipv6MinimumMTU-ipv6HeaderSize-icmpHeaderSize]
+	}
+	packet := makeIPv6Packet(request, ipProtocolICMPv6, icmpHeaderSize+len(quote))
+	message := packet[ipv6HeaderSize:]
+	message[0] = 1 // Destination Unreachable
+	message[1] = 4 // Port Unreachable
+	copy(message[icmpHeaderSize:], quote)
+	setIPv6Checksum(packet, 2)
+	return packet
+}
+
+func makeUDPPacket(id packetTunnelFlowID, data []byte) []byte {
+	packet := makeIPv4Packet(id, ipProtocolUDP, udpHeaderSize+len(data))
+	datagram := packet[ipv4HeaderSize:]
+	binary.BigEndian.PutUint16(datagram[0:2], id.remotePort)
+	binary.BigEndian.PutUint16(datagram[2:4], id.localPort)
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(len(datagram)))
+	copy(datagram[udpHeaderSize:], data)
+	setTransportChecksum(packet, 6)
+	return packet
+}
+
+// packetTunnelUDPFlow relays the UDP packets between a local and a remote
+// address through a udpgw port forward.
+type packetTunnelUDPFlow struct {
+	tunnel           *PacketTunnel
+	id               packetTunnelFlowID
+	packets          chan []byte
+	stopBroadcast    chan struct{}
+	mutex            sync.Mutex
+	isClosed         bool
+	conn             net.Conn
+	lastActivityTime time.Time
+}
+
+func newPacketTunnelUDPFlow(tunnel *PacketTunnel, id packetTunnelFlowID) *packetTunnelUDPFlow {
+	return &packetTunnelUDPFlow{
+		tunnel:           tunnel,
+		id:               id,
+		packets:          make(chan []byte, PACKET_TUNNEL_UDP_QUEUE_SIZE),
+		stopBroadcast:    make(chan struct{}),
+		lastActivityTime: time.Now(),
+	}
+}
+
+// enqueue queues an upstream packet. When the queue is full, as when the
+// port forward is still being dialed, the packet is dropped.
+func (flow *packetTunnelUDPFlow) enqueue(data []byte) {
+	flow.touch()
+	packet := append([]byte(nil), data...)
+	select {
+	case flow.packets <- packet:
+	default:
+	}
+}
+
+func (flow *packetTunnelUDPFlow) relay() {
+
+	conn, err := flow.tunnel.tunneler.Dial(flow.tunnel.udpgwServerAddress, true, nil)
+	if err != nil {
+		flow.tunnel.notices.LocalProxyError(_PACKET_TUNNEL_TYPE, ContextError(err))
+		flow.close()
+		return
+	}
+
+	flow.mutex.Lock()
+	if flow.isClosed {
+		flow.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	flow.conn = conn
+	flow.mutex.Unlock()
+
+	client := newUdpgwClient(conn)
+	remoteAddr := &net.UDPAddr{
+		IP:   net.IPv4(flow.id.remoteIP[0], flow.id.remoteIP[1], flow.id.remoteIP[2], flow.id.remoteIP[3]),
+		Port: int(flow.id.remotePort),
+	}
+
+	go flow.relayDownstream(client)
+
+	for {
+		select {
+		case packet := <-flow.packets:
+			err := client.send(remoteAddr, packet)
+			if err != nil {
+				flow.fail(err)
+				return
+			}
+		case <-flow.stopBroadcast:
+			return
+		}
+	}
+}
+
+func (flow *packetTunnelUDPFlow) relayDownstream(client *udpgwClient) {
+	maxSize := flow.tunnel.mtu - ipv4HeaderSize - udpHeaderSize
+	buffer := make([]byte, udpgwProtocolMaxMessageSize)
+	for {
+		// Note: will be interrupted by conn.Close() call made by flow.close()
+		_, packet, err := client.receive(buffer)
+		if err != nil {
+			flow.fail(err)
+			return
+		}
+		if len(packet) > maxSize {
+			continue
+		}
+		flow.touch()
+		flow.tunnel.writePacket(makeUDPPacket(flow.id, packet))
+	}
+}
+
+func (flow *packetTunnelUDPFlow) touch() {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+	flow.lastActivityTime = time.Now()
+}
+
+func (flow *packetTunnelUDPFlow) isIdle(timeout time.Duration) bool {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+	return time.Since(flow.lastActivityTime) >= timeout
+}
+
+// fail reports a relay error, unless the flow was closed, and closes the
+// flow.
+func (flow *packetTunnelUDPFlow) fail(err error) {
+	flow.mutex.Lock()
+	isClosed := flow.isClosed
+	flow.mutex.Unlock()
+	if !isClosed {
+		flow.tunnel.notices.LocalProxyError(_PACKET_TUNNEL_TYPE, ContextError(err))
+	}
+	flow.close()
+}
+
+func (flow *packetTunnelUDPFlow) close() {
+	flow.mutex.Lock()
+	if flow.isClosed {
+		flow.mutex.Unlock()
+		return
+	}
+	flow.isClosed = true
+	close(flow.stopBroadcast)
+	if flow.conn != nil {
+		flow.conn.Close()
+	}
+	flow.mutex.Unlock()
+
+	flow.tunnel.flowsMutex.Lock()
+	if flow.tunnel.udpFlows[flow.id] == flow {
+		delete(flow.tunnel.udpFlows, flow.id)
+	}
+	flow.tunnel.flowsMutex.Unlock()
+}
@@ -0,0 +1,717 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	tcpHeaderSize = 20
+
+	tcpFlagFIN = 1 << 0
+	tcpFlagSYN = 1 << 1
+	tcpFlagRST = 1 << 2
+	tcpFlagPSH = 1 << 3
+	tcpFlagACK = 1 << 4
+
+	tcpOptionEnd = 0
+	tcpOptionNOP = 1
+	tcpOptionMSS = 2
+
+	// tcpDefaultMSS is the MSS assumed when the SYN has no MSS option.
+	tcpDefaultMSS = 536
+)
+
+// tcpSegment is a parsed TCP segment. data references the packet buffer.
+type tcpSegment struct {
+	sequence       uint32
+	acknowledgment uint32
+	flags          byte
+	window         uint16
+	data           []byte
+}
+
+// packetTunnelTCPFlow is the local endpoint of a TCP connection made by an
+// application on the host, which is relayed through a port forward.
+//
+// The TCP implementation is only what's needed to interoperate with host
+// TCP stacks over a local device, where loss is rare: segments are received
+// in order only, and out-of-order segments are dropped and recovered by the
+// host's retransmissions; sent segments are retransmitted go-back-N, with an
+// exponential retransmit timeout; the MSS option is supported; and a zero
+// window is probed. Window scaling, SACK, and congestion control aren't
+// implemented, so the send rate is limited by the host's receive window.
+//
+// The SYN-ACK is sent only once the port forward is established, so a
+// failed port forward is reported to the application with a RST. The
+// SYN-ACK isn't retransmitted; instead, a retransmitted SYN is answered.
+type packetTunnelTCPFlow struct {
+	tunnel           *PacketTunnel
+	id               packetTunnelFlowID
+	mutex            sync.Mutex
+	cond             *sync.Cond
+	conn             io.ReadWriteCloser
+	isEstablished    bool
+	isClosed         bool
+	lastActivityTime time.Time
+
+	// The receive state, for data sent by the host. receiveBuffer holds
+	// received data not yet relayed.
+	receiveNext      uint32
+	receiveBuffer    []byte
+	receivedFIN      bool
+	relayedFIN       bool
+	advertisedWindow int
+
+	// The send state, for data from the port forward. sendBuffer holds the
+	// data, sent and unsent, starting at sendUnacknowledged. Once the port
+	// forward reaches EOF, a FIN follows the data in sendBuffer.
+	initialSequence    uint32
+	sendUnacknowledged uint32
+	sendNext           uint32
+	sendMaximum        uint32
+	sendBuffer         []byte
+	sendWindow         int
+	maxSegmentSize     int
+	remoteEOF          bool
+	acknowledgedFIN    bool
+	retransmitTimer    *time.Timer
+	retransmitTimeout  time.Duration
+	retransmitCount    int
+}
+
+// parseTCPSegment parses the TCP header of packet, returning the ports,
+// the segment, and the header options. The segment is nil when the header
+// is malformed.
+func parseTCPSegment(
+	packet []byte) (localPort, remotePort uint16, segment *tcpSegment, options []byte) {
+
+	if len(packet) < tcpHeaderSize {
+		return 0, 0, nil, nil
+	}
+	headerSize := int(packet[12]>>4) * 4
+	if headerSize < tcpHeaderSize || headerSize > len(packet) {
+		return 0, 0, nil, nil
+	}
+	segment = &tcpSegment{
+		sequence:       binary.BigEndian.Uint32(packet[4:8]),
+		acknowledgment: binary.BigEndian.Uint32(packet[8:12]),
+		flags:          packet[13],
+		window:         binary.BigEndian.Uint16(packet[14:16]),
+		data:           packet[headerSize:],
+	}
+	return binary.BigEndian.Uint16(packet[0:2]),
+		binary.BigEndian.Uint16(packet[2:4]),
+		segment,
+		packet[tcpHeaderSize:headerSize]
+}
+
+func (tunnel *PacketTunnel) handleTCPSegment(id packetTunnelFlowID, packet []byte) {
+
+	var segment *tcpSegment
+	var options []byte
+	id.localPort, id.remotePort, segment, options = parseTCPSegment(packet)
+	if segment == nil {
+		return
+	}
+
+	tunnel.flowsMutex.Lock()
+	flow, ok := tunnel.tcpFlows[id]
+	if !ok && segment.flags&(tcpFlagSYN|tcpFlagACK|tcpFlagRST) == tcpFlagSYN {
+		var err error
+		flow, err = newPacketTunnelTCPFlow(tunnel, id, segment, options)
+		if err == nil {
+			tunnel.tcpFlows[id] = flow
+		}
+		tunnel.flowsMutex.Unlock()
+		if err != nil {
+			tunnel.notices.LocalProxyError(_PACKET_TUNNEL_TYPE, ContextError(err))
+			tunnel.writePacket(makeTCPResetPacket(id, segment))
+			return
+		}
+		go flow.dial()
+		return
+	}
+	tunnel.flowsMutex.Unlock()
+
+	if !ok {
+		if segment.flags&tcpFlagRST == 0 {
+			tunnel.writePacket(makeTCPResetPacket(id, segment))
+		}
+		return
+	}
+
+	flow.handleSegment(segment)
+}
+
+func newPacketTunnelTCPFlow(
+	tunnel *PacketTunnel,
+	id packetTunnelFlowID,
+	syn *tcpSegment,
+	options []byte) (*packetTunnelTCPFlow, error) {
+
+	initialSequenceBytes, err := MakeSecureRandomBytes(4)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	initialSequence := binary.BigEndian.Uint32(initialSequenceBytes)
+
+	maxSegmentSize := getTCPMaxSegmentSize(options)
+	if maxSegmentSize > tunnel.mtu-ipv4HeaderSize-tcpHeaderSize {
+		maxSegmentSize = tunnel.mtu - ipv4HeaderSize - tcpHeaderSize
+	}
+
+	flow := &packetTunnelTCPFlow{
+		tunnel:             tunnel,
+		id:                 id,
+		lastActivityTime:   time.Now(),
+		receiveNext:        syn.sequence + 1,
+		advertisedWindow:   PACKET_TUNNEL_TCP_RECEIVE_WINDOW,
+		initialSequence:    initialSequence,
+		sendUnacknowledged: initialSequence + 1,
+		sendNext:           initialSequence + 1,
+		sendMaximum:        initialSequence + 1,
+		sendWindow:         int(syn.window),
+		maxSegmentSize:     maxSegmentSize,
+		retransmitTimeout:  PACKET_TUNNEL_TCP_RETRANSMIT_TIMEOUT,
+	}
+	flow.cond = sync.NewCond(&flow.mutex)
+	return flow, nil
+}
+
+// getTCPMaxSegmentSize returns the value of the MSS option, if present in
+// the SYN options, or the default MSS.
+func getTCPMaxSegmentSize(options []byte) int {
+	for i := 0; i < len(options); {
+		switch options[i] {
+		case tcpOptionEnd:
+			return tcpDefaultMSS
+		case tcpOptionNOP:
+			i++
+			continue
+		}
+		if i+1 >= len(options) || options[i+1] < 2 {
+			break
+		}
+		length := int(options[i+1])
+		if options[i] == tcpOptionMSS && length == 4 && i+4 <= len(options) {
+			maxSegmentSize := int(binary.BigEndian.Uint16(options[i+2 : i+4]))
+			if maxSegmentSize > 0 {
+				return maxSegmentSize
+			}
+		}
+		i += length
+	}
+	return tcpDefaultMSS
+}
+
+// sequenceLess compares sequence numbers, allowing for wraparound.
+func sequenceLess(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// dial makes the port forward for the flow and completes the handshake.
+// DNS queries over TCP, which the host may send when a UDP response is
+// truncated, are answered locally instead, as with UDP.
+func (flow *packetTunnelTCPFlow) dial() {
+
+	var conn io.ReadWriteCloser
+	var err error
+	if flow.id.remotePort == dnsPort {
+		conn = flow.tunnel.newLocalDnsConn()
+	} else {
+		// Using the host application's destination address, so split tunnel
+		// classification applies.
+		conn, err = flow.tunnel.tunneler.Dial(flow.id.remoteAddr(), false, nil)
+	}
+
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+
+	if err != nil {
+		flow.tunnel.notices.LocalProxyError(_PACKET_TUNNEL_TYPE, ContextError(err))
+		flow.resetLocked()
+		return
+	}
+
+	if flow.isClosed {
+		conn.Close()
+		return
+	}
+
+	flow.conn = conn
+	flow.isEstablished = true
+	flow.sendSYNACK()
+
+	go flow.relayUpstream()
+	go flow.relayDownstream()
+}
+
+func (flow *packetTunnelTCPFlow) handleSegment(segment *tcpSegment) {
+
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+
+	if flow.isClosed {
+		return
+	}
+	flow.lastActivityTime = time.Now()
+
+	if segment.flags&tcpFlagRST != 0 {
+		flow.closeLocked()
+		return
+	}
+
+	if segment.flags&tcpFlagSYN != 0 {
+		// A retransmitted SYN, when the SYN-ACK was lost. SYNs received
+		// while the port forward is being dialed are ignored.
+		if flow.isEstablished && segment.sequence+1 == flow.receiveNext {
+			flow.sendSYNACK()
+		}
+		return
+	}
+
+	if !flow.isEstablished || segment.flags&tcpFlagACK == 0 {
+		return
+	}
+
+	flow.handleAcknowledgment(segment.acknowledgment, int(segment.window))
+	if flow.isClosed {
+		return
+	}
+
+	isFIN := segment.flags&tcpFlagFIN != 0
+	if len(segment.data) == 0 && !isFIN {
+		return
+	}
+
+	// Accept the data, or the part of the data, which starts at
+	// receiveNext, up to the free receive buffer space. Retransmitted data
+	// which was already received is trimmed.
+	offset := int(int32(flow.receiveNext - segment.sequence))
+	if !flow.receivedFIN && offset >= 0 && offset <= len(segment.data) {
+		data := segment.data[offset:]
+		free := PACKET_TUNNEL_TCP_RECEIVE_WINDOW - len(flow.receiveBuffer)
+		if len(data) > free {
+			data = data[:free]
+			isFIN = false
+		}
+		if len(data) > 0 {
+			flow.receiveBuffer = append(flow.receiveBuffer, data...)
+			flow.receiveNext += uint32(len(data))
+			flow.cond.Broadcast()
+		}
+		if isFIN {
+			flow.receiveNext++
+			flow.receivedFIN = true
+			flow.cond.Broadcast()
+		}
+	}
+
+	// Every data segment is acknowledged, including out-of-order and
+	// duplicate segments, which prompts the host to retransmit.
+	flow.sendAcknowledgment()
+}
+
+// handleAcknowledgment processes the acknowledgment number and window of an
+// ACK segment. Acknowledgments of data which wasn't sent are ignored.
+func (flow *packetTunnelTCPFlow) handleAcknowledgment(acknowledgment uint32, window int) {
+
+	acknowledged := int(int32(acknowledgment - flow.sendUnacknowledged))
+	if acknowledged < 0 || acknowledged > int(int32(flow.sendMaximum-flow.sendUnacknowledged)) {
+		return
+	}
+
+	flow.sendWindow = window
+
+	if acknowledged > 0 {
+		if acknowledged > len(flow.sendBuffer) {
+			flow.acknowledgedFIN = true
+			acknowledged = len(flow.sendBuffer)
+		}
+		flow.sendBuffer = flow.sendBuffer[acknowledged:]
+		flow.sendUnacknowledged = acknowledgment
+		if sequenceLess(flow.sendNext, acknowledgment) {
+			flow.sendNext = acknowledgment
+		}
+		flow.retransmitTimeout = PACKET_TUNNEL_TCP_RETRANSMIT_TIMEOUT
+		flow.retransmitCount = 0
+		flow.stopRetransmitTimer()
+		flow.cond.Broadcast()
+	}
+
+	if flow.acknowledgedFIN && flow.relayedFIN {
+		flow.closeLocked()
+		return
+	}
+
+	flow.transmit()
+}
+
+// transmit sends the unsent data in sendBuffer which the host's receive
+// window allows, followed by a FIN once the port forward has reached EOF
+// and all data is sent. The retransmit timer runs while there's data or a
+// FIN to be acknowledged or, for zero window probes, data to be sent.
+func (flow *packetTunnelTCPFlow) transmit() {
+
+	for {
+		offset := int(flow.sendNext - flow.sendUnacknowledged)
+		if offset >= len(flow.sendBuffer) {
+			break
+		}
+		size := len(flow.sendBuffer) - offset
+		if size > flow.maxSegmentSize {
+			size = flow.maxSegmentSize
+		}
+		if size > flow.sendWindow-offset {
+			size = flow.sendWindow - offset
+		}
+		if size <= 0 {
+			break
+		}
+		flow.sendSegment(
+			tcpFlagACK|tcpFlagPSH, flow.sendNext, flow.sendBuffer[offset:offset+size])
+		flow.sendNext += uint32(size)
+	}
+
+	if flow.remoteEOF && !flow.acknowledgedFIN &&
+		int(flow.sendNext-flow.sendUnacknowledged) == len(flow.sendBuffer) {
+
+		flow.sendSegment(tcpFlagACK|tcpFlagFIN, flow.sendNext, nil)
+		flow.sendNext++
+	}
+
+	if sequenceLess(flow.sendMaximum, flow.sendNext) {
+		flow.sendMaximum = flow.sendNext
+	}
+
+	if flow.sendNext != flow.sendUnacknowledged || len(flow.sendBuffer) > 0 {
+		flow.startRetransmitTimer()
+	} else {
+		flow.stopRetransmitTimer()
+	}
+}
+
+func (flow *packetTunnelTCPFlow) startRetransmitTimer() {
+	if flow.retransmitTimer != nil {
+		return
+	}
+	// The callback takes flow.mutex, which is held here, before reading
+	// timer, so timer is set before the callback reads it.
+	var timer *time.Timer
+	timer = time.AfterFunc(flow.retransmitTimeout, func() {
+		flow.mutex.Lock()
+		defer flow.mutex.Unlock()
+		flow.retransmit(timer)
+	})
+	flow.retransmitTimer = timer
+}
+
+func (flow *packetTunnelTCPFlow) stopRetransmitTimer() {
+	if flow.retransmitTimer != nil {
+		flow.retransmitTimer.Stop()
+		flow.retransmitTimer = nil
+	}
+}
+
+// retransmit resends all unacknowledged data, go-back-N. When the host's
+// window is zero, one byte is sent instead, as a probe which the host
+// acknowledges with its current window; probes aren't limited in number.
+// The caller must hold flow.mutex.
+func (flow *packetTunnelTCPFlow) retransmit(timer *time.Timer) {
+
+	if flow.isClosed || flow.retransmitTimer != timer {
+		return
+	}
+	flow.retransmitTimer = nil
+
+	flow.sendNext = flow.sendUnacknowledged
+
+	if flow.sendWindow == 0 && len(flow.sendBuffer) > 0 {
+		flow.sendSegment(tcpFlagACK, flow.sendNext, flow.sendBuffer[:1])
+		flow.sendNext++
+	} else {
+		flow.retransmitCount++
+		if flow.retransmitCount > PACKET_TUNNEL_TCP_MAX_RETRANSMITS {
+			flow.resetLocked()
+			return
+		}
+		flow.retransmitTimeout *= 2
+		if flow.retransmitTimeout > PACKET_TUNNEL_TCP_MAX_RETRANSMIT_TIMEOUT {
+			flow.retransmitTimeout = PACKET_TUNNEL_TCP_MAX_RETRANSMIT_TIMEOUT
+		}
+	}
+
+	flow.transmit()
+}
+
+// relayUpstream writes the data received from the host to the port forward.
+func (flow *packetTunnelTCPFlow) relayUpstream() {
+	var buffer []byte
+	for {
+		flow.mutex.Lock()
+		for !flow.isClosed && len(flow.receiveBuffer) == 0 && !flow.receivedFIN {
+			flow.cond.Wait()
+		}
+		if flow.isClosed {
+			flow.mutex.Unlock()
+			return
+		}
+		if len(flow.receiveBuffer) == 0 {
+			// All data, up to the host's FIN, is relayed. Port forwards may
+			// not support half-closing, in which case the flow remains open
+			// until the port forward reaches EOF.
+			if closeWriter, ok := flow.conn.(interface {
+				CloseWrite() error
+			}); ok {
+				closeWriter.CloseWrite()
+			}
+			flow.relayedFIN = true
+			if flow.acknowledgedFIN {
+				flow.closeLocked()
+			}
+			flow.mutex.Unlock()
+			return
+		}
+
+		// Swap buffers, so that the host may send more data while this data
+		// is written to the port forward. When the advertised window was
+		// small, the host is told that the window has opened.
+		data := flow.receiveBuffer
+		flow.receiveBuffer = buffer[:0]
+		buffer = data
+		if flow.advertisedWindow < PACKET_TUNNEL_TCP_RECEIVE_WINDOW/2 {
+			flow.sendAcknowledgment()
+		}
+		flow.mutex.Unlock()
+
+		_, err := flow.conn.Write(buffer)
+		if err != nil {
+			flow.fail(err)
+			return
+		}
+	}
+}
+
+// relayDownstream reads data from the port forward and sends it to the
+// host, limited by the send buffer size.
+func (flow *packetTunnelTCPFlow) relayDownstream() {
+	buffer := make([]byte, 32768)
+	for {
+		flow.mutex.Lock()
+		for !flow.isClosed && len(flow.sendBuffer) >= PACKET_TUNNEL_TCP_SEND_BUFFER_SIZE {
+			flow.cond.Wait()
+		}
+		isClosed := flow.isClosed
+		flow.mutex.Unlock()
+		if isClosed {
+			return
+		}
+
+		// Note: will be interrupted by conn.Close() call made by flow.closeLocked()
+		n, err := flow.conn.Read(buffer)
+
+		if err != nil && err != io.EOF {
+			flow.fail(err)
+			return
+		}
+
+		flow.mutex.Lock()
+		if flow.isClosed {
+			flow.mutex.Unlock()
+			return
+		}
+		flow.lastActivityTime = time.Now()
+		flow.sendBuffer = append(flow.sendBuffer, buffer[:n]...)
+		if err == io.EOF {
+			flow.remoteEOF = true
+		}
+		flow.transmit()
+		flow.mutex.Unlock()
+
+		if err == io.EOF {
+			return
+		}
+	}
+}
+
+func (flow *packetTunnelTCPFlow) sendSYNACK() {
+	options := make([]byte, 4)
+	options[0] = tcpOptionMSS
+	options[1] = 4
+	binary.BigEndian.PutUint16(
+		options[2:4], uint16(flow.tunnel.mtu-ipv4HeaderSize-tcpHeaderSize))
+	flow.tunnel.writePacket(makeTCPPacket(
+		flow.id, flow.initialSequence, flow.receiveNext,
+		tcpFlagSYN|tcpFlagACK, PACKET_TUNNEL_TCP_RECEIVE_WINDOW, options, nil))
+}
+
+func (flow *packetTunnelTCPFlow) sendAcknowledgment() {
+	flow.sendSegment(tcpFlagACK, flow.sendNext, nil)
+}
+
+// sendSegment sends a segment which acknowledges the received data and
+// advertises the free receive buffer space as the window.
+func (flow *packetTunnelTCPFlow) sendSegment(flags byte, sequence uint32, data []byte) {
+	flow.advertisedWindow = PACKET_TUNNEL_TCP_RECEIVE_WINDOW - len(flow.receiveBuffer)
+	flow.tunnel.writePacket(makeTCPPacket(
+		flow.id, sequence, flow.receiveNext, flags, uint16(flow.advertisedWindow), nil, data))
+}
+
+func (flow *packetTunnelTCPFlow) isIdle(timeout time.Duration) bool {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+	return time.Since(flow.lastActivityTime) >= timeout
+}
+
+// fail reports a port forward error, unless the flow was closed, and resets
+// the flow.
+func (flow *packetTunnelTCPFlow) fail(err error) {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+	if !flow.isClosed {
+		flow.tunnel.notices.LocalProxyError(_PACKET_TUNNEL_TYPE, ContextError(err))
+	}
+	flow.resetLocked()
+}
+
+// reset sends a RST to the host and closes the flow.
+func (flow *packetTunnelTCPFlow) reset() {
+	flow.mutex.Lock()
+	defer flow.mutex.Unlock()
+	flow.resetLocked()
+}
+
+func (flow *packetTunnelTCPFlow) resetLocked() {
+	if flow.isClosed {
+		return
+	}
+	if flow.isEstablished {
+		flow.sendSegment(tcpFlagRST|tcpFlagACK, flow.sendNext, nil)
+	} else {
+		// Before the SYN-ACK, the RST refuses the connection.
+		flow.tunnel.writePacket(makeTCPPacket(
+			flow.id, 0, flow.receiveNext, tcpFlagRST|tcpFlagACK, 0, nil, nil))
+	}
+	flow.closeLocked()
+}
+
+// closeLocked closes the flow and its port forward and removes the flow
+// from the packet tunnel. The caller must hold flow.mutex, and must not
+// hold tunnel.flowsMutex.
+func (flow *packetTunnelTCPFlow) closeLocked() {
+	if flow.isClosed {
+		return
+	}
+	flow.isClosed = true
+	flow.stopRetransmitTimer()
+	flow.cond.Broadcast()
+	if flow.conn != nil {
+		flow.conn.Close()
+	}
+
+	flow.tunnel.flowsMutex.Lock()
+	if flow.tunnel.tcpFlows[flow.id] == flow {
+		delete(flow.tunnel.tcpFlows, flow.id)
+	}
+	flow.tunnel.flowsMutex.Unlock()
+}
+
+// makeTCPResetPacket makes a RST in response to a segment which doesn't
+// belong to a flow.
+func makeTCPResetPacket(id packetTunnelFlowID, segment *tcpSegment) []byte {
+	sequence, acknowledgment, flags := getTCPResetFields(segment)
+	return makeTCPPacket(id, sequence, acknowledgment, flags, 0, nil, nil)
+}
+
+// makeIPv6TCPResetPacket makes a RST in response to the segment in the IPv6
+// packet request.
+func makeIPv6TCPResetPacket(
+	request []byte, localPort, remotePort uint16, segment *tcpSegment) []byte {
+
+	sequence, acknowledgment, flags := getTCPResetFields(segment)
+	packet := makeIPv6Packet(request, ipProtocolTCP, tcpHeaderSize)
+	putTCPHeader(
+		packet[ipv6HeaderSize:], localPort, remotePort,
+		sequence, acknowledgment, flags, 0, nil)
+	setIPv6Checksum(packet, 16)
+	return packet
+}
+
+// getTCPResetFields returns the sequence number, acknowledgment number, and
+// flags of a RST in response to segment, as specified in RFC 793.
+func getTCPResetFields(segment *tcpSegment) (uint32, uint32, byte) {
+	if segment.flags&tcpFlagACK != 0 {
+		return segment.acknowledgment, 0, tcpFlagRST
+	}
+	acknowledgment := segment.sequence + uint32(len(segment.data))
+	if segment.flags&tcpFlagSYN != 0 {
+		acknowledgment++
+	}
+	if segment.flags&tcpFlagFIN != 0 {
+		acknowledgment++
+	}
+	return 0, acknowledgment, tcpFlagRST | tcpFlagACK
+}
+
+// makeTCPPacket makes a TCP packet, sent from the remote address to the
+// local address of the flow. The length of options must be a multiple of 4.
+func makeTCPPacket(
+	id packetTunnelFlowID,
+	sequence, acknowledgment uint32,
+	flags byte,
+	window uint16,
+	options, data []byte) []byte {
+
+	headerSize := tcpHeaderSize + len(options)
+	packet := makeIPv4Packet(id, ipProtocolTCP, headerSize+len(data))
+	segment := packet[ipv4HeaderSize:]
+	putTCPHeader(
+		segment, id.localPort, id.remotePort,
+		sequence, acknowledgment, flags, window, options)
+	copy(segment[headerSize:], data)
+	setTransportChecksum(packet, 16)
+	return packet
+}
+
+// putTCPHeader writes the header, with options, of a TCP segment sent from
+// remotePort to localPort. The checksum is set by the caller.
+func putTCPHeader(
+	segment []byte,
+	localPort, remotePort uint16,
+	sequence, acknowledgment uint32,
+	flags byte,
+	window uint16,
+	options []byte) {
+
+	headerSize := tcpHeaderSize + len(options)
+	binary.BigEndian.PutUint16(segment[0:2], remotePort)
+	binary.BigEndian.PutUint16(segment[2:4], localPort)
+	binary.BigEndian.PutUint32(segment[4:8], sequence)
+	binary.BigEndian.PutUint32(segment[8:12], acknowledgment)
+	segment[12] = byte(headerSize/4) << 4
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:16], window)
+	copy(segment[tcpHeaderSize:], options)
+}
@@ -0,0 +1,105 @@
+// +build linux
+
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/if_tun.h.
+const (
+	tunDevicePath = "/dev/net/tun"
+	tunSetIff     = 0x400454ca
+	iffTun        = 0x0001
+	iffNoPI       = 0x1000
+)
+
+// tunInterfaceRequest is the struct ifreq used with TUNSETIFF.
+type tunInterfaceRequest struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// newTunDevice makes a device from a TUN file descriptor, such as the
+// file descriptor of an Android VpnService, which reads and writes IP
+// packets without a packet information header. The device takes ownership
+// of the file descriptor, which is closed on failure.
+func newTunDevice(fileDescriptor int) (io.ReadWriteCloser, error) {
+
+	// In non-blocking mode, the file uses the Go poller, so that a blocked
+	// read is interrupted when the file is closed.
+	err := syscall.SetNonblock(fileDescriptor, true)
+	if err != nil {
+		syscall.Close(fileDescriptor)
+		return nil, ContextError(err)
+	}
+
+	return os.NewFile(uintptr(fileDescriptor), "tun"), nil
+}
+
+// closeTunFileDescriptor closes a TUN file descriptor for which no device
+// was made.
+func closeTunFileDescriptor(fileDescriptor int) {
+	syscall.Close(fileDescriptor)
+}
+
+// openTunDevice attaches to the named TUN interface, which must be created
+// and configured, with its addresses and routes, outside of the Psiphon
+// client. For example, the interface may be created with
+// "ip tuntap add dev <name> mode tun user <user>", which allows the client
+// to run as <user> without CAP_NET_ADMIN.
+func openTunDevice(name string) (io.ReadWriteCloser, error) {
+
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, ContextError(errors.New("invalid TUN device name"))
+	}
+
+	fileDescriptor, err := syscall.Open(tunDevicePath, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, ContextError(os.NewSyscallError("open", err))
+	}
+
+	var request tunInterfaceRequest
+	copy(request.name[:], name)
+	request.flags = iffTun | iffNoPI
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		uintptr(fileDescriptor),
+		uintptr(tunSetIff),
+		uintptr(unsafe.Pointer(&request)))
+	if errno != 0 {
+		syscall.Close(fileDescriptor)
+		return nil, ContextError(os.NewSyscallError("ioctl", errno))
+	}
+
+	device, err := newTunDevice(fileDescriptor)
+	if err != nil {
+		syscall.Close(fileDescriptor)
+		return nil, ContextError(err)
+	}
+	return device, nil
+}
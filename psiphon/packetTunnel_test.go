@@ -0,0 +1,551 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Psiphon-Inc/dns"
+)
+
+// testTunDevice is a TUN device which exchanges packets over channels.
+type testTunDevice struct {
+	upstream   chan []byte
+	downstream chan []byte
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+func newTestTunDevice() *testTunDevice {
+	return &testTunDevice{
+		upstream:   make(chan []byte, 256),
+		downstream: make(chan []byte, 256),
+		closed:     make(chan struct{}),
+	}
+}
+
+func (device *testTunDevice) Read(buffer []byte) (int, error) {
+	select {
+	case packet := <-device.upstream:
+		return copy(buffer, packet), nil
+	case <-device.closed:
+		return 0, io.EOF
+	}
+}
+
+func (device *testTunDevice) Write(packet []byte) (int, error) {
+	select {
+	case device.downstream <- append([]byte(nil), packet...):
+		return len(packet), nil
+	case <-device.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (device *testTunDevice) Close() error {
+	device.closeOnce.Do(func() { close(device.closed) })
+	return nil
+}
+
+// readPacket returns the next packet sent to the host with the specified
+// protocol, after checking its checksums, and its transport payload.
+func (device *testTunDevice) readPacket(t *testing.T, protocol byte) []byte {
+	for {
+		var packet []byte
+		select {
+		case packet = <-device.downstream:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout reading packet")
+		}
+		if foldChecksum(addChecksum(0, packet[:ipv4HeaderSize])) != 0xffff {
+			t.Fatalf("invalid IP checksum: %x", packet)
+		}
+		payload := packet[ipv4HeaderSize:]
+		sum := uint32(0)
+		if packet[9] != ipProtocolICMP {
+			// The TCP and UDP checksums cover the pseudo header
+			sum = addChecksum(0, packet[12:20]) + uint32(packet[9]) + uint32(len(payload))
+		}
+		if foldChecksum(addChecksum(sum, payload)) != 0xffff {
+			t.Fatalf("invalid transport checksum: %x", packet)
+		}
+		if packet[9] == protocol {
+			return payload
+		}
+	}
+}
+
+func (device *testTunDevice) readTCPSegment(t *testing.T) (*tcpSegment, []byte) {
+	packet := device.readPacket(t, ipProtocolTCP)
+	headerSize := int(packet[12]>>4) * 4
+	return &tcpSegment{
+		sequence:       binary.BigEndian.Uint32(packet[4:8]),
+		acknowledgment: binary.BigEndian.Uint32(packet[8:12]),
+		flags:          packet[13],
+		window:         binary.BigEndian.Uint16(packet[14:16]),
+		data:           packet[headerSize:],
+	}, packet[tcpHeaderSize:headerSize]
+}
+
+// reverseFlowID returns the ID with the local and remote addresses swapped,
+// so that packets made with it are sent from the host.
+func reverseFlowID(id packetTunnelFlowID) packetTunnelFlowID {
+	return packetTunnelFlowID{
+		localIP:    id.remoteIP,
+		localPort:  id.remotePort,
+		remoteIP:   id.localIP,
+		remotePort: id.localPort,
+	}
+}
+
+func TestPacketTunnelTCP(t *testing.T) {
+
+	echoServer := runTestServer(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+	})
+	defer echoServer.Close()
+	_, portString, _ := net.SplitHostPort(echoServer.Addr().String())
+	port, _ := strconv.Atoi(portString)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+
+	device := newTestTunDevice()
+	tunnel := newPacketTunnel(config, &DialConfig{}, testTunneler{}, nil, device)
+	defer tunnel.Close()
+
+	id := packetTunnelFlowID{
+		localIP:    [4]byte{10, 0, 0, 2},
+		localPort:  40000,
+		remoteIP:   [4]byte{127, 0, 0, 1},
+		remotePort: uint16(port),
+	}
+	hostID := reverseFlowID(id)
+	send := func(sequence, acknowledgment uint32, flags byte, options, data []byte) {
+		device.upstream <- makeTCPPacket(
+			hostID, sequence, acknowledgment, flags, 65535, options, data)
+	}
+
+	// The handshake completes once the port forward is established, with the
+	// MSS limited by the MTU
+	hostSequence := uint32(1000)
+	send(hostSequence, 0, tcpFlagSYN, []byte{tcpOptionMSS, 4, 0x27, 0x10}, nil)
+	segment, options := device.readTCPSegment(t)
+	if segment.flags != tcpFlagSYN|tcpFlagACK || segment.acknowledgment != hostSequence+1 ||
+		getTCPMaxSegmentSize(options) != PACKET_TUNNEL_MTU-40 {
+		t.Fatalf("unexpected SYN-ACK: %+v, %x", segment, options)
+	}
+	hostSequence++
+	sequence := segment.sequence + 1
+	send(hostSequence, sequence, tcpFlagACK, nil, nil)
+
+	// Data is echoed in segments no larger than the MSS
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	for i := 0; i < len(data); i += 1000 {
+		send(hostSequence, sequence, tcpFlagACK|tcpFlagPSH, nil, data[i:i+1000])
+		hostSequence += 1000
+	}
+	var echoed []byte
+	for len(echoed) < len(data) {
+		segment, _ = device.readTCPSegment(t)
+		if len(segment.data) == 0 {
+			continue
+		}
+		if segment.sequence != sequence || len(segment.data) > PACKET_TUNNEL_MTU-40 {
+			t.Fatalf("unexpected segment: %+v", segment)
+		}
+		echoed = append(echoed, segment.data...)
+		sequence += uint32(len(segment.data))
+		send(hostSequence, sequence, tcpFlagACK, nil, nil)
+	}
+	if !bytes.Equal(echoed, data) {
+		t.Fatalf("unexpected echoed data")
+	}
+
+	// Unacknowledged data is retransmitted
+	send(hostSequence, sequence, tcpFlagACK|tcpFlagPSH, nil, []byte("retransmit"))
+	hostSequence += 10
+	var retransmitted *tcpSegment
+	for i := 0; i < 2; {
+		segment, _ = device.readTCPSegment(t)
+		if len(segment.data) == 0 {
+			continue
+		}
+		if segment.sequence != sequence || string(segment.data) != "retransmit" {
+			t.Fatalf("unexpected segment: %+v", segment)
+		}
+		retransmitted = segment
+		i++
+	}
+	sequence += uint32(len(retransmitted.data))
+	send(hostSequence, sequence, tcpFlagACK, nil, nil)
+
+	// The host's FIN is relayed, and the echo server's FIN follows
+	send(hostSequence, sequence, tcpFlagACK|tcpFlagFIN, nil, nil)
+	hostSequence++
+	for {
+		segment, _ = device.readTCPSegment(t)
+		if segment.acknowledgment != hostSequence {
+			t.Fatalf("unexpected segment: %+v", segment)
+		}
+		if segment.flags&tcpFlagFIN != 0 {
+			break
+		}
+	}
+	if segment.sequence != sequence {
+		t.Fatalf("unexpected FIN: %+v", segment)
+	}
+	send(hostSequence, sequence+1, tcpFlagACK, nil, nil)
+
+	for i := 0; ; i++ {
+		tunnel.flowsMutex.Lock()
+		flowCount := len(tunnel.tcpFlows)
+		tunnel.flowsMutex.Unlock()
+		if flowCount == 0 {
+			break
+		}
+		if i > 50 {
+			t.Fatalf("flow not closed")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// Segments of unknown flows are reset
+	send(hostSequence, sequence+1, tcpFlagACK, nil, []byte("unknown"))
+	segment, _ = device.readTCPSegment(t)
+	if segment.flags != tcpFlagRST || segment.sequence != sequence+1 {
+		t.Fatalf("unexpected RST: %+v", segment)
+	}
+
+	// A failed port forward refuses the connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	_, portString, _ = net.SplitHostPort(listener.Addr().String())
+	port, _ = strconv.Atoi(portString)
+	listener.Close()
+	hostID.localPort = uint16(port)
+	send(2000, 0, tcpFlagSYN, nil, nil)
+	segment, _ = device.readTCPSegment(t)
+	if segment.flags != tcpFlagRST|tcpFlagACK || segment.acknowledgment != 2001 {
+		t.Fatalf("unexpected RST: %+v", segment)
+	}
+}
+
+func TestPacketTunnelDNS(t *testing.T) {
+
+	resolver := runTestServer(t, func(conn net.Conn) {
+		dnsConn := &dns.Conn{Conn: conn}
+		query, err := dnsConn.ReadMsg()
+		if err != nil {
+			return
+		}
+		dnsConn.WriteMsg(makeTestDnsResponse(query))
+	})
+	defer resolver.Close()
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+	config.DnsProxyResolverAddress = resolver.Addr().String()
+
+	device := newTestTunDevice()
+	tunnel := newPacketTunnel(config, &DialConfig{}, testTunneler{}, nil, device)
+	defer tunnel.Close()
+
+	// Queries to any address are resolved through the tunnel
+	id := packetTunnelFlowID{
+		localIP:    [4]byte{10, 0, 0, 2},
+		localPort:  40000,
+		remoteIP:   [4]byte{192, 0, 2, 53},
+		remotePort: dnsPort,
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("www.example.", dns.TypeA)
+	packedQuery, _ := query.Pack()
+	device.upstream <- makeUDPPacket(reverseFlowID(id), packedQuery)
+
+	datagram := device.readPacket(t, ipProtocolUDP)
+	if binary.BigEndian.Uint16(datagram[0:2]) != dnsPort ||
+		binary.BigEndian.Uint16(datagram[2:4]) != id.localPort {
+		t.Fatalf("unexpected datagram: %x", datagram)
+	}
+	response := new(dns.Msg)
+	err = response.Unpack(datagram[udpHeaderSize:])
+	if err != nil {
+		t.Fatalf("Unpack failed: %s", err)
+	}
+	if response.Id != query.Id || len(response.Answer) != 1 ||
+		!response.Answer[0].(*dns.A).A.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("unexpected response: %s", response)
+	}
+
+	// Queries over TCP are also answered locally, with the TCP DNS message
+	// framing, and the flow closes after the host's FIN
+	id.localPort = 40001
+	hostID := reverseFlowID(id)
+	send := func(sequence, acknowledgment uint32, flags byte, data []byte) {
+		device.upstream <- makeTCPPacket(
+			hostID, sequence, acknowledgment, flags, 65535, nil, data)
+	}
+	hostSequence := uint32(1000)
+	send(hostSequence, 0, tcpFlagSYN, nil)
+	segment, _ := device.readTCPSegment(t)
+	if segment.flags != tcpFlagSYN|tcpFlagACK {
+		t.Fatalf("unexpected SYN-ACK: %+v", segment)
+	}
+	hostSequence++
+	sequence := segment.sequence + 1
+	query.SetQuestion("tcp.example.", dns.TypeA)
+	packedQuery, _ = query.Pack()
+	message := append([]byte{0, byte(len(packedQuery))}, packedQuery...)
+	send(hostSequence, sequence, tcpFlagACK|tcpFlagPSH, message)
+	hostSequence += uint32(len(message))
+	var received []byte
+	for len(received) < 2 ||
+		len(received) < 2+int(binary.BigEndian.Uint16(received[0:2])) {
+		segment, _ = device.readTCPSegment(t)
+		received = append(received, segment.data...)
+		sequence += uint32(len(segment.data))
+	}
+	response = new(dns.Msg)
+	err = response.Unpack(received[2:])
+	if err != nil {
+		t.Fatalf("Unpack failed: %s", err)
+	}
+	if response.Id != query.Id || len(response.Answer) != 1 ||
+		response.Answer[0].Header().Name != "tcp.example." {
+		t.Errorf("unexpected response: %s", response)
+	}
+	send(hostSequence, sequence, tcpFlagACK|tcpFlagFIN, nil)
+	hostSequence++
+	for segment.flags&tcpFlagFIN == 0 {
+		segment, _ = device.readTCPSegment(t)
+	}
+	send(hostSequence, segment.sequence+1, tcpFlagACK, nil)
+
+	// Other UDP packets are answered with an ICMP port unreachable, quoting
+	// the IP header and UDP header, when udpgw isn't configured
+	id.remotePort = 443
+	droppedPacket := makeUDPPacket(reverseFlowID(id), []byte("dropped"))
+	device.upstream <- droppedPacket
+	icmpMessage := device.readPacket(t, ipProtocolICMP)
+	if icmpMessage[0] != 3 || icmpMessage[1] != 3 ||
+		!bytes.Equal(icmpMessage[icmpHeaderSize:], droppedPacket[:ipv4HeaderSize+udpHeaderSize]) {
+		t.Errorf("unexpected ICMP message: %x", icmpMessage)
+	}
+	tunnel.flowsMutex.Lock()
+	flowCount := len(tunnel.udpFlows)
+	tunnel.flowsMutex.Unlock()
+	if flowCount != 0 {
+		t.Errorf("unexpected UDP flow")
+	}
+}
+
+func TestPacketTunnelUDP(t *testing.T) {
+
+	// The fake udpgw server echoes each packet back, clearing the flags,
+	// as the Psiphon server does in downstream messages, and reports when
+	// the port forward is closed.
+	udpgwClosed := make(chan struct{}, 1)
+	udpgwServer := runTestServer(t, func(conn net.Conn) {
+		defer func() { udpgwClosed <- *new(struct{}) }()
+		buffer := make([]byte, udpgwProtocolMaxMessageSize)
+		for {
+			_, err := io.ReadFull(conn, buffer[0:2])
+			if err != nil {
+				return
+			}
+			size := int(binary.LittleEndian.Uint16(buffer[0:2]))
+			_, err = io.ReadFull(conn, buffer[2:2+size])
+			if err != nil {
+				return
+			}
+			buffer[2] = 0
+			conn.Write(buffer[0 : 2+size])
+		}
+	})
+	defer udpgwServer.Close()
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+	config.UdpgwServerAddress = udpgwServer.Addr().String()
+
+	device := newTestTunDevice()
+	tunnel := newPacketTunnel(config, &DialConfig{}, testTunneler{}, nil, device)
+	defer tunnel.Close()
+
+	id := packetTunnelFlowID{
+		localIP:    [4]byte{10, 0, 0, 2},
+		localPort:  40000,
+		remoteIP:   [4]byte{192, 0, 2, 1},
+		remotePort: 443,
+	}
+
+	// Datagrams of a flow are relayed over one udpgw port forward
+	for _, data := range []string{"first", "second"} {
+		device.upstream <- makeUDPPacket(reverseFlowID(id), []byte(data))
+		datagram := device.readPacket(t, ipProtocolUDP)
+		if binary.BigEndian.Uint16(datagram[0:2]) != id.remotePort ||
+			binary.BigEndian.Uint16(datagram[2:4]) != id.localPort ||
+			string(datagram[udpHeaderSize:]) != data {
+			t.Fatalf("unexpected datagram: %x", datagram)
+		}
+	}
+	tunnel.flowsMutex.Lock()
+	flow, ok := tunnel.udpFlows[id]
+	flowCount := len(tunnel.udpFlows)
+	tunnel.flowsMutex.Unlock()
+	if !ok || flowCount != 1 {
+		t.Fatalf("unexpected UDP flows: %d", flowCount)
+	}
+
+	// A flow is closed, with its port forward, when idle
+	tunnel.closeIdleFlowsNow()
+	tunnel.flowsMutex.Lock()
+	flowCount = len(tunnel.udpFlows)
+	tunnel.flowsMutex.Unlock()
+	if flowCount != 1 {
+		t.Fatalf("active flow should not be closed")
+	}
+
+	flow.mutex.Lock()
+	flow.lastActivityTime = time.Now().Add(-PACKET_TUNNEL_UDP_IDLE_TIMEOUT)
+	flow.mutex.Unlock()
+	tunnel.closeIdleFlowsNow()
+	tunnel.flowsMutex.Lock()
+	flowCount = len(tunnel.udpFlows)
+	tunnel.flowsMutex.Unlock()
+	if flowCount != 0 {
+		t.Fatalf("idle flow should be closed")
+	}
+	select {
+	case <-udpgwClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("udpgw port forward not closed")
+	}
+}
+
+// makeTestIPv6Packet makes an IPv6 packet sent from the host.
+func makeTestIPv6Packet(nextHeader byte, payload []byte) []byte {
+	packet := make([]byte, ipv6HeaderSize+len(payload))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(payload)))
+	packet[6] = nextHeader
+	packet[7] = 64
+	copy(packet[8:24], net.ParseIP("fd00::2"))
+	copy(packet[24:40], net.ParseIP("2001:db8::1"))
+	copy(packet[ipv6HeaderSize:], payload)
+	return packet
+}
+
+// readIPv6Packet returns the payload of the next packet sent to the host,
+// after checking its addresses, next header and checksum.
+func (device *testTunDevice) readIPv6Packet(t *testing.T, nextHeader byte) []byte {
+	var packet []byte
+	select {
+	case packet = <-device.downstream:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout reading packet")
+	}
+	if packet[0]>>4 != 6 || packet[6] != nextHeader ||
+		!net.IP(packet[8:24]).Equal(net.ParseIP("2001:db8::1")) ||
+		!net.IP(packet[24:40]).Equal(net.ParseIP("fd00::2")) {
+		t.Fatalf("unexpected packet: %x", packet)
+	}
+	payload := packet[ipv6HeaderSize:]
+	sum := addChecksum(0, packet[8:40]) + uint32(nextHeader) + uint32(len(payload))
+	if foldChecksum(addChecksum(sum, payload)) != 0xffff {
+		t.Fatalf("invalid checksum: %x", packet)
+	}
+	return payload
+}
+
+func TestPacketTunnelIPv6(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+
+	device := newTestTunDevice()
+	tunnel := newPacketTunnel(config, &DialConfig{}, testTunneler{}, nil, device)
+	defer tunnel.Close()
+
+	// A TCP SYN is refused with a RST
+	syn := make([]byte, tcpHeaderSize)
+	binary.BigEndian.PutUint16(syn[0:2], 40000)
+	binary.BigEndian.PutUint16(syn[2:4], 443)
+	binary.BigEndian.PutUint32(syn[4:8], 1000)
+	syn[12] = byte(tcpHeaderSize/4) << 4
+	syn[13] = tcpFlagSYN
+	device.upstream <- makeTestIPv6Packet(ipProtocolTCP, syn)
+
+	segment := device.readIPv6Packet(t, ipProtocolTCP)
+	if binary.BigEndian.Uint16(segment[0:2]) != 443 ||
+		binary.BigEndian.Uint16(segment[2:4]) != 40000 ||
+		binary.BigEndian.Uint32(segment[8:12]) != 1001 ||
+		segment[13] != tcpFlagRST|tcpFlagACK {
+		t.Errorf("unexpected RST: %x", segment)
+	}
+
+	// A UDP packet, including a DNS query, is answered with an ICMPv6 port
+	// unreachable quoting the packet
+	datagram := make([]byte, udpHeaderSize+4)
+	binary.BigEndian.PutUint16(datagram[0:2], 40000)
+	binary.BigEndian.PutUint16(datagram[2:4], dnsPort)
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(len(datagram)))
+	udpPacket := makeTestIPv6Packet(ipProtocolUDP, datagram)
+	device.upstream <- udpPacket
+
+	message := device.readIPv6Packet(t, ipProtocolICMPv6)
+	if message[0] != 1 || message[1] != 4 ||
+		!bytes.Equal(message[icmpHeaderSize:], udpPacket) {
+		t.Errorf("unexpected ICMPv6 message: %x", message)
+	}
+
+	// Packets to multicast addresses aren't answered
+	multicastPacket := makeTestIPv6Packet(ipProtocolUDP, datagram)
+	copy(multicastPacket[24:40], net.ParseIP("ff02::fb"))
+	device.upstream <- multicastPacket
+	select {
+	case packet := <-device.downstream:
+		t.Errorf("unexpected packet: %x", packet)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
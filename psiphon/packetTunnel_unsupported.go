@@ -0,0 +1,42 @@
+// +build !linux
+
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"io"
+)
+
+// newTunDevice simply returns an error when used on an unsupported platform.
+func newTunDevice(fileDescriptor int) (io.ReadWriteCloser, error) {
+	return nil, ContextError(errors.New("packet tunnel not supported on this platform"))
+}
+
+// closeTunFileDescriptor simply does nothing on an unsupported platform,
+// where TUN file descriptors aren't used.
+func closeTunFileDescriptor(fileDescriptor int) {
+}
+
+// openTunDevice simply returns an error when used on an unsupported platform.
+func openTunDevice(name string) (io.ReadWriteCloser, error) {
+	return nil, ContextError(errors.New("packet tunnel not supported on this platform"))
+}
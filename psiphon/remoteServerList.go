@@ -36,7 +36,7 @@ func FetchRemoteServerList(
 	tunnel *Tunnel,
 	untunneledDialConfig *DialConfig) error {
 
-	NoticeInfo("fetching remote server list")
+	config.notices.Info("fetching remote server list")
 
 	// Select tunneled or untunneled configuration
 
@@ -58,7 +58,7 @@ func FetchRemoteServerList(
 		downloadFilename = splitPath[len(splitPath)-1]
 	}
 
-	lastETag, err := GetUrlETag(config.RemoteServerListUrl)
+	lastETag, err := config.dataStore.GetUrlETag(config.RemoteServerListUrl)
 	if err != nil {
 		return ContextError(err)
 	}
@@ -66,7 +66,7 @@ func FetchRemoteServerList(
 	n, responseETag, err := ResumeDownload(
 		httpClient, requestUrl, downloadFilename, lastETag)
 
-	NoticeRemoteServerListDownloadedBytes(n)
+	config.notices.RemoteServerListDownloadedBytes(n)
 
 	if err != nil {
 		return ContextError(err)
@@ -77,7 +77,7 @@ func FetchRemoteServerList(
 		return nil
 	}
 
-	NoticeRemoteServerListDownloaded(downloadFilename)
+	config.notices.RemoteServerListDownloaded(downloadFilename)
 
 	// The downloaded content is a zlib compressed authenticated
 	// data package containing a list of encoded server entries.
@@ -106,6 +106,7 @@ func FetchRemoteServerList(
 	}
 
 	serverEntries, err := DecodeAndValidateServerEntryList(
+		config.notices,
 		remoteServerList,
 		GetCurrentTimestamp(),
 		SERVER_ENTRY_SOURCE_REMOTE)
@@ -113,7 +114,7 @@ func FetchRemoteServerList(
 		return ContextError(err)
 	}
 
-	err = StoreServerEntries(serverEntries, true)
+	err = config.dataStore.StoreServerEntries(serverEntries, true)
 	if err != nil {
 		return ContextError(err)
 	}
@@ -122,9 +123,9 @@ func FetchRemoteServerList(
 	// ETag so we won't re-download this same data again.
 
 	if responseETag != "" {
-		err := SetUrlETag(config.RemoteServerListUrl, responseETag)
+		err := config.dataStore.SetUrlETag(config.RemoteServerListUrl, responseETag)
 		if err != nil {
-			NoticeAlert("failed to set remote server list ETag: %s", ContextError(err))
+			config.notices.Alert("failed to set remote server list ETag: %s", ContextError(err))
 			// This fetch is still reported as a success, even if we can't store the etag
 		}
 	}
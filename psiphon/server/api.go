@@ -186,7 +186,7 @@ func connectedAPIRequestHandler(
 	}
 
 	connectedResponse.ConnectedTimestamp =
-		psiphon.TruncateTimestampToHour(psiphon.GetCurrentTimestamp())
+		psiphon.TruncateTimestampToHour(nil, psiphon.GetCurrentTimestamp())
 
 	responsePayload, err := json.Marshal(connectedResponse)
 	if err != nil {
@@ -313,6 +313,21 @@ func statusAPIRequestHandler(
 			}
 			sessionFields["total_bytes_received"] = totalBytesReceived
 
+			// Round trip times are omitted by older clients and when no
+			// measurement was made.
+			// Client reports round trip times in nanoseconds; divide to get to
+			// milliseconds
+			for _, name := range []string{"round_trip_time", "round_trip_time_jitter"} {
+				delete(sessionFields, name)
+				if tunnelStat[name] != nil {
+					value, err := getInt64RequestParam(tunnelStat, name)
+					if err != nil {
+						return nil, psiphon.ContextError(err)
+					}
+					sessionFields[name] = value / 1000000
+				}
+			}
+
 			log.WithContextFields(sessionFields).Info("API event")
 		}
 	}
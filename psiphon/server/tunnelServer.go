@@ -466,7 +466,8 @@ func (sshServer *sshServer) handleClient(tunnelProtocol string, clientConn net.C
 			conn, result.err = psiphon.NewObfuscatedSshConn(
 				psiphon.OBFUSCATION_CONN_MODE_SERVER,
 				clientConn,
-				sshServer.support.Config.ObfuscatedSSHKey)
+				sshServer.support.Config.ObfuscatedSSHKey,
+				nil)
 			if result.err != nil {
 				result.err = psiphon.ContextError(result.err)
 			}
@@ -56,6 +56,7 @@ type ServerContext struct {
 	psiphonHttpsClient       *http.Client
 	statsRegexps             *transferstats.Regexps
 	clientRegion             string
+	homepages                []string
 	clientUpgradeVersion     string
 	serverHandshakeTimestamp string
 }
@@ -130,7 +131,7 @@ func (serverContext *ServerContext) doHandshakeRequest() error {
 
 	// *TODO*: this is obsolete?
 	/*
-		serverEntryIpAddresses, err := GetServerEntryIpAddresses()
+		serverEntryIpAddresses, err := serverContext.tunnel.config.dataStore.GetServerEntryIpAddresses()
 		if err != nil {
 			return ContextError(err)
 		}
@@ -197,7 +198,7 @@ func (serverContext *ServerContext) doHandshakeRequest() error {
 	}
 
 	serverContext.clientRegion = handshakeResponse.ClientRegion
-	NoticeClientRegion(serverContext.clientRegion)
+	serverContext.tunnel.config.notices.ClientRegion(serverContext.clientRegion)
 
 	var decodedServerEntries []*ServerEntry
 
@@ -208,13 +209,14 @@ func (serverContext *ServerContext) doHandshakeRequest() error {
 
 		serverEntry, err := DecodeServerEntry(
 			encodedServerEntry,
-			TruncateTimestampToHour(handshakeResponse.ServerTimestamp),
+			TruncateTimestampToHour(
+				serverContext.tunnel.config.notices, handshakeResponse.ServerTimestamp),
 			SERVER_ENTRY_SOURCE_DISCOVERY)
 		if err != nil {
 			return ContextError(err)
 		}
 
-		err = ValidateServerEntry(serverEntry)
+		err = ValidateServerEntry(serverContext.tunnel.config.notices, serverEntry)
 		if err != nil {
 			// Skip this entry and continue with the next one
 			continue
@@ -226,22 +228,23 @@ func (serverContext *ServerContext) doHandshakeRequest() error {
 	// The reason we are storing the entire array of server entries at once rather
 	// than one at a time is that some desirable side-effects get triggered by
 	// StoreServerEntries that don't get triggered by StoreServerEntry.
-	err = StoreServerEntries(decodedServerEntries, true)
+	err = serverContext.tunnel.config.dataStore.StoreServerEntries(decodedServerEntries, true)
 	if err != nil {
 		return ContextError(err)
 	}
 
 	// TODO: formally communicate the sponsor and upgrade info to an
 	// outer client via some control interface.
+	serverContext.homepages = handshakeResponse.Homepages
 	for _, homepage := range handshakeResponse.Homepages {
-		NoticeHomepage(homepage)
+		serverContext.tunnel.config.notices.Homepage(homepage)
 	}
 
 	serverContext.clientUpgradeVersion = handshakeResponse.UpgradeClientVersion
 	if handshakeResponse.UpgradeClientVersion != "" {
-		NoticeClientUpgradeAvailable(handshakeResponse.UpgradeClientVersion)
+		serverContext.tunnel.config.notices.ClientUpgradeAvailable(handshakeResponse.UpgradeClientVersion)
 	} else {
-		NoticeClientIsLatestVersion("")
+		serverContext.tunnel.config.notices.ClientIsLatestVersion("")
 	}
 
 	var regexpsNotices []string
@@ -250,13 +253,13 @@ func (serverContext *ServerContext) doHandshakeRequest() error {
 		handshakeResponse.HttpsRequestRegexes)
 
 	for _, notice := range regexpsNotices {
-		NoticeAlert(notice)
+		serverContext.tunnel.config.notices.Alert(notice)
 	}
 
 	serverContext.serverHandshakeTimestamp = handshakeResponse.ServerTimestamp
 
 	if handshakeResponse.ClientVerificationRequired {
-		NoticeClientVerificationRequired()
+		serverContext.tunnel.config.notices.ClientVerificationRequired()
 	}
 
 	return nil
@@ -273,7 +276,7 @@ func (serverContext *ServerContext) DoConnectedRequest() error {
 	params := serverContext.getBaseParams()
 
 	const DATA_STORE_LAST_CONNECTED_KEY = "lastConnected"
-	lastConnected, err := GetKeyValue(DATA_STORE_LAST_CONNECTED_KEY)
+	lastConnected, err := serverContext.tunnel.config.dataStore.GetKeyValue(DATA_STORE_LAST_CONNECTED_KEY)
 	if err != nil {
 		return ContextError(err)
 	}
@@ -316,7 +319,7 @@ func (serverContext *ServerContext) DoConnectedRequest() error {
 		return ContextError(err)
 	}
 
-	err = SetKeyValue(
+	err = serverContext.tunnel.config.dataStore.SetKeyValue(
 		DATA_STORE_LAST_CONNECTED_KEY, connectedResponse.ConnectedTimestamp)
 	if err != nil {
 		return ContextError(err)
@@ -338,7 +341,7 @@ func (serverContext *ServerContext) DoStatusRequest(tunnel *Tunnel) error {
 	// payload for future attempt, in all failure cases.
 
 	statusPayload, statusPayloadInfo, err := makeStatusRequestPayload(
-		tunnel.serverEntry.IpAddress)
+		tunnel.config, tunnel.serverEntry.IpAddress)
 	if err != nil {
 		return ContextError(err)
 	}
@@ -370,12 +373,12 @@ func (serverContext *ServerContext) DoStatusRequest(tunnel *Tunnel) error {
 		// Resend the transfer stats and tunnel stats later
 		// Note: potential duplicate reports if the server received and processed
 		// the request but the client failed to receive the response.
-		putBackStatusRequestPayload(statusPayloadInfo)
+		putBackStatusRequestPayload(tunnel.config, statusPayloadInfo)
 
 		return ContextError(err)
 	}
 
-	confirmStatusRequestPayload(statusPayloadInfo)
+	confirmStatusRequestPayload(tunnel.config, statusPayloadInfo)
 
 	return nil
 }
@@ -389,7 +392,7 @@ func (serverContext *ServerContext) getStatusParams(isTunneled bool) requestJSON
 	// TODO: base64 encoding of padding means the padding size is not exactly
 	// [0, PADDING_MAX_BYTES].
 
-	randomPadding := MakeSecureRandomPadding(0, PSIPHON_API_STATUS_REQUEST_PADDING_MAX_BYTES)
+	randomPadding := MakeSecureRandomPadding(serverContext.tunnel.config.notices, 0, PSIPHON_API_STATUS_REQUEST_PADDING_MAX_BYTES)
 	params["padding"] = base64.StdEncoding.EncodeToString(randomPadding)
 
 	// Legacy clients set "connected" to "0" when disconnecting, and this value
@@ -419,13 +422,13 @@ type statusRequestPayloadInfo struct {
 }
 
 func makeStatusRequestPayload(
-	serverId string) ([]byte, *statusRequestPayloadInfo, error) {
+	config *Config, serverId string) ([]byte, *statusRequestPayloadInfo, error) {
 
-	transferStats := transferstats.TakeOutStatsForServer(serverId)
-	tunnelStats, err := TakeOutUnreportedTunnelStats(
+	transferStats := config.transferStats.TakeOutStatsForServer(serverId)
+	tunnelStats, err := config.dataStore.TakeOutUnreportedTunnelStats(
 		PSIPHON_API_TUNNEL_STATS_MAX_COUNT)
 	if err != nil {
-		NoticeAlert(
+		config.notices.Alert(
 			"TakeOutUnreportedTunnelStats failed: %s", ContextError(err))
 		tunnelStats = nil
 		// Proceed with transferStats only
@@ -454,7 +457,7 @@ func makeStatusRequestPayload(
 	if err != nil {
 
 		// Send the transfer stats and tunnel stats later
-		putBackStatusRequestPayload(payloadInfo)
+		putBackStatusRequestPayload(config, payloadInfo)
 
 		return nil, nil, ContextError(err)
 	}
@@ -462,23 +465,23 @@ func makeStatusRequestPayload(
 	return jsonPayload, payloadInfo, nil
 }
 
-func putBackStatusRequestPayload(payloadInfo *statusRequestPayloadInfo) {
-	transferstats.PutBackStatsForServer(
+func putBackStatusRequestPayload(config *Config, payloadInfo *statusRequestPayloadInfo) {
+	config.transferStats.PutBackStatsForServer(
 		payloadInfo.serverId, payloadInfo.transferStats)
-	err := PutBackUnreportedTunnelStats(payloadInfo.tunnelStats)
+	err := config.dataStore.PutBackUnreportedTunnelStats(payloadInfo.tunnelStats)
 	if err != nil {
 		// These tunnel stats records won't be resent under after a
 		// datastore re-initialization.
-		NoticeAlert(
+		config.notices.Alert(
 			"PutBackUnreportedTunnelStats failed: %s", ContextError(err))
 	}
 }
 
-func confirmStatusRequestPayload(payloadInfo *statusRequestPayloadInfo) {
-	err := ClearReportedTunnelStats(payloadInfo.tunnelStats)
+func confirmStatusRequestPayload(config *Config, payloadInfo *statusRequestPayloadInfo) {
+	err := config.dataStore.ClearReportedTunnelStats(payloadInfo.tunnelStats)
 	if err != nil {
 		// These tunnel stats records may be resent.
-		NoticeAlert(
+		config.notices.Alert(
 			"ClearReportedTunnelStats failed: %s", ContextError(err))
 	}
 }
@@ -496,7 +499,7 @@ func (serverContext *ServerContext) TryUntunneledStatusRequest(isShutdown bool)
 		if err == nil {
 			return nil
 		}
-		NoticeAlert("doUntunneledStatusRequest failed for %s:%s: %s",
+		serverContext.tunnel.config.notices.Alert("doUntunneledStatusRequest failed for %s:%s: %s",
 			serverContext.tunnel.serverEntry.IpAddress, port, err)
 	}
 
@@ -539,7 +542,8 @@ func (serverContext *ServerContext) doUntunneledStatusRequest(
 		return ContextError(err)
 	}
 
-	statusPayload, statusPayloadInfo, err := makeStatusRequestPayload(tunnel.serverEntry.IpAddress)
+	statusPayload, statusPayloadInfo, err := makeStatusRequestPayload(
+		tunnel.config, tunnel.serverEntry.IpAddress)
 	if err != nil {
 		return ContextError(err)
 	}
@@ -557,20 +561,21 @@ func (serverContext *ServerContext) doUntunneledStatusRequest(
 		// Resend the transfer stats and tunnel stats later
 		// Note: potential duplicate reports if the server received and processed
 		// the request but the client failed to receive the response.
-		putBackStatusRequestPayload(statusPayloadInfo)
+		putBackStatusRequestPayload(tunnel.config, statusPayloadInfo)
 
 		// Trim this error since it may include long URLs
 		return ContextError(TrimError(err))
 	}
-	confirmStatusRequestPayload(statusPayloadInfo)
+	confirmStatusRequestPayload(tunnel.config, statusPayloadInfo)
 	response.Body.Close()
 
 	return nil
 }
 
-// RecordTunnelStats records a tunnel duration and bytes
-// sent and received for subsequent reporting and quality
-// analysis.
+// RecordTunnelStats records a tunnel duration, bytes
+// sent and received, and round trip time and jitter for
+// subsequent reporting and quality analysis. The round
+// trip time fields are omitted when sampleCount is 0.
 //
 // Tunnel durations are precisely measured client-side
 // and reported in status requests. As the duration is
@@ -612,11 +617,14 @@ func (serverContext *ServerContext) doUntunneledStatusRequest(
 // processes a status request but the client fails to receive
 // the response.
 func RecordTunnelStats(
+	config *Config,
 	sessionId string,
 	tunnelNumber int64,
 	tunnelServerIpAddress string,
 	serverHandshakeTimestamp, duration string,
-	totalBytesSent, totalBytesReceived int64) error {
+	totalBytesSent, totalBytesReceived int64,
+	roundTripTime, roundTripTimeJitter time.Duration,
+	sampleCount int) error {
 
 	tunnelStats := struct {
 		SessionId                string `json:"session_id"`
@@ -626,14 +634,24 @@ func RecordTunnelStats(
 		Duration                 string `json:"duration"`
 		TotalBytesSent           int64  `json:"total_bytes_sent"`
 		TotalBytesReceived       int64  `json:"total_bytes_received"`
+		RoundTripTime            *int64 `json:"round_trip_time,omitempty"`
+		RoundTripTimeJitter      *int64 `json:"round_trip_time_jitter,omitempty"`
 	}{
-		sessionId,
-		tunnelNumber,
-		tunnelServerIpAddress,
-		serverHandshakeTimestamp,
-		duration,
-		totalBytesSent,
-		totalBytesReceived,
+		SessionId:                sessionId,
+		TunnelNumber:             tunnelNumber,
+		TunnelServerIpAddress:    tunnelServerIpAddress,
+		ServerHandshakeTimestamp: serverHandshakeTimestamp,
+		Duration:                 duration,
+		TotalBytesSent:           totalBytesSent,
+		TotalBytesReceived:       totalBytesReceived,
+	}
+
+	// As with duration, round trip times are reported in nanoseconds
+	if sampleCount > 0 {
+		roundTripTimeNanoseconds := int64(roundTripTime)
+		roundTripTimeJitterNanoseconds := int64(roundTripTimeJitter)
+		tunnelStats.RoundTripTime = &roundTripTimeNanoseconds
+		tunnelStats.RoundTripTimeJitter = &roundTripTimeJitterNanoseconds
 	}
 
 	tunnelStatsJson, err := json.Marshal(tunnelStats)
@@ -641,7 +659,7 @@ func RecordTunnelStats(
 		return ContextError(err)
 	}
 
-	return StoreTunnelStats(tunnelStatsJson)
+	return config.dataStore.StoreTunnelStats(tunnelStatsJson)
 }
 
 // DoClientVerificationRequest performs the "client_verification" API
@@ -783,7 +801,8 @@ func (serverContext *ServerContext) getBaseParams() requestJSONObject {
 	// a precise handshake request server timestamp, is truncated
 	// to hour granularity to avoid introducing a reconstructable
 	// cross-session user trace into server logs.
-	localServerEntryTimestamp := TruncateTimestampToHour(tunnel.serverEntry.LocalTimestamp)
+	localServerEntryTimestamp := TruncateTimestampToHour(
+		tunnel.config.notices, tunnel.serverEntry.LocalTimestamp)
 	if localServerEntryTimestamp != "" {
 		params["server_entry_timestamp"] = localServerEntryTimestamp
 	}
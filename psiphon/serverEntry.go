@@ -239,14 +239,14 @@ func DecodeServerEntry(
 // Currently, it checks for a valid ipAddress. This is important since
 // handshake requests submit back to the server a list of known server
 // IP addresses and the handshake API expects well-formed inputs.
+// Some callers skip invalid server entries without propagating
+// the error message, so an alert is emitted with the specified notices.
 // TODO: validate more fields
-func ValidateServerEntry(serverEntry *ServerEntry) error {
+func ValidateServerEntry(notices *Notices, serverEntry *ServerEntry) error {
 	ipAddr := net.ParseIP(serverEntry.IpAddress)
 	if ipAddr == nil {
 		errMsg := fmt.Sprintf("server entry has invalid IpAddress: '%s'", serverEntry.IpAddress)
-		// Some callers skip invalid server entries without propagating
-		// the error mesage, so issue a notice.
-		NoticeAlert(errMsg)
+		notices.Alert("%s", errMsg)
 		return ContextError(errors.New(errMsg))
 	}
 	return nil
@@ -256,7 +256,9 @@ func ValidateServerEntry(serverEntry *ServerEntry) error {
 // used by remote server lists and Psiphon server handshake requests.
 // Each server entry is validated and invalid entries are skipped.
 // See DecodeServerEntry for note on serverEntrySource/timestamp.
+// Invalid entry alerts are emitted with the specified notices.
 func DecodeAndValidateServerEntryList(
+	notices *Notices,
 	encodedServerEntryList, timestamp,
 	serverEntrySource string) (serverEntries []*ServerEntry, err error) {
 
@@ -272,7 +274,7 @@ func DecodeAndValidateServerEntryList(
 			return nil, ContextError(err)
 		}
 
-		if ValidateServerEntry(serverEntry) != nil {
+		if ValidateServerEntry(notices, serverEntry) != nil {
 			// Skip this entry and continue with the next one
 			continue
 		}
@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"math"
+	"time"
+)
+
+// ServerEntryPerformance is the persistent connection history for a
+// single server entry. History is recorded per tunnel protocol, since
+// a server may be reachable with one protocol and blocked with another.
+type ServerEntryPerformance struct {
+	Protocols map[string]*ProtocolPerformance `json:"protocols"`
+}
+
+// ProtocolPerformance is the connection history for a tunnel protocol, with
+// a single server entry or on a single network.
+//
+// SuccessWeight and FailureWeight are exponentially decaying counts of
+// successful and failed connection attempts, as of UpdateTime. They decay
+// with a half life of SERVER_ENTRY_PERFORMANCE_HALF_LIFE so that recent
+// outcomes dominate the server entry score and old failures are eventually
+// forgiven. The dial counts are plain totals, kept for diagnostics.
+//
+// EstablishDuration and TunnelDuration are smoothed averages of, respectively,
+// the time taken to establish a tunnel and the lifetime of established tunnels.
+type ProtocolPerformance struct {
+	SuccessWeight     float64       `json:"successWeight"`
+	FailureWeight     float64       `json:"failureWeight"`
+	UpdateTime        time.Time     `json:"updateTime"`
+	DialSuccessCount  int64         `json:"dialSuccessCount"`
+	DialFailureCount  int64         `json:"dialFailureCount"`
+	LastSuccessTime   time.Time     `json:"lastSuccessTime"`
+	LastFailureTime   time.Time     `json:"lastFailureTime"`
+	LastFailureReason string        `json:"lastFailureReason"`
+	EstablishDuration time.Duration `json:"establishDuration"`
+	TunnelDuration    time.Duration `json:"tunnelDuration"`
+}
+
+// newServerEntryPerformance creates an empty ServerEntryPerformance.
+func newServerEntryPerformance() *ServerEntryPerformance {
+	return &ServerEntryPerformance{
+		Protocols: make(map[string]*ProtocolPerformance),
+	}
+}
+
+// getProtocol returns the history record for the specified protocol,
+// creating an empty record when none exists.
+func (performance *ServerEntryPerformance) getProtocol(protocol string) *ProtocolPerformance {
+	if performance.Protocols == nil {
+		performance.Protocols = make(map[string]*ProtocolPerformance)
+	}
+	return getProtocolPerformance(performance.Protocols, protocol)
+}
+
+// Score returns the server entry score, in the range (0, 1), used to order
+// server entry candidates. Higher is better. When protocol is not blank, only
+// the history for that protocol is considered; otherwise, history for all
+// protocols is combined.
+//
+// A server entry with no history is assigned a neutral score, so it ranks
+// below servers that have recently succeeded and above servers that have
+// recently failed.
+func (performance *ServerEntryPerformance) Score(protocol string, now time.Time) float64 {
+
+	var successWeight, failureWeight float64
+	var establishDuration time.Duration
+	establishDurationCount := 0
+
+	for recordProtocol, record := range performance.Protocols {
+		if protocol != "" && recordProtocol != protocol {
+			continue
+		}
+		decay := performanceDecay(record.UpdateTime, now)
+		successWeight += record.SuccessWeight * decay
+		failureWeight += record.FailureWeight * decay
+		if record.EstablishDuration > 0 {
+			establishDuration += record.EstablishDuration
+			establishDurationCount += 1
+		}
+	}
+
+	if establishDurationCount > 0 {
+		establishDuration /= time.Duration(establishDurationCount)
+	}
+
+	return computePerformanceScore(successWeight, failureWeight, establishDuration)
+}
+
+// LastResult returns the most recent success and failure times recorded for
+// the server entry. When protocol is not blank, only that protocol is
+// considered.
+func (performance *ServerEntryPerformance) LastResult(
+	protocol string) (lastSuccessTime, lastFailureTime time.Time) {
+
+	for recordProtocol, record := range performance.Protocols {
+		if protocol != "" && recordProtocol != protocol {
+			continue
+		}
+		if record.LastSuccessTime.After(lastSuccessTime) {
+			lastSuccessTime = record.LastSuccessTime
+		}
+		if record.LastFailureTime.After(lastFailureTime) {
+			lastFailureTime = record.LastFailureTime
+		}
+	}
+	return lastSuccessTime, lastFailureTime
+}
+
+// NetworkPerformance is the persistent connection history, per tunnel
+// protocol, for a single network. Unlike ServerEntryPerformance, the history
+// spans all servers, and so reflects which protocols the network permits.
+type NetworkPerformance struct {
+	Protocols map[string]*ProtocolPerformance `json:"protocols"`
+}
+
+// newNetworkPerformance creates an empty NetworkPerformance.
+func newNetworkPerformance() *NetworkPerformance {
+	return &NetworkPerformance{
+		Protocols: make(map[string]*ProtocolPerformance),
+	}
+}
+
+// getProtocol returns the history record for the specified protocol,
+// creating an empty record when none exists.
+func (performance *NetworkPerformance) getProtocol(protocol string) *ProtocolPerformance {
+	if performance.Protocols == nil {
+		performance.Protocols = make(map[string]*ProtocolPerformance)
+	}
+	return getProtocolPerformance(performance.Protocols, protocol)
+}
+
+// Score returns the score, in the range (0, 1), for the specified protocol
+// on this network. A protocol with no history is assigned a neutral score.
+func (performance *NetworkPerformance) Score(protocol string, now time.Time) float64 {
+	record, ok := performance.Protocols[protocol]
+	if !ok {
+		return computePerformanceScore(0, 0, 0)
+	}
+	decay := performanceDecay(record.UpdateTime, now)
+	return computePerformanceScore(
+		record.SuccessWeight*decay, record.FailureWeight*decay, record.EstablishDuration)
+}
+
+func getProtocolPerformance(
+	protocols map[string]*ProtocolPerformance, protocol string) *ProtocolPerformance {
+
+	protocolPerformance, ok := protocols[protocol]
+	if !ok {
+		protocolPerformance = new(ProtocolPerformance)
+		protocols[protocol] = protocolPerformance
+	}
+	return protocolPerformance
+}
+
+// computePerformanceScore combines decayed success and failure weights
+// with the typical establishment latency into a single score.
+//
+// The base score is the Laplace-smoothed success ratio, so an unknown
+// server scores 0.5. The base score is scaled down by up to half as the
+// establishment latency grows relative to SERVER_ENTRY_PERFORMANCE_LATENCY_SCALE,
+// with an unknown latency treated as typical.
+func computePerformanceScore(
+	successWeight, failureWeight float64, establishDuration time.Duration) float64 {
+
+	score := (successWeight + 1) / (successWeight + failureWeight + 2)
+
+	if establishDuration <= 0 {
+		establishDuration = SERVER_ENTRY_PERFORMANCE_LATENCY_SCALE
+	}
+	latency := float64(establishDuration) / float64(SERVER_ENTRY_PERFORMANCE_LATENCY_SCALE)
+
+	return score * (1 - 0.5*latency/(latency+1))
+}
+
+// performanceDecay returns the multiplier to apply to weights recorded at
+// updateTime to bring them forward to now.
+func performanceDecay(updateTime, now time.Time) float64 {
+	if updateTime.IsZero() || !now.After(updateTime) {
+		return 1
+	}
+	age := float64(now.Sub(updateTime)) / float64(SERVER_ENTRY_PERFORMANCE_HALF_LIFE)
+	return math.Pow(0.5, age)
+}
+
+// decay brings the weights forward to now.
+func (record *ProtocolPerformance) decay(now time.Time) {
+	multiplier := performanceDecay(record.UpdateTime, now)
+	record.SuccessWeight *= multiplier
+	record.FailureWeight *= multiplier
+	record.UpdateTime = now
+}
+
+func (record *ProtocolPerformance) recordDialSuccess(
+	now time.Time, establishDuration time.Duration) {
+
+	record.decay(now)
+	record.SuccessWeight += 1
+	record.DialSuccessCount += 1
+	record.LastSuccessTime = now
+	record.EstablishDuration = smoothDuration(record.EstablishDuration, establishDuration)
+}
+
+func (record *ProtocolPerformance) recordDialFailure(now time.Time, reason string) {
+
+	record.decay(now)
+	record.FailureWeight += 1
+	record.DialFailureCount += 1
+	record.LastFailureTime = now
+	record.LastFailureReason = reason
+}
+
+// recordTunnelClosed records the lifetime of an established tunnel. A tunnel
+// that fails sooner than IMPAIRED_PROTOCOL_CLASSIFICATION_DURATION after it
+// was established is counted against the server, in the same way as a failed
+// dial, but is not included in the dial counts.
+func (record *ProtocolPerformance) recordTunnelClosed(
+	now time.Time, tunnelDuration time.Duration, failureReason string) {
+
+	record.decay(now)
+	record.TunnelDuration = smoothDuration(record.TunnelDuration, tunnelDuration)
+	if failureReason != "" && tunnelDuration < IMPAIRED_PROTOCOL_CLASSIFICATION_DURATION {
+		record.FailureWeight += 1
+		record.LastFailureTime = now
+		record.LastFailureReason = failureReason
+	}
+}
+
+// smoothDuration returns an exponentially weighted moving average of
+// duration samples.
+func smoothDuration(average, sample time.Duration) time.Duration {
+	if average == 0 {
+		return sample
+	}
+	return time.Duration(
+		float64(average)*(1-SERVER_ENTRY_PERFORMANCE_SMOOTHING) +
+			float64(sample)*SERVER_ENTRY_PERFORMANCE_SMOOTHING)
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestServerEntryPerformanceScore(t *testing.T) {
+	now := time.Now()
+
+	unknown := newServerEntryPerformance()
+
+	succeeded := newServerEntryPerformance()
+	succeeded.getProtocol(TUNNEL_PROTOCOL_OBFUSCATED_SSH).recordDialSuccess(
+		now, 2*time.Second)
+
+	failed := newServerEntryPerformance()
+	failed.getProtocol(TUNNEL_PROTOCOL_OBFUSCATED_SSH).recordDialFailure(
+		now.Add(-5*time.Minute), "timeout")
+
+	if !(succeeded.Score("", now) > unknown.Score("", now)) {
+		t.Error("recently succeeded server should score above unknown server")
+	}
+
+	if !(unknown.Score("", now) > failed.Score("", now)) {
+		t.Error("recently failed server should score below unknown server")
+	}
+
+	// A failure for one protocol doesn't count against another protocol
+	if failed.Score(TUNNEL_PROTOCOL_FRONTED_MEEK, now) != unknown.Score("", now) {
+		t.Error("failure should not affect score for other protocols")
+	}
+
+	// Old failures are forgiven
+	later := now.Add(10 * SERVER_ENTRY_PERFORMANCE_HALF_LIFE)
+	if unknown.Score("", later)-failed.Score("", later) > 0.01 {
+		t.Error("old failure should decay")
+	}
+
+	// Faster servers score higher
+	slow := newServerEntryPerformance()
+	slow.getProtocol(TUNNEL_PROTOCOL_OBFUSCATED_SSH).recordDialSuccess(
+		now, 20*time.Second)
+	if !(succeeded.Score("", now) > slow.Score("", now)) {
+		t.Error("faster server should score above slower server")
+	}
+
+	// Short lived tunnel failures count against the server
+	shortLived := newServerEntryPerformance()
+	record := shortLived.getProtocol(TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+	record.recordDialSuccess(now, 2*time.Second)
+	record.recordTunnelClosed(now, 10*time.Second, "ssh keep alive failed")
+	if !(succeeded.Score("", now) > shortLived.Score("", now)) {
+		t.Error("short lived tunnel failure should lower score")
+	}
+	lastSuccessTime, lastFailureTime := shortLived.LastResult("")
+	if lastSuccessTime.After(lastFailureTime) {
+		t.Error("short lived tunnel failure should be the last result")
+	}
+}
+
+func TestSelectWeightedProtocol(t *testing.T) {
+	now := time.Now()
+
+	networkPerformance := newNetworkPerformance()
+	for i := 0; i < 5; i++ {
+		networkPerformance.getProtocol(TUNNEL_PROTOCOL_OBFUSCATED_SSH).recordDialFailure(
+			now, "timeout")
+		networkPerformance.getProtocol(TUNNEL_PROTOCOL_FRONTED_MEEK).recordDialSuccess(
+			now, 5*time.Second)
+	}
+
+	candidateProtocols := []string{
+		TUNNEL_PROTOCOL_OBFUSCATED_SSH,
+		TUNNEL_PROTOCOL_FRONTED_MEEK,
+		TUNNEL_PROTOCOL_UNFRONTED_MEEK,
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		protocol, err := selectWeightedProtocol(candidateProtocols, networkPerformance, now)
+		if err != nil {
+			t.Fatalf("selectWeightedProtocol failed: %s", err)
+		}
+		counts[protocol] += 1
+	}
+
+	if !(counts[TUNNEL_PROTOCOL_FRONTED_MEEK] > counts[TUNNEL_PROTOCOL_UNFRONTED_MEEK] &&
+		counts[TUNNEL_PROTOCOL_UNFRONTED_MEEK] > counts[TUNNEL_PROTOCOL_OBFUSCATED_SSH]) {
+		t.Errorf("unexpected protocol selection counts: %+v", counts)
+	}
+
+	// Failed protocols are still explored
+	if counts[TUNNEL_PROTOCOL_OBFUSCATED_SSH] == 0 {
+		t.Error("failed protocol should still be selected occasionally")
+	}
+}
+
+func TestServerEntryIteratorOrder(t *testing.T) {
+
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon-server-entry-performance-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataStoreDirectory)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = dataStoreDirectory
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+	config.TunnelPoolSize = 2
+
+	config.dataStore, err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer config.dataStore.Close()
+
+	ipAddress := func(i int) string { return fmt.Sprintf("192.0.2.%d", i) }
+
+	serverEntryCount := 8
+	for i := 1; i <= serverEntryCount; i++ {
+		err := config.dataStore.StoreServerEntry(&ServerEntry{IpAddress: ipAddress(i)}, false)
+		if err != nil {
+			t.Fatalf("StoreServerEntry failed: %s", err)
+		}
+	}
+
+	// Server 1 is fast, server 2 is slow, server 3 has failed, and the
+	// remaining servers have no history
+	networkID := getNetworkID(config)
+	protocol := TUNNEL_PROTOCOL_OBFUSCATED_SSH
+	err = config.dataStore.RecordServerEntryDialSuccess(networkID, ipAddress(1), protocol, 1*time.Second)
+	if err == nil {
+		err = config.dataStore.RecordServerEntryDialSuccess(networkID, ipAddress(2), protocol, 5*time.Second)
+	}
+	if err == nil {
+		err = config.dataStore.RecordServerEntryDialFailure(networkID, ipAddress(3), protocol, "timeout")
+	}
+	if err != nil {
+		t.Fatalf("RecordServerEntryDial failed: %s", err)
+	}
+
+	iterator, err := NewServerEntryIterator(config)
+	if err != nil {
+		t.Fatalf("NewServerEntryIterator failed: %s", err)
+	}
+	defer iterator.Close()
+
+	iterate := func() []string {
+		err := iterator.Reset()
+		if err != nil {
+			t.Fatalf("Reset failed: %s", err)
+		}
+		var ipAddresses []string
+		for {
+			serverEntry, err := iterator.Next()
+			if err != nil {
+				t.Fatalf("Next failed: %s", err)
+			}
+			if serverEntry == nil {
+				return ipAddresses
+			}
+			ipAddresses = append(ipAddresses, serverEntry.IpAddress)
+		}
+	}
+
+	// The first TunnelPoolSize candidates are in strict score order. In the
+	// tail, the failed server is last unless exploration raises it up.
+	explored := false
+	for i := 0; i < 200; i++ {
+		ipAddresses := iterate()
+		if len(ipAddresses) != serverEntryCount {
+			t.Fatalf("unexpected candidate count: %d", len(ipAddresses))
+		}
+		if ipAddresses[0] != ipAddress(1) || ipAddresses[1] != ipAddress(2) {
+			t.Fatalf("unexpected head candidates: %v", ipAddresses[0:2])
+		}
+		if ipAddresses[serverEntryCount-1] != ipAddress(3) {
+			explored = true
+		}
+	}
+	if !explored {
+		t.Errorf("failed server should be explored")
+	}
+
+	// The affinity server is first
+	err = config.dataStore.PromoteServerEntry(ipAddress(2))
+	if err != nil {
+		t.Fatalf("PromoteServerEntry failed: %s", err)
+	}
+	if ipAddresses := iterate(); ipAddresses[0] != ipAddress(2) || ipAddresses[1] != ipAddress(1) {
+		t.Errorf("unexpected affinity candidates: %v", ipAddresses[0:2])
+	}
+
+	// The affinity server is no longer first once it has failed
+	err = config.dataStore.RecordServerEntryDialFailure(networkID, ipAddress(2), protocol, "timeout")
+	if err != nil {
+		t.Fatalf("RecordServerEntryDialFailure failed: %s", err)
+	}
+	if ipAddresses := iterate(); ipAddresses[0] != ipAddress(1) {
+		t.Errorf("failed affinity server should be demoted: %v", ipAddresses[0:2])
+	}
+}
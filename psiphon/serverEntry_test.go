@@ -41,7 +41,7 @@ func TestDecodeAndValidateServerEntryList(t *testing.T) {
 		hex.EncodeToString([]byte(_INVALID_MALFORMED_IP_ADDRESS_SERVER_ENTRY))
 
 	serverEntries, err := DecodeAndValidateServerEntryList(
-		testEncodedServerEntryList, GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
+		nil, testEncodedServerEntryList, GetCurrentTimestamp(), SERVER_ENTRY_SOURCE_EMBEDDED)
 	if err != nil {
 		t.Error(err.Error())
 		t.FailNow()
@@ -68,7 +68,7 @@ func TestInvalidServerEntries(t *testing.T) {
 		if err != nil {
 			t.Error(err.Error())
 		}
-		err = ValidateServerEntry(serverEntry)
+		err = ValidateServerEntry(nil, serverEntry)
 		if err == nil {
 			t.Error("server entry should not validate: %s", testCase)
 		}
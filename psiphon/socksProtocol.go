@@ -0,0 +1,375 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// The SOCKS4, SOCKS4a, and SOCKS5 protocols are specified in:
+// https://www.openssh.com/txt/socks4.protocol
+// https://www.openssh.com/txt/socks4a.protocol
+// https://tools.ietf.org/html/rfc1928
+// https://tools.ietf.org/html/rfc1929
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socks5MethodNoAuthentication       = 0x00
+	socks5MethodUsernamePassword       = 0x02
+	socks5MethodNoAcceptableMethods    = 0xFF
+	socks5UsernamePasswordVersion      = 0x01
+	socks5UsernamePasswordSuccess      = 0x00
+	socks5UsernamePasswordFailure      = 0x01
+	socksCommandConnect                = 0x01
+	socksCommandUDPAssociate           = 0x03
+	socks5AddressTypeIPv4              = 0x01
+	socks5AddressTypeDomainName        = 0x03
+	socks5AddressTypeIPv6              = 0x04
+	socks5ReplySucceeded               = 0x00
+	socks5ReplyGeneralFailure          = 0x01
+	socks5ReplyNotAllowed              = 0x02
+	socks5ReplyCommandNotSupported     = 0x07
+	socks5ReplyAddressTypeNotSupported = 0x08
+	socks4ReplyGranted                 = 0x5A
+	socks4ReplyRejected                = 0x5B
+
+	socks4MaxUserIdLength = 255
+)
+
+// socksAuthenticator checks the username and password sent by a SOCKS5
+// client, returning true when they're valid.
+type socksAuthenticator func(username, password string) bool
+
+// socksRequest is a SOCKS4, SOCKS4a, or SOCKS5 client request. For
+// CONNECT, target is the destination host and port. For UDP ASSOCIATE,
+// target is the address from which the client expects to send datagrams,
+// which may be unspecified.
+type socksRequest struct {
+	version byte
+	command byte
+	target  string
+}
+
+// readSocksRequest performs the SOCKS handshake, including SOCKS5 method
+// negotiation and authentication, and reads the client request. When
+// authenticate is not nil, SOCKS5 clients must authenticate and SOCKS4
+// clients, which can't send a password, are rejected. Failure
+// replies are sent for handshakes which the client can be told about, such
+// as an authentication failure or an unsupported address type.
+func readSocksRequest(conn net.Conn, authenticate socksAuthenticator) (*socksRequest, error) {
+
+	var version [1]byte
+	_, err := io.ReadFull(conn, version[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	switch version[0] {
+	case socks4Version:
+		if authenticate != nil {
+			writeSocksReply(conn, socks4Version, socks5ReplyNotAllowed, nil)
+			return nil, ContextError(errors.New("SOCKS4 not allowed with authentication"))
+		}
+		return readSocks4Request(conn)
+	case socks5Version:
+		return readSocks5Request(conn, authenticate)
+	}
+
+	return nil, ContextError(fmt.Errorf("unsupported SOCKS version: %d", version[0]))
+}
+
+func readSocks4Request(conn net.Conn) (*socksRequest, error) {
+
+	// | VN | CD | DSTPORT | DSTIP | USERID | NULL | [ HOST | NULL ]
+	// The version has already been read.
+
+	var header [7]byte
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	command := header[0]
+	port := binary.BigEndian.Uint16(header[1:3])
+	ip := net.IP(header[3:7])
+
+	// The user ID is ignored.
+	_, err = readSocks4String(conn)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	// SOCKS4a: a destination IP of 0.0.0.x, with x non-zero, indicates that
+	// the destination host name follows the user ID.
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err = readSocks4String(conn)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	if command != socksCommandConnect {
+		writeSocksReply(conn, socks4Version, socks5ReplyCommandNotSupported, nil)
+		return nil, ContextError(fmt.Errorf("unsupported SOCKS4 command: %d", command))
+	}
+
+	return &socksRequest{
+		version: socks4Version,
+		command: command,
+		target:  net.JoinHostPort(host, strconv.Itoa(int(port))),
+	}, nil
+}
+
+// readSocks4String reads a NULL terminated string. The string is read
+// one byte at a time so that no data following the request is consumed.
+func readSocks4String(conn net.Conn) (string, error) {
+	var value []byte
+	var b [1]byte
+	for {
+		_, err := io.ReadFull(conn, b[:])
+		if err != nil {
+			return "", ContextError(err)
+		}
+		if b[0] == 0 {
+			return string(value), nil
+		}
+		if len(value) >= socks4MaxUserIdLength {
+			return "", ContextError(errors.New("SOCKS4 string too long"))
+		}
+		value = append(value, b[0])
+	}
+}
+
+func readSocks5Request(conn net.Conn, authenticate socksAuthenticator) (*socksRequest, error) {
+
+	// Method selection: | VER | NMETHODS | METHODS |
+	// The version has already been read.
+
+	var methodCount [1]byte
+	_, err := io.ReadFull(conn, methodCount[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	methods := make([]byte, methodCount[0])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	method := byte(socks5MethodNoAuthentication)
+	if authenticate != nil {
+		method = socks5MethodUsernamePassword
+	}
+	if bytes.IndexByte(methods, method) == -1 {
+		conn.Write([]byte{socks5Version, socks5MethodNoAcceptableMethods})
+		return nil, ContextError(errors.New("no acceptable SOCKS5 method"))
+	}
+	_, err = conn.Write([]byte{socks5Version, method})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if authenticate != nil {
+		err = readSocks5UsernamePassword(conn, authenticate)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+	}
+
+	// Request: | VER | CMD | RSV | ATYP | DST.ADDR | DST.PORT |
+
+	var header [3]byte
+	_, err = io.ReadFull(conn, header[:])
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if header[0] != socks5Version {
+		return nil, ContextError(fmt.Errorf("unexpected SOCKS5 request version: %d", header[0]))
+	}
+	command := header[1]
+
+	host, port, err := readSocks5Address(conn)
+	if err == errSocks5AddressTypeNotSupported {
+		writeSocksReply(conn, socks5Version, socks5ReplyAddressTypeNotSupported, nil)
+	}
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	if command != socksCommandConnect && command != socksCommandUDPAssociate {
+		writeSocksReply(conn, socks5Version, socks5ReplyCommandNotSupported, nil)
+		return nil, ContextError(fmt.Errorf("unsupported SOCKS5 command: %d", command))
+	}
+
+	return &socksRequest{
+		version: socks5Version,
+		command: command,
+		target:  net.JoinHostPort(host, strconv.Itoa(port)),
+	}, nil
+}
+
+// readSocks5UsernamePassword performs RFC 1929 authentication.
+func readSocks5UsernamePassword(conn net.Conn, authenticate socksAuthenticator) error {
+
+	// | VER | ULEN | UNAME | PLEN | PASSWD |
+
+	var header [2]byte
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		return ContextError(err)
+	}
+	if header[0] != socks5UsernamePasswordVersion {
+		return ContextError(fmt.Errorf("unexpected SOCKS5 authentication version: %d", header[0]))
+	}
+	username := make([]byte, header[1])
+	_, err = io.ReadFull(conn, username)
+	if err != nil {
+		return ContextError(err)
+	}
+	var passwordLength [1]byte
+	_, err = io.ReadFull(conn, passwordLength[:])
+	if err != nil {
+		return ContextError(err)
+	}
+	password := make([]byte, passwordLength[0])
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	if !authenticate(string(username), string(password)) {
+		conn.Write([]byte{socks5UsernamePasswordVersion, socks5UsernamePasswordFailure})
+		return ContextError(errors.New("invalid SOCKS5 username or password"))
+	}
+
+	_, err = conn.Write([]byte{socks5UsernamePasswordVersion, socks5UsernamePasswordSuccess})
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+var errSocks5AddressTypeNotSupported = errors.New("SOCKS5 address type not supported")
+
+// readSocks5Address reads a SOCKS5 address: | ATYP | ADDR | PORT |
+func readSocks5Address(reader io.Reader) (string, int, error) {
+
+	var addressType [1]byte
+	_, err := io.ReadFull(reader, addressType[:])
+	if err != nil {
+		return "", 0, ContextError(err)
+	}
+
+	var host string
+	switch addressType[0] {
+	case socks5AddressTypeIPv4, socks5AddressTypeIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if addressType[0] == socks5AddressTypeIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(reader, ip)
+		if err != nil {
+			return "", 0, ContextError(err)
+		}
+		host = ip.String()
+	case socks5AddressTypeDomainName:
+		var length [1]byte
+		_, err = io.ReadFull(reader, length[:])
+		if err != nil {
+			return "", 0, ContextError(err)
+		}
+		name := make([]byte, length[0])
+		_, err = io.ReadFull(reader, name)
+		if err != nil {
+			return "", 0, ContextError(err)
+		}
+		host = string(name)
+	default:
+		return "", 0, errSocks5AddressTypeNotSupported
+	}
+
+	var port [2]byte
+	_, err = io.ReadFull(reader, port[:])
+	if err != nil {
+		return "", 0, ContextError(err)
+	}
+
+	return host, int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+// appendSocks5Address appends the SOCKS5 encoding of an IP address and port.
+func appendSocks5Address(buffer []byte, ip net.IP, port int) []byte {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		buffer = append(buffer, socks5AddressTypeIPv4)
+		buffer = append(buffer, ipv4...)
+	} else if ip.To16() != nil {
+		buffer = append(buffer, socks5AddressTypeIPv6)
+		buffer = append(buffer, ip.To16()...)
+	} else {
+		buffer = append(buffer, socks5AddressTypeIPv4)
+		buffer = append(buffer, net.IPv4zero.To4()...)
+	}
+	return append(buffer, byte(port>>8), byte(port))
+}
+
+// writeSocksReply sends a reply to a SOCKS request. reply is a SOCKS5 reply
+// code, which is mapped to a SOCKS4 reply code for SOCKS4 requests. A nil
+// bindAddr is sent as 0.0.0.0:0.
+func writeSocksReply(conn net.Conn, version, reply byte, bindAddr net.Addr) error {
+
+	var ip net.IP
+	port := 0
+	switch addr := bindAddr.(type) {
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+
+	var message []byte
+	if version == socks4Version {
+		socks4Reply := byte(socks4ReplyGranted)
+		if reply != socks5ReplySucceeded {
+			socks4Reply = socks4ReplyRejected
+		}
+		// SOCKS4 replies have only IPv4 addresses.
+		message = []byte{0x00, socks4Reply, byte(port >> 8), byte(port)}
+		ipv4 := ip.To4()
+		if ipv4 == nil {
+			ipv4 = net.IPv4zero.To4()
+		}
+		message = append(message, ipv4...)
+	} else {
+		message = appendSocks5Address([]byte{socks5Version, reply, 0x00}, ip, port)
+	}
+
+	_, err := conn.Write(message)
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
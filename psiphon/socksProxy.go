@@ -20,23 +20,36 @@
 package psiphon
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"sync"
-
-	socks "github.com/Psiphon-Inc/goptlib"
+	"time"
 )
 
 // SocksProxy is a SOCKS server that accepts local host connections
 // and, for each connection, establishes a port forward through
 // the tunnel SSH client and relays traffic through the port
 // forward.
+//
+// SOCKS4, SOCKS4a, and SOCKS5 clients are supported. SOCKS5 clients may
+// specify IPv4, IPv6, and domain name destinations, and must authenticate
+// when local proxy users are configured; see localProxyAccessControl. When
+// a udpgw server address
+// is configured, the SOCKS5 UDP ASSOCIATE command is supported, and UDP
+// packets are relayed through the tunnel using the udpgw protocol.
 type SocksProxy struct {
 	tunneler               Tunneler
-	listener               *socks.SocksListener
+	listener               net.Listener
+	accessControl          *localProxyAccessControl
+	udpgwServerAddress     string
 	serveWaitGroup         *sync.WaitGroup
 	openConns              *Conns
 	stopListeningBroadcast chan struct{}
+	notices                *Notices
 }
 
 var _SOCKS_PROXY_TYPE = "SOCKS"
@@ -49,24 +62,28 @@ func NewSocksProxy(
 	tunneler Tunneler,
 	listenIP string) (proxy *SocksProxy, err error) {
 
-	listener, err := socks.ListenSocks(
+	listener, err := net.Listen(
 		"tcp", fmt.Sprintf("%s:%d", listenIP, config.LocalSocksProxyPort))
 	if err != nil {
 		if IsAddressInUseError(err) {
-			NoticeSocksProxyPortInUse(config.LocalSocksProxyPort)
+			config.notices.SocksProxyPortInUse(config.LocalSocksProxyPort)
 		}
 		return nil, ContextError(err)
 	}
 	proxy = &SocksProxy{
-		tunneler:               tunneler,
-		listener:               listener,
+		tunneler: tunneler,
+		listener: newLocalProxyListener(
+			listener, config.localProxyAccessControl, _SOCKS_PROXY_TYPE, config.notices),
+		accessControl:          config.localProxyAccessControl,
+		udpgwServerAddress:     config.UdpgwServerAddress,
 		serveWaitGroup:         new(sync.WaitGroup),
 		openConns:              new(Conns),
 		stopListeningBroadcast: make(chan struct{}),
+		notices:                config.notices,
 	}
 	proxy.serveWaitGroup.Add(1)
 	go proxy.serve()
-	NoticeListeningSocksProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
+	config.notices.ListeningSocksProxyPort(proxy.listener.Addr().(*net.TCPAddr).Port)
 	return proxy, nil
 }
 
@@ -79,33 +96,222 @@ func (proxy *SocksProxy) Close() {
 	proxy.openConns.CloseAll()
 }
 
-func (proxy *SocksProxy) socksConnectionHandler(localConn *socks.SocksConn) (err error) {
+func (proxy *SocksProxy) socksConnectionHandler(localConn net.Conn) (err error) {
 	defer localConn.Close()
 	defer proxy.openConns.Remove(localConn)
 	proxy.openConns.Add(localConn)
+
+	// The deadline is cleared once the request is read, as a CONNECT may
+	// wait for a tunnel to be established.
+	localConn.SetDeadline(time.Now().Add(SOCKS_PROXY_REQUEST_TIMEOUT))
+	var user *localProxyUser
+	var authenticate socksAuthenticator
+	if proxy.accessControl.requiresAuthentication(_SOCKS_PROXY_TYPE) {
+		authenticate = func(username, password string) bool {
+			user = proxy.accessControl.authenticate(_SOCKS_PROXY_TYPE, username, password)
+			return user != nil
+		}
+	}
+	request, err := readSocksRequest(localConn, authenticate)
+	if err != nil {
+		return ContextError(err)
+	}
+	localConn.SetDeadline(time.Time{})
+
+	if !user.openConnection() {
+		writeSocksReply(localConn, request.version, socks5ReplyNotAllowed, nil)
+		return ContextError(fmt.Errorf("connection limit reached: %s", user.username))
+	}
+	defer user.closeConnection()
+
+	if request.command == socksCommandUDPAssociate {
+		return proxy.udpAssociateHandler(localConn, user, request)
+	}
+
 	// Using downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
 	// This ensures that the downstream client (e.g., web browser) doesn't keep waiting on the
 	// open connection for data which will never arrive.
-	remoteConn, err := proxy.tunneler.Dial(localConn.Req.Target, false, localConn)
+	remoteConn, err := proxy.tunneler.Dial(request.target, false, localConn)
+	if err != nil {
+		writeSocksReply(localConn, request.version, socks5ReplyGeneralFailure, nil)
+		return ContextError(err)
+	}
+	defer remoteConn.Close()
+	err = writeSocksReply(localConn, request.version, socks5ReplySucceeded, nil)
+	if err != nil {
+		return ContextError(err)
+	}
+	LocalProxyRelay(proxy.notices, _SOCKS_PROXY_TYPE, user.wrapConn(localConn), remoteConn)
+	return nil
+}
+
+// udpAssociateHandler implements the SOCKS5 UDP ASSOCIATE command. UDP
+// packets from the client are relayed through a single port forward to the
+// udpgw server address, which the Psiphon server intercepts. The association
+// ends when the client closes the SOCKS connection.
+func (proxy *SocksProxy) udpAssociateHandler(
+	localConn net.Conn, user *localProxyUser, request *socksRequest) error {
+
+	if proxy.udpgwServerAddress == "" {
+		writeSocksReply(localConn, request.version, socks5ReplyCommandNotSupported, nil)
+		return ContextError(errors.New("UDP ASSOCIATE requires a udpgw server address"))
+	}
+
+	// The udpgw server address is a special address which must be tunneled
+	// and not subject to split tunnel classification.
+	remoteConn, err := proxy.tunneler.Dial(proxy.udpgwServerAddress, true, localConn)
 	if err != nil {
+		writeSocksReply(localConn, request.version, socks5ReplyGeneralFailure, nil)
 		return ContextError(err)
 	}
 	defer remoteConn.Close()
-	err = localConn.Grant(&net.TCPAddr{IP: net.ParseIP("0.0.0.0"), Port: 0})
+
+	// Packets are received on the same interface as the SOCKS connection.
+	packetConn, err := net.ListenUDP(
+		"udp", &net.UDPAddr{IP: localConn.LocalAddr().(*net.TCPAddr).IP})
 	if err != nil {
+		writeSocksReply(localConn, request.version, socks5ReplyGeneralFailure, nil)
 		return ContextError(err)
 	}
-	LocalProxyRelay(_SOCKS_PROXY_TYPE, localConn, remoteConn)
+	defer packetConn.Close()
+	proxy.openConns.Add(packetConn)
+	defer proxy.openConns.Remove(packetConn)
+
+	err = writeSocksReply(localConn, request.version, socks5ReplySucceeded, packetConn.LocalAddr())
+	if err != nil {
+		return ContextError(err)
+	}
+
+	relay := &socksUDPRelay{
+		notices:    proxy.notices,
+		user:       user,
+		packetConn: packetConn,
+		clientIP:   localConn.RemoteAddr().(*net.TCPAddr).IP,
+		udpgw:      newUdpgwClient(remoteConn),
+	}
+
+	relayWaitGroup := new(sync.WaitGroup)
+	relayWaitGroup.Add(2)
+	go func() {
+		defer relayWaitGroup.Done()
+		io.Copy(ioutil.Discard, localConn)
+		packetConn.Close()
+		remoteConn.Close()
+	}()
+	go func() {
+		defer relayWaitGroup.Done()
+		relay.relayDownstream()
+		localConn.Close()
+	}()
+	relay.relayUpstream()
+	localConn.Close()
+	remoteConn.Close()
+	relayWaitGroup.Wait()
+
 	return nil
 }
 
+// socksUDPRelay relays the UDP packets of one SOCKS5 UDP association.
+type socksUDPRelay struct {
+	notices    *Notices
+	user       *localProxyUser
+	packetConn *net.UDPConn
+	clientIP   net.IP
+	udpgw      *udpgwClient
+	mutex      sync.Mutex
+	clientAddr *net.UDPAddr
+}
+
+func (relay *socksUDPRelay) getClientAddr() *net.UDPAddr {
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	return relay.clientAddr
+}
+
+// relayUpstream reads SOCKS5 UDP request packets from the client and sends
+// them through udpgw. Only packets from the SOCKS client host are accepted,
+// and the first such packet fixes the client address for the association.
+func (relay *socksUDPRelay) relayUpstream() {
+	buffer := make([]byte, 65536)
+	for {
+		n, addr, err := relay.packetConn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+
+		relay.mutex.Lock()
+		if relay.clientAddr == nil && addr.IP.Equal(relay.clientIP) {
+			relay.clientAddr = addr
+		}
+		clientAddr := relay.clientAddr
+		relay.mutex.Unlock()
+
+		if clientAddr == nil || !addr.IP.Equal(clientAddr.IP) || addr.Port != clientAddr.Port {
+			continue
+		}
+
+		// | RSV | FRAG | ATYP | DST.ADDR | DST.PORT | DATA |
+		// Fragmentation isn't supported: fragments are dropped.
+		if n < 3 || buffer[2] != 0 {
+			continue
+		}
+		reader := bytes.NewReader(buffer[3:n])
+		host, port, err := readSocks5Address(reader)
+		if err != nil {
+			continue
+		}
+		packet := buffer[n-reader.Len() : n]
+
+		// udpgw carries only IP addresses. Resolving the domain name here
+		// would send the DNS request outside of the tunnel, so packets
+		// addressed to domain names are dropped.
+		ip := net.ParseIP(host)
+		if ip == nil {
+			relay.notices.Info("SOCKS UDP packet to domain name dropped")
+			continue
+		}
+
+		err = relay.udpgw.send(&net.UDPAddr{IP: ip, Port: port}, packet)
+		if err != nil {
+			relay.notices.LocalProxyError(_SOCKS_PROXY_TYPE, ContextError(err))
+			return
+		}
+		relay.user.addBytesTransferred(int64(len(packet)), 0)
+	}
+}
+
+// relayDownstream receives packets through udpgw and sends them to the
+// client as SOCKS5 UDP reply packets.
+func (relay *socksUDPRelay) relayDownstream() {
+	buffer := make([]byte, udpgwProtocolMaxMessageSize)
+	for {
+		remoteAddr, packet, err := relay.udpgw.receive(buffer)
+		if err != nil {
+			return
+		}
+
+		clientAddr := relay.getClientAddr()
+		if clientAddr == nil {
+			continue
+		}
+
+		message := appendSocks5Address([]byte{0x00, 0x00, 0x00}, remoteAddr.IP, remoteAddr.Port)
+		message = append(message, packet...)
+		_, err = relay.packetConn.WriteToUDP(message, clientAddr)
+		if err != nil {
+			return
+		}
+		relay.user.addBytesTransferred(0, int64(len(packet)))
+	}
+}
+
 func (proxy *SocksProxy) serve() {
 	defer proxy.listener.Close()
 	defer proxy.serveWaitGroup.Done()
 loop:
 	for {
 		// Note: will be interrupted by listener.Close() call made by proxy.Close()
-		socksConnection, err := proxy.listener.AcceptSocks()
+		socksConnection, err := proxy.listener.Accept()
 		// Can't check for the exact error that Close() will cause in Accept(),
 		// (see: https://code.google.com/p/go/issues/detail?id=4373). So using an
 		// explicit stop signal to stop gracefully.
@@ -115,7 +321,7 @@ loop:
 		default:
 		}
 		if err != nil {
-			NoticeAlert("SOCKS proxy accept error: %s", err)
+			proxy.notices.Alert("SOCKS proxy accept error: %s", err)
 			if e, ok := err.(net.Error); ok && e.Temporary() {
 				// Temporary error, keep running
 				continue
@@ -127,9 +333,9 @@ loop:
 		go func() {
 			err := proxy.socksConnectionHandler(socksConnection)
 			if err != nil {
-				NoticeLocalProxyError(_SOCKS_PROXY_TYPE, ContextError(err))
+				proxy.notices.LocalProxyError(_SOCKS_PROXY_TYPE, ContextError(err))
 			}
 		}()
 	}
-	NoticeInfo("SOCKS proxy stopped")
+	proxy.notices.Info("SOCKS proxy stopped")
 }
@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testTunneler dials directly instead of through a tunnel.
+type testTunneler struct{}
+
+func (testTunneler) Dial(remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+	return net.Dial("tcp", remoteAddr)
+}
+
+func (testTunneler) SignalComponentFailure() {}
+
+// runTestServer runs a TCP server which handles each connection with handler.
+func runTestServer(t *testing.T, handler func(net.Conn)) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestSocksProxy(t *testing.T) {
+
+	echoServer := runTestServer(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	defer echoServer.Close()
+	_, echoPort, _ := net.SplitHostPort(echoServer.Addr().String())
+
+	// The fake udpgw server echoes each packet back, clearing the flags,
+	// as the Psiphon server does in downstream messages.
+	udpgwServer := runTestServer(t, func(conn net.Conn) {
+		buffer := make([]byte, udpgwProtocolMaxMessageSize)
+		for {
+			_, err := io.ReadFull(conn, buffer[0:2])
+			if err != nil {
+				return
+			}
+			size := int(binary.LittleEndian.Uint16(buffer[0:2]))
+			_, err = io.ReadFull(conn, buffer[2:2+size])
+			if err != nil {
+				return
+			}
+			buffer[2] = 0
+			conn.Write(buffer[0 : 2+size])
+		}
+	})
+	defer udpgwServer.Close()
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+	config.LocalSocksProxyUsername = "username"
+	config.LocalSocksProxyPassword = "password"
+	config.UdpgwServerAddress = udpgwServer.Addr().String()
+	config.localProxyAccessControl, err = newLocalProxyAccessControl(config)
+	if err != nil {
+		t.Fatalf("newLocalProxyAccessControl failed: %s", err)
+	}
+
+	proxy, err := NewSocksProxy(config, testTunneler{}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	dialSocks5 := func(password string, command byte, target []byte) (net.Conn, []byte) {
+		conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte{socks5Version, 1, socks5MethodUsernamePassword})
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(conn, reply)
+		if err != nil || reply[1] != socks5MethodUsernamePassword {
+			t.Fatalf("unexpected method selection: %v, %v", reply, err)
+		}
+		auth := []byte{socks5UsernamePasswordVersion, byte(len("username"))}
+		auth = append(auth, "username"...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		conn.Write(auth)
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			t.Fatalf("authentication failed: %s", err)
+		}
+		if reply[1] != socks5UsernamePasswordSuccess {
+			return conn, reply
+		}
+		conn.Write(append([]byte{socks5Version, command, 0x00}, target...))
+		reply = make([]byte, 10)
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		return conn, reply
+	}
+
+	// CONNECT to a domain name destination
+	port, _ := strconv.Atoi(echoPort)
+	target := []byte{socks5AddressTypeDomainName, byte(len("localhost"))}
+	target = append(target, "localhost"...)
+	target = append(target, byte(port>>8), byte(port))
+	conn, reply := dialSocks5("password", socksCommandConnect, target)
+	if reply[1] != socks5ReplySucceeded {
+		t.Fatalf("unexpected CONNECT reply: %v", reply)
+	}
+	conn.Write([]byte("hello"))
+	echo := make([]byte, 5)
+	_, err = io.ReadFull(conn, echo)
+	if err != nil || string(echo) != "hello" {
+		t.Errorf("unexpected echo: %s, %v", echo, err)
+	}
+	conn.Close()
+
+	// An invalid password is rejected
+	conn, reply = dialSocks5("invalid", socksCommandConnect, target)
+	if reply[1] != socks5UsernamePasswordFailure {
+		t.Errorf("unexpected authentication reply: %v", reply)
+	}
+	conn.Close()
+
+	// SOCKS4 is rejected when authentication is required
+	conn, err = net.Dial("tcp", proxy.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{socks4Version, socksCommandConnect, 0, 80, 127, 0, 0, 1, 0})
+	reply = make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || reply[1] != socks4ReplyRejected {
+		t.Errorf("unexpected SOCKS4 reply: %v, %v", reply, err)
+	}
+	conn.Close()
+
+	// UDP ASSOCIATE relays packets through udpgw
+	conn, reply = dialSocks5(
+		"password", socksCommandUDPAssociate, []byte{socks5AddressTypeIPv4, 0, 0, 0, 0, 0, 0})
+	defer conn.Close()
+	if reply[1] != socks5ReplySucceeded || reply[3] != socks5AddressTypeIPv4 {
+		t.Fatalf("unexpected UDP ASSOCIATE reply: %v", reply)
+	}
+	relayAddr := &net.UDPAddr{
+		IP:   net.IP(reply[4:8]),
+		Port: int(binary.BigEndian.Uint16(reply[8:10])),
+	}
+
+	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %s", err)
+	}
+	defer packetConn.Close()
+	packetConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	for _, remoteIP := range []string{"192.0.2.1", "2001:db8::1"} {
+		request := appendSocks5Address([]byte{0x00, 0x00, 0x00}, net.ParseIP(remoteIP), 53)
+		packet := append(request, []byte("packet to "+remoteIP)...)
+		_, err = packetConn.WriteToUDP(packet, relayAddr)
+		if err != nil {
+			t.Fatalf("WriteToUDP failed: %s", err)
+		}
+		response := make([]byte, 1024)
+		n, _, err := packetConn.ReadFromUDP(response)
+		if err != nil {
+			t.Fatalf("ReadFromUDP failed: %s", err)
+		}
+		if !bytes.Equal(response[:n], packet) {
+			t.Errorf("unexpected UDP response: %v", response[:n])
+		}
+	}
+}
+
+func TestSocks4aProxy(t *testing.T) {
+
+	echoServer := runTestServer(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	defer echoServer.Close()
+	_, echoPort, _ := net.SplitHostPort(echoServer.Addr().String())
+	port, _ := strconv.Atoi(echoPort)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+
+	proxy, err := NewSocksProxy(config, testTunneler{}, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewSocksProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// SOCKS4a request with a user ID and a host name
+	request := []byte{socks4Version, socksCommandConnect, byte(port >> 8), byte(port), 0, 0, 0, 1}
+	request = append(request, "user\x00localhost\x00hello"...)
+	conn.Write(request)
+
+	reply := make([]byte, 8+len("hello"))
+	_, err = io.ReadFull(conn, reply)
+	if err != nil || reply[1] != socks4ReplyGranted || string(reply[8:]) != "hello" {
+		t.Errorf("unexpected SOCKS4a reply: %v, %v", reply, err)
+	}
+}
+
+func TestReadSocks5Address(t *testing.T) {
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1"} {
+		encoded := appendSocks5Address(nil, net.ParseIP(ip), 443)
+		host, port, err := readSocks5Address(bytes.NewReader(encoded))
+		if err != nil || host != ip || port != 443 {
+			t.Errorf("unexpected address: %s, %d, %v", host, port, err)
+		}
+	}
+
+	_, _, err := readSocks5Address(bytes.NewReader([]byte{0x05, 0, 0}))
+	if err != errSocks5AddressTypeNotSupported {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
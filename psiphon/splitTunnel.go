@@ -77,6 +77,7 @@ type SplitTunnelClassifier struct {
 	isRoutesSet              bool
 	cache                    map[string]*classification
 	routes                   networkList
+	notices                  *Notices
 }
 
 type classification struct {
@@ -93,6 +94,7 @@ func NewSplitTunnelClassifier(config *Config, tunneler Tunneler) *SplitTunnelCla
 		fetchRoutesWaitGroup:     new(sync.WaitGroup),
 		isRoutesSet:              false,
 		cache:                    make(map[string]*classification),
+		notices:                  config.notices,
 	}
 }
 
@@ -166,7 +168,7 @@ func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool
 	ipAddr, ttl, err := tunneledLookupIP(
 		classifier.dnsServerAddress, classifier.dnsTunneler, targetAddress)
 	if err != nil {
-		NoticeAlert("failed to resolve address for split tunnel classification: %s", err)
+		classifier.notices.Alert("failed to resolve address for split tunnel classification: %s", err)
 		return false
 	}
 	expiry := time.Now().Add(ttl)
@@ -180,7 +182,7 @@ func (classifier *SplitTunnelClassifier) IsUntunneled(targetAddress string) bool
 	classifier.mutex.Unlock()
 
 	if isUntunneled {
-		NoticeUntunneled(targetAddress)
+		classifier.notices.Untunneled(targetAddress)
 	}
 
 	return isUntunneled
@@ -197,17 +199,17 @@ func (classifier *SplitTunnelClassifier) setRoutes(tunnel *Tunnel) {
 
 	routesData, err := classifier.getRoutes(tunnel)
 	if err != nil {
-		NoticeAlert("failed to get split tunnel routes: %s", err)
+		classifier.notices.Alert("failed to get split tunnel routes: %s", err)
 		return
 	}
 
 	err = classifier.installRoutes(routesData)
 	if err != nil {
-		NoticeAlert("failed to install split tunnel routes: %s", err)
+		classifier.notices.Alert("failed to install split tunnel routes: %s", err)
 		return
 	}
 
-	NoticeSplitTunnelRegion(tunnel.serverContext.clientRegion)
+	classifier.notices.SplitTunnelRegion(tunnel.serverContext.clientRegion)
 }
 
 // getRoutes makes a web request to download fresh routes data for the
@@ -222,7 +224,7 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 		return nil, ContextError(err)
 	}
 
-	etag, err := GetSplitTunnelRoutesETag(tunnel.serverContext.clientRegion)
+	etag, err := tunnel.config.dataStore.GetSplitTunnelRoutesETag(tunnel.serverContext.clientRegion)
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -255,7 +257,7 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 		err = fmt.Errorf("unexpected response status code: %d", response.StatusCode)
 	}
 	if err != nil {
-		NoticeAlert("failed to request split tunnel routes package: %s", ContextError(err))
+		classifier.notices.Alert("failed to request split tunnel routes package: %s", ContextError(err))
 		useCachedRoutes = true
 	}
 
@@ -270,7 +272,7 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 	if !useCachedRoutes {
 		routesDataPackage, err = ioutil.ReadAll(response.Body)
 		if err != nil {
-			NoticeAlert("failed to download split tunnel routes package: %s", ContextError(err))
+			classifier.notices.Alert("failed to download split tunnel routes package: %s", ContextError(err))
 			useCachedRoutes = true
 		}
 	}
@@ -280,7 +282,7 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 		encodedRoutesData, err = ReadAuthenticatedDataPackage(
 			routesDataPackage, classifier.routesSignaturePublicKey)
 		if err != nil {
-			NoticeAlert("failed to read split tunnel routes package: %s", ContextError(err))
+			classifier.notices.Alert("failed to read split tunnel routes package: %s", ContextError(err))
 			useCachedRoutes = true
 		}
 	}
@@ -289,7 +291,7 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 	if !useCachedRoutes {
 		compressedRoutesData, err = base64.StdEncoding.DecodeString(encodedRoutesData)
 		if err != nil {
-			NoticeAlert("failed to decode split tunnel routes: %s", ContextError(err))
+			classifier.notices.Alert("failed to decode split tunnel routes: %s", ContextError(err))
 			useCachedRoutes = true
 		}
 	}
@@ -301,7 +303,7 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 			zlibReader.Close()
 		}
 		if err != nil {
-			NoticeAlert("failed to decompress split tunnel routes: %s", ContextError(err))
+			classifier.notices.Alert("failed to decompress split tunnel routes: %s", ContextError(err))
 			useCachedRoutes = true
 		}
 	}
@@ -309,16 +311,16 @@ func (classifier *SplitTunnelClassifier) getRoutes(tunnel *Tunnel) (routesData [
 	if !useCachedRoutes {
 		etag := response.Header.Get("ETag")
 		if etag != "" {
-			err := SetSplitTunnelRoutes(tunnel.serverContext.clientRegion, etag, routesData)
+			err := tunnel.config.dataStore.SetSplitTunnelRoutes(tunnel.serverContext.clientRegion, etag, routesData)
 			if err != nil {
-				NoticeAlert("failed to cache split tunnel routes: %s", ContextError(err))
+				classifier.notices.Alert("failed to cache split tunnel routes: %s", ContextError(err))
 				// Proceed with fetched data, even when we can't cache it
 			}
 		}
 	}
 
 	if useCachedRoutes {
-		routesData, err = GetSplitTunnelRoutesData(tunnel.serverContext.clientRegion)
+		routesData, err = tunnel.config.dataStore.GetSplitTunnelRoutesData(tunnel.serverContext.clientRegion)
 		if err != nil {
 			return nil, ContextError(err)
 		}
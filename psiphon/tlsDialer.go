@@ -119,6 +119,10 @@ type CustomTLSConfig struct {
 	// SSL_CTX_load_verify_locations
 	// Only applies to UseIndistinguishableTLS connections.
 	TrustedCACertificatesFilename string
+
+	// establishTimings, when set, records the TLS handshake phase timing
+	// of a tunnel establishment attempt.
+	establishTimings *EstablishTimings
 }
 
 func NewCustomTLSDialer(config *CustomTLSConfig) Dialer {
@@ -205,6 +209,8 @@ func CustomTLSDial(network, addr string, config *CustomTLSConfig) (net.Conn, err
 		conn = tls.Client(rawConn, tlsConfig)
 	}
 
+	endPhase := config.establishTimings.startPhase(ESTABLISH_PHASE_TLS_HANDSHAKE)
+
 	if config.Timeout == 0 {
 		err = conn.Handshake()
 	} else {
@@ -231,6 +237,8 @@ func CustomTLSDial(network, addr string, config *CustomTLSConfig) (net.Conn, err
 		}
 	}
 
+	endPhase(err)
+
 	if err != nil {
 		rawConn.Close()
 		return nil, ContextError(err)
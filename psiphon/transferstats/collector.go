@@ -74,12 +74,29 @@ type serverStats struct {
 	recentBytesReceived int64
 }
 
-// allStats is the root object that holds stats for all servers and all hosts,
-// as well as the mutex to access them.
-var allStats = struct {
+// Collector is the root object that holds stats for all servers and all
+// hosts, as well as the mutex to access them. Each Collector is independent,
+// so that multiple tunnel controllers in one process may keep separate stats.
+// A nil *Collector refers to the process-wide collector, which is used by the
+// package-level functions.
+type Collector struct {
 	statsMutex      sync.RWMutex
 	serverIDtoStats map[string]*serverStats
-}{serverIDtoStats: make(map[string]*serverStats)}
+}
+
+// NewCollector creates a new, empty Collector.
+func NewCollector() *Collector {
+	return &Collector{serverIDtoStats: make(map[string]*serverStats)}
+}
+
+var allStats = NewCollector()
+
+func (collector *Collector) get() *Collector {
+	if collector == nil {
+		return allStats
+	}
+	return collector
+}
 
 // statsUpdate contains new stats counts to be aggregated.
 type statsUpdate struct {
@@ -89,23 +106,24 @@ type statsUpdate struct {
 	numBytesReceived int64
 }
 
-// recordStats makes sure the given stats update is added to the global
+// recordStats makes sure the given stats update is added to the
 // collection. recentBytes are not adjusted when isPutBack is true,
 // as recentBytes aren't subject to TakeOut/PutBack.
-func recordStat(stat *statsUpdate, isPutBack bool) {
-	allStats.statsMutex.Lock()
-	defer allStats.statsMutex.Unlock()
+func (collector *Collector) recordStat(stat *statsUpdate, isPutBack bool) {
+	collector = collector.get()
+	collector.statsMutex.Lock()
+	defer collector.statsMutex.Unlock()
 
 	if stat.hostname == "" {
 		stat.hostname = "(OTHER)"
 	}
 
-	storedServerStats := allStats.serverIDtoStats[stat.serverID]
+	storedServerStats := collector.serverIDtoStats[stat.serverID]
 	if storedServerStats == nil {
 		storedServerStats = &serverStats{
 			accumulatedStats: &AccumulatedStats{
 				hostnameToStats: make(map[string]*hostStats)}}
-		allStats.serverIDtoStats[stat.serverID] = storedServerStats
+		collector.serverIDtoStats[stat.serverID] = storedServerStats
 	}
 
 	storedHostStats := storedServerStats.accumulatedStats.hostnameToStats[stat.hostname]
@@ -123,14 +141,24 @@ func recordStat(stat *statsUpdate, isPutBack bool) {
 	}
 }
 
+// ReportRecentBytesTransferredForServer returns bytes sent and received since
+// the last call to ReportRecentBytesTransferredForServer, using the process-wide
+// collector.
+func ReportRecentBytesTransferredForServer(serverID string) (sent, received int64) {
+	return allStats.ReportRecentBytesTransferredForServer(serverID)
+}
+
 // ReportRecentBytesTransferredForServer returns bytes sent and received since
 // the last call to ReportRecentBytesTransferredForServer. The accumulated sent
 // and received are reset to 0 by this call.
-func ReportRecentBytesTransferredForServer(serverID string) (sent, received int64) {
-	allStats.statsMutex.Lock()
-	defer allStats.statsMutex.Unlock()
+func (collector *Collector) ReportRecentBytesTransferredForServer(
+	serverID string) (sent, received int64) {
 
-	stats := allStats.serverIDtoStats[serverID]
+	collector = collector.get()
+	collector.statsMutex.Lock()
+	defer collector.statsMutex.Unlock()
+
+	stats := collector.serverIDtoStats[serverID]
 
 	if stats == nil {
 		return
@@ -145,21 +173,30 @@ func ReportRecentBytesTransferredForServer(serverID string) (sent, received int6
 	return
 }
 
+// TakeOutStatsForServer borrows the AccumulatedStats for the specified
+// server from the process-wide collector.
+func TakeOutStatsForServer(serverID string) (accumulatedStats *AccumulatedStats) {
+	return allStats.TakeOutStatsForServer(serverID)
+}
+
 // TakeOutStatsForServer borrows the AccumulatedStats for the specified
 // server. When we fail to report these stats, resubmit them with
 // PutBackStatsForServer. Stats will continue to be accumulated between
 // TakeOut and PutBack calls. The recentBytes values are unaffected by
 // TakeOut/PutBack. Returns empty stats if the serverID is not found.
-func TakeOutStatsForServer(serverID string) (accumulatedStats *AccumulatedStats) {
-	allStats.statsMutex.Lock()
-	defer allStats.statsMutex.Unlock()
+func (collector *Collector) TakeOutStatsForServer(
+	serverID string) (accumulatedStats *AccumulatedStats) {
+
+	collector = collector.get()
+	collector.statsMutex.Lock()
+	defer collector.statsMutex.Unlock()
 
 	newAccumulatedStats := &AccumulatedStats{
 		hostnameToStats: make(map[string]*hostStats)}
 
 	// Note: for an existing serverStats, only the accumulatedStats is
 	// affected; the recentBytes fields are not changed.
-	serverStats := allStats.serverIDtoStats[serverID]
+	serverStats := collector.serverIDtoStats[serverID]
 	if serverStats != nil {
 		accumulatedStats = serverStats.accumulatedStats
 		serverStats.accumulatedStats = newAccumulatedStats
@@ -169,10 +206,18 @@ func TakeOutStatsForServer(serverID string) (accumulatedStats *AccumulatedStats)
 	return
 }
 
-// PutBackStatsForServer re-adds a set of server stats to the collection.
+// PutBackStatsForServer re-adds a set of server stats to the process-wide
+// collector.
 func PutBackStatsForServer(serverID string, accumulatedStats *AccumulatedStats) {
+	allStats.PutBackStatsForServer(serverID, accumulatedStats)
+}
+
+// PutBackStatsForServer re-adds a set of server stats to the collection.
+func (collector *Collector) PutBackStatsForServer(
+	serverID string, accumulatedStats *AccumulatedStats) {
+
 	for hostname, hoststats := range accumulatedStats.hostnameToStats {
-		recordStat(
+		collector.recordStat(
 			&statsUpdate{
 				serverID:         serverID,
 				hostname:         hostname,
@@ -39,6 +39,7 @@ import (
 // It inspects requests and responses and derives stats from them.
 type Conn struct {
 	net.Conn
+	collector      *Collector
 	serverID       string
 	firstWrite     int32
 	hostnameParsed int32
@@ -46,12 +47,20 @@ type Conn struct {
 	regexps        *Regexps
 }
 
-// NewConn creates a Conn. serverID can be anything that uniquely
-// identifies the server; it will be passed to TakeOutStatsForServer() when
-// retrieving the accumulated stats.
+// NewConn creates a Conn which records stats in the process-wide collector.
+// serverID can be anything that uniquely identifies the server; it will be
+// passed to TakeOutStatsForServer() when retrieving the accumulated stats.
 func NewConn(nextConn net.Conn, serverID string, regexps *Regexps) *Conn {
+	return allStats.NewConn(nextConn, serverID, regexps)
+}
+
+// NewConn creates a Conn which records stats in this collector.
+func (collector *Collector) NewConn(
+	nextConn net.Conn, serverID string, regexps *Regexps) *Conn {
+
 	return &Conn{
 		Conn:           nextConn,
+		collector:      collector,
 		serverID:       serverID,
 		firstWrite:     1,
 		hostnameParsed: 0,
@@ -81,7 +90,7 @@ func (conn *Conn) Write(buffer []byte) (n int, err error) {
 			}
 		}
 
-		recordStat(&statsUpdate{
+		conn.collector.recordStat(&statsUpdate{
 			conn.serverID,
 			conn.hostname,
 			int64(n),
@@ -105,7 +114,7 @@ func (conn *Conn) Read(buffer []byte) (n int, err error) {
 
 	// Count bytes without checking the error condition. It could happen that the
 	// buffer was partially read and then an error occurred.
-	recordStat(&statsUpdate{
+	conn.collector.recordStat(&statsUpdate{
 		conn.serverID,
 		hostname,
 		0,
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const (
+	TRANSPARENT_PROXY_MODE_REDIRECT = "REDIRECT"
+	TRANSPARENT_PROXY_MODE_TPROXY   = "TPROXY"
+)
+
+// TransparentProxy accepts TCP connections which are redirected to it, by
+// iptables on a Linux host or gateway, and relays each connection through
+// the tunnel to its original destination. Applications don't need to be
+// configured to use a proxy. As with the SOCKS and HTTP proxies, port
+// forwards are made with Controller.Dial, so split tunnel classification
+// applies.
+//
+// In REDIRECT mode, connections are redirected with the nat table REDIRECT
+// target and the original destination is recovered with SO_ORIGINAL_DST;
+// only IPv4 is supported. For example:
+//
+// iptables -t nat -A PREROUTING -i <lan> -p tcp -j REDIRECT --to-ports <port>
+//
+// In TPROXY mode, connections are redirected with the mangle table TPROXY
+// target, and the listening socket is IP_TRANSPARENT so that the local
+// address of each connection is its original destination. This requires
+// CAP_NET_ADMIN and the policy routing which TPROXY uses.
+//
+// Connections made by the Psiphon client itself, including tunnel
+// connections and untunneled split tunnel connections, must not be
+// redirected; for example, for locally originated traffic, exclude the
+// client user with "-m owner ! --uid-owner <user>". Connections whose
+// original destination is the transparent proxy itself are rejected.
+type TransparentProxy struct {
+	tunneler               Tunneler
+	listener               net.Listener
+	isTProxy               bool
+	serveWaitGroup         *sync.WaitGroup
+	openConns              *Conns
+	stopListeningBroadcast chan struct{}
+	notices                *Notices
+}
+
+var _TRANSPARENT_PROXY_TYPE = "TRANSPARENT"
+
+// NewTransparentProxy initializes and runs a new transparent proxy.
+func NewTransparentProxy(
+	config *Config,
+	tunneler Tunneler,
+	listenIP string) (proxy *TransparentProxy, err error) {
+
+	isTProxy := config.TransparentProxyMode == TRANSPARENT_PROXY_MODE_TPROXY
+
+	listener, err := listenTransparentProxy(listenIP, config.LocalTransparentProxyPort, isTProxy)
+	if err != nil {
+		if IsAddressInUseError(err) {
+			config.notices.TransparentProxyPortInUse(config.LocalTransparentProxyPort)
+		}
+		return nil, ContextError(err)
+	}
+
+	proxy = &TransparentProxy{
+		tunneler: tunneler,
+		listener: newLocalProxyListener(
+			listener, config.localProxyAccessControl, _TRANSPARENT_PROXY_TYPE, config.notices),
+		isTProxy:               isTProxy,
+		serveWaitGroup:         new(sync.WaitGroup),
+		openConns:              new(Conns),
+		stopListeningBroadcast: make(chan struct{}),
+		notices:                config.notices,
+	}
+	proxy.serveWaitGroup.Add(1)
+	go proxy.serve()
+
+	config.notices.ListeningTransparentProxyPort(listener.Addr().(*net.TCPAddr).Port)
+
+	return proxy, nil
+}
+
+// Close terminates the listener and waits for the accept loop
+// goroutine to complete.
+func (proxy *TransparentProxy) Close() {
+	close(proxy.stopListeningBroadcast)
+	proxy.listener.Close()
+	proxy.serveWaitGroup.Wait()
+	proxy.openConns.CloseAll()
+}
+
+func (proxy *TransparentProxy) transparentConnectionHandler(localConn net.Conn) error {
+	defer localConn.Close()
+	defer proxy.openConns.Remove(localConn)
+	proxy.openConns.Add(localConn)
+
+	destination, err := getTransparentProxyDestination(localConn, proxy.isTProxy)
+	if err != nil {
+		return ContextError(err)
+	}
+
+	// A connection made directly to the transparent proxy, which wasn't
+	// redirected, would otherwise be relayed back to the proxy.
+	listenerAddr := proxy.listener.Addr().(*net.TCPAddr)
+	if destination.Port == listenerAddr.Port &&
+		(listenerAddr.IP.IsUnspecified() || destination.IP.Equal(listenerAddr.IP)) {
+		return ContextError(errors.New("connection not redirected"))
+	}
+
+	// Using downstreamConn so localConn.Close() will be called when remoteConn.Close() is called.
+	remoteConn, err := proxy.tunneler.Dial(destination.String(), false, localConn)
+	if err != nil {
+		return ContextError(err)
+	}
+	defer remoteConn.Close()
+
+	LocalProxyRelay(proxy.notices, _TRANSPARENT_PROXY_TYPE, localConn, remoteConn)
+	return nil
+}
+
+func (proxy *TransparentProxy) serve() {
+	defer proxy.listener.Close()
+	defer proxy.serveWaitGroup.Done()
+loop:
+	for {
+		// Note: will be interrupted by listener.Close() call made by proxy.Close()
+		conn, err := proxy.listener.Accept()
+		select {
+		case <-proxy.stopListeningBroadcast:
+			break loop
+		default:
+		}
+		if err != nil {
+			proxy.notices.Alert("transparent proxy accept error: %s", err)
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				// Temporary error, keep running
+				continue
+			}
+			// Fatal error, stop the proxy
+			proxy.tunneler.SignalComponentFailure()
+			break loop
+		}
+		go func() {
+			err := proxy.transparentConnectionHandler(conn)
+			if err != nil {
+				proxy.notices.LocalProxyError(_TRANSPARENT_PROXY_TYPE, ContextError(err))
+			}
+		}()
+	}
+	proxy.notices.Info("transparent proxy stopped")
+}
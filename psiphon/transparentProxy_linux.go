@@ -0,0 +1,130 @@
+// +build linux
+
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST, from linux/netfilter_ipv4.h.
+const soOriginalDst = 80
+
+// listenTransparentProxy listens for redirected connections. For TPROXY,
+// the listening socket is made with the lower-level syscall APIs in order
+// to set IP_TRANSPARENT before binding.
+func listenTransparentProxy(listenIP string, port int, isTProxy bool) (net.Listener, error) {
+
+	if !isTProxy {
+		listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", listenIP, port))
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		return listener, nil
+	}
+
+	ip := net.ParseIP(listenIP).To4()
+	if ip == nil {
+		return nil, ContextError(errors.New("TPROXY requires an IPv4 listen address"))
+	}
+
+	socketFd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	// The listener dups the socket, so the socket is always closed here.
+	file := os.NewFile(uintptr(socketFd), "transparent-proxy-listener")
+	defer file.Close()
+
+	err = syscall.SetsockoptInt(socketFd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	err = syscall.SetsockoptInt(socketFd, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	sockAddr := syscall.SockaddrInet4{Port: port}
+	copy(sockAddr.Addr[:], ip)
+	err = syscall.Bind(socketFd, &sockAddr)
+	if err != nil {
+		return nil, ContextError(os.NewSyscallError("bind", err))
+	}
+	err = syscall.Listen(socketFd, syscall.SOMAXCONN)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return listener, nil
+}
+
+// getTransparentProxyDestination returns the original destination of a
+// redirected connection. For TPROXY, this is the local address of the
+// connection. For REDIRECT, this is the SO_ORIGINAL_DST recorded by
+// conntrack.
+func getTransparentProxyDestination(conn net.Conn, isTProxy bool) (*net.TCPAddr, error) {
+
+	if isTProxy {
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, ContextError(errors.New("unexpected conn type"))
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	// The option value is a struct sockaddr_in, which is read as the
+	// similarly sized struct ipv6_mreq. Control is used rather than File,
+	// which would dup the socket and switch it to blocking mode.
+	var value *syscall.IPv6Mreq
+	var getsockoptErr error
+	err = rawConn.Control(func(fd uintptr) {
+		value, getsockoptErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+	})
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	if getsockoptErr != nil {
+		return nil, ContextError(os.NewSyscallError("getsockopt", getsockoptErr))
+	}
+	return parseSockaddrInet4(value.Multiaddr), nil
+}
+
+// parseSockaddrInet4 parses the port and address of a raw struct sockaddr_in:
+// | 2 byte family | 2 byte port, big endian | 4 byte address | padding |
+func parseSockaddrInet4(sockAddr [16]byte) *net.TCPAddr {
+	return &net.TCPAddr{
+		IP:   net.IPv4(sockAddr[4], sockAddr[5], sockAddr[6], sockAddr[7]),
+		Port: int(sockAddr[2])<<8 | int(sockAddr[3]),
+	}
+}
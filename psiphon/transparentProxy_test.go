@@ -0,0 +1,178 @@
+// +build linux
+
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingTunneler counts dials and dials directly.
+type countingTunneler struct {
+	testTunneler
+	dialCount int32
+}
+
+func (tunneler *countingTunneler) Dial(
+	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (net.Conn, error) {
+
+	atomic.AddInt32(&tunneler.dialCount, 1)
+	return tunneler.testTunneler.Dial(remoteAddr, alwaysTunnel, downstreamConn)
+}
+
+func TestParseSockaddrInet4(t *testing.T) {
+	addr := parseSockaddrInet4([16]byte{2, 0, 0x1f, 0x90, 192, 0, 2, 1})
+	if !addr.IP.Equal(net.IPv4(192, 0, 2, 1)) || addr.Port != 8080 {
+		t.Errorf("unexpected address: %s", addr)
+	}
+}
+
+func TestTransparentProxy(t *testing.T) {
+
+	config, err := LoadConfig([]byte(`
+	{
+		"PropagationChannelId": "0",
+		"SponsorId": "0",
+		"TransparentProxyMode": "REDIRECT"
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+
+	_, err = LoadConfig([]byte(`
+	{
+		"PropagationChannelId": "0",
+		"SponsorId": "0",
+		"TransparentProxyMode": "INVALID"
+	}`))
+	if err == nil {
+		t.Errorf("LoadConfig unexpectedly succeeded with invalid mode")
+	}
+
+	tunneler := &countingTunneler{}
+	proxy, err := NewTransparentProxy(config, tunneler, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewTransparentProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	// A connection which wasn't redirected has no original destination, or
+	// has the proxy itself as its original destination, and is closed
+	// without a port forward
+	conn, err := net.Dial("tcp", proxy.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Errorf("connection should be closed")
+	}
+	if atomic.LoadInt32(&tunneler.dialCount) != 0 {
+		t.Errorf("unexpected port forward")
+	}
+}
+
+func TestTransparentProxyTProxy(t *testing.T) {
+
+	// The interceptor listener stands in for the TPROXY rule: the
+	// destination of a connection it accepts is the connection's local
+	// address, the interceptor's own address.
+	interceptor, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer interceptor.Close()
+
+	conn, err := net.Dial("tcp", interceptor.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	interceptedConn, err := interceptor.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	defer interceptedConn.Close()
+
+	destination, err := getTransparentProxyDestination(interceptedConn, true)
+	if err != nil {
+		t.Fatalf("getTransparentProxyDestination failed: %s", err)
+	}
+	if destination.String() != interceptor.Addr().String() {
+		t.Errorf("unexpected destination: %s", destination)
+	}
+
+	// Setting IP_TRANSPARENT on the proxy listener requires root
+	if os.Geteuid() != 0 {
+		t.Skip("TPROXY listener requires root")
+	}
+
+	config, err := LoadConfig([]byte(`
+	{
+		"PropagationChannelId": "0",
+		"SponsorId": "0",
+		"TransparentProxyMode": "TPROXY"
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.notices = newNotices(newJSONNoticeWriter(ioutil.Discard))
+
+	tunneler := &countingTunneler{}
+	proxy, err := NewTransparentProxy(config, tunneler, "127.0.0.1")
+	if err != nil {
+		t.Fatalf("NewTransparentProxy failed: %s", err)
+	}
+	defer proxy.Close()
+
+	// The intercepted connection is relayed through a port forward to the
+	// destination, where the interceptor echoes it
+	go proxy.transparentConnectionHandler(interceptedConn)
+	relayedConn, err := interceptor.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	defer relayedConn.Close()
+	go io.Copy(relayedConn, relayedConn)
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte("relayed"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	echoed := make([]byte, 7)
+	_, err = io.ReadFull(conn, echoed)
+	if err != nil || string(echoed) != "relayed" {
+		t.Fatalf("unexpected relay: %q, %v", echoed, err)
+	}
+	if atomic.LoadInt32(&tunneler.dialCount) != 1 {
+		t.Errorf("unexpected port forward count")
+	}
+}
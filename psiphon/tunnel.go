@@ -26,6 +26,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -55,8 +56,12 @@ type Tunneler interface {
 // TunnerOwner specifies the interface required by Tunnel to notify its
 // owner when it has failed. The owner may, as in the case of the Controller,
 // remove the tunnel from its list of active tunnels.
+// SignalTunnelDegraded is called, once, when the tunnel is still operating
+// but performing poorly. The owner may, as in the case of the Controller,
+// replace the tunnel before it fails.
 type TunnelOwner interface {
 	SignalTunnelFailure(tunnel *Tunnel)
+	SignalTunnelDegraded(tunnel *Tunnel)
 }
 
 // Tunnel is a connection to a Psiphon server. An established
@@ -68,18 +73,30 @@ type Tunnel struct {
 	untunneledDialConfig         *DialConfig
 	isDiscarded                  bool
 	isClosed                     bool
+	isStandby                    bool
+	isDegraded                   bool
 	serverEntry                  *ServerEntry
 	serverContext                *ServerContext
 	protocol                     string
+	dialParameters               *DialParameters
+	networkID                    string
 	conn                         net.Conn
 	sshClient                    *ssh.Client
 	operateWaitGroup             *sync.WaitGroup
 	shutdownOperateBroadcast     chan struct{}
 	signalPortForwardFailure     chan struct{}
+	signalNetworkChanged         chan struct{}
 	totalPortForwardFailures     int
 	startTime                    time.Time
+	activeTime                   time.Time
 	meekStats                    *MeekStats
 	newClientVerificationPayload chan string
+	totalBytesSent               int64
+	totalBytesReceived           int64
+	openPortForwardCount         int
+	roundTripTime                time.Duration
+	roundTripTimeJitter          time.Duration
+	roundTripTimeSampleCount     int
 }
 
 // EstablishTunnel first makes a network transport connection to the
@@ -89,25 +106,37 @@ type Tunnel struct {
 // Depending on the server's capabilities, the connection may use
 // plain SSH over TCP, obfuscated SSH over TCP, or obfuscated SSH over
 // HTTP (meek protocol).
-// When requiredProtocol is not blank, that protocol is used. Otherwise,
-// the a random supported protocol is used.
+// The caller selects the protocol and other dial parameters, typically
+// with selectDialParameters.
 // untunneledDialConfig is used for untunneled final status requests.
+// establishTimings, when not nil, records the timing of each phase of the
+// establishment; the caller completes it with the result.
 func EstablishTunnel(
 	config *Config,
 	untunneledDialConfig *DialConfig,
 	sessionId string,
 	pendingConns *Conns,
 	serverEntry *ServerEntry,
+	dialParameters *DialParameters,
+	establishTimings *EstablishTimings,
 	tunnelOwner TunnelOwner) (tunnel *Tunnel, err error) {
 
-	selectedProtocol, err := selectProtocol(config, serverEntry)
-	if err != nil {
-		return nil, ContextError(err)
+	// Select the obfuscation padding length here, rather than leaving it to
+	// the obfuscator, so that it's recorded in the tunnel dial parameters
+	// for replay. The caller's dial parameters aren't modified.
+	if dialParameters.ObfuscatorPaddingLength == nil {
+		paddingLength, err := MakeSecureRandomInt(OBFUSCATE_MAX_PADDING + 1)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		selectedDialParameters := *dialParameters
+		selectedDialParameters.ObfuscatorPaddingLength = &paddingLength
+		dialParameters = &selectedDialParameters
 	}
 
 	// Build transport layers and establish SSH connection
 	conn, sshClient, meekStats, err := dialSsh(
-		config, pendingConns, serverEntry, selectedProtocol, sessionId)
+		config, pendingConns, serverEntry, dialParameters, establishTimings, sessionId)
 	if err != nil {
 		return nil, ContextError(err)
 	}
@@ -127,7 +156,9 @@ func EstablishTunnel(
 		untunneledDialConfig:     untunneledDialConfig,
 		isClosed:                 false,
 		serverEntry:              serverEntry,
-		protocol:                 selectedProtocol,
+		protocol:                 dialParameters.TunnelProtocol,
+		dialParameters:           dialParameters,
+		networkID:                getNetworkID(config),
 		conn:                     conn,
 		sshClient:                sshClient,
 		operateWaitGroup:         new(sync.WaitGroup),
@@ -135,6 +166,7 @@ func EstablishTunnel(
 		// A buffer allows at least one signal to be sent even when the receiver is
 		// not listening. Senders should not block.
 		signalPortForwardFailure: make(chan struct{}, 1),
+		signalNetworkChanged:     make(chan struct{}, 1),
 		meekStats:                meekStats,
 		// Buffer allows SetClientVerificationPayload to submit one new payload
 		// without blocking or dropping it.
@@ -145,8 +177,10 @@ func EstablishTunnel(
 	// performing a handshake request. If the handshake fails, this establishment
 	// fails.
 	if !config.DisableApi {
-		NoticeInfo("starting server context for %s", tunnel.serverEntry.IpAddress)
+		tunnel.config.notices.Info("starting server context for %s", tunnel.serverEntry.IpAddress)
+		endPhase := establishTimings.startPhase(ESTABLISH_PHASE_PSIPHON_HANDSHAKE)
 		tunnel.serverContext, err = NewServerContext(tunnel, sessionId)
+		endPhase(err)
 		if err != nil {
 			return nil, ContextError(
 				fmt.Errorf("error starting server context for %s: %s",
@@ -155,6 +189,7 @@ func EstablishTunnel(
 	}
 
 	tunnel.startTime = time.Now()
+	tunnel.activeTime = tunnel.startTime
 
 	// Now that network operations are complete, cancel interruptibility
 	pendingConns.Remove(conn)
@@ -211,6 +246,119 @@ func (tunnel *Tunnel) IsDiscarded() bool {
 	return tunnel.isDiscarded
 }
 
+// IsStandby returns the tunnel's standby status. A standby tunnel is
+// established and kept alive, but carries no port forwards and doesn't make
+// periodic status requests until it's promoted to an active tunnel.
+func (tunnel *Tunnel) IsStandby() bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.isStandby
+}
+
+// setStandby sets the tunnel's standby status. When a standby tunnel is
+// promoted, its active time, from which the reported tunnel duration is
+// measured, is reset to the promotion time.
+func (tunnel *Tunnel) setStandby(isStandby bool) {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	if tunnel.isStandby && !isStandby {
+		tunnel.activeTime = time.Now()
+	}
+	tunnel.isStandby = isStandby
+}
+
+// getActiveTime returns the time the tunnel became active: its start
+// time, or, for a promoted standby tunnel, its promotion time.
+func (tunnel *Tunnel) getActiveTime() time.Time {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.activeTime
+}
+
+// IsDegraded returns the tunnel's degraded status. A degraded tunnel is
+// operating but performing poorly; see operateTunnel.
+func (tunnel *Tunnel) IsDegraded() bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.isDegraded
+}
+
+// setDegraded sets the tunnel's degraded status. Returns true when the
+// tunnel wasn't already degraded.
+func (tunnel *Tunnel) setDegraded() bool {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	isDegraded := tunnel.isDegraded
+	tunnel.isDegraded = true
+	return !isDegraded
+}
+
+// GetOpenPortForwardCount returns the number of port forwards currently
+// open through the tunnel.
+func (tunnel *Tunnel) GetOpenPortForwardCount() int {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.openPortForwardCount
+}
+
+// GetRoundTripTime returns the smoothed round trip time measured by SSH keep
+// alives. Returns 0 when no keep alive has completed.
+func (tunnel *Tunnel) GetRoundTripTime() time.Duration {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.roundTripTime
+}
+
+// GetRoundTripTimeStats returns the smoothed round trip time and jitter, the
+// smoothed mean deviation of the round trip time, measured by SSH keep alives,
+// and the number of measurements.
+func (tunnel *Tunnel) GetRoundTripTimeStats() (
+	roundTripTime, jitter time.Duration, sampleCount int) {
+
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.roundTripTime, tunnel.roundTripTimeJitter, tunnel.roundTripTimeSampleCount
+}
+
+// addRoundTripTimeSample updates the rolling round trip time measurements
+// using the smoothing of the TCP retransmission timer (RFC 6298): the round
+// trip time gain is 1/8 and the jitter gain is 1/4.
+func (tunnel *Tunnel) addRoundTripTimeSample(sample time.Duration) (
+	roundTripTime, jitter time.Duration) {
+
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	if tunnel.roundTripTimeSampleCount == 0 {
+		tunnel.roundTripTime = sample
+		tunnel.roundTripTimeJitter = 0
+	} else {
+		deviation := tunnel.roundTripTime - sample
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		tunnel.roundTripTimeJitter = (3*tunnel.roundTripTimeJitter + deviation) / 4
+		tunnel.roundTripTime = (7*tunnel.roundTripTime + sample) / 8
+	}
+	tunnel.roundTripTimeSampleCount++
+	return tunnel.roundTripTime, tunnel.roundTripTimeJitter
+}
+
+// GetTotalBytesTransferred returns the number of bytes sent and received
+// through the tunnel, as of the last operateTunnel transfer stats check.
+func (tunnel *Tunnel) GetTotalBytesTransferred() (int64, int64) {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	return tunnel.totalBytesSent, tunnel.totalBytesReceived
+}
+
+// setTotalBytesTransferred records the operateTunnel transfer totals.
+func (tunnel *Tunnel) setTotalBytesTransferred(sent, received int64) {
+	tunnel.mutex.Lock()
+	defer tunnel.mutex.Unlock()
+	tunnel.totalBytesSent = sent
+	tunnel.totalBytesReceived = received
+}
+
 // SendAPIRequest sends an API request as an SSH request through the tunnel.
 // This function blocks awaiting a response. Only one request may be in-flight
 // at once; a concurrent SendAPIRequest will block until an active request
@@ -241,8 +389,20 @@ func (tunnel *Tunnel) SendAPIRequest(
 func (tunnel *Tunnel) Dial(
 	remoteAddr string, alwaysTunnel bool, downstreamConn net.Conn) (conn net.Conn, err error) {
 
+	conn, _, err = tunnel.dial(remoteAddr, downstreamConn)
+	return conn, err
+}
+
+// dial is Dial, which additionally reports whether a failed port forward
+// may succeed through another tunnel. That's the case when the tunnel or
+// the server failed, but not when the server reports that the destination
+// refused or failed the connection, nor when the dial timed out, as these
+// are most likely faults of the destination.
+func (tunnel *Tunnel) dial(
+	remoteAddr string, downstreamConn net.Conn) (conn net.Conn, isRetriable bool, err error) {
+
 	if tunnel.IsClosed() {
-		return nil, ContextError(errors.New("tunnel is closed"))
+		return nil, true, ContextError(errors.New("tunnel is closed"))
 	}
 
 	type tunnelDialResult struct {
@@ -250,9 +410,10 @@ func (tunnel *Tunnel) Dial(
 		err                error
 	}
 	resultChannel := make(chan *tunnelDialResult, 2)
+	dialTimeoutError := errors.New("tunnel dial timeout")
 	if *tunnel.config.TunnelPortForwardTimeoutSeconds > 0 {
 		time.AfterFunc(time.Duration(*tunnel.config.TunnelPortForwardTimeoutSeconds)*time.Second, func() {
-			resultChannel <- &tunnelDialResult{nil, errors.New("tunnel dial timeout")}
+			resultChannel <- &tunnelDialResult{nil, dialTimeoutError}
 		})
 	}
 	go func() {
@@ -267,9 +428,18 @@ func (tunnel *Tunnel) Dial(
 		case tunnel.signalPortForwardFailure <- *new(struct{}):
 		default:
 		}
-		return nil, ContextError(result.err)
+		isRetriable = result.err != dialTimeoutError
+		if openChannelErr, ok := result.err.(*ssh.OpenChannelError); ok &&
+			openChannelErr.Reason == ssh.ConnectionFailed {
+			isRetriable = false
+		}
+		return nil, isRetriable, ContextError(result.err)
 	}
 
+	tunnel.mutex.Lock()
+	tunnel.openPortForwardCount++
+	tunnel.mutex.Unlock()
+
 	conn = &TunneledConn{
 		Conn:           result.sshPortForwardConn,
 		tunnel:         tunnel,
@@ -282,15 +452,15 @@ func (tunnel *Tunnel) Dial(
 	if tunnel.serverContext != nil {
 		regexps = tunnel.serverContext.StatsRegexps()
 	}
-	conn = transferstats.NewConn(conn, tunnel.serverEntry.IpAddress, regexps)
+	conn = tunnel.config.transferStats.NewConn(conn, tunnel.serverEntry.IpAddress, regexps)
 
-	return conn, nil
+	return conn, false, nil
 }
 
 // SignalComponentFailure notifies the tunnel that an associated component has failed.
 // This will terminate the tunnel.
 func (tunnel *Tunnel) SignalComponentFailure() {
-	NoticeAlert("tunnel received component failure signal")
+	tunnel.config.notices.Alert("tunnel received component failure signal")
 	tunnel.Close(false)
 }
 
@@ -305,6 +475,16 @@ func (tunnel *Tunnel) SetClientVerificationPayload(clientVerificationPayload str
 	}
 }
 
+// SignalNetworkChanged triggers an immediate SSH keep alive probe, which
+// fails the tunnel when it's no longer usable after a network change.
+// If a probe is already pending, the signal is dropped.
+func (tunnel *Tunnel) SignalNetworkChanged() {
+	select {
+	case tunnel.signalNetworkChanged <- *new(struct{}):
+	default:
+	}
+}
+
 // TunneledConn implements net.Conn and wraps a port foward connection.
 // It is used to hook into Read and Write to observe I/O errors and
 // report these errors back to the tunnel monitor as port forward failures.
@@ -314,6 +494,7 @@ type TunneledConn struct {
 	net.Conn
 	tunnel         *Tunnel
 	downstreamConn net.Conn
+	isClosed       int32
 }
 
 func (conn *TunneledConn) Read(buffer []byte) (n int, err error) {
@@ -343,14 +524,145 @@ func (conn *TunneledConn) Write(buffer []byte) (n int, err error) {
 }
 
 func (conn *TunneledConn) Close() error {
+	if atomic.CompareAndSwapInt32(&conn.isClosed, 0, 1) {
+		conn.tunnel.mutex.Lock()
+		conn.tunnel.openPortForwardCount--
+		conn.tunnel.mutex.Unlock()
+	}
 	if conn.downstreamConn != nil {
 		conn.downstreamConn.Close()
 	}
 	return conn.Conn.Close()
 }
 
+// DialParameters are the parameters selected for one tunnel establishment
+// attempt: the tunnel protocol and, for fronted meek protocols, the
+// fronting address and fronting host.
+//
+// ObfuscatorPaddingLength is the obfuscated SSH seed message padding length.
+// It's nil in selected dial parameters, and EstablishTunnel selects a random
+// length for each attempt, which is recorded in the tunnel dial parameters.
+//
+// The dial parameters of the last successful tunnel to each server are
+// stored and replayed; see selectDialParameters. Meek host name transforms
+// are applied anew for each attempt, replayed or not.
+type DialParameters struct {
+	TunnelProtocol          string
+	FrontingAddress         string
+	FrontingHost            string
+	ObfuscatorPaddingLength *int
+	isReplay                bool
+}
+
+// selectDialParameters selects up to maxCount distinct sets of dial
+// parameters for the server entry. The selections are random, weighted by
+// the protocol performance history for the current network, so fewer sets
+// are returned when the server entry offers few options.
+//
+// When there are stored dial parameters for the server, which are within
+// the replay TTL and still applicable, the single replayed set is returned
+// instead. The caller should delete the stored dial parameters when the
+// replay fails, so that the next selection for the server is random.
+func selectDialParameters(
+	config *Config,
+	networkID string,
+	serverEntry *ServerEntry,
+	maxCount int) ([]*DialParameters, error) {
+
+	replayDialParameters := selectReplayDialParameters(config, serverEntry)
+	if replayDialParameters != nil {
+		return []*DialParameters{replayDialParameters}, nil
+	}
+
+	networkPerformance, err := config.dataStore.GetNetworkPerformance(networkID)
+	if err != nil {
+		config.notices.Alert("selectDialParameters: %s", err)
+		networkPerformance = newNetworkPerformance()
+	}
+
+	selectedDialParameters := make([]*DialParameters, 0, maxCount)
+
+	// Since selection is random, the same parameters may be selected more
+	// than once. Make a bounded number of attempts to select distinct sets.
+	for i := 0; i < 2*maxCount && len(selectedDialParameters) < maxCount; i++ {
+
+		dialParameters := new(DialParameters)
+
+		dialParameters.TunnelProtocol, err = selectProtocol(
+			config, networkPerformance, serverEntry)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+
+		if dialParameters.TunnelProtocol == TUNNEL_PROTOCOL_FRONTED_MEEK ||
+			dialParameters.TunnelProtocol == TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP {
+
+			dialParameters.FrontingAddress, dialParameters.FrontingHost, err =
+				selectFrontingParameters(serverEntry)
+			if err != nil {
+				return nil, ContextError(err)
+			}
+		}
+
+		isDuplicate := false
+		for _, selected := range selectedDialParameters {
+			if *selected == *dialParameters {
+				isDuplicate = true
+				break
+			}
+		}
+		if !isDuplicate {
+			selectedDialParameters = append(selectedDialParameters, dialParameters)
+		}
+	}
+
+	return selectedDialParameters, nil
+}
+
+// selectReplayDialParameters is a helper that retrieves the stored dial
+// parameters for the server entry. It returns nil when replay is disabled,
+// when there are no stored dial parameters within the replay TTL, or when
+// the stored dial parameters are no longer applicable, as when the required
+// tunnel protocol has changed or the protocol has been disabled.
+func selectReplayDialParameters(
+	config *Config, serverEntry *ServerEntry) *DialParameters {
+
+	if *config.ReplayDialParametersTTLSeconds == 0 {
+		return nil
+	}
+
+	dialParameters, err := config.dataStore.GetReplayDialParameters(
+		serverEntry.IpAddress,
+		time.Duration(*config.ReplayDialParametersTTLSeconds)*time.Second)
+	if err != nil {
+		config.notices.Alert("selectReplayDialParameters: %s", err)
+		return nil
+	}
+	if dialParameters == nil {
+		return nil
+	}
+
+	if (config.TunnelProtocol != "" && dialParameters.TunnelProtocol != config.TunnelProtocol) ||
+		!serverEntry.SupportsProtocol(dialParameters.TunnelProtocol) {
+		return nil
+	}
+
+	if (dialParameters.TunnelProtocol == TUNNEL_PROTOCOL_FRONTED_MEEK ||
+		dialParameters.TunnelProtocol == TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP) &&
+		dialParameters.FrontingAddress == "" {
+		return nil
+	}
+
+	dialParameters.isReplay = true
+	return dialParameters
+}
+
 // selectProtocol is a helper that picks the tunnel protocol
-func selectProtocol(config *Config, serverEntry *ServerEntry) (selectedProtocol string, err error) {
+func selectProtocol(
+	config *Config,
+	networkPerformance *NetworkPerformance,
+	serverEntry *ServerEntry) (selectedProtocol string, err error) {
+
 	// TODO: properly handle protocols (e.g. FRONTED-MEEK-OSSH) vs. capabilities (e.g., {FRONTED-MEEK, OSSH})
 	// for now, the code is simply assuming that MEEK capabilities imply OSSH capability.
 	if config.TunnelProtocol != "" {
@@ -359,26 +671,70 @@ func selectProtocol(config *Config, serverEntry *ServerEntry) (selectedProtocol
 		}
 		selectedProtocol = config.TunnelProtocol
 	} else {
-		// Pick at random from the supported protocols. This ensures that we'll eventually
-		// try all possible protocols. Depending on network configuration, it may be the
-		// case that some protocol is only available through multi-capability servers,
-		// and a simpler ranked preference of protocols could lead to that protocol never
-		// being selected.
+		// Pick at random from the supported protocols, weighted by the protocol
+		// performance history for the current network. Every protocol retains a
+		// non-zero probability of selection. This ensures that we'll eventually
+		// try all possible protocols. Depending on network configuration, it may
+		// be the case that some protocol is only available through multi-capability
+		// servers, and a simpler ranked preference of protocols could lead to that
+		// protocol never being selected.
 
 		candidateProtocols := serverEntry.GetSupportedProtocols()
 		if len(candidateProtocols) == 0 {
 			return "", ContextError(fmt.Errorf("server does not have any supported capabilities"))
 		}
 
-		index, err := MakeSecureRandomInt(len(candidateProtocols))
+		selectedProtocol, err = selectWeightedProtocol(
+			candidateProtocols, networkPerformance, time.Now())
 		if err != nil {
 			return "", ContextError(err)
 		}
-		selectedProtocol = candidateProtocols[index]
 	}
 	return selectedProtocol, nil
 }
 
+// selectWeightedProtocol picks one of the candidate protocols at random.
+// With probability PROTOCOL_SELECTION_EXPLORATION_PROBABILITY, the pick is
+// uniform, to explore protocols regardless of history. Otherwise, protocols
+// are weighted by the square of their network performance score, which
+// strongly favors protocols that work on the network while still
+// occasionally retrying protocols that have failed.
+func selectWeightedProtocol(
+	candidateProtocols []string,
+	networkPerformance *NetworkPerformance,
+	now time.Time) (string, error) {
+
+	weights := make([]float64, len(candidateProtocols))
+	totalWeight := 0.0
+	for i, protocol := range candidateProtocols {
+		score := networkPerformance.Score(protocol, now)
+		weights[i] = score * score
+		totalWeight += weights[i]
+	}
+
+	explore := PROTOCOL_SELECTION_EXPLORATION_PROBABILITY
+	for i := range weights {
+		weights[i] = (1-explore)*weights[i]/totalWeight +
+			explore/float64(len(candidateProtocols))
+	}
+
+	randomInt, err := MakeSecureRandomInt64(math.MaxInt64)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	value := float64(randomInt) / float64(math.MaxInt64)
+
+	for i, weight := range weights {
+		if value < weight {
+			return candidateProtocols[i], nil
+		}
+		value -= weight
+	}
+
+	// Rounding error fallback
+	return candidateProtocols[len(candidateProtocols)-1], nil
+}
+
 // selectFrontingParameters is a helper which selects/generates meek fronting
 // parameters where the server entry provides multiple options or patterns.
 func selectFrontingParameters(
@@ -426,7 +782,7 @@ func selectFrontingParameters(
 func initMeekConfig(
 	config *Config,
 	serverEntry *ServerEntry,
-	selectedProtocol,
+	dialParameters *DialParameters,
 	sessionId string) (*MeekConfig, error) {
 
 	// The meek protocol always uses OSSH
@@ -437,27 +793,19 @@ func initMeekConfig(
 	var SNIServerName, hostHeader string
 	transformedHostName := false
 
-	switch selectedProtocol {
+	switch dialParameters.TunnelProtocol {
 	case TUNNEL_PROTOCOL_FRONTED_MEEK:
-		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
-		if err != nil {
-			return nil, ContextError(err)
-		}
-		dialAddress = fmt.Sprintf("%s:443", frontingAddress)
+		dialAddress = fmt.Sprintf("%s:443", dialParameters.FrontingAddress)
 		useHTTPS = true
 		if !serverEntry.MeekFrontingDisableSNI {
 			SNIServerName, transformedHostName =
-				config.HostNameTransformer.TransformHostName(frontingAddress)
+				config.HostNameTransformer.TransformHostName(dialParameters.FrontingAddress)
 		}
-		hostHeader = frontingHost
+		hostHeader = dialParameters.FrontingHost
 
 	case TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP:
-		frontingAddress, frontingHost, err := selectFrontingParameters(serverEntry)
-		if err != nil {
-			return nil, ContextError(err)
-		}
-		dialAddress = fmt.Sprintf("%s:80", frontingAddress)
-		hostHeader = frontingHost
+		dialAddress = fmt.Sprintf("%s:80", dialParameters.FrontingAddress)
+		hostHeader = dialParameters.FrontingHost
 
 	case TUNNEL_PROTOCOL_UNFRONTED_MEEK:
 		dialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.MeekServerPort)
@@ -481,7 +829,7 @@ func initMeekConfig(
 		}
 
 	default:
-		return nil, ContextError(errors.New("unexpected selectedProtocol"))
+		return nil, ContextError(errors.New("unexpected tunnel protocol"))
 	}
 
 	// The unnderlying TLS will automatically disable SNI for IP address server name
@@ -509,7 +857,8 @@ func dialSsh(
 	config *Config,
 	pendingConns *Conns,
 	serverEntry *ServerEntry,
-	selectedProtocol,
+	dialParameters *DialParameters,
+	establishTimings *EstablishTimings,
 	sessionId string) (net.Conn, *ssh.Client, *MeekStats, error) {
 
 	// The meek protocols tunnel obfuscated SSH. Obfuscated SSH is layered on top of SSH.
@@ -520,7 +869,7 @@ func dialSsh(
 	var meekConfig *MeekConfig
 	var err error
 
-	switch selectedProtocol {
+	switch dialParameters.TunnelProtocol {
 	case TUNNEL_PROTOCOL_OBFUSCATED_SSH:
 		useObfuscatedSsh = true
 		directTCPDialAddress = fmt.Sprintf("%s:%d", serverEntry.IpAddress, serverEntry.SshObfuscatedPort)
@@ -530,16 +879,16 @@ func dialSsh(
 
 	default:
 		useObfuscatedSsh = true
-		meekConfig, err = initMeekConfig(config, serverEntry, selectedProtocol, sessionId)
+		meekConfig, err = initMeekConfig(config, serverEntry, dialParameters, sessionId)
 		if err != nil {
 			return nil, nil, nil, ContextError(err)
 		}
 	}
 
-	NoticeConnectingServer(
+	config.notices.ConnectingServer(
 		serverEntry.IpAddress,
 		serverEntry.Region,
-		selectedProtocol,
+		dialParameters.TunnelProtocol,
 		directTCPDialAddress,
 		meekConfig)
 
@@ -567,6 +916,8 @@ func dialSsh(
 		TrustedCACertificatesFilename: config.TrustedCACertificatesFilename,
 		DeviceRegion:                  config.DeviceRegion,
 		ResolvedIPCallback:            setResolvedIPAddress,
+		notices:                       config.notices,
+		establishTimings:              establishTimings,
 	}
 	var conn net.Conn
 	if meekConfig != nil {
@@ -593,7 +944,10 @@ func dialSsh(
 	sshConn := conn
 	if useObfuscatedSsh {
 		sshConn, err = NewObfuscatedSshConn(
-			OBFUSCATION_CONN_MODE_CLIENT, conn, serverEntry.SshObfuscatedKey)
+			OBFUSCATION_CONN_MODE_CLIENT,
+			conn,
+			serverEntry.SshObfuscatedKey,
+			dialParameters.ObfuscatorPaddingLength)
 		if err != nil {
 			return nil, nil, nil, ContextError(err)
 		}
@@ -650,6 +1004,8 @@ func dialSsh(
 		})
 	}
 
+	endPhase := establishTimings.startPhase(ESTABLISH_PHASE_SSH_HANDSHAKE)
+
 	go func() {
 		// The following is adapted from ssh.Dial(), here using a custom conn
 		// The sshAddress is passed through to host key verification callbacks; we don't use it.
@@ -663,6 +1019,7 @@ func dialSsh(
 	}()
 
 	result := <-resultChannel
+	endPhase(result.err)
 	if result.err != nil {
 		return nil, nil, nil, ContextError(result.err)
 	}
@@ -677,7 +1034,7 @@ func dialSsh(
 			TransformedHostName: meekConfig.TransformedHostName,
 		}
 
-		NoticeConnectedMeekStats(serverEntry.IpAddress, meekStats)
+		config.notices.ConnectedMeekStats(serverEntry.IpAddress, meekStats)
 	}
 
 	cleanupConn = nil
@@ -705,6 +1062,12 @@ func dialSsh(
 // failed dial or failed read/write. This keep alive has a shorter
 // timeout.
 //
+// The tunnel is considered degraded, and its owner is signaled, when the
+// smoothed round trip time is high for several consecutive keep alives;
+// when there are many port forward failures within a period; or, when
+// configured, when received throughput is low for a period during which
+// port forwards are open and sending data.
+//
 // Note that port foward failures may be due to non-failure conditions.
 // For example, when the user inputs an invalid domain name and
 // resolution is done by the ssh server; or trying to connect to a
@@ -731,6 +1094,12 @@ func dialSsh(
 // TODO: change "recently active" to include having received any
 // SSH protocol messages from the server, not just user payload?
 //
+// Round trip time probes are the exception: they're SSH keep alives sent
+// whether or not the tunnel is active, so that round trip time measurements
+// stay current for busy tunnels. For the reason above, a probe which times
+// out doesn't fail the tunnel; it's only counted as a high round trip time
+// sample.
+//
 func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	defer tunnel.operateWaitGroup.Done()
 
@@ -748,6 +1117,7 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	// Note: not using Tickers since these are not fixed time periods.
 	nextStatusRequestPeriod := func() time.Duration {
 		return MakeRandomPeriod(
+			tunnel.config.notices,
 			PSIPHON_API_STATUS_REQUEST_PERIOD_MIN,
 			PSIPHON_API_STATUS_REQUEST_PERIOD_MAX)
 	}
@@ -763,16 +1133,18 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	// tunnel candidates which attempt to send an immediate request
 	// before being discarded. For now, we mitigate this with a short,
 	// random delay.
-	unreported := CountUnreportedTunnelStats()
+	unreported := tunnel.config.dataStore.CountUnreportedTunnelStats()
 	if unreported > 0 {
-		NoticeInfo("Unreported tunnel stats: %d", unreported)
+		tunnel.config.notices.Info("Unreported tunnel stats: %d", unreported)
 		statsTimer.Reset(MakeRandomPeriod(
+			tunnel.config.notices,
 			PSIPHON_API_STATUS_REQUEST_SHORT_PERIOD_MIN,
 			PSIPHON_API_STATUS_REQUEST_SHORT_PERIOD_MAX))
 	}
 
 	nextSshKeepAlivePeriod := func() time.Duration {
 		return MakeRandomPeriod(
+			tunnel.config.notices,
 			TUNNEL_SSH_KEEP_ALIVE_PERIOD_MIN,
 			TUNNEL_SSH_KEEP_ALIVE_PERIOD_MAX)
 	}
@@ -785,6 +1157,38 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 		defer sshKeepAliveTimer.Stop()
 	}
 
+	nextRttProbePeriod := func() time.Duration {
+		return MakeRandomPeriod(
+			tunnel.config.notices,
+			TUNNEL_RTT_PROBE_PERIOD_MIN,
+			TUNNEL_RTT_PROBE_PERIOD_MAX)
+	}
+
+	rttProbeTimer := time.NewTimer(nextRttProbePeriod())
+	if tunnel.config.DisablePeriodicSshKeepAlive {
+		rttProbeTimer.Stop()
+	} else {
+		defer rttProbeTimer.Stop()
+	}
+
+	signalDegraded := func(reason string) {
+		if tunnel.setDegraded() {
+			tunnel.config.notices.Alert("tunnel degraded: %s: %s", tunnel.serverEntry.IpAddress, reason)
+			tunnelOwner.SignalTunnelDegraded(tunnel)
+		}
+	}
+
+	degradedRoundTripTime :=
+		time.Duration(*tunnel.config.TunnelDegradedRoundTripTimeMilliseconds) * time.Millisecond
+	degradedRoundTripTimeSamples := 0
+
+	recentPortForwardFailures := make([]time.Time, 0)
+
+	throughputPeriodStart := time.Now()
+	throughputPeriodSent := int64(0)
+	throughputPeriodReceived := int64(0)
+	throughputPeriodIdle := false
+
 	// Perform network requests in separate goroutines so as not to block
 	// other operations.
 	requestsWaitGroup := new(sync.WaitGroup)
@@ -798,14 +1202,55 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 		}
 	}()
 
+	addDegradedRoundTripTimeSample := func() {
+		degradedRoundTripTimeSamples++
+		if degradedRoundTripTimeSamples >= TUNNEL_DEGRADED_ROUND_TRIP_TIME_SAMPLES {
+			signalDegraded("high round trip time")
+		}
+	}
+
+	// Round trip time probes share the SSH keep alive goroutine, so that
+	// only one keep alive is in flight at a time.
 	requestsWaitGroup.Add(1)
 	signalSshKeepAlive := make(chan time.Duration)
+	signalRttProbe := make(chan time.Duration)
 	sshKeepAliveError := make(chan error, 1)
 	go func() {
 		defer requestsWaitGroup.Done()
-		for timeout := range signalSshKeepAlive {
-			err := sendSshKeepAlive(tunnel.sshClient, tunnel.conn, timeout)
-			if err != nil {
+		for {
+			var timeout time.Duration
+			isRttProbe := false
+			select {
+			case keepAliveTimeout, ok := <-signalSshKeepAlive:
+				if !ok {
+					return
+				}
+				timeout = keepAliveTimeout
+			case timeout = <-signalRttProbe:
+				isRttProbe = true
+			}
+
+			sample, err := sendSshKeepAlive(tunnel.config.notices, tunnel.sshClient, tunnel.conn, timeout)
+			if err == nil {
+				roundTripTime, jitter := tunnel.addRoundTripTimeSample(sample)
+				tunnel.config.notices.TunnelHealth(
+					tunnel.serverEntry.IpAddress, roundTripTime, jitter)
+
+				if degradedRoundTripTime > 0 && roundTripTime > degradedRoundTripTime {
+					addDegradedRoundTripTimeSample()
+				} else {
+					degradedRoundTripTimeSamples = 0
+				}
+			} else if isRttProbe {
+				// A probe may time out on a busy tunnel which is otherwise
+				// working, so the timeout is recorded as a high round trip
+				// time rather than as a tunnel failure.
+				tunnel.config.notices.Info("round trip time probe failed for %s: %s",
+					tunnel.serverEntry.IpAddress, ContextError(err))
+				if degradedRoundTripTime > 0 {
+					addDegradedRoundTripTimeSample()
+				}
+			} else {
 				select {
 				case sshKeepAliveError <- err:
 				default:
@@ -852,7 +1297,7 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	for !shutdown && err == nil {
 		select {
 		case <-noticeBytesTransferredTicker.C:
-			sent, received := transferstats.ReportRecentBytesTransferredForServer(
+			sent, received := tunnel.config.transferStats.ReportRecentBytesTransferredForServer(
 				tunnel.serverEntry.IpAddress)
 
 			if received > 0 {
@@ -861,21 +1306,46 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 
 			totalSent += sent
 			totalReceived += received
+			tunnel.setTotalBytesTransferred(totalSent, totalReceived)
 
 			if lastTotalBytesTransferedTime.Add(TOTAL_BYTES_TRANSFERRED_NOTICE_PERIOD).Before(time.Now()) {
-				NoticeTotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
+				tunnel.config.notices.TotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
 				lastTotalBytesTransferedTime = time.Now()
 			}
 
 			// Only emit the frequent BytesTransferred notice when tunnel is not idle.
 			if tunnel.config.EmitBytesTransferred && (sent > 0 || received > 0) {
-				NoticeBytesTransferred(tunnel.serverEntry.IpAddress, sent, received)
+				tunnel.config.notices.BytesTransferred(tunnel.serverEntry.IpAddress, sent, received)
+			}
+
+			if tunnel.config.TunnelDegradedThroughputBytesPerSecond > 0 {
+				throughputPeriodSent += sent
+				throughputPeriodReceived += received
+				if tunnel.GetOpenPortForwardCount() == 0 {
+					throughputPeriodIdle = true
+				}
+				throughputPeriod := time.Since(throughputPeriodStart)
+				if throughputPeriod >= TUNNEL_DEGRADED_THROUGHPUT_PERIOD {
+					if !throughputPeriodIdle && throughputPeriodSent > 0 &&
+						throughputPeriodReceived < int64(
+							throughputPeriod.Seconds()*float64(tunnel.config.TunnelDegradedThroughputBytesPerSecond)) {
+						signalDegraded("low throughput")
+					}
+					throughputPeriodStart = time.Now()
+					throughputPeriodSent = 0
+					throughputPeriodReceived = 0
+					throughputPeriodIdle = false
+				}
 			}
 
 		case <-statsTimer.C:
-			select {
-			case signalStatusRequest <- *new(struct{}):
-			default:
+			// A standby tunnel carries no traffic, so there are no stats to
+			// report until it's promoted.
+			if !tunnel.IsStandby() {
+				select {
+				case signalStatusRequest <- *new(struct{}):
+				default:
+				}
 			}
 			statsTimer.Reset(nextStatusRequestPeriod())
 
@@ -888,12 +1358,31 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 			}
 			sshKeepAliveTimer.Reset(nextSshKeepAlivePeriod())
 
+		case <-rttProbeTimer.C:
+			select {
+			case signalRttProbe <- time.Duration(*tunnel.config.TunnelSshKeepAlivePeriodicTimeoutSeconds) * time.Second:
+			default:
+			}
+			rttProbeTimer.Reset(nextRttProbePeriod())
+
 		case <-tunnel.signalPortForwardFailure:
 			// Note: no mutex on portForwardFailureTotal; only referenced here
 			tunnel.totalPortForwardFailures++
-			NoticeInfo("port forward failures for %s: %d",
+			tunnel.config.notices.Info("port forward failures for %s: %d",
 				tunnel.serverEntry.IpAddress, tunnel.totalPortForwardFailures)
 
+			if *tunnel.config.TunnelDegradedPortForwardFailures > 0 {
+				now := time.Now()
+				recentPortForwardFailures = append(recentPortForwardFailures, now)
+				for len(recentPortForwardFailures) > 0 &&
+					recentPortForwardFailures[0].Add(TUNNEL_DEGRADED_PORT_FORWARD_FAILURE_PERIOD).Before(now) {
+					recentPortForwardFailures = recentPortForwardFailures[1:]
+				}
+				if len(recentPortForwardFailures) >= *tunnel.config.TunnelDegradedPortForwardFailures {
+					signalDegraded("port forward failures")
+				}
+			}
+
 			if lastBytesReceivedTime.Add(TUNNEL_SSH_KEEP_ALIVE_PROBE_INACTIVE_PERIOD).Before(time.Now()) {
 				select {
 				case signalSshKeepAlive <- time.Duration(*tunnel.config.TunnelSshKeepAliveProbeTimeoutSeconds) * time.Second:
@@ -904,6 +1393,14 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 				sshKeepAliveTimer.Reset(nextSshKeepAlivePeriod())
 			}
 
+		case <-tunnel.signalNetworkChanged:
+			// The tunnel may be dead after a network change, so probe it now
+			// rather than waiting for the next periodic SSH keep alive.
+			select {
+			case signalSshKeepAlive <- time.Duration(*tunnel.config.TunnelSshKeepAliveProbeTimeoutSeconds) * time.Second:
+			default:
+			}
+
 		case err = <-sshKeepAliveError:
 
 		case <-tunnel.shutdownOperateBroadcast:
@@ -917,12 +1414,13 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	requestsWaitGroup.Wait()
 
 	// Capture bytes transferred since the last noticeBytesTransferredTicker tick
-	sent, received := transferstats.ReportRecentBytesTransferredForServer(tunnel.serverEntry.IpAddress)
+	sent, received := tunnel.config.transferStats.ReportRecentBytesTransferredForServer(tunnel.serverEntry.IpAddress)
 	totalSent += sent
 	totalReceived += received
+	tunnel.setTotalBytesTransferred(totalSent, totalReceived)
 
 	// Always emit a final NoticeTotalBytesTransferred
-	NoticeTotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
+	tunnel.config.notices.TotalBytesTransferred(tunnel.serverEntry.IpAddress, totalSent, totalReceived)
 
 	// The stats for this tunnel will be reported via the next successful
 	// status request.
@@ -931,17 +1429,44 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	// will be slightly earlier than the actual tunnel activation time, as the
 	// client has to receive and parse the response and activate the tunnel.
 	// Tunnel does not have a serverContext when DisableApi is set.
-	if tunnel.serverContext != nil && !tunnel.IsDiscarded() {
+	// A standby tunnel which was never promoted carried no traffic, so there
+	// are no tunnel stats to record; and the duration of a promoted standby
+	// tunnel is measured from its promotion.
+	if tunnel.serverContext != nil && !tunnel.IsDiscarded() && !tunnel.IsStandby() {
+		roundTripTime, jitter, sampleCount := tunnel.GetRoundTripTimeStats()
 		err := RecordTunnelStats(
+			tunnel.config,
 			tunnel.serverContext.sessionId,
 			tunnel.serverContext.tunnelNumber,
 			tunnel.serverEntry.IpAddress,
 			tunnel.serverContext.serverHandshakeTimestamp,
-			fmt.Sprintf("%d", time.Now().Sub(tunnel.startTime)),
+			fmt.Sprintf("%d", time.Now().Sub(tunnel.getActiveTime())),
 			totalSent,
-			totalReceived)
+			totalReceived,
+			roundTripTime,
+			jitter,
+			sampleCount)
+		if err != nil {
+			tunnel.config.notices.Alert("RecordTunnelStats failed: %s", ContextError(err))
+		}
+	}
+
+	// Add the tunnel lifetime to the server performance history. As with
+	// PromoteServerEntry, the history isn't updated for TargetServerEntry
+	// tunnels, which aren't necessarily in the datastore.
+	if !tunnel.IsDiscarded() && tunnel.config.TargetServerEntry == "" {
+		failureReason := ""
 		if err != nil {
-			NoticeAlert("RecordTunnelStats failed: %s", ContextError(err))
+			failureReason = err.Error()
+		}
+		recordErr := tunnel.config.dataStore.RecordServerEntryTunnelClosed(
+			tunnel.networkID,
+			tunnel.serverEntry.IpAddress,
+			tunnel.protocol,
+			time.Now().Sub(tunnel.startTime),
+			failureReason)
+		if recordErr != nil {
+			tunnel.config.notices.Alert("RecordServerEntryTunnelClosed failed: %s", ContextError(recordErr))
 		}
 	}
 
@@ -972,22 +1497,23 @@ func (tunnel *Tunnel) operateTunnel(tunnelOwner TunnelOwner) {
 	// in the case of a shutdown.
 
 	if err == nil {
-		NoticeInfo("shutdown operate tunnel")
+		tunnel.config.notices.Info("shutdown operate tunnel")
 		if !sendStats(tunnel) {
 			sendUntunneledStats(tunnel, true)
 		}
 	} else {
-		NoticeAlert("operate tunnel error for %s: %s", tunnel.serverEntry.IpAddress, err)
+		tunnel.config.notices.Alert("operate tunnel error for %s: %s", tunnel.serverEntry.IpAddress, err)
 		go sendUntunneledStats(tunnel, false)
 		tunnelOwner.SignalTunnelFailure(tunnel)
 	}
 }
 
 // sendSshKeepAlive is a helper which sends a keepalive@openssh.com request
-// on the specified SSH connections and returns true of the request succeeds
-// within a specified timeout.
+// on the specified SSH connections and returns the round trip time when the
+// request succeeds within a specified timeout.
 func sendSshKeepAlive(
-	sshClient *ssh.Client, conn net.Conn, timeout time.Duration) error {
+	notices *Notices,
+	sshClient *ssh.Client, conn net.Conn, timeout time.Duration) (time.Duration, error) {
 
 	errChannel := make(chan error, 2)
 	if timeout > 0 {
@@ -996,11 +1522,13 @@ func sendSshKeepAlive(
 		})
 	}
 
+	startTime := time.Now()
+
 	go func() {
 		// Random padding to frustrate fingerprinting
 		_, _, err := sshClient.SendRequest(
 			"keepalive@openssh.com", true,
-			MakeSecureRandomPadding(0, TUNNEL_SSH_KEEP_ALIVE_PAYLOAD_MAX_BYTES))
+			MakeSecureRandomPadding(notices, 0, TUNNEL_SSH_KEEP_ALIVE_PAYLOAD_MAX_BYTES))
 		errChannel <- err
 	}()
 
@@ -1008,9 +1536,10 @@ func sendSshKeepAlive(
 	if err != nil {
 		sshClient.Close()
 		conn.Close()
+		return 0, ContextError(err)
 	}
 
-	return ContextError(err)
+	return time.Since(startTime), nil
 }
 
 // sendStats is a helper for sending session stats to the server.
@@ -1028,7 +1557,7 @@ func sendStats(tunnel *Tunnel) bool {
 
 	err := tunnel.serverContext.DoStatusRequest(tunnel)
 	if err != nil {
-		NoticeAlert("DoStatusRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
+		tunnel.config.notices.Alert("DoStatusRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
 	}
 
 	return err == nil
@@ -1051,7 +1580,7 @@ func sendUntunneledStats(tunnel *Tunnel, isShutdown bool) {
 
 	err := tunnel.serverContext.TryUntunneledStatusRequest(isShutdown)
 	if err != nil {
-		NoticeAlert("TryUntunneledStatusRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
+		tunnel.config.notices.Alert("TryUntunneledStatusRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
 	}
 }
 
@@ -1071,9 +1600,9 @@ func sendClientVerification(tunnel *Tunnel, clientVerificationPayload string) bo
 
 	err := tunnel.serverContext.DoClientVerificationRequest(clientVerificationPayload)
 	if err != nil {
-		NoticeAlert("DoClientVerificationRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
+		tunnel.config.notices.Alert("DoClientVerificationRequest failed for %s: %s", tunnel.serverEntry.IpAddress, err)
 	} else {
-		NoticeClientVerificationRequestCompleted(tunnel.serverEntry.IpAddress)
+		tunnel.config.notices.ClientVerificationRequestCompleted(tunnel.serverEntry.IpAddress)
 	}
 
 	return err == nil
@@ -0,0 +1,308 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSelectDialParameters(t *testing.T) {
+
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon-tunnel-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataStoreDirectory)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = dataStoreDirectory
+
+	config.dataStore, err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer config.dataStore.Close()
+
+	frontingAddresses := []string{"a.example.com", "b.example.com", "c.example.com"}
+
+	serverEntry := &ServerEntry{
+		IpAddress:             "192.0.2.1",
+		Capabilities:          []string{"OSSH", "FRONTED-MEEK"},
+		MeekFrontingAddresses: frontingAddresses,
+		MeekFrontingHosts:     []string{"host.example.com"},
+	}
+
+	maxSelected := 0
+	for i := 0; i < 100; i++ {
+		dialParameters, err := selectDialParameters(config, "", serverEntry, 3)
+		if err != nil {
+			t.Fatalf("selectDialParameters failed: %s", err)
+		}
+		if len(dialParameters) == 0 || len(dialParameters) > 3 {
+			t.Fatalf("unexpected dial parameters count: %d", len(dialParameters))
+		}
+		if len(dialParameters) > maxSelected {
+			maxSelected = len(dialParameters)
+		}
+		for j, parameters := range dialParameters {
+			for _, other := range dialParameters[:j] {
+				if *parameters == *other {
+					t.Errorf("duplicate dial parameters: %+v", parameters)
+				}
+			}
+			switch parameters.TunnelProtocol {
+			case TUNNEL_PROTOCOL_FRONTED_MEEK, TUNNEL_PROTOCOL_FRONTED_MEEK_HTTP:
+				if !Contains(frontingAddresses, parameters.FrontingAddress) ||
+					parameters.FrontingHost != "host.example.com" {
+					t.Errorf("unexpected fronting parameters: %+v", parameters)
+				}
+			case TUNNEL_PROTOCOL_OBFUSCATED_SSH:
+				if parameters.FrontingAddress != "" {
+					t.Errorf("unexpected fronting parameters: %+v", parameters)
+				}
+			default:
+				t.Errorf("unexpected tunnel protocol: %s", parameters.TunnelProtocol)
+			}
+		}
+	}
+	if maxSelected < 2 {
+		t.Errorf("server entry should fan out into multiple candidates")
+	}
+
+	// With a single option, there's a single candidate
+	serverEntry.Capabilities = []string{"OSSH"}
+	dialParameters, err := selectDialParameters(config, "", serverEntry, 3)
+	if err != nil {
+		t.Fatalf("selectDialParameters failed: %s", err)
+	}
+	if len(dialParameters) != 1 {
+		t.Errorf("unexpected dial parameters count: %d", len(dialParameters))
+	}
+}
+
+func TestReplayDialParameters(t *testing.T) {
+
+	dataStoreDirectory, err := ioutil.TempDir("", "psiphon-tunnel-test")
+	if err != nil {
+		t.Fatalf("TempDir failed: %s", err)
+	}
+	defer os.RemoveAll(dataStoreDirectory)
+
+	config, err := LoadConfig([]byte(`{"PropagationChannelId": "0", "SponsorId": "0"}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %s", err)
+	}
+	config.DataStoreDirectory = dataStoreDirectory
+
+	config.dataStore, err = OpenDataStore(config)
+	if err != nil {
+		t.Fatalf("OpenDataStore failed: %s", err)
+	}
+	defer config.dataStore.Close()
+
+	serverEntry := &ServerEntry{
+		IpAddress:             "192.0.2.1",
+		Capabilities:          []string{"OSSH", "FRONTED-MEEK"},
+		MeekFrontingAddresses: []string{"a.example.com", "b.example.com"},
+		MeekFrontingHosts:     []string{"host.example.com"},
+	}
+
+	paddingLength := 100
+	storedDialParameters := &DialParameters{
+		TunnelProtocol:          TUNNEL_PROTOCOL_FRONTED_MEEK,
+		FrontingAddress:         "generated.example.com",
+		FrontingHost:            "host.example.com",
+		ObfuscatorPaddingLength: &paddingLength,
+	}
+	err = config.dataStore.SetReplayDialParameters(serverEntry.IpAddress, storedDialParameters)
+	if err != nil {
+		t.Fatalf("SetReplayDialParameters failed: %s", err)
+	}
+
+	isReplay := func() bool {
+		dialParameters, err := selectDialParameters(config, "", serverEntry, 3)
+		if err != nil {
+			t.Fatalf("selectDialParameters failed: %s", err)
+		}
+		return len(dialParameters) == 1 && dialParameters[0].isReplay
+	}
+
+	dialParameters, err := selectDialParameters(config, "", serverEntry, 3)
+	if err != nil {
+		t.Fatalf("selectDialParameters failed: %s", err)
+	}
+	if len(dialParameters) != 1 ||
+		dialParameters[0].FrontingAddress != "generated.example.com" ||
+		dialParameters[0].ObfuscatorPaddingLength == nil ||
+		*dialParameters[0].ObfuscatorPaddingLength != paddingLength {
+		t.Errorf("unexpected dial parameters: %+v", dialParameters)
+	}
+
+	// Stored dial parameters for a protocol other than the required
+	// protocol aren't replayed
+	config.TunnelProtocol = TUNNEL_PROTOCOL_OBFUSCATED_SSH
+	if isReplay() {
+		t.Error("unexpected replay of another protocol")
+	}
+	config.TunnelProtocol = ""
+
+	// Stored dial parameters older than the TTL aren't replayed
+	ttlSeconds := 1
+	config.ReplayDialParametersTTLSeconds = &ttlSeconds
+	time.Sleep(1100 * time.Millisecond)
+	if isReplay() {
+		t.Error("unexpected replay after TTL")
+	}
+
+	// Deleted dial parameters aren't replayed
+	ttlSeconds = REPLAY_DIAL_PARAMETERS_TTL_SECONDS
+	if !isReplay() {
+		t.Error("missing replay")
+	}
+	err = config.dataStore.DeleteReplayDialParameters(serverEntry.IpAddress)
+	if err != nil {
+		t.Fatalf("DeleteReplayDialParameters failed: %s", err)
+	}
+	if isReplay() {
+		t.Error("unexpected replay after delete")
+	}
+}
+
+func TestCandidateGroup(t *testing.T) {
+	group := newCandidateGroup([]*DialParameters{
+		{TunnelProtocol: TUNNEL_PROTOCOL_FRONTED_MEEK, FrontingAddress: "a.example.com"},
+		{TunnelProtocol: TUNNEL_PROTOCOL_FRONTED_MEEK, FrontingAddress: "b.example.com"},
+		{TunnelProtocol: TUNNEL_PROTOCOL_OBFUSCATED_SSH},
+	}, false)
+
+	// One blocked front isn't recorded while another front is pending
+	if group.completeCandidate(TUNNEL_PROTOCOL_FRONTED_MEEK, false, false) {
+		t.Error("failure with pending candidates should not be recorded")
+	}
+	if !group.completeCandidate(TUNNEL_PROTOCOL_FRONTED_MEEK, false, false) {
+		t.Error("failure of all candidates should be recorded")
+	}
+
+	// Skipped candidates aren't recorded
+	if group.completeCandidate(TUNNEL_PROTOCOL_OBFUSCATED_SSH, false, true) {
+		t.Error("skipped candidate should not be recorded")
+	}
+
+	group = newCandidateGroup([]*DialParameters{
+		{TunnelProtocol: TUNNEL_PROTOCOL_FRONTED_MEEK, FrontingAddress: "a.example.com"},
+		{TunnelProtocol: TUNNEL_PROTOCOL_FRONTED_MEEK, FrontingAddress: "b.example.com"},
+	}, false)
+	if !group.completeCandidate(TUNNEL_PROTOCOL_FRONTED_MEEK, true, false) {
+		t.Error("success should be recorded")
+	}
+	if group.completeCandidate(TUNNEL_PROTOCOL_FRONTED_MEEK, false, false) {
+		t.Error("failure after success should not be recorded")
+	}
+}
+
+func TestServerAffinitySlots(t *testing.T) {
+	affinity := newServerAffinity()
+
+	isDone := func() bool {
+		select {
+		case <-affinity.doneBroadcast:
+			return true
+		default:
+			return false
+		}
+	}
+
+	dialParameters := []*DialParameters{
+		{TunnelProtocol: TUNNEL_PROTOCOL_FRONTED_MEEK, FrontingAddress: "a.example.com"},
+		{TunnelProtocol: TUNNEL_PROTOCOL_FRONTED_MEEK, FrontingAddress: "b.example.com"},
+	}
+
+	failingGroup := newCandidateGroup(dialParameters, true)
+	affinity.assignSlot()
+	succeedingGroup := newCandidateGroup(dialParameters, true)
+	affinity.assignSlot()
+	affinity.assignmentDone()
+
+	// A slot is released when all of its candidates fail
+	failingGroup.completeCandidate(TUNNEL_PROTOCOL_FRONTED_MEEK, false, false)
+	if failingGroup.releaseServerAffinity(false) {
+		t.Error("slot with pending candidates should not be released")
+	}
+	failingGroup.completeCandidate(TUNNEL_PROTOCOL_FRONTED_MEEK, false, false)
+	if !failingGroup.releaseServerAffinity(false) {
+		t.Error("slot with all candidates failed should be released")
+	}
+	affinity.releaseSlot()
+
+	if isDone() {
+		t.Error("affinity should not be done with a pending slot")
+	}
+
+	// A slot is released when a tunnel is delivered, and not when
+	// the remaining candidates fail first
+	succeedingGroup.completeCandidate(TUNNEL_PROTOCOL_FRONTED_MEEK, true, false)
+	succeedingGroup.completeCandidate(TUNNEL_PROTOCOL_FRONTED_MEEK, false, false)
+	if succeedingGroup.releaseServerAffinity(false) {
+		t.Error("slot with a success should not be released before delivery")
+	}
+	if !succeedingGroup.releaseServerAffinity(true) {
+		t.Error("slot should be released after delivery")
+	}
+	if succeedingGroup.releaseServerAffinity(true) {
+		t.Error("slot should be released only once")
+	}
+	affinity.releaseSlot()
+
+	if !isDone() {
+		t.Error("affinity should be done with all slots released")
+	}
+
+	// Non-affinity groups don't hold slots
+	if newCandidateGroup(dialParameters, false).releaseServerAffinity(true) {
+		t.Error("non-affinity group should not release a slot")
+	}
+}
+
+func TestRoundTripTimeStats(t *testing.T) {
+	tunnel := &Tunnel{mutex: new(sync.Mutex)}
+
+	roundTripTime, jitter := tunnel.addRoundTripTimeSample(100 * time.Millisecond)
+	if roundTripTime != 100*time.Millisecond || jitter != 0 {
+		t.Errorf("unexpected stats: %s, %s", roundTripTime, jitter)
+	}
+
+	roundTripTime, jitter = tunnel.addRoundTripTimeSample(200 * time.Millisecond)
+	if roundTripTime != 112500*time.Microsecond || jitter != 25*time.Millisecond {
+		t.Errorf("unexpected stats: %s, %s", roundTripTime, jitter)
+	}
+
+	roundTripTime, jitter, sampleCount := tunnel.GetRoundTripTimeStats()
+	if roundTripTime != tunnel.GetRoundTripTime() ||
+		jitter != 25*time.Millisecond || sampleCount != 2 {
+		t.Errorf("unexpected stats: %s, %s, %d", roundTripTime, jitter, sampleCount)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2016, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// The udpgw protocol, as implemented by the Psiphon server; see
+// handleUDPChannel in psiphon/server/udp.go. As with the server, the
+// connection ID and port are little endian.
+const (
+	udpgwProtocolFlagKeepalive = 1 << 0
+	udpgwProtocolFlagRebind    = 1 << 1
+	udpgwProtocolFlagDNS       = 1 << 2
+	udpgwProtocolFlagIPv6      = 1 << 3
+
+	udpgwProtocolMaxPreambleSize = 23
+	udpgwProtocolMaxPayloadSize  = 32768
+	udpgwProtocolMaxMessageSize  = udpgwProtocolMaxPreambleSize + udpgwProtocolMaxPayloadSize
+)
+
+// udpgwClient relays UDP packets through a single tunneled connection to
+// the udpgw server address which the Psiphon server intercepts; see
+// Config.UdpgwServerAddress. Each remote address is assigned a connection
+// ID, which the server maps to a UDP port forward.
+type udpgwClient struct {
+	conn        net.Conn
+	mutex       sync.Mutex
+	writeBuffer []byte
+	nextConnID  uint16
+	connIDs     map[string]uint16
+	remoteAddrs map[uint16]*net.UDPAddr
+}
+
+func newUdpgwClient(conn net.Conn) *udpgwClient {
+	return &udpgwClient{
+		conn:        conn,
+		writeBuffer: make([]byte, udpgwProtocolMaxMessageSize),
+		connIDs:     make(map[string]uint16),
+		remoteAddrs: make(map[uint16]*net.UDPAddr),
+	}
+}
+
+// send relays an upstream packet to the specified remote address.
+func (client *udpgwClient) send(remoteAddr *net.UDPAddr, packet []byte) error {
+	return client.sendMessage(remoteAddr, 0, packet)
+}
+
+// sendDNS relays an upstream DNS query packet with the transparent DNS
+// flag, which tells the server to forward the query to its own resolver,
+// when it has one, instead of the specified remote address.
+func (client *udpgwClient) sendDNS(remoteAddr *net.UDPAddr, packet []byte) error {
+	return client.sendMessage(remoteAddr, udpgwProtocolFlagDNS, packet)
+}
+
+func (client *udpgwClient) sendMessage(remoteAddr *net.UDPAddr, flags byte, packet []byte) error {
+
+	if len(packet) > udpgwProtocolMaxPayloadSize {
+		return ContextError(errors.New("packet too large"))
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	connID, ok := client.connIDs[remoteAddr.String()]
+	if !ok {
+		// When the connection IDs wrap around, the connection ID is reused
+		// for the new remote address and the rebind flag tells the server
+		// to discard the previous UDP port forward.
+		connID = client.nextConnID
+		client.nextConnID += 1
+		if previousRemoteAddr, ok := client.remoteAddrs[connID]; ok {
+			delete(client.connIDs, previousRemoteAddr.String())
+		}
+		client.connIDs[remoteAddr.String()] = connID
+		client.remoteAddrs[connID] = remoteAddr
+		flags |= udpgwProtocolFlagRebind
+	}
+
+	ip := remoteAddr.IP.To4()
+	if ip == nil {
+		ip = remoteAddr.IP.To16()
+		flags |= udpgwProtocolFlagIPv6
+	}
+
+	// | 2 byte size | 1 byte flags | 2 byte conn ID | 4 or 16 byte IP | 2 byte port | packet |
+
+	preambleSize := 7 + len(ip)
+	size := preambleSize - 2 + len(packet)
+	buffer := client.writeBuffer[0 : preambleSize+len(packet)]
+	binary.LittleEndian.PutUint16(buffer[0:2], uint16(size))
+	buffer[2] = flags
+	binary.LittleEndian.PutUint16(buffer[3:5], connID)
+	copy(buffer[5:5+len(ip)], ip)
+	binary.LittleEndian.PutUint16(buffer[5+len(ip):preambleSize], uint16(remoteAddr.Port))
+	copy(buffer[preambleSize:], packet)
+
+	_, err := client.conn.Write(buffer)
+	if err != nil {
+		return ContextError(err)
+	}
+	return nil
+}
+
+// receive reads the next downstream packet into buffer, which must be
+// udpgwProtocolMaxMessageSize bytes, and returns the remote address which
+// sent the packet. The returned packet references memory in buffer.
+func (client *udpgwClient) receive(buffer []byte) (*net.UDPAddr, []byte, error) {
+	for {
+		_, err := io.ReadFull(client.conn, buffer[0:2])
+		if err != nil {
+			return nil, nil, ContextError(err)
+		}
+		size := int(binary.LittleEndian.Uint16(buffer[0:2]))
+		if size < 3 || size > len(buffer)-2 {
+			return nil, nil, ContextError(errors.New("invalid udpgw message size"))
+		}
+		_, err = io.ReadFull(client.conn, buffer[2:2+size])
+		if err != nil {
+			return nil, nil, ContextError(err)
+		}
+		message := buffer[2 : 2+size]
+
+		flags := message[0]
+		if flags&udpgwProtocolFlagKeepalive != 0 {
+			continue
+		}
+		connID := binary.LittleEndian.Uint16(message[1:3])
+
+		client.mutex.Lock()
+		remoteAddr, ok := client.remoteAddrs[connID]
+		client.mutex.Unlock()
+		if !ok {
+			// The connection ID was reassigned.
+			continue
+		}
+
+		// The server doesn't set the IPv6 flag in downstream messages, so
+		// the address length is that of the remote address.
+		ipLength := net.IPv4len
+		if flags&udpgwProtocolFlagIPv6 != 0 || remoteAddr.IP.To4() == nil {
+			ipLength = net.IPv6len
+		}
+		if len(message) < 3+ipLength+2 {
+			return nil, nil, ContextError(errors.New("invalid udpgw message size"))
+		}
+
+		return remoteAddr, message[3+ipLength+2:], nil
+	}
+}
@@ -60,7 +60,7 @@ func DownloadUpgrade(
 	// Check if complete file already downloaded
 
 	if _, err := os.Stat(config.UpgradeDownloadFilename); err == nil {
-		NoticeClientUpgradeDownloaded(config.UpgradeDownloadFilename)
+		config.notices.ClientUpgradeDownloaded(config.UpgradeDownloadFilename)
 		return nil
 	}
 
@@ -108,14 +108,14 @@ func DownloadUpgrade(
 			// return an error so that we don't go into a rapid retry loop making
 			// ineffective HEAD requests (the client may still signal an upgrade
 			// download later in the session).
-			NoticeAlert(
+			config.notices.Alert(
 				"failed to download upgrade: invalid %s header value %s: %s",
 				config.UpgradeDownloadClientVersionHeader, availableClientVersion, err)
 			return nil
 		}
 
 		if currentClientVersion >= checkAvailableClientVersion {
-			NoticeClientIsLatestVersion(availableClientVersion)
+			config.notices.ClientIsLatestVersion(availableClientVersion)
 			return nil
 		}
 	}
@@ -131,7 +131,7 @@ func DownloadUpgrade(
 	n, _, err := ResumeDownload(
 		httpClient, requestUrl, downloadFilename, "")
 
-	NoticeClientUpgradeDownloadedBytes(n)
+	config.notices.ClientUpgradeDownloadedBytes(n)
 
 	if err != nil {
 		return ContextError(err)
@@ -142,7 +142,7 @@ func DownloadUpgrade(
 		return ContextError(err)
 	}
 
-	NoticeClientUpgradeDownloaded(config.UpgradeDownloadFilename)
+	config.notices.ClientUpgradeDownloaded(config.UpgradeDownloadFilename)
 
 	return nil
 }
@@ -90,18 +90,18 @@ func MakeSecureRandomBytes(length int) ([]byte, error) {
 // MakeSecureRandomPadding selects a random padding length in the indicated
 // range and returns a random byte array of the selected length.
 // In the unlikely case where an underlying MakeRandom functions fails,
-// the padding is length 0.
-func MakeSecureRandomPadding(minLength, maxLength int) []byte {
+// the padding is length 0 and an alert is emitted with the specified notices.
+func MakeSecureRandomPadding(notices *Notices, minLength, maxLength int) []byte {
 	var padding []byte
 	paddingSize, err := MakeSecureRandomInt(maxLength - minLength)
 	if err != nil {
-		NoticeAlert("MakeSecureRandomPadding: MakeSecureRandomInt failed")
+		notices.Alert("MakeSecureRandomPadding: MakeSecureRandomInt failed")
 		return make([]byte, 0)
 	}
 	paddingSize += minLength
 	padding, err = MakeSecureRandomBytes(paddingSize)
 	if err != nil {
-		NoticeAlert("MakeSecureRandomPadding: MakeSecureRandomBytes failed")
+		notices.Alert("MakeSecureRandomPadding: MakeSecureRandomBytes failed")
 		return make([]byte, 0)
 	}
 	return padding
@@ -109,11 +109,11 @@ func MakeSecureRandomPadding(minLength, maxLength int) []byte {
 
 // MakeRandomPeriod returns a random duration, within a given range.
 // In the unlikely case where an  underlying MakeRandom functions fails,
-// the period is the minimum.
-func MakeRandomPeriod(min, max time.Duration) (duration time.Duration) {
+// the period is the minimum and an alert is emitted with the specified notices.
+func MakeRandomPeriod(notices *Notices, min, max time.Duration) (duration time.Duration) {
 	period, err := MakeSecureRandomInt64(max.Nanoseconds() - min.Nanoseconds())
 	if err != nil {
-		NoticeAlert("NextRandomRangePeriod: MakeSecureRandomInt64 failed")
+		notices.Alert("NextRandomRangePeriod: MakeSecureRandomInt64 failed")
 	}
 	duration = min + time.Duration(period)
 	return
@@ -266,11 +266,11 @@ func GetCurrentTimestamp() string {
 
 // TruncateTimestampToHour truncates an RFC 3339 formatted string
 // to hour granularity. If the input is not a valid format, the
-// result is "".
-func TruncateTimestampToHour(timestamp string) string {
+// result is "" and an alert is emitted with the specified notices.
+func TruncateTimestampToHour(notices *Notices, timestamp string) string {
 	t, err := time.Parse(time.RFC3339, timestamp)
 	if err != nil {
-		NoticeAlert("failed to truncate timestamp: %s", err)
+		notices.Alert("failed to truncate timestamp: %s", err)
 		return ""
 	}
 	return t.Truncate(1 * time.Hour).Format(time.RFC3339)